@@ -0,0 +1,197 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+)
+
+// PluginRef is a reference from a plugin to another plugin.
+type PluginRef struct {
+	Tag string `json:"tag"`
+
+	// Kind describes how the plugin is referred, e.g. "entry", "exec".
+	Kind string `json:"kind"`
+
+	// Type is the required type of the referred plugin.
+	// Empty means any type.
+	Type string `json:"type,omitempty"`
+}
+
+// ArgsChecker can be implemented by plugin args. CheckArgs returns the
+// plugins that the args refer to, and errors that can be found without
+// initializing the plugin. It is used by CheckConfig.
+type ArgsChecker interface {
+	CheckArgs() (refs []PluginRef, errs []error)
+}
+
+// CheckedPlugin is a plugin that was checked by CheckConfig.
+type CheckedPlugin struct {
+	Tag  string      `json:"tag"`
+	Type string      `json:"type"`
+	File string      `json:"file,omitempty"` // Empty for preset plugins.
+	Refs []PluginRef `json:"refs,omitempty"`
+}
+
+// CheckResult is the result of CheckConfig.
+type CheckResult struct {
+	// Plugins are in the order that they will be loaded.
+	Plugins []CheckedPlugin `json:"plugins"`
+	Errors  []error         `json:"-"`
+}
+
+// CheckConfig loads the config file and its includes and checks all
+// plugins without initializing them. It reports unknown plugin types,
+// invalid args, duplicated tags, and references to plugins that are
+// missing, defined later or of a wrong type. It does not stop at the
+// first error.
+func CheckConfig(file string) *CheckResult {
+	c := &configChecker{
+		res:  new(CheckResult),
+		tags: make(map[string]int),
+	}
+	var presets []string
+	for tag := range LoadNewPersetPluginFuncs() {
+		presets = append(presets, tag)
+	}
+	sort.Strings(presets)
+	for _, tag := range presets {
+		c.add(CheckedPlugin{Tag: tag, Type: "preset"})
+	}
+
+	cfg, fileUsed, err := loadConfig(file)
+	if err != nil {
+		c.res.Errors = append(c.res.Errors, err)
+		return c.res
+	}
+	c.checkCfg(cfg, fileUsed, 0)
+	c.checkRefs()
+	return c.res
+}
+
+type configChecker struct {
+	res  *CheckResult
+	tags map[string]int // index of plugins in res.Plugins
+}
+
+func (c *configChecker) add(p CheckedPlugin) {
+	c.tags[p.Tag] = len(c.res.Plugins)
+	c.res.Plugins = append(c.res.Plugins, p)
+}
+
+func (c *configChecker) errorf(format string, a ...any) {
+	c.res.Errors = append(c.res.Errors, fmt.Errorf(format, a...))
+}
+
+// checkCfg follows the same order as Mosdns.loadPluginsFromCfg.
+func (c *configChecker) checkCfg(cfg *Config, file string, includeDepth int) {
+	const maxIncludeDepth = 8
+	if includeDepth > maxIncludeDepth {
+		c.errorf("%s: maximum include depth reached", file)
+		return
+	}
+	for _, s := range cfg.Include {
+		subCfg, path, err := loadConfig(s)
+		if err != nil {
+			c.errorf("%s: failed to include %s, %w", file, s, err)
+			continue
+		}
+		c.checkCfg(subCfg, path, includeDepth+1)
+	}
+
+	for i, pc := range cfg.Plugins {
+		tag := pc.Tag
+		if len(tag) == 0 {
+			tag = fmt.Sprintf("anonymouse_%s_%d", pc.Type, len(c.res.Plugins))
+		}
+		prefix := fmt.Sprintf("%s: plugin #%d %s", file, i, tag)
+		if _, dup := c.tags[tag]; dup {
+			c.errorf("%s: duplicated plugin tag", prefix)
+			continue
+		}
+		p := CheckedPlugin{Tag: tag, Type: pc.Type, File: file}
+		args, err := decodeArgs(pc)
+		if err != nil {
+			c.errorf("%s: %w", prefix, err)
+		} else if ac, ok := args.(ArgsChecker); ok {
+			refs, errs := ac.CheckArgs()
+			p.Refs = refs
+			for _, err := range errs {
+				c.errorf("%s: %w", prefix, err)
+			}
+		}
+		c.add(p)
+	}
+}
+
+// decodeArgs checks the type of pc and decodes its args.
+func decodeArgs(pc PluginConfig) (any, error) {
+	if len(pc.Type) == 0 {
+		return nil, errors.New("missing plugin type")
+	}
+	typeInfo, ok := GetPluginType(pc.Type)
+	if !ok {
+		err := fmt.Errorf("plugin type %s not defined", pc.Type)
+		if s := utils.Suggest(pc.Type, GetAllPluginTypes()); len(s) > 0 {
+			err = fmt.Errorf("%w, did you mean %s?", err, s)
+		}
+		return nil, err
+	}
+	args := typeInfo.NewArgs()
+	if reflect.TypeOf(pc.Args) == reflect.TypeOf(args) {
+		return pc.Args, nil
+	}
+	if err := utils.WeakDecode(pc.Args, args); err != nil {
+		return nil, fmt.Errorf("unable to decode plugin args: %w", err)
+	}
+	return args, nil
+}
+
+// checkRefs checks references after all plugins are known, so it can tell
+// whether a missing plugin is defined later.
+func (c *configChecker) checkRefs() {
+	var allTags []string
+	for _, p := range c.res.Plugins {
+		allTags = append(allTags, p.Tag)
+	}
+	for i, p := range c.res.Plugins {
+		for _, ref := range p.Refs {
+			prefix := fmt.Sprintf("%s: plugin %s: %s %s", p.File, p.Tag, ref.Kind, ref.Tag)
+			j, ok := c.tags[ref.Tag]
+			switch {
+			case !ok:
+				err := fmt.Errorf("%s: plugin not found", prefix)
+				if s := utils.Suggest(ref.Tag, allTags); len(s) > 0 {
+					err = fmt.Errorf("%w, did you mean %s?", err, s)
+				}
+				c.res.Errors = append(c.res.Errors, err)
+			case j >= i:
+				c.errorf("%s: plugin must be defined before it is referred", prefix)
+			case len(ref.Type) > 0 && c.res.Plugins[j].Type != ref.Type:
+				c.errorf("%s: plugin is a %s, not a %s", prefix, c.res.Plugins[j].Type, ref.Type)
+			}
+		}
+	}
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type testCheckArgs struct {
+	Refs []string `yaml:"refs"`
+}
+
+func (a *testCheckArgs) CheckArgs() ([]PluginRef, []error) {
+	var refs []PluginRef
+	for _, tag := range a.Refs {
+		refs = append(refs, PluginRef{Tag: tag, Kind: "test", Type: "test_check"})
+	}
+	return refs, nil
+}
+
+func init() {
+	RegNewPluginFunc("test_check", func(_ *BP, _ any) (any, error) {
+		return struct{}{}, nil
+	}, func() any { return new(testCheckArgs) })
+}
+
+func TestCheckConfig(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, s string) string {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	write("sub.yaml", `
+plugins:
+  - tag: a
+    type: test_check
+`)
+	ok := write("ok.yaml", `
+include: [`+filepath.Join(dir, "sub.yaml")+`]
+plugins:
+  - tag: b
+    type: test_check
+    args:
+      refs: [a]
+`)
+	res := CheckConfig(ok)
+	if len(res.Errors) > 0 {
+		t.Fatalf("unexpected errors: %v", res.Errors)
+	}
+	var tags []string
+	for _, p := range res.Plugins {
+		if p.Type != "preset" {
+			tags = append(tags, p.Tag)
+		}
+	}
+	if strings.Join(tags, ",") != "a,b" {
+		t.Fatalf("unexpected plugins %v", tags)
+	}
+
+	bad := write("bad.yaml", `
+plugins:
+  - tag: x
+    type: test_reload_exec
+  - tag: a
+    type: test_check
+    args:
+      refs: [b, missing, x]
+  - tag: b
+    type: test_check
+  - tag: b
+    type: test_chek
+  - tag: c
+    type: test_check
+    args:
+      unknown_arg: 1
+`)
+	res = CheckConfig(bad)
+	want := []string{
+		"duplicated plugin tag",
+		"unable to decode plugin args",
+		"b: plugin must be defined before it is referred",
+		"missing: plugin not found",
+		"x: plugin is a test_reload_exec, not a test_check",
+	}
+	if len(res.Errors) != len(want) {
+		t.Fatalf("want %d errors, got %v", len(want), res.Errors)
+	}
+	for i, err := range res.Errors {
+		if !strings.Contains(err.Error(), want[i]) {
+			t.Errorf("error #%d %q does not contain %q", i, err, want[i])
+		}
+	}
+}
@@ -47,4 +47,9 @@ type PluginConfig struct {
 
 type APIConfig struct {
 	HTTP string `yaml:"http"`
+
+	// TraceSequences are the tags of sequences that serve the trace
+	// debug api at /plugins/<tag>/trace. The api runs real queries
+	// through the sequence, so it is disabled by default.
+	TraceSequences []string `yaml:"trace_sequences"`
 }
@@ -33,113 +33,202 @@ import (
 	"io"
 	"net/http"
 	"net/http/pprof"
+	"sync"
+	"sync/atomic"
 )
 
 type Mosdns struct {
 	logger *zap.Logger // non-nil logger.
 
 	// Plugins
-	plugins map[string]any
+	plugins    map[string]any
+	pluginCfgs map[string]PluginConfig // configs of plugins that were loaded from config files.
+	reused     map[string]struct{}     // tags of plugins that were reused from the previous graph.
 
-	httpMux    *chi.Mux
+	pluginMux  *chi.Mux // apis of plugins, mounted at "/plugins" of root.httpMux.
 	metricsReg *prometheus.Registry
-	sc         *safe_close.SafeClose
+
+	offline *OfflineOpts // non-nil if the graph is built by NewOfflineMosdns.
+
+	// drainMu tracks queries that are running on this plugin graph. See Acquire.
+	drainMu sync.RWMutex
+
+	root *root
+}
+
+// root holds the states that are shared by all plugin graphs of a mosdns
+// instance. A config reload creates a new plugin graph (a new Mosdns)
+// which shares the same root.
+type root struct {
+	httpMux *chi.Mux
+	sc      *safe_close.SafeClose
+
+	cfgFile  string // the main config file, used by reload.
+	reloadMu sync.Mutex
+	current  atomic.Pointer[Mosdns]
+
+	// Api configs are not reloaded.
+	traceSequences map[string]struct{} // See APIConfig.TraceSequences.
 }
 
 // NewMosdns initializes a mosdns instance and its plugins.
 func NewMosdns(cfg *Config) (*Mosdns, error) {
+	return newMosdns(cfg, "")
+}
+
+// newMosdns initializes a mosdns instance. cfgFile is the file that cfg
+// was loaded from. It is used by Reload and can be empty.
+func newMosdns(cfg *Config, cfgFile string) (*Mosdns, error) {
 	// Init logger.
 	lg, err := mlog.NewLogger(cfg.Log)
 	if err != nil {
 		return nil, fmt.Errorf("failed to init logger: %w", err)
 	}
 
-	m := &Mosdns{
-		logger:     lg,
-		plugins:    make(map[string]any),
-		httpMux:    chi.NewRouter(),
-		metricsReg: newMetricsReg(),
-		sc:         safe_close.NewSafeClose(),
+	r := &root{
+		httpMux:        chi.NewRouter(),
+		sc:             safe_close.NewSafeClose(),
+		cfgFile:        cfgFile,
+		traceSequences: make(map[string]struct{}),
 	}
-	// This must be called after m.httpMux and m.metricsReg been set.
-	m.initHttpMux()
+	for _, tag := range cfg.API.TraceSequences {
+		r.traceSequences[tag] = struct{}{}
+	}
+	m := newGraph(lg, r)
+	r.current.Store(m)
+	// This must be called after r.current been set.
+	r.initHttpMux(lg)
 
 	// Start http api server
 	if httpAddr := cfg.API.HTTP; len(httpAddr) > 0 {
 		httpServer := &http.Server{
 			Addr:    httpAddr,
-			Handler: m.httpMux,
+			Handler: r.httpMux,
 		}
-		m.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
+		r.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
 			defer done()
 			errChan := make(chan error, 1)
 			go func() {
-				m.logger.Info("starting api http server", zap.String("addr", httpAddr))
+				lg.Info("starting api http server", zap.String("addr", httpAddr))
 				errChan <- httpServer.ListenAndServe()
 			}()
 			select {
 			case err := <-errChan:
-				m.sc.SendCloseSignal(err)
+				r.sc.SendCloseSignal(err)
 			case <-closeSignal:
 				_ = httpServer.Close()
 			}
 		})
 	}
 
-	// Load plugins.
+	if err := m.initPlugins(cfg); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// OfflineOpts controls how NewOfflineMosdns builds the plugin graph.
+type OfflineOpts struct {
+	// Skip reports whether the plugin of c should not be loaded, e.g. servers.
+	// Optional.
+	Skip func(c PluginConfig) bool
+
+	// Replace returns a plugin that replaces the plugin of c, e.g. a fake
+	// upstream. It returns nil if the plugin should be loaded normally.
+	// Optional.
+	Replace func(c PluginConfig) any
+}
+
+// NewOfflineMosdns initializes the plugins of cfg without starting the api
+// server or handling signals. It is used by tools that run queries through
+// a config. Close it by m.GetSafeClose().SendCloseSignal().
+func NewOfflineMosdns(cfg *Config, opts OfflineOpts) (*Mosdns, error) {
+	lg, err := mlog.NewLogger(cfg.Log)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init logger: %w", err)
+	}
+	r := &root{
+		httpMux: chi.NewRouter(),
+		sc:      safe_close.NewSafeClose(),
+	}
+	m := newGraph(lg, r)
+	m.offline = &opts
+	r.current.Store(m)
+	if err := m.initPlugins(cfg); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// initPlugins loads the preset plugins and plugins from cfg into the first
+// graph of a root. All plugins are closed when root.sc is closed.
+func (m *Mosdns) initPlugins(cfg *Config) error {
+	r, lg := m.root, m.logger
 
 	// Close all plugins on signal.
-	// From here, call m.sc.SendCloseSignal() if any plugin failed to load.
-	m.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
+	// From here, call r.sc.SendCloseSignal() if any plugin failed to load.
+	r.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
 		go func() {
 			defer done()
 			<-closeSignal
-			m.logger.Info("starting shutdown sequences")
-			for tag, p := range m.plugins {
-				if closer, _ := p.(io.Closer); closer != nil {
-					m.logger.Info("closing plugin", zap.String("tag", tag))
-					_ = closer.Close()
-				}
-			}
-			m.logger.Info("all plugins were closed")
+			lg.Info("starting shutdown sequences")
+			r.reloadMu.Lock()
+			defer r.reloadMu.Unlock()
+			r.current.Load().closePlugins(nil)
+			lg.Info("all plugins were closed")
 		}()
 	})
 
 	// Preset plugins
 	if err := m.loadPresetPlugins(); err != nil {
-		m.sc.SendCloseSignal(err)
-		_ = m.sc.WaitClosed()
-		return nil, err
+		r.sc.SendCloseSignal(err)
+		_ = r.sc.WaitClosed()
+		return err
 	}
 	// Plugins from config.
-	if err := m.loadPluginsFromCfg(cfg, 0); err != nil {
-		m.sc.SendCloseSignal(err)
-		_ = m.sc.WaitClosed()
-		return nil, err
+	if err := m.loadPluginsFromCfg(cfg, 0, nil); err != nil {
+		r.sc.SendCloseSignal(err)
+		_ = r.sc.WaitClosed()
+		return err
 	}
-	m.logger.Info("all plugins are loaded")
+	lg.Info("all plugins are loaded")
+	return nil
+}
 
-	return m, nil
+// newGraph creates an empty plugin graph.
+func newGraph(lg *zap.Logger, r *root) *Mosdns {
+	return &Mosdns{
+		logger:     lg,
+		plugins:    make(map[string]any),
+		pluginCfgs: make(map[string]PluginConfig),
+		reused:     make(map[string]struct{}),
+		pluginMux:  chi.NewRouter(),
+		metricsReg: newMetricsReg(),
+		root:       r,
+	}
 }
 
 // NewTestMosdnsWithPlugins returns a mosdns instance for testing.
 func NewTestMosdnsWithPlugins(p map[string]any) *Mosdns {
-	return &Mosdns{
-		logger:     mlog.Nop(),
-		httpMux:    chi.NewRouter(),
-		plugins:    p,
-		metricsReg: newMetricsReg(),
-		sc:         safe_close.NewSafeClose(),
+	r := &root{
+		httpMux: chi.NewRouter(),
+		sc:      safe_close.NewSafeClose(),
+	}
+	m := newGraph(mlog.Nop(), r)
+	if p != nil {
+		m.plugins = p
 	}
+	r.current.Store(m)
+	return m
 }
 
 func (m *Mosdns) GetSafeClose() *safe_close.SafeClose {
-	return m.sc
+	return m.root.sc
 }
 
 // CloseWithErr is a shortcut for m.sc.SendCloseSignal
 func (m *Mosdns) CloseWithErr(err error) {
-	m.sc.SendCloseSignal(err)
+	m.root.sc.SendCloseSignal(err)
 }
 
 // Logger returns a non-nil logger.
@@ -147,6 +236,13 @@ func (m *Mosdns) Logger() *zap.Logger {
 	return m.logger
 }
 
+// TraceAPIEnabled reports whether the sequence tag should serve the trace
+// debug api. See APIConfig.TraceSequences.
+func (m *Mosdns) TraceAPIEnabled(tag string) bool {
+	_, ok := m.root.traceSequences[tag]
+	return ok
+}
+
 // GetPlugin returns a plugin.
 func (m *Mosdns) GetPlugin(tag string) any {
 	return m.plugins[tag]
@@ -158,11 +254,11 @@ func (m *Mosdns) GetMetricsReg() prometheus.Registerer {
 }
 
 func (m *Mosdns) GetAPIRouter() *chi.Mux {
-	return m.httpMux
+	return m.root.httpMux
 }
 
 func (m *Mosdns) RegPluginAPI(tag string, mux *chi.Mux) {
-	m.httpMux.Mount("/plugins/"+tag, mux)
+	m.pluginMux.Mount("/"+tag, mux)
 }
 
 func newMetricsReg() *prometheus.Registry {
@@ -172,13 +268,31 @@ func newMetricsReg() *prometheus.Registry {
 	return reg
 }
 
-// initHttpMux initializes api entries. It MUST be called after m.metricsReg being initialized.
-func (m *Mosdns) initHttpMux() {
+// initHttpMux initializes api entries. Metrics and plugin apis are served
+// from the current plugin graph. It MUST be called after r.current being set.
+func (r *root) initHttpMux(lg *zap.Logger) {
 	// Register metrics.
-	m.httpMux.Method(http.MethodGet, "/metrics", promhttp.HandlerFor(m.metricsReg, promhttp.HandlerOpts{}))
+	r.httpMux.Method(http.MethodGet, "/metrics", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		promhttp.HandlerFor(r.current.Load().metricsReg, promhttp.HandlerOpts{}).ServeHTTP(w, req)
+	}))
+
+	// Plugin apis.
+	r.httpMux.Mount("/plugins", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.current.Load().pluginMux.ServeHTTP(w, req)
+	}))
+
+	// Reload config.
+	r.httpMux.Post("/reload", func(w http.ResponseWriter, req *http.Request) {
+		if err := r.current.Load().Reload(); err != nil {
+			lg.Error("failed to reload config", zap.Error(err))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_, _ = io.WriteString(w, "ok\n")
+	})
 
 	// Register pprof.
-	m.httpMux.Route("/debug/pprof", func(r chi.Router) {
+	r.httpMux.Route("/debug/pprof", func(r chi.Router) {
 		r.Get("/*", pprof.Index)
 		r.Get("/cmdline", pprof.Cmdline)
 		r.Get("/profile", pprof.Profile)
@@ -191,17 +305,22 @@ func (m *Mosdns) initHttpMux() {
 		b := new(bytes.Buffer)
 		_, _ = fmt.Fprintf(b, "Invalid request %s %s\n\n", req.Method, req.RequestURI)
 		b.WriteString("Available api urls:\n")
-		_ = chi.Walk(m.httpMux, func(method string, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
-			b.WriteString(method)
-			b.WriteByte(' ')
-			b.WriteString(route)
-			b.WriteByte('\n')
-			return nil
-		})
+		walk := func(prefix string, routes chi.Routes) {
+			_ = chi.Walk(routes, func(method string, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+				b.WriteString(method)
+				b.WriteByte(' ')
+				b.WriteString(prefix)
+				b.WriteString(route)
+				b.WriteByte('\n')
+				return nil
+			})
+		}
+		walk("", r.httpMux)
+		walk("/plugins", r.current.Load().pluginMux)
 		_, _ = w.Write(b.Bytes())
 	}
-	m.httpMux.NotFound(invalidApiReqHelper)
-	m.httpMux.MethodNotAllowed(invalidApiReqHelper)
+	r.httpMux.NotFound(invalidApiReqHelper)
+	r.httpMux.MethodNotAllowed(invalidApiReqHelper)
 }
 
 func (m *Mosdns) loadPresetPlugins() error {
@@ -216,7 +335,8 @@ func (m *Mosdns) loadPresetPlugins() error {
 }
 
 // loadPluginsFromCfg loads plugins from this config. It follows include first.
-func (m *Mosdns) loadPluginsFromCfg(cfg *Config, includeDepth int) error {
+// If prev is not nil, unchanged ReusablePlugin in prev are reused.
+func (m *Mosdns) loadPluginsFromCfg(cfg *Config, includeDepth int, prev *Mosdns) error {
 	const maxIncludeDepth = 8
 	if includeDepth > maxIncludeDepth {
 		return errors.New("maximum include depth reached")
@@ -230,13 +350,26 @@ func (m *Mosdns) loadPluginsFromCfg(cfg *Config, includeDepth int) error {
 			return fmt.Errorf("failed to read config from %s, %w", s, err)
 		}
 		m.logger.Info("load config", zap.String("file", path))
-		if err := m.loadPluginsFromCfg(subCfg, includeDepth); err != nil {
+		if err := m.loadPluginsFromCfg(subCfg, includeDepth, prev); err != nil {
 			return fmt.Errorf("failed to load config from %s, %w", s, err)
 		}
 	}
 
 	for i, pc := range cfg.Plugins {
-		if err := m.newPlugin(pc); err != nil {
+		if o := m.offline; o != nil {
+			if o.Skip != nil && o.Skip(pc) {
+				m.logger.Info("skipping plugin", zap.String("tag", pc.Tag), zap.String("type", pc.Type))
+				continue
+			}
+			if o.Replace != nil {
+				if p := o.Replace(pc); p != nil {
+					m.logger.Info("replacing plugin", zap.String("tag", pc.Tag), zap.String("type", pc.Type))
+					m.plugins[pc.Tag] = p
+					continue
+				}
+			}
+		}
+		if err := m.newPlugin(pc, prev); err != nil {
 			return fmt.Errorf("failed to init plugin #%d %s, %w", i, pc.Tag, err)
 		}
 	}
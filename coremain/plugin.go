@@ -87,7 +87,9 @@ func GetPluginType(typ string) (PluginTypeInfo, bool) {
 }
 
 // newPlugin initializes a Plugin from c and adds it to mosdns.
-func (m *Mosdns) newPlugin(c PluginConfig) error {
+// If prev is not nil and has an unchanged ReusablePlugin with the same tag,
+// the plugin will be reused instead.
+func (m *Mosdns) newPlugin(c PluginConfig, prev *Mosdns) error {
 	if len(c.Tag) == 0 {
 		c.Tag = fmt.Sprintf("anonymouse_%s_%d", c.Type, len(m.plugins))
 	}
@@ -96,6 +98,14 @@ func (m *Mosdns) newPlugin(c PluginConfig) error {
 		return fmt.Errorf("duplicated plugin tag %s", c.Tag)
 	}
 
+	if p := prev.reusablePlugin(c); p != nil {
+		m.logger.Info("reusing plugin", zap.String("tag", c.Tag), zap.String("type", c.Type))
+		m.plugins[c.Tag] = p
+		m.pluginCfgs[c.Tag] = c
+		m.reused[c.Tag] = struct{}{}
+		return nil
+	}
+
 	typeInfo, ok := GetPluginType(c.Type)
 	if !ok {
 		return fmt.Errorf("plugin type %s not defined", c.Type)
@@ -116,6 +126,7 @@ func (m *Mosdns) newPlugin(c PluginConfig) error {
 		return fmt.Errorf("failed to init plugin: %w", err)
 	}
 	m.plugins[c.Tag] = p
+	m.pluginCfgs[c.Tag] = c
 	return nil
 }
 
@@ -0,0 +1,157 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+
+	"go.uber.org/zap"
+)
+
+// ReusablePlugin is implemented by plugins that can be kept across config
+// reloads, e.g. servers that want to keep their listening sockets.
+// If a plugin has the same tag, type and args after a reload, the old
+// instance is kept in the new plugin graph, and Reuse is called with a BP
+// of the new graph after the whole graph is loaded.
+// Reuse must either succeed or leave the plugin unchanged.
+type ReusablePlugin interface {
+	Reuse(bp *BP) error
+}
+
+// Reload re-reads the main config file (and its includes) and builds a new
+// plugin graph next to the current one. Log and api configs are not reloaded.
+// If the new graph is loaded successfully, it replaces the current graph.
+// Old plugins that are not reused are closed after all queries running on
+// the old graph are done. Otherwise, the current graph is kept.
+func (m *Mosdns) Reload() error {
+	r := m.root
+	if len(r.cfgFile) == 0 {
+		return errors.New("mosdns was not started from a config file")
+	}
+	cfg, _, err := loadConfig(r.cfgFile)
+	if err != nil {
+		return fmt.Errorf("failed to load config, %w", err)
+	}
+	return r.reload(cfg)
+}
+
+func (r *root) reload(cfg *Config) error {
+	r.reloadMu.Lock()
+	defer r.reloadMu.Unlock()
+	select {
+	case <-r.sc.ReceiveCloseSignal():
+		return errors.New("mosdns is closed")
+	default:
+	}
+
+	prev := r.current.Load()
+	lg := prev.logger
+	lg.Info("reloading config")
+	next := newGraph(lg, r)
+	err := next.loadPresetPlugins()
+	if err == nil {
+		err = next.loadPluginsFromCfg(cfg, 0, prev)
+	}
+	if err == nil {
+		err = next.reusePlugins(prev)
+	}
+	if err != nil {
+		next.closePlugins(next.reused)
+		return err
+	}
+
+	r.current.Store(next)
+	lg.Info("config reloaded")
+	go func() {
+		prev.drain()
+		prev.closePlugins(next.reused)
+		lg.Info("old plugins were closed")
+	}()
+	return nil
+}
+
+// reusablePlugin returns the plugin in m that can be reused by c.
+// It returns nil if there is no such plugin. m can be nil.
+func (m *Mosdns) reusablePlugin(c PluginConfig) any {
+	if m == nil {
+		return nil
+	}
+	pc, ok := m.pluginCfgs[c.Tag]
+	if !ok || pc.Type != c.Type || !reflect.DeepEqual(pc.Args, c.Args) {
+		return nil
+	}
+	p, _ := m.plugins[c.Tag].(ReusablePlugin)
+	if p == nil {
+		return nil
+	}
+	return p
+}
+
+// reusePlugins calls Reuse of plugins that m reused from prev. If any of
+// them failed, plugins that were already switched to m are switched back.
+func (m *Mosdns) reusePlugins(prev *Mosdns) error {
+	var done []string
+	for tag := range m.reused {
+		if err := m.plugins[tag].(ReusablePlugin).Reuse(NewBP(tag, m)); err != nil {
+			for _, t := range done {
+				if err := m.plugins[t].(ReusablePlugin).Reuse(NewBP(t, prev)); err != nil {
+					m.logger.Error("failed to restore plugin", zap.String("tag", t), zap.Error(err))
+				}
+			}
+			return fmt.Errorf("failed to reuse plugin %s, %w", tag, err)
+		}
+		done = append(done, tag)
+	}
+	return nil
+}
+
+// closePlugins closes all plugins in m except those in skip.
+func (m *Mosdns) closePlugins(skip map[string]struct{}) {
+	for tag, p := range m.plugins {
+		if _, ok := skip[tag]; ok {
+			continue
+		}
+		if closer, _ := p.(io.Closer); closer != nil {
+			m.logger.Info("closing plugin", zap.String("tag", tag))
+			_ = closer.Close()
+		}
+	}
+}
+
+// Acquire marks the start of a query running on this plugin graph.
+// It returns false if this graph has been replaced by a reload and is
+// being closed. In this case, the caller should use the new graph.
+// If Acquire returns true, Release must be called when the query is done.
+func (m *Mosdns) Acquire() bool {
+	return m.drainMu.TryRLock()
+}
+
+// Release marks the end of a query. See Acquire.
+func (m *Mosdns) Release() {
+	m.drainMu.RUnlock()
+}
+
+// drain blocks new queries and waits for running queries to finish.
+func (m *Mosdns) drain() {
+	m.drainMu.Lock()
+}
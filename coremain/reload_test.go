@@ -0,0 +1,216 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/mlog"
+)
+
+type testReloadExecArgs struct {
+	Name string `yaml:"name"`
+}
+
+type testReloadExec struct {
+	name   string
+	closed atomic.Bool
+}
+
+func (e *testReloadExec) Close() error {
+	e.closed.Store(true)
+	return nil
+}
+
+type testReloadServerArgs struct {
+	Entry  string `yaml:"entry"`
+	Listen string `yaml:"listen"`
+}
+
+type testReloadServer struct {
+	entry  atomic.Pointer[testReloadExec]
+	closed atomic.Bool
+}
+
+func (s *testReloadServer) Reuse(bp *BP) error {
+	e, _ := bp.M().GetPlugin("exec").(*testReloadExec)
+	if e == nil {
+		return os.ErrNotExist
+	}
+	s.entry.Store(e)
+	return nil
+}
+
+func (s *testReloadServer) Close() error {
+	s.closed.Store(true)
+	return nil
+}
+
+func init() {
+	RegNewPluginFunc("test_reload_exec", func(_ *BP, args any) (any, error) {
+		return &testReloadExec{name: args.(*testReloadExecArgs).Name}, nil
+	}, func() any { return new(testReloadExecArgs) })
+	RegNewPluginFunc("test_reload_server", func(bp *BP, _ any) (any, error) {
+		s := new(testReloadServer)
+		return s, s.Reuse(bp)
+	}, func() any { return new(testReloadServerArgs) })
+}
+
+func waitClosed(t *testing.T, closed *atomic.Bool) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		if closed.Load() {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatal("plugin was not closed")
+}
+
+func TestMosdns_Reload(t *testing.T) {
+	dir := t.TempDir()
+	mainFile := filepath.Join(dir, "config.yaml")
+	includeFile := filepath.Join(dir, "exec.yaml")
+	writeCfg := func(execName, listen string) {
+		t.Helper()
+		exec := "plugins:\n  - tag: exec\n    type: test_reload_exec\n    args:\n      name: " + execName + "\n"
+		main := "include: [" + includeFile + "]\n" +
+			"plugins:\n  - tag: server\n    type: test_reload_server\n    args:\n      entry: exec\n      listen: " + listen + "\n"
+		if err := os.WriteFile(includeFile, []byte(exec), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(mainFile, []byte(main), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeCfg("v1", "a")
+	cfg, _, err := loadConfig(mainFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := newMosdns(cfg, mainFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		m.GetSafeClose().SendCloseSignal(nil)
+		_ = m.GetSafeClose().WaitClosed()
+	}()
+	current := func() *Mosdns { return m.root.current.Load() }
+	server := m.GetPlugin("server").(*testReloadServer)
+	exec1 := m.GetPlugin("exec").(*testReloadExec)
+
+	// Reload an included file. The server is reused and switched to the new
+	// entry. The old entry is closed after the running query is done.
+	writeCfg("v2", "a")
+	if !m.Acquire() {
+		t.Fatal("failed to acquire")
+	}
+	if err := m.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if current().GetPlugin("server") != server {
+		t.Fatal("server was not reused")
+	}
+	if got := server.entry.Load().name; got != "v2" {
+		t.Fatalf("want entry v2, got %s", got)
+	}
+	time.Sleep(time.Millisecond * 50)
+	if exec1.closed.Load() {
+		t.Fatal("old entry was closed before the running query is done")
+	}
+	if m.Acquire() {
+		t.Fatal("old graph accepted a new query")
+	}
+	m.Release()
+	waitClosed(t, &exec1.closed)
+	if server.closed.Load() {
+		t.Fatal("reused server was closed")
+	}
+
+	// Server args changed, a new server is created.
+	exec2 := current().GetPlugin("exec").(*testReloadExec)
+	writeCfg("v2", "b")
+	if err := m.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	server2 := current().GetPlugin("server").(*testReloadServer)
+	if server2 == server {
+		t.Fatal("server was reused with different args")
+	}
+	waitClosed(t, &server.closed)
+	waitClosed(t, &exec2.closed)
+
+	// Invalid config, the current graph is kept.
+	exec3 := current().GetPlugin("exec").(*testReloadExec)
+	g := current()
+	if err := os.WriteFile(includeFile, []byte("plugins:\n  - tag: exec\n    type: no_such_type\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Reload(); err == nil {
+		t.Fatal("want error")
+	}
+	if current() != g || server2.entry.Load() != exec3 || exec3.closed.Load() || server2.closed.Load() {
+		t.Fatal("current graph was changed by a failed reload")
+	}
+}
+
+func TestNewOfflineMosdns(t *testing.T) {
+	cfg := &Config{
+		Log: mlog.LogConfig{Level: "error"},
+		Plugins: []PluginConfig{
+			{Tag: "exec", Type: "test_reload_exec", Args: map[string]any{"name": "real"}},
+			{Tag: "stubbed", Type: "test_reload_exec", Args: map[string]any{"name": "real"}},
+			{Tag: "server", Type: "test_reload_server", Args: map[string]any{"entry": "exec"}},
+		},
+	}
+	stub := &testReloadExec{name: "stub"}
+	m, err := NewOfflineMosdns(cfg, OfflineOpts{
+		Skip: func(c PluginConfig) bool { return c.Type == "test_reload_server" },
+		Replace: func(c PluginConfig) any {
+			if c.Tag == "stubbed" {
+				return stub
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, _ := m.GetPlugin("exec").(*testReloadExec); e == nil || e.name != "real" {
+		t.Fatal("exec was not loaded")
+	}
+	if m.GetPlugin("stubbed") != stub {
+		t.Fatal("stubbed was not replaced")
+	}
+	if m.GetPlugin("server") != nil {
+		t.Fatal("server was not skipped")
+	}
+	m.GetSafeClose().SendCloseSignal(nil)
+	_ = m.GetSafeClose().WaitClosed()
+	if !stub.closed.Load() {
+		t.Fatal("stub was not closed")
+	}
+}
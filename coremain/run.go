@@ -68,7 +68,7 @@ func init() {
 				signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
 				sig := <-c
 				m.logger.Warn("signal received", zap.Stringer("signal", sig))
-				m.sc.SendCloseSignal(nil)
+				m.GetSafeClose().SendCloseSignal(nil)
 			}()
 			return m.GetSafeClose().WaitClosed()
 		},
@@ -126,7 +126,28 @@ func NewServer(sf *serverFlags) (*Mosdns, error) {
 	}
 	mlog.L().Info("main config loaded", zap.String("file", fileUsed))
 
-	return NewMosdns(cfg)
+	m, err := newMosdns(cfg, fileUsed)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGHUP)
+		for sig := range c {
+			m.logger.Info("signal received, reloading config", zap.Stringer("signal", sig))
+			if err := m.Reload(); err != nil {
+				m.logger.Error("failed to reload config", zap.Error(err))
+			}
+		}
+	}()
+	return m, nil
+}
+
+// LoadConfig loads a config from a file. See loadConfig.
+// It returns the config and the file that was used.
+func LoadConfig(filePath string) (*Config, string, error) {
+	return loadConfig(filePath)
 }
 
 // loadConfig load a config from a file. If filePath is empty, it will
@@ -0,0 +1,115 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package dnscrypt
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Sizes of the protocol fields.
+const (
+	PublicKeySize   = 32
+	ClientMagicSize = 8
+	NonceSize       = 24
+	HalfNonceSize   = NonceSize / 2
+
+	certMinSize = 124
+)
+
+var (
+	certMagic = [4]byte{'D', 'N', 'S', 'C'}
+
+	// ResolverMagic is the first 8 bytes of a resolver response.
+	ResolverMagic = [8]byte{'r', '6', 'f', 'n', 'v', 'W', 'j', '8'}
+)
+
+// Cert is a resolver certificate. Clients fetch it with a TXT query
+// of the provider name.
+type Cert struct {
+	EsVersion   EsVersion
+	Signature   [ed25519.SignatureSize]byte
+	ResolverPk  [PublicKeySize]byte
+	ClientMagic [ClientMagicSize]byte
+	Serial      uint32
+	NotBefore   uint32 // unix timestamp
+	NotAfter    uint32 // unix timestamp
+}
+
+// ParseCert parses a cert and verifies its signature with the provider
+// public key. It does not check the validity period.
+func ParseCert(b []byte, providerPk ed25519.PublicKey) (*Cert, error) {
+	if len(b) < certMinSize {
+		return nil, errors.New("cert is too short")
+	}
+	if !bytes.Equal(b[:4], certMagic[:]) {
+		return nil, errors.New("invalid cert magic")
+	}
+	c := new(Cert)
+	c.EsVersion = EsVersion(binary.BigEndian.Uint16(b[4:6]))
+	if minor := binary.BigEndian.Uint16(b[6:8]); minor != 0 {
+		return nil, fmt.Errorf("unsupported protocol minor version %d", minor)
+	}
+	copy(c.Signature[:], b[8:72])
+	if !ed25519.Verify(providerPk, b[72:], c.Signature[:]) {
+		return nil, errors.New("invalid cert signature")
+	}
+	copy(c.ResolverPk[:], b[72:104])
+	copy(c.ClientMagic[:], b[104:112])
+	c.Serial = binary.BigEndian.Uint32(b[112:116])
+	c.NotBefore = binary.BigEndian.Uint32(b[116:120])
+	c.NotAfter = binary.BigEndian.Uint32(b[120:124])
+	return c, nil
+}
+
+// signed returns the signed part of the cert.
+func (c *Cert) signed() []byte {
+	b := make([]byte, 0, certMinSize-72)
+	b = append(b, c.ResolverPk[:]...)
+	b = append(b, c.ClientMagic[:]...)
+	b = binary.BigEndian.AppendUint32(b, c.Serial)
+	b = binary.BigEndian.AppendUint32(b, c.NotBefore)
+	b = binary.BigEndian.AppendUint32(b, c.NotAfter)
+	return b
+}
+
+// Sign signs the cert with the provider private key.
+func (c *Cert) Sign(providerSk ed25519.PrivateKey) {
+	copy(c.Signature[:], ed25519.Sign(providerSk, c.signed()))
+}
+
+// Marshal returns the binary form of the cert.
+func (c *Cert) Marshal() []byte {
+	b := make([]byte, 0, certMinSize)
+	b = append(b, certMagic[:]...)
+	b = binary.BigEndian.AppendUint16(b, uint16(c.EsVersion))
+	b = append(b, 0, 0)
+	b = append(b, c.Signature[:]...)
+	return append(b, c.signed()...)
+}
+
+// ValidAt reports whether t is in the validity period of the cert.
+func (c *Cert) ValidAt(t time.Time) bool {
+	u := t.Unix()
+	return u >= int64(c.NotBefore) && u <= int64(c.NotAfter)
+}
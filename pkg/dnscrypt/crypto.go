@@ -0,0 +1,285 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package dnscrypt
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/poly1305"
+)
+
+// EsVersion is the encryption system of a cert.
+type EsVersion uint16
+
+const (
+	XSalsa20Poly1305  EsVersion = 0x0001
+	XChacha20Poly1305 EsVersion = 0x0002
+)
+
+func (v EsVersion) String() string {
+	switch v {
+	case XSalsa20Poly1305:
+		return "XSalsa20Poly1305"
+	case XChacha20Poly1305:
+		return "XChacha20Poly1305"
+	default:
+		return fmt.Sprintf("EsVersion(%d)", uint16(v))
+	}
+}
+
+// Supported reports whether v is implemented.
+func (v EsVersion) Supported() bool {
+	return v == XSalsa20Poly1305 || v == XChacha20Poly1305
+}
+
+const (
+	// TagSize is the size of the authentication tag.
+	TagSize = poly1305.TagSize
+
+	// MinUDPQueryLen is the minimum padded length of udp queries.
+	MinUDPQueryLen = 256
+
+	queryHeaderLen    = ClientMagicSize + PublicKeySize + HalfNonceSize
+	responseHeaderLen = len(ResolverMagic) + NonceSize
+
+	// ResponseOverhead is the length of an encrypted response minus
+	// the length of its padded message.
+	ResponseOverhead = responseHeaderLen + TagSize
+)
+
+var errDecrypt = errors.New("failed to decrypt message")
+
+// GenerateKey generates a X25519 key pair.
+func GenerateKey() (pk, sk [PublicKeySize]byte, err error) {
+	if _, err = rand.Read(sk[:]); err != nil {
+		return
+	}
+	p, err := curve25519.X25519(sk[:], curve25519.Basepoint)
+	if err != nil {
+		return
+	}
+	copy(pk[:], p)
+	return
+}
+
+// SharedKey computes the shared key of es from a private key and
+// the peer's public key.
+func SharedKey(es EsVersion, sk, pk *[PublicKeySize]byte) (*[32]byte, error) {
+	key := new([32]byte)
+	switch es {
+	case XSalsa20Poly1305:
+		box.Precompute(key, pk, sk)
+		if *key == [32]byte{} {
+			return nil, errors.New("invalid public key")
+		}
+	case XChacha20Poly1305:
+		s, err := curve25519.X25519(sk[:], pk[:])
+		if err != nil {
+			return nil, err
+		}
+		k, err := chacha20.HChaCha20(s, make([]byte, 16))
+		if err != nil {
+			return nil, err
+		}
+		copy(key[:], k)
+	default:
+		return nil, fmt.Errorf("unsupported encryption system %s", es)
+	}
+	return key, nil
+}
+
+// seal appends the encrypted msg (tag || ciphertext) to out.
+func seal(es EsVersion, out, msg []byte, nonce *[NonceSize]byte, key *[32]byte) []byte {
+	if es == XSalsa20Poly1305 {
+		return box.SealAfterPrecomputation(out, msg, nonce, key)
+	}
+	return xchachaSeal(out, msg, nonce, key)
+}
+
+func open(es EsVersion, b []byte, nonce *[NonceSize]byte, key *[32]byte) ([]byte, error) {
+	var msg []byte
+	var ok bool
+	if es == XSalsa20Poly1305 {
+		msg, ok = box.OpenAfterPrecomputation(nil, b, nonce, key)
+	} else {
+		msg, ok = xchachaOpen(b, nonce, key)
+	}
+	if !ok {
+		return nil, errDecrypt
+	}
+	return msg, nil
+}
+
+// xchachaStream returns the stream cipher and the poly1305 key of the
+// XChaCha20Poly1305 secretbox construction (libsodium
+// crypto_secretbox_xchacha20poly1305). The first half of the first
+// block is the poly1305 key. The second half encrypts the first 32
+// bytes of the message.
+func xchachaStream(nonce *[NonceSize]byte, key *[32]byte) (*chacha20.Cipher, *[64]byte) {
+	subKey, _ := chacha20.HChaCha20(key[:], nonce[:16])
+	var subNonce [chacha20.NonceSize]byte
+	copy(subNonce[4:], nonce[16:])
+	c, _ := chacha20.NewUnauthenticatedCipher(subKey, subNonce[:])
+	block0 := new([64]byte)
+	c.XORKeyStream(block0[:], block0[:])
+	return c, block0
+}
+
+func xchachaSeal(out, msg []byte, nonce *[NonceSize]byte, key *[32]byte) []byte {
+	c, block0 := xchachaStream(nonce, key)
+	start := len(out)
+	out = append(out, make([]byte, TagSize+len(msg))...)
+	ct := out[start+TagSize:]
+	n := min(32, len(msg))
+	subtle.XORBytes(ct[:n], msg[:n], block0[32:32+n])
+	c.XORKeyStream(ct[n:], msg[n:])
+	var polyKey [32]byte
+	copy(polyKey[:], block0[:32])
+	var t [TagSize]byte
+	poly1305.Sum(&t, ct, &polyKey)
+	copy(out[start:], t[:])
+	return out
+}
+
+func xchachaOpen(b []byte, nonce *[NonceSize]byte, key *[32]byte) ([]byte, bool) {
+	if len(b) < TagSize {
+		return nil, false
+	}
+	c, block0 := xchachaStream(nonce, key)
+	var polyKey [32]byte
+	copy(polyKey[:], block0[:32])
+	var t [TagSize]byte
+	copy(t[:], b[:TagSize])
+	ct := b[TagSize:]
+	if !poly1305.Verify(&t, ct, &polyKey) {
+		return nil, false
+	}
+	msg := make([]byte, len(ct))
+	n := min(32, len(ct))
+	subtle.XORBytes(msg[:n], ct[:n], block0[32:32+n])
+	c.XORKeyStream(msg[n:], ct[n:])
+	return msg, true
+}
+
+// PaddedLen returns the padded length of a message of n bytes. It is a
+// multiple of 64 and at least minLen. There is at least one byte of padding.
+func PaddedLen(n, minLen int) int {
+	return max(minLen, (n+1+63)/64*64)
+}
+
+func pad(msg []byte, l int) []byte {
+	b := make([]byte, l)
+	copy(b, msg)
+	b[len(msg)] = 0x80
+	return b
+}
+
+func unpad(b []byte) ([]byte, error) {
+	i := len(b) - 1
+	for i >= 0 && b[i] == 0 {
+		i--
+	}
+	if i >= 0 && b[i] == 0x80 {
+		return b[:i], nil
+	}
+	return nil, errors.New("invalid padding")
+}
+
+// QueryHeader is the unencrypted header of a query.
+type QueryHeader struct {
+	ClientMagic [ClientMagicSize]byte
+	ClientPk    [PublicKeySize]byte
+	ClientNonce [HalfNonceSize]byte
+}
+
+// EncryptQuery encrypts the dns query q, padded to paddedLen bytes.
+// paddedLen must be greater than len(q). See PaddedLen.
+func EncryptQuery(es EsVersion, key *[32]byte, h *QueryHeader, q []byte, paddedLen int) []byte {
+	out := make([]byte, 0, queryHeaderLen+TagSize+paddedLen)
+	out = append(out, h.ClientMagic[:]...)
+	out = append(out, h.ClientPk[:]...)
+	out = append(out, h.ClientNonce[:]...)
+	var nonce [NonceSize]byte
+	copy(nonce[:], h.ClientNonce[:])
+	return seal(es, out, pad(q, paddedLen), &nonce, key)
+}
+
+// ParseQuery parses the header of an encrypted query and returns the
+// encrypted part.
+func ParseQuery(b []byte) (*QueryHeader, []byte, error) {
+	if len(b) < queryHeaderLen+TagSize {
+		return nil, nil, errors.New("query is too short")
+	}
+	h := new(QueryHeader)
+	copy(h.ClientMagic[:], b)
+	copy(h.ClientPk[:], b[ClientMagicSize:])
+	copy(h.ClientNonce[:], b[ClientMagicSize+PublicKeySize:])
+	return h, b[queryHeaderLen:], nil
+}
+
+// DecryptQuery decrypts the encrypted part of a query. See ParseQuery.
+func DecryptQuery(es EsVersion, key *[32]byte, h *QueryHeader, encrypted []byte) ([]byte, error) {
+	var nonce [NonceSize]byte
+	copy(nonce[:], h.ClientNonce[:])
+	b, err := open(es, encrypted, &nonce, key)
+	if err != nil {
+		return nil, err
+	}
+	return unpad(b)
+}
+
+// EncryptResponse encrypts the dns response r, padded to paddedLen bytes.
+// paddedLen must be greater than len(r). See PaddedLen.
+func EncryptResponse(es EsVersion, key *[32]byte, clientNonce *[HalfNonceSize]byte, r []byte, paddedLen int) ([]byte, error) {
+	var nonce [NonceSize]byte
+	copy(nonce[:], clientNonce[:])
+	if _, err := rand.Read(nonce[HalfNonceSize:]); err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, responseHeaderLen+TagSize+paddedLen)
+	out = append(out, ResolverMagic[:]...)
+	out = append(out, nonce[:]...)
+	return seal(es, out, pad(r, paddedLen), &nonce, key), nil
+}
+
+// DecryptResponse decrypts a response of the query with clientNonce.
+func DecryptResponse(es EsVersion, key *[32]byte, clientNonce *[HalfNonceSize]byte, b []byte) ([]byte, error) {
+	if len(b) < responseHeaderLen+TagSize {
+		return nil, errors.New("response is too short")
+	}
+	if [8]byte(b[:8]) != ResolverMagic {
+		return nil, errors.New("invalid resolver magic")
+	}
+	var nonce [NonceSize]byte
+	copy(nonce[:], b[8:])
+	if [HalfNonceSize]byte(nonce[:HalfNonceSize]) != *clientNonce {
+		return nil, errors.New("unexpected response nonce")
+	}
+	r, err := open(es, b[responseHeaderLen:], &nonce, key)
+	if err != nil {
+		return nil, err
+	}
+	return unpad(r)
+}
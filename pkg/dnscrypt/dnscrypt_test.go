@@ -0,0 +1,186 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package dnscrypt
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+func seq(start, n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(start + i)
+	}
+	return b
+}
+
+// Vectors are generated by libsodium crypto_box_curve25519*_easy_afternm.
+func TestSeal_Libsodium(t *testing.T) {
+	var sk1, sk2, pk2 [32]byte
+	copy(sk1[:], seq(0, 32))
+	copy(sk2[:], seq(32, 32))
+	p, _ := curve25519.X25519(sk2[:], curve25519.Basepoint)
+	copy(pk2[:], p)
+	var nonce [NonceSize]byte
+	copy(nonce[:], seq(100, NonceSize))
+	msg := seq(0, 70)
+
+	for es, want := range map[EsVersion]string{
+		XSalsa20Poly1305:  "68da2fe7872ae617a70d1878ac567008e58269d7b00428affff95d0c6f24ad98415b1699e1abc64b2cb116427d9a5cc6ee3659d7d132d83852b9767823370d9e6f8e0f74fd58ba5e582ae2af8d03372a87b6d632a185",
+		XChacha20Poly1305: "5305542267bb7e5d3204c80578f5e19c35a8b4158fc3d5801885dd91e6205c4c888c39f706b257bb23133190d997f41ebcf4e33aed5682189d556929a3c38c919290031a9db3ca3622bc717ba47845abe351978def8a",
+	} {
+		key, err := SharedKey(es, &sk1, &pk2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := seal(es, nil, msg, &nonce, key)
+		if got := hex.EncodeToString(b); got != want {
+			t.Fatalf("%s: want %s, got %s", es, want, got)
+		}
+		m, err := open(es, b, &nonce, key)
+		if err != nil || !bytes.Equal(m, msg) {
+			t.Fatalf("%s: open failed, %v", es, err)
+		}
+		b[len(b)-1]++
+		if _, err := open(es, b, &nonce, key); err == nil {
+			t.Fatalf("%s: modified message should fail", es)
+		}
+	}
+}
+
+func TestStamp(t *testing.T) {
+	st := &Stamp{
+		Props:        StampPropDNSSEC | StampPropNoLog,
+		ServerAddr:   "127.0.0.1:5443",
+		ServerPk:     seq(0, 32),
+		ProviderName: "2.dnscrypt-cert.example.com",
+	}
+	got, err := ParseStamp(st.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, st) {
+		t.Fatalf("want %+v, got %+v", st, got)
+	}
+
+	for _, s := range []string{"", "sdns://", "sdns://AgcAAAAAAAAA", "https://example.com"} {
+		if _, err := ParseStamp(s); err == nil {
+			t.Fatalf("%q should fail", s)
+		}
+	}
+}
+
+func TestCert(t *testing.T) {
+	pk, sk, _ := ed25519.GenerateKey(nil)
+	now := time.Now()
+	c := &Cert{
+		EsVersion: XChacha20Poly1305,
+		Serial:    1,
+		NotBefore: uint32(now.Unix()),
+		NotAfter:  uint32(now.Add(time.Hour).Unix()),
+	}
+	copy(c.ResolverPk[:], seq(1, 32))
+	copy(c.ClientMagic[:], seq(2, 8))
+	c.Sign(sk)
+
+	got, err := ParseCert(c.Marshal(), pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != *c {
+		t.Fatalf("want %+v, got %+v", c, got)
+	}
+	if !got.ValidAt(now) || got.ValidAt(now.Add(2*time.Hour)) {
+		t.Fatal("invalid validity period")
+	}
+
+	b := c.Marshal()
+	b[len(b)-1]++
+	if _, err := ParseCert(b, pk); err == nil {
+		t.Fatal("modified cert should fail")
+	}
+}
+
+func TestQueryResponse(t *testing.T) {
+	cPk, cSk, _ := GenerateKey()
+	sPk, sSk, _ := GenerateKey()
+	for _, es := range []EsVersion{XSalsa20Poly1305, XChacha20Poly1305} {
+		cKey, _ := SharedKey(es, &cSk, &sPk)
+		sKey, _ := SharedKey(es, &sSk, &cPk)
+
+		h := &QueryHeader{ClientPk: cPk}
+		copy(h.ClientMagic[:], seq(1, 8))
+		copy(h.ClientNonce[:], seq(2, HalfNonceSize))
+		q := seq(0, 40)
+		b := EncryptQuery(es, cKey, h, q, PaddedLen(len(q), MinUDPQueryLen))
+		if l := len(b); l != queryHeaderLen+TagSize+MinUDPQueryLen {
+			t.Fatalf("unexpected query length %d", l)
+		}
+
+		gotH, enc, err := ParseQuery(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *gotH != *h {
+			t.Fatal("header mismatched")
+		}
+		gotQ, err := DecryptQuery(es, sKey, gotH, enc)
+		if err != nil || !bytes.Equal(gotQ, q) {
+			t.Fatalf("%s: failed to decrypt query, %v", es, err)
+		}
+
+		r := seq(3, 64)
+		rb, err := EncryptResponse(es, sKey, &h.ClientNonce, r, PaddedLen(len(r), 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotR, err := DecryptResponse(es, cKey, &h.ClientNonce, rb)
+		if err != nil || !bytes.Equal(gotR, r) {
+			t.Fatalf("%s: failed to decrypt response, %v", es, err)
+		}
+		var otherNonce [HalfNonceSize]byte
+		if _, err := DecryptResponse(es, cKey, &otherNonce, rb); err == nil {
+			t.Fatal("response with a wrong nonce should fail")
+		}
+	}
+}
+
+func TestPad(t *testing.T) {
+	for _, n := range []int{0, 1, 63, 64, 65, 300} {
+		msg := seq(1, n)
+		l := PaddedLen(n, 0)
+		if l%64 != 0 || l <= n {
+			t.Fatalf("invalid padded length %d of %d", l, n)
+		}
+		got, err := unpad(pad(msg, l))
+		if err != nil || !bytes.Equal(got, msg) {
+			t.Fatalf("unpad failed, %v", err)
+		}
+	}
+	if _, err := unpad(make([]byte, 10)); err == nil {
+		t.Fatal("invalid padding should fail")
+	}
+}
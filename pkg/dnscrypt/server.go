@@ -0,0 +1,87 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package dnscrypt
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// ResolverCert is a resolver cert and its private key.
+type ResolverCert struct {
+	*Cert
+	Sk  [PublicKeySize]byte
+	Raw []byte // marshaled Cert
+}
+
+// NewResolverCert generates a resolver key pair and a cert signed by
+// the provider key. The client magic is the first 8 bytes of the
+// resolver public key.
+func NewResolverCert(providerSk ed25519.PrivateKey, es EsVersion, serial uint32, notBefore, notAfter time.Time) (*ResolverCert, error) {
+	if !es.Supported() {
+		return nil, errors.New("unsupported encryption system")
+	}
+	pk, sk, err := GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	c := &Cert{
+		EsVersion:  es,
+		ResolverPk: pk,
+		Serial:     serial,
+		NotBefore:  uint32(notBefore.Unix()),
+		NotAfter:   uint32(notAfter.Unix()),
+	}
+	copy(c.ClientMagic[:], pk[:ClientMagicSize])
+	c.Sign(providerSk)
+	return &ResolverCert{Cert: c, Sk: sk, Raw: c.Marshal()}, nil
+}
+
+// CertStore stores the certs that a resolver is currently using.
+// It is safe for concurrent use.
+type CertStore struct {
+	certs atomic.Pointer[[]*ResolverCert]
+}
+
+// Set replaces all certs. The first cert is the newest one.
+func (s *CertStore) Set(certs []*ResolverCert) {
+	s.certs.Store(&certs)
+}
+
+// Certs returns all certs. The returned slice must not be modified.
+func (s *CertStore) Certs() []*ResolverCert {
+	p := s.certs.Load()
+	if p == nil {
+		return nil
+	}
+	return *p
+}
+
+// Lookup returns the cert that has the client magic. It returns nil if
+// there is no such cert.
+func (s *CertStore) Lookup(clientMagic [ClientMagicSize]byte) *ResolverCert {
+	for _, c := range s.Certs() {
+		if c.ClientMagic == clientMagic {
+			return c
+		}
+	}
+	return nil
+}
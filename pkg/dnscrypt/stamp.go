@@ -0,0 +1,114 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+// Package dnscrypt implements the DNSCrypt version 2 protocol.
+// See https://dnscrypt.info/protocol.
+package dnscrypt
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// StampProtoDNSCrypt is the protocol identifier of DNSCrypt stamps.
+const StampProtoDNSCrypt = 0x01
+
+// Stamp properties.
+const (
+	StampPropDNSSEC   uint64 = 1 << 0
+	StampPropNoLog    uint64 = 1 << 1
+	StampPropNoFilter uint64 = 1 << 2
+)
+
+// Stamp is a DNSCrypt server stamp ("sdns://...").
+// See https://dnscrypt.info/stamps-specifications.
+type Stamp struct {
+	Props        uint64
+	ServerAddr   string // ip[:port], default port is 443.
+	ServerPk     []byte // ed25519 public key of the provider.
+	ProviderName string // e.g. "2.dnscrypt-cert.example.com"
+}
+
+// ParseStamp parses a DNSCrypt stamp.
+func ParseStamp(s string) (*Stamp, error) {
+	b64, ok := strings.CutPrefix(s, "sdns://")
+	if !ok {
+		return nil, errors.New("stamp must start with sdns://")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(b64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid stamp encoding, %w", err)
+	}
+	if len(b) < 9 {
+		return nil, errors.New("stamp is too short")
+	}
+	if b[0] != StampProtoDNSCrypt {
+		return nil, fmt.Errorf("unsupported stamp protocol 0x%02x", b[0])
+	}
+	st := &Stamp{Props: binary.LittleEndian.Uint64(b[1:9])}
+	b = b[9:]
+
+	var addr, pk, name []byte
+	for _, p := range [...]*[]byte{&addr, &pk, &name} {
+		if *p, b, err = readLP(b); err != nil {
+			return nil, err
+		}
+	}
+	if len(b) > 0 {
+		return nil, errors.New("stamp has trailing data")
+	}
+	if len(addr) == 0 {
+		return nil, errors.New("stamp has no server address")
+	}
+	if len(pk) != PublicKeySize {
+		return nil, fmt.Errorf("invalid provider public key length %d", len(pk))
+	}
+	if len(name) == 0 {
+		return nil, errors.New("stamp has no provider name")
+	}
+	st.ServerAddr = string(addr)
+	st.ServerPk = pk
+	st.ProviderName = string(name)
+	return st, nil
+}
+
+func readLP(b []byte) (v, remain []byte, err error) {
+	if len(b) == 0 {
+		return nil, nil, errors.New("stamp is truncated")
+	}
+	l := int(b[0])
+	b = b[1:]
+	if len(b) < l {
+		return nil, nil, errors.New("stamp is truncated")
+	}
+	return b[:l], b[l:], nil
+}
+
+// String returns the "sdns://" form of the stamp.
+func (st *Stamp) String() string {
+	b := []byte{StampProtoDNSCrypt}
+	b = binary.LittleEndian.AppendUint64(b, st.Props)
+	for _, v := range [...]string{st.ServerAddr, string(st.ServerPk), st.ProviderName} {
+		b = append(b, byte(len(v)))
+		b = append(b, v...)
+	}
+	return "sdns://" + base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,206 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package file_watcher
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/mlog"
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+// debounce is the time to wait after the last change before calling
+// onChange. Scripts usually write a file in several steps.
+const debounce = time.Millisecond * 500
+
+type Opts struct {
+	// Watch watches files with inotify/kqueue/etc.
+	Watch bool
+
+	// PollInterval polls the modification time and the size of files at
+	// this interval. It is ignored if Watch is true. Zero disables polling.
+	PollInterval time.Duration
+
+	// Logger is used for logging. Default is a noop logger.
+	Logger *zap.Logger
+}
+
+// Enabled reports whether opts enables watching or polling.
+func (opts *Opts) Enabled() bool {
+	return opts.Watch || opts.PollInterval > 0
+}
+
+// Watcher calls onChange when any of the files is changed, created,
+// removed or replaced.
+type Watcher struct {
+	files    map[string]struct{} // cleaned abs paths
+	onChange func()
+	opts     Opts
+
+	fw *fsnotify.Watcher
+
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+	done        chan struct{}
+}
+
+// New starts a Watcher. onChange is called from the watcher goroutine,
+// never concurrently. It returns nil if opts does not enable watching or
+// there is no file. A nil Watcher can be closed.
+func New(files []string, onChange func(), opts Opts) (*Watcher, error) {
+	if !opts.Enabled() || len(files) == 0 {
+		return nil, nil
+	}
+	if opts.Logger == nil {
+		opts.Logger = mlog.Nop()
+	}
+	w := &Watcher{
+		files:       make(map[string]struct{}),
+		onChange:    onChange,
+		opts:        opts,
+		closeNotify: make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	for _, f := range files {
+		abs, err := filepath.Abs(f)
+		if err != nil {
+			return nil, err
+		}
+		w.files[abs] = struct{}{}
+	}
+
+	if opts.Watch {
+		fw, err := fsnotify.NewWatcher()
+		if err != nil {
+			return nil, err
+		}
+		// Watch dirs, so we can still get events after a file was
+		// replaced by a rename.
+		dirs := make(map[string]struct{})
+		for f := range w.files {
+			dirs[filepath.Dir(f)] = struct{}{}
+		}
+		for dir := range dirs {
+			if err := fw.Add(dir); err != nil {
+				_ = fw.Close()
+				return nil, err
+			}
+		}
+		w.fw = fw
+		go w.watchLoop()
+	} else {
+		go w.pollLoop()
+	}
+	return w, nil
+}
+
+func (w *Watcher) Close() error {
+	if w == nil {
+		return nil
+	}
+	w.closeOnce.Do(func() {
+		close(w.closeNotify)
+	})
+	<-w.done
+	if w.fw != nil {
+		return w.fw.Close()
+	}
+	return nil
+}
+
+func (w *Watcher) watchLoop() {
+	defer close(w.done)
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+	for {
+		select {
+		case e, ok := <-w.fw.Events:
+			if !ok {
+				return
+			}
+			if _, ok := w.files[filepath.Clean(e.Name)]; !ok || e.Op == fsnotify.Chmod {
+				continue
+			}
+			timer.Reset(debounce)
+		case err, ok := <-w.fw.Errors:
+			if !ok {
+				return
+			}
+			w.opts.Logger.Warn("file watcher error", zap.Error(err))
+		case <-timer.C:
+			w.onChange()
+		case <-w.closeNotify:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+type fileState struct {
+	modTime time.Time
+	size    int64
+	exist   bool
+}
+
+func (w *Watcher) stat() map[string]fileState {
+	s := make(map[string]fileState, len(w.files))
+	for f := range w.files {
+		fi, err := os.Stat(f)
+		switch {
+		case err == nil:
+			s[f] = fileState{modTime: fi.ModTime(), size: fi.Size(), exist: true}
+		case errors.Is(err, os.ErrNotExist):
+			s[f] = fileState{}
+		default:
+			w.opts.Logger.Warn("failed to stat file", zap.String("file", f), zap.Error(err))
+		}
+	}
+	return s
+}
+
+func (w *Watcher) pollLoop() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.opts.PollInterval)
+	defer ticker.Stop()
+	last := w.stat()
+	for {
+		select {
+		case <-ticker.C:
+			s := w.stat()
+			changed := false
+			for f, fs := range s {
+				if prev, ok := last[f]; ok && prev != fs {
+					changed = true
+				}
+			}
+			last = s
+			if changed {
+				w.onChange()
+			}
+		case <-w.closeNotify:
+			return
+		}
+	}
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package file_watcher
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatcher(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Opts
+	}{
+		{"watch", Opts{Watch: true}},
+		{"poll", Opts{PollInterval: time.Millisecond * 10}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			f := filepath.Join(dir, "rules.txt")
+			other := filepath.Join(dir, "other.txt")
+			if err := os.WriteFile(f, []byte("a"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			changed := make(chan struct{}, 16)
+			w, err := New([]string{f}, func() { changed <- struct{}{} }, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer w.Close()
+
+			wait := func(want bool) {
+				t.Helper()
+				select {
+				case <-changed:
+					if !want {
+						t.Fatal("unexpected change")
+					}
+				case <-time.After(debounce * 2):
+					if want {
+						t.Fatal("change was not detected")
+					}
+				}
+			}
+
+			// Other files in the same dir are ignored.
+			if err := os.WriteFile(other, []byte("b"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			wait(false)
+
+			if err := os.WriteFile(f, []byte("ab"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			wait(true)
+
+			// Replaced by a rename.
+			if err := os.WriteFile(other, []byte("abc"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Rename(other, f); err != nil {
+				t.Fatal(err)
+			}
+			wait(true)
+		})
+	}
+}
+
+func TestNew_Disabled(t *testing.T) {
+	w, err := New([]string{"a"}, func() {}, Opts{})
+	if err != nil || w != nil {
+		t.Fatalf("want nil watcher, got %v, %v", w, err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
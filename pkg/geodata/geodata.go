@@ -0,0 +1,277 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package geodata loads v2ray format geosite.dat and geoip.dat files.
+package geodata
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/netlist"
+	"google.golang.org/protobuf/proto"
+)
+
+// Selector selects entries from a category of a geosite or geoip file.
+// Its string form is "file:category[@attr][@!attr]...", e.g.
+// "geosite.dat:cn@!ads". Categories are case-insensitive. Attributes
+// are only used by geosite files. A domain is selected if it has all
+// Attrs and none of NotAttrs.
+type Selector struct {
+	File     string
+	Category string
+	Attrs    []string
+	NotAttrs []string
+}
+
+// ParseSelector parses s into a Selector.
+func ParseSelector(s string) (Selector, error) {
+	var sel Selector
+	i := strings.LastIndexByte(s, ':')
+	if i <= 0 {
+		return sel, fmt.Errorf("invalid selector %s, missing file or category", s)
+	}
+	sel.File = s[:i]
+	fs := strings.Split(s[i+1:], "@")
+	sel.Category = strings.ToLower(strings.TrimSpace(fs[0]))
+	if len(sel.Category) == 0 {
+		return sel, fmt.Errorf("invalid selector %s, empty category", s)
+	}
+	for _, attr := range fs[1:] {
+		attr = strings.ToLower(strings.TrimSpace(attr))
+		not := strings.HasPrefix(attr, "!")
+		if not {
+			attr = attr[1:]
+		}
+		if len(attr) == 0 {
+			return sel, fmt.Errorf("invalid selector %s, empty attribute", s)
+		}
+		if not {
+			sel.NotAttrs = append(sel.NotAttrs, attr)
+		} else {
+			sel.Attrs = append(sel.Attrs, attr)
+		}
+	}
+	return sel, nil
+}
+
+// Files returns the files used by selectors. Duplicates are removed.
+func Files(selectors []string) ([]string, error) {
+	var fs []string
+	seen := make(map[string]struct{})
+	for _, s := range selectors {
+		sel, err := ParseSelector(s)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := seen[sel.File]; ok {
+			continue
+		}
+		seen[sel.File] = struct{}{}
+		fs = append(fs, sel.File)
+	}
+	return fs, nil
+}
+
+// LoadGeoSiteFile reads and decodes a geosite file.
+func LoadGeoSiteFile(file string) (*GeoSiteList, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	l := new(GeoSiteList)
+	if err := proto.Unmarshal(b, l); err != nil {
+		return nil, fmt.Errorf("invalid geosite file, %w", err)
+	}
+	return l, nil
+}
+
+// LoadGeoIPFile reads and decodes a geoip file.
+func LoadGeoIPFile(file string) (*GeoIPList, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	l := new(GeoIPList)
+	if err := proto.Unmarshal(b, l); err != nil {
+		return nil, fmt.Errorf("invalid geoip file, %w", err)
+	}
+	return l, nil
+}
+
+// Find returns the entry of category. It returns nil if there is no such entry.
+func (x *GeoSiteList) Find(category string) *GeoSite {
+	for _, e := range x.GetEntry() {
+		if strings.EqualFold(e.GetCountryCode(), category) {
+			return e
+		}
+	}
+	return nil
+}
+
+// Find returns the entry of category. It returns nil if there is no such entry.
+func (x *GeoIPList) Find(category string) *GeoIP {
+	for _, e := range x.GetEntry() {
+		if strings.EqualFold(e.GetCountryCode(), category) {
+			return e
+		}
+	}
+	return nil
+}
+
+func (x *Domain) hasAttr(attr string) bool {
+	for _, a := range x.GetAttribute() {
+		if strings.EqualFold(a.GetKey(), attr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (sel *Selector) selectDomain(d *Domain) bool {
+	for _, attr := range sel.Attrs {
+		if !d.hasAttr(attr) {
+			return false
+		}
+	}
+	for _, attr := range sel.NotAttrs {
+		if d.hasAttr(attr) {
+			return false
+		}
+	}
+	return true
+}
+
+// matcherType maps geosite domain types to domain.MixMatcher types.
+func matcherType(t Domain_Type) (string, error) {
+	switch t {
+	case Domain_Plain:
+		return domain.MatcherKeyword, nil
+	case Domain_Regex:
+		return domain.MatcherRegexp, nil
+	case Domain_RootDomain:
+		return domain.MatcherDomain, nil
+	case Domain_Full:
+		return domain.MatcherFull, nil
+	default:
+		return "", fmt.Errorf("unknown domain type %d", t)
+	}
+}
+
+// LoadGeoSites loads domains selected by selectors into m.
+// Each file is only read once. Patterns are added with a type prefix,
+// e.g. "full:google.com". See domain.MixMatcher.
+func LoadGeoSites(selectors []string, m domain.WriteableMatcher[struct{}]) error {
+	files := make(map[string]*GeoSiteList)
+	for i, s := range selectors {
+		sel, err := ParseSelector(s)
+		if err != nil {
+			return err
+		}
+		l := files[sel.File]
+		if l == nil {
+			l, err = LoadGeoSiteFile(sel.File)
+			if err != nil {
+				return fmt.Errorf("failed to load geosite #%d %s, %w", i, s, err)
+			}
+			files[sel.File] = l
+		}
+		if err := LoadGeoSite(l, sel, m); err != nil {
+			return fmt.Errorf("failed to load geosite #%d %s, %w", i, s, err)
+		}
+	}
+	return nil
+}
+
+// LoadGeoSite loads domains selected by sel from l into m.
+// See LoadGeoSites.
+func LoadGeoSite(l *GeoSiteList, sel Selector, m domain.WriteableMatcher[struct{}]) error {
+	site := l.Find(sel.Category)
+	if site == nil {
+		return fmt.Errorf("category %s not found", sel.Category)
+	}
+	for _, d := range site.GetDomain() {
+		if !sel.selectDomain(d) {
+			continue
+		}
+		typ, err := matcherType(d.GetType())
+		if err != nil {
+			return err
+		}
+		if err := m.Add(typ+":"+d.GetValue(), struct{}{}); err != nil {
+			return fmt.Errorf("failed to add domain %s, %w", d.GetValue(), err)
+		}
+	}
+	return nil
+}
+
+// LoadGeoIPs loads cidrs selected by selectors into l.
+// Each file is only read once. Caller must call l.Sort().
+func LoadGeoIPs(selectors []string, l *netlist.List) error {
+	files := make(map[string]*GeoIPList)
+	for i, s := range selectors {
+		sel, err := ParseSelector(s)
+		if err != nil {
+			return err
+		}
+		gl := files[sel.File]
+		if gl == nil {
+			gl, err = LoadGeoIPFile(sel.File)
+			if err != nil {
+				return fmt.Errorf("failed to load geoip #%d %s, %w", i, s, err)
+			}
+			files[sel.File] = gl
+		}
+		if err := LoadGeoIP(gl, sel, l); err != nil {
+			return fmt.Errorf("failed to load geoip #%d %s, %w", i, s, err)
+		}
+	}
+	return nil
+}
+
+// LoadGeoIP loads cidrs selected by sel from gl into l.
+// Caller must call l.Sort().
+func LoadGeoIP(gl *GeoIPList, sel Selector, l *netlist.List) error {
+	if len(sel.Attrs)+len(sel.NotAttrs) > 0 {
+		return errors.New("geoip does not support attributes")
+	}
+	e := gl.Find(sel.Category)
+	if e == nil {
+		return fmt.Errorf("category %s not found", sel.Category)
+	}
+	if e.GetReverseMatch() {
+		return errors.New("reverse match is not supported")
+	}
+	for _, c := range e.GetCidr() {
+		addr, ok := netip.AddrFromSlice(c.GetIp())
+		if !ok {
+			return fmt.Errorf("invalid ip %x", c.GetIp())
+		}
+		p := netip.PrefixFrom(addr, int(c.GetPrefix()))
+		if !p.IsValid() {
+			return fmt.Errorf("invalid prefix %s/%d", addr, c.GetPrefix())
+		}
+		l.Append(p)
+	}
+	return nil
+}
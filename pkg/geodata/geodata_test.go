@@ -0,0 +1,153 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package geodata
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/netlist"
+	"google.golang.org/protobuf/proto"
+)
+
+func writeProto(t *testing.T, m proto.Message) string {
+	t.Helper()
+	b, err := proto.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := filepath.Join(t.TempDir(), "geo.dat")
+	if err := os.WriteFile(f, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestParseSelector(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    Selector
+		wantErr bool
+	}{
+		{"geosite.dat:cn", Selector{File: "geosite.dat", Category: "cn"}, false},
+		{"/a/geosite.dat:CN@!ads", Selector{File: "/a/geosite.dat", Category: "cn", NotAttrs: []string{"ads"}}, false},
+		{"C:\\geo.dat:google@cn@!ads", Selector{File: "C:\\geo.dat", Category: "google", Attrs: []string{"cn"}, NotAttrs: []string{"ads"}}, false},
+		{"geosite.dat", Selector{}, true},
+		{":cn", Selector{}, true},
+		{"geosite.dat:", Selector{}, true},
+		{"geosite.dat:cn@!", Selector{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, err := ParseSelector(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseSelector() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("ParseSelector() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadGeoSites(t *testing.T) {
+	attr := func(k string) *Domain_Attribute {
+		return &Domain_Attribute{Key: k, TypedValue: &Domain_Attribute_BoolValue{BoolValue: true}}
+	}
+	f := writeProto(t, &GeoSiteList{Entry: []*GeoSite{
+		{CountryCode: "CN", Domain: []*Domain{
+			{Type: Domain_RootDomain, Value: "cn.com"},
+			{Type: Domain_Full, Value: "full.com"},
+			{Type: Domain_Plain, Value: "keyword"},
+			{Type: Domain_Regex, Value: "^re[0-9]+\\.com$"},
+			{Type: Domain_RootDomain, Value: "ads.com", Attribute: []*Domain_Attribute{attr("ads")}},
+		}},
+		{CountryCode: "OTHER", Domain: []*Domain{{Type: Domain_RootDomain, Value: "other.com"}}},
+	}})
+
+	m := domain.NewDomainMixMatcher()
+	if err := LoadGeoSites([]string{f + ":cn@!ads"}, m); err != nil {
+		t.Fatal(err)
+	}
+	for s, want := range map[string]bool{
+		"a.cn.com.":      true,
+		"full.com.":      true,
+		"a.full.com.":    false,
+		"a.keyword.org.": true,
+		"re1.com.":       true,
+		"re.com.":        false,
+		"ads.com.":       false,
+		"other.com.":     false,
+	} {
+		if _, ok := m.Match(s); ok != want {
+			t.Errorf("%s: want %v, got %v", s, want, ok)
+		}
+	}
+
+	m = domain.NewDomainMixMatcher()
+	if err := LoadGeoSites([]string{f + ":cn@ads", f + ":other"}, m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Len() != 2 {
+		t.Fatalf("want 2 domains, got %d", m.Len())
+	}
+
+	if err := LoadGeoSites([]string{f + ":missing"}, domain.NewDomainMixMatcher()); err == nil {
+		t.Fatal("missing category should fail")
+	}
+}
+
+func TestLoadGeoIPs(t *testing.T) {
+	f := writeProto(t, &GeoIPList{Entry: []*GeoIP{
+		{CountryCode: "CN", Cidr: []*CIDR{
+			{Ip: []byte{1, 2, 3, 0}, Prefix: 24},
+			{Ip: netip.MustParseAddr("2001:db8::").AsSlice(), Prefix: 32},
+		}},
+		{CountryCode: "BAD", Cidr: []*CIDR{{Ip: []byte{1, 2, 3, 0}, Prefix: 33}}},
+	}})
+
+	l := netlist.NewList()
+	if err := LoadGeoIPs([]string{f + ":cn"}, l); err != nil {
+		t.Fatal(err)
+	}
+	l.Sort()
+	for s, want := range map[string]bool{
+		"1.2.3.4":        true,
+		"1.2.4.4":        false,
+		"2001:db8::1":    true,
+		"2001:db9::1":    false,
+		"::ffff:1.2.3.5": true,
+	} {
+		if got := l.Match(netip.MustParseAddr(s)); got != want {
+			t.Errorf("%s: want %v, got %v", s, want, got)
+		}
+	}
+
+	if err := LoadGeoIPs([]string{f + ":bad"}, netlist.NewList()); err == nil {
+		t.Fatal("invalid prefix should fail")
+	}
+	if err := LoadGeoIPs([]string{f + ":cn@attr"}, netlist.NewList()); err == nil {
+		t.Fatal("attributes should fail")
+	}
+}
@@ -0,0 +1,243 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package compiled
+
+import (
+	"bytes"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/netlist"
+)
+
+func TestDomainSet(t *testing.T) {
+	rules := `
+google.com
+full:full.com
+domain:example.org
+regexp:^re[0-9]+\.net$
+keyword:kw
+`
+	b := NewDomainBuilder()
+	if err := domain.LoadFromTextReader[struct{}](b, strings.NewReader(rules), nil); err != nil {
+		t.Fatal(err)
+	}
+	f := filepath.Join(t.TempDir(), "d.bin")
+	if err := WriteDomainSet(f, b); err != nil {
+		t.Fatal(err)
+	}
+	s, err := OpenDomainSet(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if s.Len() != 5 {
+		t.Fatalf("want len 5, got %d", s.Len())
+	}
+	for q, want := range map[string]bool{
+		"google.com.":     true,
+		"WWW.Google.com.": true,
+		"oogle.com.":      false,
+		"com.":            false,
+		"full.com.":       true,
+		"a.full.com.":     false,
+		"a.b.example.org": true,
+		"re12.net.":       true,
+		"a.re12.net.":     false,
+		"akwb.com.":       true,
+		".":               false,
+	} {
+		if _, ok := s.Match(q); ok != want {
+			t.Errorf("compiled %s: want %v, got %v", q, want, ok)
+		}
+		if _, ok := b.Match(q); ok != want {
+			t.Errorf("builder %s: want %v, got %v", q, want, ok)
+		}
+	}
+}
+
+func TestIPSet(t *testing.T) {
+	l := netlist.NewList()
+	if err := netlist.LoadFromReader(l, strings.NewReader("1.0.0.0/24\n1.0.0.0/8\n10.0.0.1\n2001:db8::/32\n")); err != nil {
+		t.Fatal(err)
+	}
+	f := filepath.Join(t.TempDir(), "ip.bin")
+	if err := WriteIPSet(f, l); err != nil {
+		t.Fatal(err)
+	}
+	s, err := OpenIPSet(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if s.Len() != 3 {
+		t.Fatalf("want len 3, got %d", s.Len())
+	}
+	for a, want := range map[string]bool{
+		"1.2.3.4":        true,
+		"2.0.0.0":        false,
+		"10.0.0.1":       true,
+		"10.0.0.2":       false,
+		"0.0.0.0":        false,
+		"::ffff:1.0.0.1": true,
+		"2001:db8::1":    true,
+		"2001:db9::1":    false,
+	} {
+		if got := s.Match(netip.MustParseAddr(a)); got != want {
+			t.Errorf("%s: want %v, got %v", a, want, got)
+		}
+	}
+}
+
+func TestOpenInvalid(t *testing.T) {
+	dir := t.TempDir()
+	b := NewDomainBuilder()
+	_ = b.Add("google.com", struct{}{})
+	good := filepath.Join(dir, "good")
+	if err := WriteDomainSet(good, b); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(good)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, data := range map[string][]byte{
+		"empty":     nil,
+		"truncated": data[:len(data)-1],
+		"bad_magic": append([]byte("XXXXXXXX"), data[8:]...),
+	} {
+		f := filepath.Join(dir, name)
+		if err := os.WriteFile(f, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := OpenDomainSet(f); err == nil {
+			t.Errorf("%s: want an error", name)
+		}
+	}
+	if _, err := OpenIPSet(good); err == nil {
+		t.Error("opening a domain file as ip file should fail")
+	}
+}
+
+// genDomains generates n domain rules.
+func genDomains(n int) []byte {
+	buf := new(bytes.Buffer)
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(buf, "domain:%x.test%d.com\n", i*7919, i%100)
+	}
+	return buf.Bytes()
+}
+
+func heapInUse() int64 {
+	runtime.GC()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return int64(ms.HeapInuse)
+}
+
+const benchRules = 1_000_000
+
+// BenchmarkDomainMatch compares the in-memory MixMatcher with a compiled
+// file of the same rules. The heap-MB metric is the heap used by the matcher.
+func BenchmarkDomainMatch(b *testing.B) {
+	rules := genDomains(benchRules)
+	queries := []string{"abc.1e.test1.com.", "not.exist.com.", "www.f4a7.test12.com."}
+
+	b.Run("mix_matcher", func(b *testing.B) {
+		before := heapInUse()
+		m := domain.NewDomainMixMatcher()
+		if err := domain.LoadFromTextReader[struct{}](m, bytes.NewReader(rules), nil); err != nil {
+			b.Fatal(err)
+		}
+		heap := heapInUse() - before
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			m.Match(queries[i%len(queries)])
+		}
+		b.ReportMetric(float64(heap)/1e6, "heap-MB")
+		runtime.KeepAlive(m)
+	})
+
+	b.Run("compiled", func(b *testing.B) {
+		bd := NewDomainBuilder()
+		if err := domain.LoadFromTextReader[struct{}](bd, bytes.NewReader(rules), nil); err != nil {
+			b.Fatal(err)
+		}
+		f := filepath.Join(b.TempDir(), "d.bin")
+		if err := WriteDomainSet(f, bd); err != nil {
+			b.Fatal(err)
+		}
+		bd = nil
+		before := heapInUse()
+		s, err := OpenDomainSet(f)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer s.Close()
+		heap := heapInUse() - before
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			s.Match(queries[i%len(queries)])
+		}
+		b.ReportMetric(float64(heap)/1e6, "heap-MB")
+	})
+}
+
+func BenchmarkIPMatch(b *testing.B) {
+	l := netlist.NewList()
+	for i := 0; i < benchRules; i++ {
+		l.Append(netip.PrefixFrom(netip.AddrFrom4([4]byte{byte(i >> 16), byte(i >> 8), byte(i), 0}), 24))
+	}
+	l.Sort()
+	f := filepath.Join(b.TempDir(), "ip.bin")
+	if err := WriteIPSet(f, l); err != nil {
+		b.Fatal(err)
+	}
+	s, err := OpenIPSet(f)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer s.Close()
+	addr := netip.MustParseAddr("8.8.8.8")
+
+	b.Run("netlist", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			l.Match(addr)
+		}
+	})
+	b.Run("compiled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			s.Match(addr)
+		}
+	})
+}
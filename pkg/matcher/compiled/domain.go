@@ -0,0 +1,224 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package compiled
+
+import (
+	"bufio"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+)
+
+var _ domain.WriteableMatcher[struct{}] = (*DomainBuilder)(nil)
+var _ domain.Matcher[struct{}] = (*DomainSet)(nil)
+
+// DomainBuilder collects domain rules for WriteDomainSet. It accepts
+// the same rules as domain.NewDomainMixMatcher, so it can be used with
+// domain.LoadFromTextReader.
+type DomainBuilder struct {
+	full    map[string]struct{}
+	domain  map[string]struct{}
+	regexp  map[string]*regexp.Regexp
+	keyword map[string]struct{}
+}
+
+func NewDomainBuilder() *DomainBuilder {
+	return &DomainBuilder{
+		full:    make(map[string]struct{}),
+		domain:  make(map[string]struct{}),
+		regexp:  make(map[string]*regexp.Regexp),
+		keyword: make(map[string]struct{}),
+	}
+}
+
+// Add adds a rule. Rules without a type prefix are domain rules.
+func (b *DomainBuilder) Add(s string, _ struct{}) error {
+	typ, pattern, ok := utils.SplitString2(s, ":")
+	if !ok {
+		typ, pattern = domain.MatcherDomain, s
+	}
+	switch typ {
+	case domain.MatcherFull:
+		b.full[domain.NormalizeDomain(pattern)] = struct{}{}
+	case domain.MatcherDomain:
+		b.domain[domain.NormalizeDomain(pattern)] = struct{}{}
+	case domain.MatcherRegexp:
+		if _, ok := b.regexp[pattern]; !ok {
+			reg, err := regexp.Compile(pattern)
+			if err != nil {
+				return err
+			}
+			b.regexp[pattern] = reg
+		}
+	case domain.MatcherKeyword:
+		b.keyword[domain.NormalizeDomain(pattern)] = struct{}{}
+	default:
+		return fmt.Errorf("unsupported match type [%s]", typ)
+	}
+	return nil
+}
+
+func (b *DomainBuilder) Match(s string) (struct{}, bool) {
+	s = domain.NormalizeDomain(s)
+	if _, ok := b.full[s]; ok {
+		return struct{}{}, true
+	}
+	for d := s; ; {
+		if _, ok := b.domain[d]; ok {
+			return struct{}{}, true
+		}
+		i := strings.IndexByte(d, '.')
+		if i < 0 {
+			break
+		}
+		d = d[i+1:]
+	}
+	for _, reg := range b.regexp {
+		if reg.MatchString(s) {
+			return struct{}{}, true
+		}
+	}
+	for k := range b.keyword {
+		if strings.Contains(s, k) {
+			return struct{}{}, true
+		}
+	}
+	return struct{}{}, false
+}
+
+func (b *DomainBuilder) Len() int {
+	return len(b.full) + len(b.domain) + len(b.regexp) + len(b.keyword)
+}
+
+// WriteDomainSet writes rules in b to file. The file is replaced atomically.
+func WriteDomainSet(file string, b *DomainBuilder) error {
+	return writeFileAtomic(file, func(w *bufio.Writer) error {
+		writeHeader(w, domainMagic)
+		for _, m := range [...]map[string]struct{}{b.full, b.domain} {
+			if err := writeStrTable(w, keys(m)); err != nil {
+				return err
+			}
+		}
+		if err := writeStrTable(w, keys(b.regexp)); err != nil {
+			return err
+		}
+		return writeStrTable(w, keys(b.keyword))
+	})
+}
+
+func keys[V any](m map[string]V) []string {
+	ks := make([]string, 0, len(m))
+	for k := range m {
+		ks = append(ks, k)
+	}
+	return ks
+}
+
+// DomainSet is a domain matcher that matches against a mapped compiled file.
+// Full and domain rules stay in the file. Regexp and keyword rules,
+// which are usually few, are loaded into memory.
+// DomainSet is safe for concurrent use. It must not be used after Close.
+type DomainSet struct {
+	f *mappedFile
+
+	full    strTable
+	domain  strTable
+	regexp  *domain.RegexMatcher[struct{}]
+	keyword *domain.KeywordMatcher[struct{}]
+}
+
+// OpenDomainSet maps a compiled domain file.
+func OpenDomainSet(file string) (*DomainSet, error) {
+	f, err := mapFile(file)
+	if err != nil {
+		return nil, err
+	}
+	s, err := newDomainSet(f)
+	if err != nil {
+		f.close()
+		return nil, fmt.Errorf("invalid compiled domain file %s, %w", file, err)
+	}
+	return s, nil
+}
+
+func newDomainSet(f *mappedFile) (*DomainSet, error) {
+	b, err := checkHeader(f.b, domainMagic)
+	if err != nil {
+		return nil, err
+	}
+	s := &DomainSet{
+		f:       f,
+		regexp:  domain.NewRegexMatcher[struct{}](),
+		keyword: domain.NewKeywordMatcher[struct{}](),
+	}
+	if s.full, b, err = parseStrTable(b); err != nil {
+		return nil, err
+	}
+	if s.domain, b, err = parseStrTable(b); err != nil {
+		return nil, err
+	}
+	for _, m := range [...]domain.WriteableMatcher[struct{}]{s.regexp, s.keyword} {
+		var t strTable
+		if t, b, err = parseStrTable(b); err != nil {
+			return nil, err
+		}
+		for i := 0; i < t.n; i++ {
+			// Copy strings out of the mapped file.
+			if err := m.Add(strings.Clone(t.at(i)), struct{}{}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return s, nil
+}
+
+func (s *DomainSet) Match(q string) (struct{}, bool) {
+	q = domain.NormalizeDomain(q)
+	if s.full.contains(q) {
+		return struct{}{}, true
+	}
+	for d := q; ; {
+		if s.domain.contains(d) {
+			return struct{}{}, true
+		}
+		i := strings.IndexByte(d, '.')
+		if i < 0 {
+			break
+		}
+		d = d[i+1:]
+	}
+	if _, ok := s.regexp.Match(q); ok {
+		return struct{}{}, true
+	}
+	return s.keyword.Match(q)
+}
+
+// Len returns the number of rules.
+func (s *DomainSet) Len() int {
+	return s.full.n + s.domain.n + s.regexp.Len() + s.keyword.Len()
+}
+
+// Close unmaps the file.
+func (s *DomainSet) Close() error {
+	return s.f.close()
+}
@@ -0,0 +1,188 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package compiled implements a compact binary format for large domain
+// and ip lists. Compiled files are memory-mapped and matched in place,
+// so they cost almost no heap memory and open instantly.
+//
+// All integers are little endian. A file starts with an 8 bytes magic and
+// an uint32 version.
+//
+// A domain file has four string tables: full, domain, regexp and keyword.
+// A string table is an uint32 count n, n+1 uint32 offsets and a blob.
+// String i is blob[offsets[i]:offsets[i+1]]. Strings of full and domain
+// tables are sorted normalized domains, which are searched with binary search.
+//
+// An ip file has an uint32 count n and n sorted, non-overlapping prefixes.
+// Each prefix is a 16 bytes IPv6 (or IPv4-mapped) address and a byte of bits.
+package compiled
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"unsafe"
+)
+
+const (
+	version = 1
+
+	headerLen = 12
+)
+
+var (
+	domainMagic = [8]byte{'M', 'O', 'S', 'D', 'N', 'S', 'D', 'M'}
+	ipMagic     = [8]byte{'M', 'O', 'S', 'D', 'N', 'S', 'I', 'P'}
+
+	errTruncated = errors.New("truncated file")
+)
+
+func writeHeader(w *bufio.Writer, magic [8]byte) {
+	w.Write(magic[:])
+	writeUint32(w, version)
+}
+
+func checkHeader(b []byte, magic [8]byte) ([]byte, error) {
+	if len(b) < headerLen {
+		return nil, errTruncated
+	}
+	if [8]byte(b[:8]) != magic {
+		return nil, errors.New("invalid magic, not a compiled file or wrong type")
+	}
+	if v := binary.LittleEndian.Uint32(b[8:]); v != version {
+		return nil, fmt.Errorf("unsupported version %d", v)
+	}
+	return b[headerLen:], nil
+}
+
+func writeUint32(w *bufio.Writer, u uint32) {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], u)
+	w.Write(b[:])
+}
+
+// strTable is a read-only string table in a mapped file.
+type strTable struct {
+	n    int
+	offs []byte // (n+1) uint32
+	blob []byte
+}
+
+// writeStrTable writes ss as a string table. ss will be sorted.
+func writeStrTable(w *bufio.Writer, ss []string) error {
+	sort.Strings(ss)
+	if len(ss) >= math.MaxUint32 {
+		return errors.New("too many strings")
+	}
+	writeUint32(w, uint32(len(ss)))
+	off := 0
+	writeUint32(w, 0)
+	for _, s := range ss {
+		off += len(s)
+		if off > math.MaxUint32 {
+			return errors.New("string table is too large")
+		}
+		writeUint32(w, uint32(off))
+	}
+	for _, s := range ss {
+		w.WriteString(s)
+	}
+	return nil
+}
+
+// parseStrTable parses a string table from b and returns the remaining bytes.
+// It validates all offsets, so lookups never go out of bounds.
+func parseStrTable(b []byte) (strTable, []byte, error) {
+	var t strTable
+	if len(b) < 4 {
+		return t, nil, errTruncated
+	}
+	n := int(binary.LittleEndian.Uint32(b))
+	b = b[4:]
+	if len(b)/4 < n+1 {
+		return t, nil, errTruncated
+	}
+	t.n = n
+	t.offs = b[:(n+1)*4]
+	b = b[(n+1)*4:]
+	prev := uint32(0)
+	for i := 0; i <= n; i++ {
+		off := binary.LittleEndian.Uint32(t.offs[i*4:])
+		if off < prev {
+			return t, nil, errors.New("invalid string table offsets")
+		}
+		prev = off
+	}
+	if uint64(len(b)) < uint64(prev) {
+		return t, nil, errTruncated
+	}
+	t.blob = b[:prev]
+	return t, b[prev:], nil
+}
+
+// at returns string i. The returned string shares memory with the table.
+func (t *strTable) at(i int) string {
+	start := binary.LittleEndian.Uint32(t.offs[i*4:])
+	end := binary.LittleEndian.Uint32(t.offs[(i+1)*4:])
+	if start == end {
+		return ""
+	}
+	return unsafe.String(&t.blob[start], end-start)
+}
+
+func (t *strTable) contains(s string) bool {
+	i, j := 0, t.n
+	for i < j {
+		h := int(uint(i+j) >> 1)
+		if t.at(h) < s {
+			i = h + 1
+		} else {
+			j = h
+		}
+	}
+	return i < t.n && t.at(i) == s
+}
+
+// writeFileAtomic calls write with a buffered temp file in the same dir and
+// renames the file to name. Mapped readers of the old file are not affected.
+func writeFileAtomic(name string, write func(w *bufio.Writer) error) error {
+	f, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	w := bufio.NewWriter(f)
+	if err := write(w); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
@@ -0,0 +1,133 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package compiled
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/netlist"
+)
+
+var _ netlist.Matcher = (*IPSet)(nil)
+
+const ipEntryLen = 17
+
+// WriteIPSet writes l to file. The file is replaced atomically.
+func WriteIPSet(file string, l *netlist.List) error {
+	l.Sort()
+	ps := l.Prefixes()
+	if len(ps) >= math.MaxUint32 {
+		return errors.New("too many prefixes")
+	}
+	return writeFileAtomic(file, func(w *bufio.Writer) error {
+		writeHeader(w, ipMagic)
+		writeUint32(w, uint32(len(ps)))
+		for _, p := range ps {
+			a := p.Addr().As16()
+			w.Write(a[:])
+			w.WriteByte(byte(p.Bits()))
+		}
+		return nil
+	})
+}
+
+// IPSet is an ip matcher that matches against a mapped compiled file.
+// IPSet is safe for concurrent use. It must not be used after Close.
+type IPSet struct {
+	f *mappedFile
+	e []byte // n * ipEntryLen
+	n int
+}
+
+// OpenIPSet maps a compiled ip file.
+func OpenIPSet(file string) (*IPSet, error) {
+	f, err := mapFile(file)
+	if err != nil {
+		return nil, err
+	}
+	s, err := newIPSet(f)
+	if err != nil {
+		f.close()
+		return nil, fmt.Errorf("invalid compiled ip file %s, %w", file, err)
+	}
+	return s, nil
+}
+
+func newIPSet(f *mappedFile) (*IPSet, error) {
+	b, err := checkHeader(f.b, ipMagic)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < 4 {
+		return nil, errTruncated
+	}
+	n := int(binary.LittleEndian.Uint32(b))
+	b = b[4:]
+	if len(b)/ipEntryLen < n {
+		return nil, errTruncated
+	}
+	s := &IPSet{f: f, e: b[:n*ipEntryLen], n: n}
+	for i := 0; i < n; i++ {
+		if s.e[i*ipEntryLen+16] > 128 {
+			return nil, errors.New("invalid prefix bits")
+		}
+	}
+	return s, nil
+}
+
+func (s *IPSet) Match(addr netip.Addr) bool {
+	if !addr.IsValid() {
+		return false
+	}
+	a := addr.As16()
+
+	// Find the last prefix whose address <= a.
+	i, j := 0, s.n
+	for i < j {
+		h := int(uint(i+j) >> 1)
+		if bytes.Compare(s.e[h*ipEntryLen:h*ipEntryLen+16], a[:]) <= 0 {
+			i = h + 1
+		} else {
+			j = h
+		}
+	}
+	if i == 0 {
+		return false
+	}
+	e := s.e[(i-1)*ipEntryLen : i*ipEntryLen]
+	p := netip.PrefixFrom(netip.AddrFrom16([16]byte(e[:16])), int(e[16]))
+	return p.Contains(netip.AddrFrom16(a))
+}
+
+// Len returns the number of prefixes.
+func (s *IPSet) Len() int {
+	return s.n
+}
+
+// Close unmaps the file.
+func (s *IPSet) Close() error {
+	return s.f.close()
+}
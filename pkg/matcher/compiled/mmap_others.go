@@ -0,0 +1,43 @@
+//go:build !unix
+
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package compiled
+
+import "os"
+
+// mappedFile holds the file content. Files are read into memory on
+// platforms without mmap support.
+type mappedFile struct {
+	b []byte
+}
+
+func mapFile(name string) (*mappedFile, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return &mappedFile{b: b}, nil
+}
+
+func (f *mappedFile) close() error {
+	f.b = nil
+	return nil
+}
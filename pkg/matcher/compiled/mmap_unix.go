@@ -0,0 +1,64 @@
+//go:build unix
+
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package compiled
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// mappedFile is a read-only memory-mapped file.
+type mappedFile struct {
+	b []byte
+}
+
+func mapFile(name string) (*mappedFile, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := fi.Size()
+	if size == 0 || int64(int(size)) != size {
+		// Zero length mapping is invalid. Let the parser report it.
+		return &mappedFile{}, nil
+	}
+	b, err := unix.Mmap(int(f.Fd()), 0, int(size), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	return &mappedFile{b: b}, nil
+}
+
+func (f *mappedFile) close() error {
+	if f.b == nil {
+		return nil
+	}
+	b := f.b
+	f.b = nil
+	return unix.Munmap(b)
+}
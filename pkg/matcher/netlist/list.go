@@ -110,6 +110,16 @@ func (list *List) Swap(i, j int) {
 	list.e[i], list.e[j] = list.e[j], list.e[i]
 }
 
+// Prefixes returns the sorted and merged prefixes of the list. IPv4 prefixes
+// are in their IPv4-mapped IPv6 form. The list must be sorted. Caller must
+// not modify the returned slice.
+func (list *List) Prefixes() []netip.Prefix {
+	if !list.sorted {
+		panic("list is not sorted")
+	}
+	return list.e
+}
+
 func (list *List) Match(addr netip.Addr) bool {
 	return list.Contains(addr)
 }
@@ -0,0 +1,198 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package odoh
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// HPKE (RFC 9180) base mode with the only cipher suite that is
+// mandatory for ODoH: DHKEM(X25519, HKDF-SHA256), HKDF-SHA256, AES-128-GCM.
+
+const (
+	KemX25519HkdfSha256 uint16 = 0x0020
+	KdfHkdfSha256       uint16 = 0x0001
+	AeadAes128Gcm       uint16 = 0x0001
+)
+
+const (
+	nEnc    = 32
+	nSecret = 32
+	nK      = 16
+	nN      = 12
+	nH      = 32
+)
+
+var (
+	kemSuiteID  = []byte{'K', 'E', 'M', 0x00, 0x20}
+	hpkeSuiteID = []byte{'H', 'P', 'K', 'E', 0x00, 0x20, 0x00, 0x01, 0x00, 0x01}
+)
+
+func labeledExtract(suiteID, salt []byte, label string, ikm []byte) []byte {
+	b := make([]byte, 0, 7+len(suiteID)+len(label)+len(ikm))
+	b = append(b, "HPKE-v1"...)
+	b = append(b, suiteID...)
+	b = append(b, label...)
+	b = append(b, ikm...)
+	return hkdf.Extract(sha256.New, b, salt)
+}
+
+func labeledExpand(suiteID, prk []byte, label string, info []byte, l int) []byte {
+	b := make([]byte, 0, 9+len(suiteID)+len(label)+len(info))
+	b = binary.BigEndian.AppendUint16(b, uint16(l))
+	b = append(b, "HPKE-v1"...)
+	b = append(b, suiteID...)
+	b = append(b, label...)
+	b = append(b, info...)
+	return expand(prk, b, l)
+}
+
+func expand(prk, info []byte, l int) []byte {
+	out := make([]byte, l)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, prk, info), out); err != nil {
+		panic(err) // l is always far below the hkdf limit.
+	}
+	return out
+}
+
+func extractAndExpand(dh, kemContext []byte) []byte {
+	prk := labeledExtract(kemSuiteID, nil, "eae_prk", dh)
+	return labeledExpand(kemSuiteID, prk, "shared_secret", kemContext, nSecret)
+}
+
+// encap generates an ephemeral key pair and returns the shared secret
+// and the encapsulated key for pkR.
+func encap(rand io.Reader, pkR *ecdh.PublicKey) (sharedSecret, enc []byte, err error) {
+	skE, err := ecdh.X25519().GenerateKey(rand)
+	if err != nil {
+		return nil, nil, err
+	}
+	dh, err := skE.ECDH(pkR)
+	if err != nil {
+		return nil, nil, err
+	}
+	enc = skE.PublicKey().Bytes()
+	kemContext := append(append(make([]byte, 0, 2*nEnc), enc...), pkR.Bytes()...)
+	return extractAndExpand(dh, kemContext), enc, nil
+}
+
+// decap recovers the shared secret from the encapsulated key enc.
+func decap(enc []byte, skR *ecdh.PrivateKey) ([]byte, error) {
+	pkE, err := ecdh.X25519().NewPublicKey(enc)
+	if err != nil {
+		return nil, err
+	}
+	dh, err := skR.ECDH(pkE)
+	if err != nil {
+		return nil, err
+	}
+	kemContext := append(append(make([]byte, 0, 2*nEnc), enc...), skR.PublicKey().Bytes()...)
+	return extractAndExpand(dh, kemContext), nil
+}
+
+// hpkeContext is an HPKE encryption context. It is not safe for concurrent use.
+type hpkeContext struct {
+	aead           cipher.AEAD
+	baseNonce      []byte
+	exporterSecret []byte
+	seq            uint64
+}
+
+func keySchedule(sharedSecret, info []byte) (*hpkeContext, error) {
+	pskIDHash := labeledExtract(hpkeSuiteID, nil, "psk_id_hash", nil)
+	infoHash := labeledExtract(hpkeSuiteID, nil, "info_hash", info)
+	ksc := make([]byte, 0, 1+2*nH)
+	ksc = append(ksc, 0x00) // mode_base
+	ksc = append(ksc, pskIDHash...)
+	ksc = append(ksc, infoHash...)
+
+	secret := labeledExtract(hpkeSuiteID, sharedSecret, "secret", nil)
+	aead, err := newAesGcm(labeledExpand(hpkeSuiteID, secret, "key", ksc, nK))
+	if err != nil {
+		return nil, err
+	}
+	return &hpkeContext{
+		aead:           aead,
+		baseNonce:      labeledExpand(hpkeSuiteID, secret, "base_nonce", ksc, nN),
+		exporterSecret: labeledExpand(hpkeSuiteID, secret, "exp", ksc, nH),
+	}, nil
+}
+
+func newAesGcm(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (c *hpkeContext) nextNonce() []byte {
+	nonce := make([]byte, nN)
+	copy(nonce, c.baseNonce)
+	var seq [8]byte
+	binary.BigEndian.PutUint64(seq[:], c.seq)
+	for i := range seq {
+		nonce[nN-8+i] ^= seq[i]
+	}
+	c.seq++
+	return nonce
+}
+
+func (c *hpkeContext) seal(aad, pt []byte) []byte {
+	return c.aead.Seal(nil, c.nextNonce(), pt, aad)
+}
+
+func (c *hpkeContext) open(aad, ct []byte) ([]byte, error) {
+	pt, err := c.aead.Open(nil, c.nextNonce(), ct, aad)
+	if err != nil {
+		c.seq--
+		return nil, errors.New("failed to decrypt message")
+	}
+	return pt, nil
+}
+
+func (c *hpkeContext) export(exporterContext []byte, l int) []byte {
+	return labeledExpand(hpkeSuiteID, c.exporterSecret, "sec", exporterContext, l)
+}
+
+func setupBaseS(rand io.Reader, pkR *ecdh.PublicKey, info []byte) (enc []byte, c *hpkeContext, err error) {
+	sharedSecret, enc, err := encap(rand, pkR)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err = keySchedule(sharedSecret, info)
+	return enc, c, err
+}
+
+func setupBaseR(enc []byte, skR *ecdh.PrivateKey, info []byte) (*hpkeContext, error) {
+	sharedSecret, err := decap(enc, skR)
+	if err != nil {
+		return nil, err
+	}
+	return keySchedule(sharedSecret, info)
+}
@@ -0,0 +1,383 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package odoh implements the message format of Oblivious DNS over HTTPS
+// (RFC 9230). Only the mandatory HPKE cipher suite is supported.
+//
+// A client encrypts a query to the public key of a target and sends it
+// through an oblivious proxy, so the proxy sees who asks but not what, and
+// the target sees what is asked but not who.
+package odoh
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// ContentType is the media type of ODoH messages.
+	ContentType = "application/oblivious-dns-message"
+
+	// WellKnownConfigsPath is where a target publishes its configs.
+	WellKnownConfigsPath = "/.well-known/odohconfigs"
+
+	// ConfigVersion is the ODoH config version of RFC 9230.
+	ConfigVersion uint16 = 0x0001
+)
+
+const (
+	messageTypeQuery    byte = 0x01
+	messageTypeResponse byte = 0x02
+
+	responseNonceLen = max(nN, nK)
+
+	// Plaintexts are padded to multiples of these block sizes,
+	// as RFC 8467 recommends for EDNS0 padding.
+	queryPaddingBlock    = 128
+	responsePaddingBlock = 468
+)
+
+var (
+	ErrKeyMismatch   = errors.New("odoh: key id mismatch")
+	errInvalidMsg    = errors.New("odoh: invalid message")
+	errInvalidConfig = errors.New("odoh: invalid config")
+)
+
+// Config is an ObliviousDoHConfigContents.
+type Config struct {
+	KemID     uint16
+	KdfID     uint16
+	AeadID    uint16
+	PublicKey []byte
+}
+
+func (c Config) marshalContents() []byte {
+	b := make([]byte, 0, 8+len(c.PublicKey))
+	b = binary.BigEndian.AppendUint16(b, c.KemID)
+	b = binary.BigEndian.AppendUint16(b, c.KdfID)
+	b = binary.BigEndian.AppendUint16(b, c.AeadID)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(c.PublicKey)))
+	return append(b, c.PublicKey...)
+}
+
+// Supported reports whether c uses the cipher suite of this package.
+func (c Config) Supported() bool {
+	return c.KemID == KemX25519HkdfSha256 && c.KdfID == KdfHkdfSha256 && c.AeadID == AeadAes128Gcm && len(c.PublicKey) == nEnc
+}
+
+// KeyID returns the key id of c.
+func (c Config) KeyID() []byte {
+	prk := hkdf.Extract(sha256.New, c.marshalContents(), nil)
+	return expand(prk, []byte("odoh key id"), nH)
+}
+
+// MarshalConfigs encodes cs as ObliviousDoHConfigs.
+func MarshalConfigs(cs []Config) []byte {
+	var body []byte
+	for i := range cs {
+		contents := cs[i].marshalContents()
+		body = binary.BigEndian.AppendUint16(body, ConfigVersion)
+		body = binary.BigEndian.AppendUint16(body, uint16(len(contents)))
+		body = append(body, contents...)
+	}
+	b := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(body)), uint16(len(body)))
+	return append(b, body...)
+}
+
+// ParseConfigs decodes ObliviousDoHConfigs. Configs of unknown versions
+// are skipped.
+func ParseConfigs(b []byte) ([]Config, error) {
+	body, rest, ok := readVec16(b)
+	if !ok || len(rest) != 0 {
+		return nil, errInvalidConfig
+	}
+	var cs []Config
+	for len(body) > 0 {
+		if len(body) < 2 {
+			return nil, errInvalidConfig
+		}
+		version := binary.BigEndian.Uint16(body)
+		var contents []byte
+		contents, body, ok = readVec16(body[2:])
+		if !ok {
+			return nil, errInvalidConfig
+		}
+		if version != ConfigVersion {
+			continue
+		}
+		if len(contents) < 6 {
+			return nil, errInvalidConfig
+		}
+		c := Config{
+			KemID:  binary.BigEndian.Uint16(contents),
+			KdfID:  binary.BigEndian.Uint16(contents[2:]),
+			AeadID: binary.BigEndian.Uint16(contents[4:]),
+		}
+		pk, rest, ok := readVec16(contents[6:])
+		if !ok || len(rest) != 0 {
+			return nil, errInvalidConfig
+		}
+		c.PublicKey = bytes.Clone(pk)
+		cs = append(cs, c)
+	}
+	return cs, nil
+}
+
+// PickConfig returns the first supported config in cs.
+func PickConfig(cs []Config) (Config, error) {
+	for _, c := range cs {
+		if c.Supported() {
+			return c, nil
+		}
+	}
+	return Config{}, errors.New("odoh: no supported config")
+}
+
+// KeyPair is the key of a target.
+type KeyPair struct {
+	sk     *ecdh.PrivateKey
+	config Config
+	keyID  []byte
+}
+
+// NewKeyPair returns a KeyPair of sk. sk must be a X25519 key.
+func NewKeyPair(sk *ecdh.PrivateKey) (*KeyPair, error) {
+	if sk.Curve() != ecdh.X25519() {
+		return nil, errors.New("odoh: not a X25519 key")
+	}
+	k := &KeyPair{
+		sk: sk,
+		config: Config{
+			KemID:     KemX25519HkdfSha256,
+			KdfID:     KdfHkdfSha256,
+			AeadID:    AeadAes128Gcm,
+			PublicKey: sk.PublicKey().Bytes(),
+		},
+	}
+	k.keyID = k.config.KeyID()
+	return k, nil
+}
+
+// Config returns the config of k.
+func (k *KeyPair) Config() Config {
+	return k.config
+}
+
+// DecryptQuery decrypts a query message. It returns ErrKeyMismatch if the
+// message was not encrypted to k.
+func (k *KeyPair) DecryptQuery(msg []byte) ([]byte, *QueryContext, error) {
+	typ, keyID, encrypted, err := parseMessage(msg)
+	if err != nil {
+		return nil, nil, err
+	}
+	if typ != messageTypeQuery || len(encrypted) < nEnc {
+		return nil, nil, errInvalidMsg
+	}
+	if subtle.ConstantTimeCompare(keyID, k.keyID) != 1 {
+		return nil, nil, ErrKeyMismatch
+	}
+	hc, err := setupBaseR(encrypted[:nEnc], k.sk, []byte("odoh query"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("odoh: %w", err)
+	}
+	plaintext, err := hc.open(queryAad(keyID), encrypted[nEnc:])
+	if err != nil {
+		return nil, nil, fmt.Errorf("odoh: %w", err)
+	}
+	q, err := parsePlaintext(plaintext)
+	if err != nil {
+		return nil, nil, err
+	}
+	return q, &QueryContext{plaintext: plaintext, secret: hc.export([]byte("odoh response"), nK)}, nil
+}
+
+// QueryContext holds the secrets of a query that protect its response.
+type QueryContext struct {
+	plaintext []byte
+	secret    []byte
+}
+
+// EncryptQuery encrypts dns query q to the target of c.
+func EncryptQuery(c Config, q []byte) ([]byte, *QueryContext, error) {
+	if !c.Supported() {
+		return nil, nil, errors.New("odoh: unsupported config")
+	}
+	pkR, err := ecdh.X25519().NewPublicKey(c.PublicKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("odoh: %w", err)
+	}
+	plaintext, err := marshalPlaintext(q, queryPaddingBlock)
+	if err != nil {
+		return nil, nil, err
+	}
+	enc, hc, err := setupBaseS(rand.Reader, pkR, []byte("odoh query"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("odoh: %w", err)
+	}
+	keyID := c.KeyID()
+	encrypted := append(enc, hc.seal(queryAad(keyID), plaintext)...)
+	msg := marshalMessage(messageTypeQuery, keyID, encrypted)
+	return msg, &QueryContext{plaintext: plaintext, secret: hc.export([]byte("odoh response"), nK)}, nil
+}
+
+// EncryptResponse encrypts dns response r of the query.
+func (qc *QueryContext) EncryptResponse(r []byte) ([]byte, error) {
+	plaintext, err := marshalPlaintext(r, responsePaddingBlock)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, responseNonceLen)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	aead, aeadNonce, err := qc.responseAead(nonce)
+	if err != nil {
+		return nil, err
+	}
+	encrypted := aead.Seal(nil, aeadNonce, plaintext, responseAad(nonce))
+	return marshalMessage(messageTypeResponse, nonce, encrypted), nil
+}
+
+// DecryptResponse decrypts a response message of the query.
+func (qc *QueryContext) DecryptResponse(msg []byte) ([]byte, error) {
+	typ, nonce, encrypted, err := parseMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+	if typ != messageTypeResponse || len(nonce) != responseNonceLen {
+		return nil, errInvalidMsg
+	}
+	aead, aeadNonce, err := qc.responseAead(nonce)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, aeadNonce, encrypted, responseAad(nonce))
+	if err != nil {
+		return nil, errors.New("odoh: failed to decrypt response")
+	}
+	return parsePlaintext(plaintext)
+}
+
+func (qc *QueryContext) responseAead(nonce []byte) (aead cipher.AEAD, aeadNonce []byte, err error) {
+	salt := make([]byte, 0, len(qc.plaintext)+2+len(nonce))
+	salt = append(salt, qc.plaintext...)
+	salt = binary.BigEndian.AppendUint16(salt, uint16(len(nonce)))
+	salt = append(salt, nonce...)
+	prk := hkdf.Extract(sha256.New, qc.secret, salt)
+	aead, err = newAesGcm(expand(prk, []byte("odoh key"), nK))
+	if err != nil {
+		return nil, nil, err
+	}
+	return aead, expand(prk, []byte("odoh nonce"), nN), nil
+}
+
+func queryAad(keyID []byte) []byte {
+	b := append(make([]byte, 0, 3+len(keyID)), messageTypeQuery)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(keyID)))
+	return append(b, keyID...)
+}
+
+func responseAad(nonce []byte) []byte {
+	b := append(make([]byte, 0, 3+len(nonce)), messageTypeResponse)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(nonce)))
+	return append(b, nonce...)
+}
+
+// marshalMessage encodes an ObliviousDoHMessage.
+func marshalMessage(typ byte, keyID, encrypted []byte) []byte {
+	b := append(make([]byte, 0, 5+len(keyID)+len(encrypted)), typ)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(keyID)))
+	b = append(b, keyID...)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(encrypted)))
+	return append(b, encrypted...)
+}
+
+func parseMessage(b []byte) (typ byte, keyID, encrypted []byte, err error) {
+	if len(b) < 1 {
+		return 0, nil, nil, errInvalidMsg
+	}
+	typ = b[0]
+	keyID, b, ok := readVec16(b[1:])
+	if !ok {
+		return 0, nil, nil, errInvalidMsg
+	}
+	encrypted, b, ok = readVec16(b)
+	if !ok || len(b) != 0 || len(encrypted) == 0 {
+		return 0, nil, nil, errInvalidMsg
+	}
+	return typ, keyID, encrypted, nil
+}
+
+// marshalPlaintext encodes an ObliviousDoHMessagePlaintext. The message
+// is padded with zeros to a multiple of block.
+func marshalPlaintext(m []byte, block int) ([]byte, error) {
+	if len(m) == 0 || len(m) > math.MaxUint16 {
+		return nil, fmt.Errorf("odoh: invalid dns message length %d", len(m))
+	}
+	l := 4 + len(m)
+	padLen := 0
+	if r := l % block; r != 0 {
+		padLen = block - r
+	}
+	b := make([]byte, 0, l+padLen)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(m)))
+	b = append(b, m...)
+	b = binary.BigEndian.AppendUint16(b, uint16(padLen))
+	return append(b, make([]byte, padLen)...), nil
+}
+
+func parsePlaintext(b []byte) ([]byte, error) {
+	m, b, ok := readVec16(b)
+	if !ok || len(m) == 0 {
+		return nil, errInvalidMsg
+	}
+	padding, b, ok := readVec16(b)
+	if !ok || len(b) != 0 {
+		return nil, errInvalidMsg
+	}
+	for _, c := range padding {
+		if c != 0 {
+			return nil, errInvalidMsg
+		}
+	}
+	return m, nil
+}
+
+// readVec16 reads a vector with an uint16 length prefix.
+func readVec16(b []byte) (v, rest []byte, ok bool) {
+	if len(b) < 2 {
+		return nil, nil, false
+	}
+	l := int(binary.BigEndian.Uint16(b))
+	b = b[2:]
+	if len(b) < l {
+		return nil, nil, false
+	}
+	return b[:l], b[l:], true
+}
@@ -0,0 +1,186 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package odoh
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// The vector is generated by the go1.26 crypto/hpke sender.
+func TestHPKE_Vector(t *testing.T) {
+	skb := make([]byte, 32)
+	for i := range skb {
+		skb[i] = byte(i)
+	}
+	sk, err := ecdh.X25519().NewPrivateKey(skb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := mustHex(t, "930b443add79485aa19ee518cfa0a3d801ed576b6eec9b3bd778dcb2d2be3d0c")
+	ct := mustHex(t, "8f45e095a792e06e005448c3dc81c945fb668f8f4635")
+	exported := mustHex(t, "da1cbcc3d53608a91af03054c0f9cddf")
+
+	hc, err := setupBaseR(enc, sk, []byte("odoh query"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pt, err := hc.open([]byte("aad"), ct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(pt) != "mosdns" {
+		t.Fatalf("want mosdns, got %q", pt)
+	}
+	if got := hc.export([]byte("odoh response"), nK); !bytes.Equal(got, exported) {
+		t.Fatalf("want exported secret %x, got %x", exported, got)
+	}
+
+	// Round trip with our own sender.
+	enc, hc, err = setupBaseS(rand.Reader, sk.PublicKey(), []byte("info"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct = hc.seal([]byte("aad"), []byte("hello"))
+	hr, err := setupBaseR(enc, sk, []byte("info"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pt, err := hr.open([]byte("aad"), ct); err != nil || string(pt) != "hello" {
+		t.Fatalf("open failed, %v", err)
+	}
+	if _, err := hr.open([]byte("aad"), ct); err == nil {
+		t.Fatal("replayed message should fail because the nonce advanced")
+	}
+}
+
+func newTestKeyPair(t *testing.T) *KeyPair {
+	t.Helper()
+	sk, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := NewKeyPair(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestConfigs(t *testing.T) {
+	k := newTestKeyPair(t)
+	unknown := Config{KemID: 0x10, KdfID: 1, AeadID: 1, PublicKey: []byte{1, 2, 3}}
+	b := MarshalConfigs([]Config{unknown, k.Config()})
+
+	cs, err := ParseConfigs(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cs, []Config{unknown, k.Config()}) {
+		t.Fatalf("unexpected configs %+v", cs)
+	}
+	c, err := PickConfig(cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(c.KeyID(), k.keyID) {
+		t.Fatal("picked the wrong config")
+	}
+
+	// Configs of unknown versions are skipped.
+	body := append([]byte{0xff, 0xff, 0, 2, 0, 0}, b[2:]...)
+	b = append(binary.BigEndian.AppendUint16(nil, uint16(len(body))), body...)
+	if cs, err := ParseConfigs(b); err != nil || len(cs) != 2 {
+		t.Fatalf("unknown version should be skipped, %v %v", cs, err)
+	}
+
+	for _, bad := range [][]byte{nil, {0}, {0, 3, 0, 1, 0}, b[:len(b)-1]} {
+		if _, err := ParseConfigs(bad); err == nil {
+			t.Fatalf("%x should be invalid", bad)
+		}
+	}
+}
+
+func TestExchange(t *testing.T) {
+	k := newTestKeyPair(t)
+	q := []byte("a dns query")
+	r := bytes.Repeat([]byte("a dns response"), 50)
+
+	msg, qc, err := EncryptQuery(k.Config(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotQ, rc, err := k.DecryptQuery(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(gotQ, q) {
+		t.Fatalf("want query %q, got %q", q, gotQ)
+	}
+	if len(rc.plaintext)%queryPaddingBlock != 0 {
+		t.Fatalf("query is not padded, len %d", len(rc.plaintext))
+	}
+	respMsg, err := rc.EncryptResponse(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotR, err := qc.DecryptResponse(respMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(gotR, r) {
+		t.Fatalf("want response %q, got %q", r, gotR)
+	}
+
+	// Tampered messages.
+	bad := bytes.Clone(respMsg)
+	bad[len(bad)-1]++
+	if _, err := qc.DecryptResponse(bad); err == nil {
+		t.Fatal("tampered response should fail")
+	}
+	bad = bytes.Clone(msg)
+	bad[len(bad)-1]++
+	if _, _, err := k.DecryptQuery(bad); err == nil {
+		t.Fatal("tampered query should fail")
+	}
+	if _, err := qc.DecryptResponse(msg); err == nil {
+		t.Fatal("query is not a response")
+	}
+
+	// Another target.
+	if _, _, err := newTestKeyPair(t).DecryptQuery(msg); !errors.Is(err, ErrKeyMismatch) {
+		t.Fatalf("want ErrKeyMismatch, got %v", err)
+	}
+}
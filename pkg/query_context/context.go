@@ -48,6 +48,9 @@ type Context struct {
 	resp        *dns.Msg
 	respOpt     *dns.OPT // nil if clientOpt == nil
 	upstreamOpt *dns.OPT // may be nil
+	respSigner  func(m *dns.Msg) error
+
+	trace *Trace // nil if tracing is disabled. Shared with copies.
 
 	// lazy init.
 	kv    map[uint32]any
@@ -149,6 +152,19 @@ func (ctx *Context) RespOpt() *dns.OPT {
 	return ctx.respOpt
 }
 
+// SetRespSigner sets f to sign the response, e.g. with TSIG.
+// The server calls f with the final response right before packing it,
+// after the EDNS0 OPT is added and the response is truncated.
+// f must keep the signature as the last record of the additional section.
+func (ctx *Context) SetRespSigner(f func(m *dns.Msg) error) {
+	ctx.respSigner = f
+}
+
+// RespSigner returns the function set by SetRespSigner. It might be nil.
+func (ctx *Context) RespSigner() func(m *dns.Msg) error {
+	return ctx.respSigner
+}
+
 // UpstreamOpt returns the OPT from upstream. May be nil.
 // Plugins that responsible for handling EDNS0 option should
 // check UpstreamOpt and pick/add options into RespOpt on demand.
@@ -188,6 +204,8 @@ func (ctx *Context) CopyTo(d *Context) *Context {
 		d.respOpt = dns.Copy(ctx.respOpt).(*dns.OPT)
 	}
 	d.upstreamOpt = ctx.upstreamOpt
+	d.respSigner = ctx.respSigner
+	d.trace = ctx.trace
 
 	d.kv = copyMap(ctx.kv)
 	d.marks = copyMap(ctx.marks)
@@ -0,0 +1,107 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package query_context
+
+import (
+	"sync"
+	"time"
+)
+
+// Trace records the sequence nodes that a query passed through.
+// It is safe for concurrent use, because copies of a Context share the same
+// Trace (e.g. the fallback plugin runs copies concurrently).
+type Trace struct {
+	mu     sync.Mutex
+	events []TraceEvent
+}
+
+// TraceEvent is a record of a sequence node.
+type TraceEvent struct {
+	// Sequence is the tag of the sequence. Node is the index of the
+	// rule in the sequence.
+	Sequence string `json:"sequence"`
+	Node     int    `json:"node"`
+
+	// Matches are results of the matchers of the node. Matchers after
+	// the first unmatched one are not evaluated.
+	Matches []TraceMatch `json:"matches,omitempty"`
+
+	// Exec is the executable that was run. It is empty if the node
+	// was skipped because a matcher did not match.
+	Exec string `json:"exec,omitempty"`
+
+	// Recursive executables (e.g. jump, fallback) run the rest of the
+	// chain. Their Elapsed and response flags include the following nodes.
+	Recursive bool `json:"recursive,omitempty"`
+
+	Start   time.Time     `json:"start"`
+	Elapsed time.Duration `json:"elapsed_ns"`
+
+	// RespSet reports whether the executable set a response when there was none.
+	// RespChanged reports whether it changed or removed an existing response.
+	RespSet     bool   `json:"response_set,omitempty"`
+	RespChanged bool   `json:"response_changed,omitempty"`
+	Rcode       int    `json:"rcode"` // Rcode of the response after the node. -1 if there is no response.
+	Err         string `json:"error,omitempty"`
+}
+
+// TraceMatch is the result of a matcher.
+type TraceMatch struct {
+	Matcher string `json:"matcher"`
+	Result  bool   `json:"result"`
+	Err     string `json:"error,omitempty"`
+}
+
+// Add adds e to the trace and returns its index.
+func (t *Trace) Add(e TraceEvent) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.events = append(t.events, e)
+	return len(t.events) - 1
+}
+
+// Update calls f with the event at index i.
+func (t *Trace) Update(i int, f func(e *TraceEvent)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f(&t.events[i])
+}
+
+// Events returns a copy of the recorded events.
+func (t *Trace) Events() []TraceEvent {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]TraceEvent(nil), t.events...)
+}
+
+// EnableTrace enables tracing for this Context. Sequences record
+// every node the query passes through into Trace().
+// It should be called before the Context is executed.
+func (ctx *Context) EnableTrace() {
+	if ctx.trace == nil {
+		ctx.trace = new(Trace)
+	}
+}
+
+// Trace returns the trace of this Context. It returns nil if
+// tracing is not enabled.
+func (ctx *Context) Trace() *Trace {
+	return ctx.trace
+}
@@ -0,0 +1,434 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package remote_file
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/mlog"
+	"go.uber.org/zap"
+	"golang.org/x/net/proxy"
+)
+
+const (
+	defaultUpdateInterval = time.Hour * 24
+	retryInterval         = time.Minute * 5
+	downloadTimeout       = time.Minute
+	maxFileSize           = 64 << 20
+)
+
+// Args configures a remote file.
+type Args struct {
+	// URL is the http(s) url of the file. Required.
+	URL string `yaml:"url"`
+
+	// CacheFile stores the last good copy of the file, so it can be loaded
+	// when the url is not reachable at startup. Optional.
+	CacheFile string `yaml:"cache_file"`
+
+	// UpdateInterval is the interval in seconds to check for updates.
+	// Default is 86400 (one day).
+	UpdateInterval int `yaml:"update_interval"`
+
+	// SHA256 is the hex encoded sha256 of the file. The file is pinned
+	// to this content.
+	SHA256 string `yaml:"sha256"`
+
+	// SHA256URL is the url of a checksum file, e.g. a "sha256sum" output.
+	// Its first field is the hex encoded sha256 of the file.
+	SHA256URL string `yaml:"sha256_url"`
+
+	// PublicKey is a base64 encoded ed25519 public key. If set, the file
+	// must have a valid detached signature at SignatureURL.
+	PublicKey string `yaml:"public_key"`
+
+	// SignatureURL is the url of the signature. The signature can be raw
+	// or base64 encoded. Default is URL + ".sig".
+	SignatureURL string `yaml:"signature_url"`
+
+	// Socks5 is the address of a socks5 proxy server. Optional.
+	Socks5 string `yaml:"socks5"`
+}
+
+type Opts struct {
+	// Validate checks the content of a new file. If it returns an error,
+	// the file is discarded and the last good file is kept. Optional.
+	Validate func(b []byte) error
+
+	// OnUpdate is called after the file was updated by the update loop.
+	OnUpdate func()
+
+	// Logger is used for logging. Default is a noop logger.
+	Logger *zap.Logger
+}
+
+// Source is a file that is downloaded from a url and updated periodically.
+type Source struct {
+	args   Args
+	opts   Opts
+	client *http.Client
+
+	interval time.Duration
+	sha256   []byte
+	pubKey   ed25519.PublicKey
+
+	data atomic.Pointer[[]byte]
+
+	// Accessed by New and the update loop only.
+	meta       cacheMeta
+	lastUpdate time.Time
+
+	startOnce   sync.Once
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+	done        chan struct{}
+}
+
+// cacheMeta is stored next to the cache file.
+type cacheMeta struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// New creates a Source and loads the file from the cache or the url.
+// The cache is trusted. Only SHA256 is checked when the cache is loaded.
+// Call Start to start the update loop.
+func New(args Args, opts Opts) (*Source, error) {
+	if !strings.HasPrefix(args.URL, "http://") && !strings.HasPrefix(args.URL, "https://") {
+		return nil, fmt.Errorf("invalid url %s", args.URL)
+	}
+	if opts.Logger == nil {
+		opts.Logger = mlog.Nop()
+	}
+	opts.Logger = opts.Logger.With(zap.String("url", args.URL))
+	s := &Source{
+		args:        args,
+		opts:        opts,
+		interval:    time.Duration(args.UpdateInterval) * time.Second,
+		closeNotify: make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	if s.interval <= 0 {
+		s.interval = defaultUpdateInterval
+	}
+	if len(args.SHA256) > 0 {
+		b, err := hex.DecodeString(args.SHA256)
+		if err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("invalid sha256 %s", args.SHA256)
+		}
+		s.sha256 = b
+	}
+	if len(args.PublicKey) > 0 {
+		b, err := base64.StdEncoding.DecodeString(args.PublicKey)
+		if err != nil || len(b) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid ed25519 public key")
+		}
+		s.pubKey = b
+		if len(s.args.SignatureURL) == 0 {
+			s.args.SignatureURL = args.URL + ".sig"
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if len(args.Socks5) > 0 {
+		d, err := proxy.SOCKS5("tcp", args.Socks5, nil, &net.Dialer{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to init socks5 dialer: %w", err)
+		}
+		transport.Proxy = nil
+		transport.DialContext = d.(proxy.ContextDialer).DialContext
+	}
+	s.client = &http.Client{Transport: transport, Timeout: downloadTimeout}
+
+	if err := s.loadCache(); err != nil {
+		opts.Logger.Warn("failed to load cache file", zap.String("file", args.CacheFile), zap.Error(err))
+	}
+	if s.data.Load() == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), downloadTimeout)
+		defer cancel()
+		if _, err := s.update(ctx); err != nil {
+			return nil, fmt.Errorf("failed to download %s, %w", args.URL, err)
+		}
+	}
+	return s, nil
+}
+
+// Data returns the content of the last good file.
+func (s *Source) Data() []byte {
+	return *s.data.Load()
+}
+
+// Start starts the update loop. It is a noop if it was called.
+func (s *Source) Start() {
+	s.startOnce.Do(func() {
+		go s.updateLoop()
+	})
+}
+
+// Close stops the update loop.
+func (s *Source) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closeNotify)
+	})
+	started := true
+	s.startOnce.Do(func() { started = false })
+	if started {
+		<-s.done
+	}
+	return nil
+}
+
+func (s *Source) updateLoop() {
+	defer close(s.done)
+	timer := time.NewTimer(time.Until(s.lastUpdate.Add(s.interval)))
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-s.closeNotify:
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), downloadTimeout)
+		go func() {
+			select {
+			case <-s.closeNotify:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		updated, err := s.update(ctx)
+		cancel()
+		if err != nil {
+			s.opts.Logger.Warn("failed to update file, keep using the last file", zap.Error(err))
+			timer.Reset(min(retryInterval, s.interval))
+			continue
+		}
+		if updated {
+			s.opts.Logger.Info("file updated", zap.Int("size", len(s.Data())))
+			if s.opts.OnUpdate != nil {
+				s.opts.OnUpdate()
+			}
+		}
+		timer.Reset(s.interval)
+	}
+}
+
+func (s *Source) loadCache() error {
+	if len(s.args.CacheFile) == 0 {
+		return nil
+	}
+	fi, err := os.Stat(s.args.CacheFile)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	b, err := os.ReadFile(s.args.CacheFile)
+	if err != nil {
+		return err
+	}
+	if s.sha256 != nil {
+		if err := checkSHA256(b, s.sha256); err != nil {
+			return err
+		}
+	}
+	if s.opts.Validate != nil {
+		if err := s.opts.Validate(b); err != nil {
+			return err
+		}
+	}
+	if mb, err := os.ReadFile(s.args.CacheFile + ".meta"); err == nil {
+		_ = json.Unmarshal(mb, &s.meta)
+	}
+	s.data.Store(&b)
+	s.lastUpdate = fi.ModTime()
+	return nil
+}
+
+// update downloads the file if it was modified. It reports whether the
+// file was updated.
+func (s *Source) update(ctx context.Context) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.args.URL, nil)
+	if err != nil {
+		return false, err
+	}
+	if s.data.Load() != nil {
+		if len(s.meta.ETag) > 0 {
+			req.Header.Set("If-None-Match", s.meta.ETag)
+		}
+		if len(s.meta.LastModified) > 0 {
+			req.Header.Set("If-Modified-Since", s.meta.LastModified)
+		}
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && s.data.Load() != nil {
+		s.lastUpdate = time.Now()
+		if len(s.args.CacheFile) > 0 {
+			_ = os.Chtimes(s.args.CacheFile, s.lastUpdate, s.lastUpdate)
+		}
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("unexpected http status %s", resp.Status)
+	}
+	b, err := readAll(resp.Body)
+	if err != nil {
+		return false, err
+	}
+	if err := s.verify(ctx, b); err != nil {
+		return false, err
+	}
+	if s.opts.Validate != nil {
+		if err := s.opts.Validate(b); err != nil {
+			return false, fmt.Errorf("invalid file, %w", err)
+		}
+	}
+
+	s.data.Store(&b)
+	s.meta = cacheMeta{ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified")}
+	s.lastUpdate = time.Now()
+	if len(s.args.CacheFile) > 0 {
+		if err := s.writeCache(b); err != nil {
+			s.opts.Logger.Warn("failed to write cache file", zap.String("file", s.args.CacheFile), zap.Error(err))
+		}
+	}
+	return true, nil
+}
+
+// verify checks the sha256 and the signature of b.
+func (s *Source) verify(ctx context.Context, b []byte) error {
+	if s.sha256 != nil {
+		if err := checkSHA256(b, s.sha256); err != nil {
+			return err
+		}
+	}
+	if len(s.args.SHA256URL) > 0 {
+		sb, err := s.get(ctx, s.args.SHA256URL)
+		if err != nil {
+			return fmt.Errorf("failed to download sha256, %w", err)
+		}
+		f := strings.Fields(string(sb))
+		if len(f) == 0 {
+			return errors.New("empty sha256 file")
+		}
+		sum, err := hex.DecodeString(f[0])
+		if err != nil {
+			return fmt.Errorf("invalid sha256 file, %w", err)
+		}
+		if err := checkSHA256(b, sum); err != nil {
+			return err
+		}
+	}
+	if s.pubKey != nil {
+		sig, err := s.get(ctx, s.args.SignatureURL)
+		if err != nil {
+			return fmt.Errorf("failed to download signature, %w", err)
+		}
+		if len(sig) != ed25519.SignatureSize {
+			sig, err = base64.StdEncoding.DecodeString(string(bytes.TrimSpace(sig)))
+			if err != nil {
+				return fmt.Errorf("invalid signature, %w", err)
+			}
+		}
+		if !ed25519.Verify(s.pubKey, b, sig) {
+			return errors.New("bad signature")
+		}
+	}
+	return nil
+}
+
+func (s *Source) get(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected http status %s", resp.Status)
+	}
+	return readAll(resp.Body)
+}
+
+// writeCache writes b to the cache file atomically.
+func (s *Source) writeCache(b []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(s.args.CacheFile), filepath.Base(s.args.CacheFile)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), s.args.CacheFile); err != nil {
+		return err
+	}
+	mb, _ := json.Marshal(s.meta)
+	return os.WriteFile(s.args.CacheFile+".meta", mb, 0644)
+}
+
+func readAll(r io.Reader) ([]byte, error) {
+	b, err := io.ReadAll(io.LimitReader(r, maxFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxFileSize {
+		return nil, errors.New("file is too large")
+	}
+	return b, nil
+}
+
+func checkSHA256(b []byte, want []byte) error {
+	sum := sha256.Sum256(b)
+	if !bytes.Equal(sum[:], want) {
+		return fmt.Errorf("sha256 mismatched, want %x, got %x", want, sum)
+	}
+	return nil
+}
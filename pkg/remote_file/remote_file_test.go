@@ -0,0 +1,176 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package remote_file
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testServer struct {
+	mu       sync.Mutex
+	data     string
+	etag     string
+	sig      []byte
+	requests int
+	notMod   int
+}
+
+func (s *testServer) set(data, etag string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data, s.etag = data, etag
+}
+
+func (s *testServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch r.URL.Path {
+	case "/list.txt":
+		s.requests++
+		if r.Header.Get("If-None-Match") == s.etag {
+			s.notMod++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", s.etag)
+		_, _ = w.Write([]byte(s.data))
+	case "/list.txt.sha256sum":
+		sum := sha256.Sum256([]byte(s.data))
+		_, _ = w.Write([]byte(hex.EncodeToString(sum[:]) + "  list.txt\n"))
+	case "/list.txt.sig":
+		_, _ = w.Write([]byte(base64.StdEncoding.EncodeToString(s.sig)))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestSource(t *testing.T) {
+	ts := &testServer{data: "v1", etag: `"1"`}
+	hs := httptest.NewServer(ts)
+	defer hs.Close()
+	cacheFile := filepath.Join(t.TempDir(), "list.txt")
+
+	updated := make(chan struct{}, 1)
+	opts := Opts{
+		Validate: func(b []byte) error {
+			if string(b) == "invalid" {
+				return errors.New("invalid")
+			}
+			return nil
+		},
+		OnUpdate: func() { updated <- struct{}{} },
+	}
+	args := Args{URL: hs.URL + "/list.txt", CacheFile: cacheFile, UpdateInterval: 1, SHA256URL: hs.URL + "/list.txt.sha256sum"}
+	s, err := New(args, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if string(s.Data()) != "v1" {
+		t.Fatalf("want v1, got %s", s.Data())
+	}
+	s.Start()
+
+	// Not modified.
+	time.Sleep(time.Millisecond * 1500)
+	ts.mu.Lock()
+	if ts.notMod == 0 {
+		t.Fatal("If-None-Match was not used")
+	}
+	ts.mu.Unlock()
+
+	// Updated.
+	ts.set("v2", `"2"`)
+	select {
+	case <-updated:
+	case <-time.After(time.Second * 3):
+		t.Fatal("file was not updated")
+	}
+	if string(s.Data()) != "v2" {
+		t.Fatalf("want v2, got %s", s.Data())
+	}
+
+	// Invalid file is discarded.
+	ts.set("invalid", `"3"`)
+	time.Sleep(time.Millisecond * 1500)
+	if string(s.Data()) != "v2" {
+		t.Fatalf("want v2, got %s", s.Data())
+	}
+	_ = s.Close()
+
+	// Offline startup from the cache.
+	hs.Close()
+	s2, err := New(args, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	if string(s2.Data()) != "v2" {
+		t.Fatalf("want v2 from cache, got %s", s2.Data())
+	}
+}
+
+func TestSource_Verify(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := &testServer{data: "data", etag: `"1"`, sig: ed25519.Sign(priv, []byte("data"))}
+	hs := httptest.NewServer(ts)
+	defer hs.Close()
+	url := hs.URL + "/list.txt"
+	sum := sha256.Sum256([]byte("data"))
+	pubKey := base64.StdEncoding.EncodeToString(pub)
+
+	tests := []struct {
+		name    string
+		args    Args
+		wantErr bool
+	}{
+		{"sha256", Args{URL: url, SHA256: hex.EncodeToString(sum[:])}, false},
+		{"bad sha256", Args{URL: url, SHA256: hex.EncodeToString(make([]byte, 32))}, true},
+		{"sha256 url", Args{URL: url, SHA256URL: url + ".sha256sum"}, false},
+		{"signature", Args{URL: url, PublicKey: pubKey}, false},
+		{"no signature", Args{URL: url, PublicKey: pubKey, SignatureURL: url + ".missing"}, true},
+		{"bad public key", Args{URL: url, PublicKey: base64.StdEncoding.EncodeToString(make([]byte, 32))}, true},
+		{"bad url", Args{URL: "ftp://example.com/list.txt"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := New(tt.args, Opts{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("want err %v, got %v", tt.wantErr, err)
+			}
+			if s != nil {
+				_ = s.Close()
+			}
+		})
+	}
+}
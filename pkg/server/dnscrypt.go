@@ -0,0 +1,251 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnscrypt"
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+type DNSCryptServerOpts struct {
+	// Nil logger == nop
+	Logger *zap.Logger
+
+	// ProviderName is the provider name, e.g. "2.dnscrypt-cert.example.com".
+	// Plain TXT queries of it are answered with certs in Certs.
+	// Other plain queries are dropped. Required.
+	ProviderName string
+
+	// Certs are the resolver certs. Required.
+	Certs *dnscrypt.CertStore
+
+	// IdleTimeout is the idle timeout of tcp connections.
+	// Default is defaultTCPIdleTimeout.
+	IdleTimeout time.Duration
+}
+
+// certTTL is the ttl of cert TXT records.
+const certTTL = 600
+
+type dnscryptHandler struct {
+	h      Handler
+	opts   DNSCryptServerOpts
+	logger *zap.Logger
+}
+
+func newDNSCryptHandler(h Handler, opts DNSCryptServerOpts) *dnscryptHandler {
+	logger := opts.Logger
+	if logger == nil {
+		logger = nopLogger
+	}
+	opts.ProviderName = dns.Fqdn(opts.ProviderName)
+	return &dnscryptHandler{h: h, opts: opts, logger: logger}
+}
+
+// handle returns the response of packet b. It returns nil if b should be
+// dropped. If maxLen > 0, responses longer than maxLen are replaced by
+// truncated responses.
+func (d *dnscryptHandler) handle(ctx context.Context, b []byte, meta QueryMeta, maxLen int) []byte {
+	if len(b) < dnscrypt.ClientMagicSize {
+		return nil
+	}
+	c := d.opts.Certs.Lookup([dnscrypt.ClientMagicSize]byte(b))
+	if c == nil {
+		return d.handleCertQuery(b)
+	}
+
+	h, enc, err := dnscrypt.ParseQuery(b)
+	if err != nil {
+		return nil
+	}
+	key, err := dnscrypt.SharedKey(c.EsVersion, &c.Sk, &h.ClientPk)
+	if err != nil {
+		return nil
+	}
+	qb, err := dnscrypt.DecryptQuery(c.EsVersion, key, h, enc)
+	if err != nil {
+		d.logger.Debug("failed to decrypt query", zap.Stringer("client", meta.ClientAddr), zap.Error(err))
+		return nil
+	}
+	q := new(dns.Msg)
+	if err := q.Unpack(qb); err != nil {
+		d.logger.Warn("invalid msg", zap.Error(err), zap.Binary("msg", qb), zap.Stringer("from", meta.ClientAddr))
+		return nil
+	}
+
+	payload := d.h.Handle(ctx, q, meta, pool.PackBuffer)
+	if payload == nil {
+		return nil
+	}
+	defer pool.ReleaseBuf(payload)
+	r := *payload
+	if maxLen > 0 && dnscrypt.ResponseOverhead+dnscrypt.PaddedLen(len(r), 0) > maxLen {
+		tr := new(dns.Msg)
+		tr.SetReply(q)
+		tr.Truncated = true
+		if r, err = tr.Pack(); err != nil {
+			return nil
+		}
+	}
+	out, err := dnscrypt.EncryptResponse(c.EsVersion, key, &h.ClientNonce, r, dnscrypt.PaddedLen(len(r), 0))
+	if err != nil {
+		d.logger.Error("failed to encrypt response", zap.Error(err))
+		return nil
+	}
+	return out
+}
+
+// handleCertQuery answers plain cert queries.
+func (d *dnscryptHandler) handleCertQuery(b []byte) []byte {
+	q := new(dns.Msg)
+	if err := q.Unpack(b); err != nil || len(q.Question) != 1 {
+		return nil
+	}
+	question := q.Question[0]
+	if question.Qtype != dns.TypeTXT || question.Qclass != dns.ClassINET || !strings.EqualFold(question.Name, d.opts.ProviderName) {
+		return nil
+	}
+	r := new(dns.Msg)
+	r.SetReply(q)
+	for _, c := range d.opts.Certs.Certs() {
+		r.Answer = append(r.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: certTTL},
+			Txt: txtStrings(c.Raw),
+		})
+	}
+	out, err := r.Pack()
+	if err != nil {
+		return nil
+	}
+	return out
+}
+
+// txtStrings splits b into escaped txt strings. See dns.TXT.
+func txtStrings(b []byte) []string {
+	var ss []string
+	for len(b) > 0 {
+		n := min(len(b), 255)
+		var sb strings.Builder
+		for _, c := range b[:n] {
+			fmt.Fprintf(&sb, "\\%03d", c)
+		}
+		ss = append(ss, sb.String())
+		b = b[n:]
+	}
+	return ss
+}
+
+// ServeDNSCryptUDP starts a DNSCrypt server at c. It returns if c had
+// a read error. It always returns a non-nil error.
+func ServeDNSCryptUDP(c net.PacketConn, h Handler, opts DNSCryptServerOpts) error {
+	d := newDNSCryptHandler(h, opts)
+	listenerCtx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(errListenerCtxCanceled)
+
+	rb := pool.GetBuf(dns.MaxMsgSize)
+	defer pool.ReleaseBuf(rb)
+	for {
+		n, remoteAddr, err := c.ReadFrom(*rb)
+		if err != nil {
+			if n == 0 {
+				return fmt.Errorf("unexpected read err: %w", err)
+			}
+			d.logger.Warn("read err", zap.Error(err))
+			continue
+		}
+		b := append([]byte(nil), (*rb)[:n]...)
+
+		go func() {
+			var clientAddr netip.Addr
+			if ua, ok := remoteAddr.(*net.UDPAddr); ok {
+				clientAddr = ua.AddrPort().Addr()
+			}
+			// Responses must not be longer than queries to avoid amplification.
+			r := d.handle(listenerCtx, b, QueryMeta{ClientAddr: clientAddr, FromUDP: true}, len(b))
+			if r == nil {
+				return
+			}
+			if _, err := c.WriteTo(r, remoteAddr); err != nil {
+				d.logger.Warn("failed to write response", zap.Stringer("client", remoteAddr), zap.Error(err))
+			}
+		}()
+	}
+}
+
+// ServeDNSCryptTCP starts a DNSCrypt server at l. It returns if l had
+// an Accept() error. It always returns a non-nil error.
+func ServeDNSCryptTCP(l net.Listener, h Handler, opts DNSCryptServerOpts) error {
+	d := newDNSCryptHandler(h, opts)
+	idleTimeout := opts.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = defaultTCPIdleTimeout
+	}
+
+	listenerCtx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(errListenerCtxCanceled)
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return fmt.Errorf("unexpected listener err: %w", err)
+		}
+
+		connCtx, cancelConn := context.WithCancelCause(listenerCtx)
+		go func() {
+			defer c.Close()
+			defer cancelConn(errConnectionCtxCanceled)
+
+			var clientAddr netip.Addr
+			if ta, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+				clientAddr = ta.AddrPort().Addr()
+			}
+			for {
+				c.SetReadDeadline(time.Now().Add(idleTimeout))
+				b, err := dnsutils.ReadRawMsgFromTCP(c)
+				if err != nil {
+					return
+				}
+				go func() {
+					defer pool.ReleaseBuf(b)
+					r := d.handle(connCtx, *b, QueryMeta{ClientAddr: clientAddr}, 0)
+					if r == nil {
+						c.Close()
+						return
+					}
+					wb := make([]byte, 2+len(r))
+					binary.BigEndian.PutUint16(wb, uint16(len(r)))
+					copy(wb[2:], r)
+					if _, err := c.Write(wb); err != nil {
+						d.logger.Warn("failed to write response", zap.Stringer("client", c.RemoteAddr()), zap.Error(err))
+					}
+				}()
+			}
+		}()
+	}
+}
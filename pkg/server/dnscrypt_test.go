@@ -0,0 +1,113 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package server
+
+import (
+	"context"
+	"crypto/ed25519"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnscrypt"
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	dnscryptupstream "github.com/IrineSistiana/mosdns/v5/pkg/upstream/dnscrypt"
+	"github.com/miekg/dns"
+)
+
+// testHandler answers queries with an A record and a TXT record of size
+// txtLen.
+type testHandler struct {
+	txtLen int
+}
+
+func (h *testHandler) Handle(_ context.Context, q *dns.Msg, _ QueryMeta, pack func(m *dns.Msg) (*[]byte, error)) *[]byte {
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Answer = append(r.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IPv4(127, 0, 0, 1),
+	})
+	if h.txtLen > 0 {
+		r.Extra = append(r.Extra, &dns.TXT{
+			Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+			Txt: []string{string(make([]byte, h.txtLen))},
+		})
+	}
+	b, _ := pack(r)
+	return b
+}
+
+func TestDNSCryptServer(t *testing.T) {
+	providerPk, providerSk, _ := ed25519.GenerateKey(nil)
+	now := time.Now()
+	c, err := dnscrypt.NewResolverCert(providerSk, dnscrypt.XChacha20Poly1305, 1, now, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs := new(dnscrypt.CertStore)
+	certs.Set([]*dnscrypt.ResolverCert{c})
+	const provider = "2.dnscrypt-cert.example.com"
+
+	uc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+	addr := uc.LocalAddr().String()
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	h := &testHandler{txtLen: 200} // Larger than a padded udp query.
+	opts := DNSCryptServerOpts{ProviderName: provider, Certs: certs}
+	go ServeDNSCryptUDP(uc, h, opts)
+	go ServeDNSCryptTCP(l, h, opts)
+
+	stamp := &dnscrypt.Stamp{ServerAddr: addr, ServerPk: providerPk, ProviderName: provider}
+	d := new(net.Dialer)
+	u, err := dnscryptupstream.NewUpstream(stamp, dnscryptupstream.Opts{
+		DialContext: func(ctx context.Context, network string) (net.Conn, error) {
+			return d.DialContext(ctx, network, addr)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	qb, _ := q.Pack()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	// The udp response is truncated, the upstream retries over tcp.
+	rb, err := u.ExchangeContext(ctx, qb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.ReleaseBuf(rb)
+	r := new(dns.Msg)
+	if err := r.Unpack(*rb); err != nil {
+		t.Fatal(err)
+	}
+	if r.Id != q.Id || r.Truncated || len(r.Answer) != 1 || len(r.Extra) != 1 {
+		t.Fatalf("unexpected response %s", r)
+	}
+}
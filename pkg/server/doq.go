@@ -74,6 +74,8 @@ func ServeDoQ(l *quic.Listener, h Handler, opts DoQServerOpts) error {
 			if ok {
 				clientAddr = ta.AddrPort().Addr()
 			}
+			tlsState := c.ConnectionState().TLS
+			clientID := clientIdentity(&tlsState)
 
 			firstRead := true
 			for {
@@ -105,8 +107,9 @@ func ServeDoQ(l *quic.Listener, h Handler, opts DoQServerOpts) error {
 						return
 					}
 					queryMeta := QueryMeta{
-						ClientAddr: clientAddr,
-						ServerName: c.ConnectionState().TLS.ServerName,
+						ClientAddr:     clientAddr,
+						ServerName:     tlsState.ServerName,
+						ClientIdentity: clientID,
 					}
 
 					resp := h.Handle(connCtx, req, queryMeta, pool.PackTCPBuffer)
@@ -28,6 +28,7 @@ import (
 	"net/netip"
 	"strings"
 
+	"github.com/IrineSistiana/mosdns/v5/pkg/odoh"
 	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
 	"github.com/miekg/dns"
 	"go.uber.org/zap"
@@ -41,12 +42,23 @@ type HttpHandlerOpts struct {
 	// Logger specifies the logger which Handler writes its log to.
 	// Default is a nop logger.
 	Logger *zap.Logger
+
+	// ODoHKey enables the oblivious DoH (RFC 9230) target. Queries with
+	// the oblivious media type are decrypted with it. Its config is
+	// published at odoh.WellKnownConfigsPath.
+	ODoHKey *odoh.KeyPair
+
+	// ODoHProxy enables the oblivious proxy. Requests with "targethost" and
+	// "targetpath" parameters are forwarded to the target.
+	ODoHProxy *ODoHProxy
 }
 
 type HttpHandler struct {
 	dnsHandler  Handler
 	logger      *zap.Logger
 	srcIPHeader string
+	odohKey     *odoh.KeyPair // nil if target is disabled
+	odohProxy   *ODoHProxy    // nil if proxy is disabled
 }
 
 var _ http.Handler = (*HttpHandler)(nil)
@@ -56,6 +68,8 @@ func NewHttpHandler(h Handler, opts HttpHandlerOpts) *HttpHandler {
 	hh.dnsHandler = h
 	hh.srcIPHeader = opts.GetSrcIPFromHeader
 	hh.logger = opts.Logger
+	hh.odohKey = opts.ODoHKey
+	hh.odohProxy = opts.ODoHProxy
 	if hh.logger == nil {
 		hh.logger = nopLogger
 	}
@@ -67,6 +81,15 @@ func (h *HttpHandler) warnErr(req *http.Request, msg string, err error) {
 }
 
 func (h *HttpHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if h.odohKey != nil && req.URL.Path == odoh.WellKnownConfigsPath {
+		h.serveODoHConfigs(w, req)
+		return
+	}
+	if h.odohProxy != nil && isODoHProxyReq(req) {
+		h.serveODoHProxy(w, req)
+		return
+	}
+
 	addrPort, err := netip.ParseAddrPort(req.RemoteAddr)
 	if err != nil {
 		h.logger.Error("failed to parse request remote addr", zap.String("addr", req.RemoteAddr), zap.Error(err))
@@ -88,14 +111,6 @@ func (h *HttpHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
-	// read msg
-	q, err := ReadMsgFromReq(req)
-	if err != nil {
-		h.warnErr(req, "invalid request", err)
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
 	queryMeta := QueryMeta{
 		ClientAddr: clientAddr,
 	}
@@ -104,7 +119,22 @@ func (h *HttpHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 	if tlsStat := req.TLS; tlsStat != nil {
 		queryMeta.ServerName = tlsStat.ServerName
+		queryMeta.ClientIdentity = clientIdentity(tlsStat)
+	}
+
+	if h.odohKey != nil && req.Header.Get("Content-Type") == odoh.ContentType {
+		h.serveODoHTarget(w, req, queryMeta)
+		return
 	}
+
+	// read msg
+	q, err := ReadMsgFromReq(req)
+	if err != nil {
+		h.warnErr(req, "invalid request", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
 	resp := h.dnsHandler.Handle(req.Context(), q, queryMeta, pool.PackBuffer)
 	if resp == nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -26,4 +26,13 @@ type QueryMeta struct {
 	ClientAddr netip.Addr
 	ServerName string
 	UrlPath    string
+
+	// ClientIdentity is the identity of the verified tls client certificate.
+	// Empty if the client did not present a certificate. See NewTLSConfig.
+	ClientIdentity string
+
+	// RawQuery is the wire format of the query. It is only set by udp and tcp
+	// servers when the query is signed with TSIG, because verifying TSIG needs
+	// the original bytes.
+	RawQuery []byte
 }
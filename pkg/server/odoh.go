@@ -0,0 +1,199 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/odoh"
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/miekg/dns"
+)
+
+// Encrypted messages are padded and have some overhead.
+const maxODoHMsgSize = 2 * dns.MaxMsgSize
+
+// ODoHProxy is the config of an oblivious proxy (RFC 9230).
+type ODoHProxy struct {
+	// Transport is used to forward queries to targets.
+	// Default is http.DefaultTransport.
+	Transport http.RoundTripper
+
+	// AllowedTargets are the target hosts ("host[:port]") that queries
+	// can be forwarded to. Queries to other targets are rejected. Empty
+	// rejects all queries, otherwise the proxy would be an open relay.
+	AllowedTargets []string
+}
+
+func (p *ODoHProxy) targetAllowed(host string) bool {
+	for _, s := range p.AllowedTargets {
+		if strings.EqualFold(s, host) {
+			return true
+		}
+	}
+	return false
+}
+
+func isODoHProxyReq(req *http.Request) bool {
+	return req.URL != nil && req.URL.Query().Has("targethost")
+}
+
+func readODoHMsg(req *http.Request) ([]byte, error) {
+	if req.Method != http.MethodPost {
+		return nil, fmt.Errorf("unsupported method: %s", req.Method)
+	}
+	if req.Header.Get("Content-Type") != odoh.ContentType {
+		return nil, errInvalidMediaType
+	}
+	b, err := io.ReadAll(io.LimitReader(req.Body, maxODoHMsgSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read request body: %w", err)
+	}
+	return b, nil
+}
+
+func writeODoHMsg(w http.ResponseWriter, b []byte) error {
+	w.Header().Set("Content-Type", odoh.ContentType)
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	_, err := w.Write(b)
+	return err
+}
+
+func (h *HttpHandler) serveODoHConfigs(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if _, err := w.Write(odoh.MarshalConfigs([]odoh.Config{h.odohKey.Config()})); err != nil {
+		h.warnErr(req, "failed to write response", err)
+	}
+}
+
+// serveODoHTarget decrypts the query, handles it and encrypts the response.
+func (h *HttpHandler) serveODoHTarget(w http.ResponseWriter, req *http.Request, queryMeta QueryMeta) {
+	b, err := readODoHMsg(req)
+	if err != nil {
+		h.warnErr(req, "invalid request", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	wire, qc, err := h.odohKey.DecryptQuery(b)
+	if err != nil {
+		h.warnErr(req, "failed to decrypt odoh query", err)
+		if errors.Is(err, odoh.ErrKeyMismatch) {
+			// Tell the client to refresh the config.
+			w.WriteHeader(http.StatusUnauthorized)
+		} else {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		return
+	}
+	q := new(dns.Msg)
+	if err := q.Unpack(wire); err != nil {
+		h.warnErr(req, "invalid request", fmt.Errorf("failed to unpack msg [%x], %w", wire, err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	resp := h.dnsHandler.Handle(req.Context(), q, queryMeta, pool.PackBuffer)
+	if resp == nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer pool.ReleaseBuf(resp)
+	m, err := qc.EncryptResponse(*resp)
+	if err != nil {
+		h.warnErr(req, "failed to encrypt odoh response", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err := writeODoHMsg(w, m); err != nil {
+		h.warnErr(req, "failed to write response", err)
+	}
+}
+
+// serveODoHProxy forwards the query to the target in the request parameters.
+// Nothing that identifies the client is forwarded.
+func (h *HttpHandler) serveODoHProxy(w http.ResponseWriter, req *http.Request) {
+	params := req.URL.Query()
+	targetHost := params.Get("targethost")
+	targetPath := params.Get("targetpath")
+	if len(targetHost) == 0 || !strings.HasPrefix(targetPath, "/") {
+		h.warnErr(req, "invalid request", errors.New("invalid targethost or targetpath"))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !h.odohProxy.targetAllowed(targetHost) {
+		h.warnErr(req, "invalid request", fmt.Errorf("target %s is not allowed", targetHost))
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	b, err := readODoHMsg(req)
+	if err != nil {
+		h.warnErr(req, "invalid request", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	target := url.URL{Scheme: "https", Host: targetHost, Path: targetPath}
+	fReq, err := http.NewRequestWithContext(req.Context(), http.MethodPost, target.String(), bytes.NewReader(b))
+	if err != nil {
+		h.warnErr(req, "invalid request", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	fReq.Header["Content-Type"] = []string{odoh.ContentType}
+	fReq.Header["Accept"] = []string{odoh.ContentType}
+	fReq.Header["User-Agent"] = nil
+
+	rt := h.odohProxy.Transport
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	fResp, err := rt.RoundTrip(fReq)
+	if err != nil {
+		h.warnErr(req, "failed to forward odoh query", err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer fResp.Body.Close()
+	rb, err := io.ReadAll(io.LimitReader(fResp.Body, maxODoHMsgSize))
+	if err != nil {
+		h.warnErr(req, "failed to read odoh response", err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	if fResp.StatusCode != http.StatusOK {
+		// Pass the status through, e.g. 401 tells the client to refresh
+		// the target config.
+		w.WriteHeader(fResp.StatusCode)
+		return
+	}
+	if err := writeODoHMsg(w, rb); err != nil {
+		h.warnErr(req, "failed to write response", err)
+	}
+}
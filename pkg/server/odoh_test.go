@@ -0,0 +1,134 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/odoh"
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/IrineSistiana/mosdns/v5/pkg/upstream/doh"
+	"github.com/miekg/dns"
+)
+
+func newODoHKey(t *testing.T) *odoh.KeyPair {
+	t.Helper()
+	sk, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := odoh.NewKeyPair(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestODoH(t *testing.T) {
+	var targetHandler atomic.Pointer[HttpHandler]
+	targetHandler.Store(NewHttpHandler(&testHandler{}, HttpHandlerOpts{ODoHKey: newODoHKey(t)}))
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		targetHandler.Load().ServeHTTP(w, r)
+	}))
+	defer target.Close()
+	targetHost := strings.TrimPrefix(target.URL, "https://")
+
+	// The proxy only forwards queries. It has no dns handler.
+	var forwarded atomic.Int32
+	proxyHandler := NewHttpHandler(nil, HttpHandlerOpts{ODoHProxy: &ODoHProxy{
+		Transport:      target.Client().Transport,
+		AllowedTargets: []string{targetHost},
+	}})
+	proxy := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded.Add(1)
+		proxyHandler.ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+
+	u, err := doh.NewObliviousUpstream(doh.ObliviousOpts{
+		Target:          target.URL + "/dns-query",
+		Proxy:           proxy.URL + "/proxy",
+		TargetTransport: target.Client().Transport,
+		ProxyTransport:  proxy.Client().Transport,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exchange := func() {
+		t.Helper()
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		q.Id = 1234
+		b, err := q.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rb, err := u.ExchangeContext(context.Background(), b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pool.ReleaseBuf(rb)
+		r := new(dns.Msg)
+		if err := r.Unpack(*rb); err != nil {
+			t.Fatal(err)
+		}
+		if r.Id != q.Id || len(r.Answer) != 1 || r.Answer[0].Header().Name != "example.com." {
+			t.Fatalf("unexpected response %s", r)
+		}
+	}
+
+	exchange()
+	if forwarded.Load() != 1 {
+		t.Fatalf("want 1 query through the proxy, got %d", forwarded.Load())
+	}
+
+	// The target rotates its key. The client gets 401 and refetches the config.
+	targetHandler.Store(NewHttpHandler(&testHandler{}, HttpHandlerOpts{ODoHKey: newODoHKey(t)}))
+	exchange()
+	if forwarded.Load() != 3 {
+		t.Fatalf("want 3 queries through the proxy, got %d", forwarded.Load())
+	}
+
+	// Targets that are not allowed.
+	proxyStatus := func(h *HttpHandler, targetHost string) int {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/proxy?targethost="+targetHost+"&targetpath=/dns-query", strings.NewReader("x"))
+		req.Header.Set("Content-Type", odoh.ContentType)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+	if c := proxyStatus(proxyHandler, "example.com"); c != http.StatusForbidden {
+		t.Fatalf("want status 403, got %d", c)
+	}
+	// A proxy without allowed targets is not an open relay.
+	openProxy := NewHttpHandler(nil, HttpHandlerOpts{ODoHProxy: &ODoHProxy{Transport: target.Client().Transport}})
+	if c := proxyStatus(openProxy, targetHost); c != http.StatusForbidden {
+		t.Fatalf("want status 403, got %d", c)
+	}
+}
@@ -27,7 +27,6 @@ import (
 	"net/netip"
 	"time"
 
-	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
 	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
 	"go.uber.org/zap"
 )
@@ -83,15 +82,17 @@ func ServeTCP(l net.Listener, h Handler, opts TCPServerOpts) error {
 				} else {
 					c.SetReadDeadline(time.Now().Add(idleTimeout))
 				}
-				req, _, err := dnsutils.ReadMsgFromTCP(c)
+				req, raw, err := readMsgFromTCP(c)
 				if err != nil {
 					return // read err, close the connection
 				}
 
-				// Try to get server name from tls conn.
-				var serverName string
+				// Try to get server name and client identity from tls conn.
+				var serverName, clientID string
 				if tlsConn, ok := c.(*tls.Conn); ok {
-					serverName = tlsConn.ConnectionState().ServerName
+					cs := tlsConn.ConnectionState()
+					serverName = cs.ServerName
+					clientID = clientIdentity(&cs)
 				}
 
 				// handle query
@@ -101,7 +102,7 @@ func ServeTCP(l net.Listener, h Handler, opts TCPServerOpts) error {
 					if ok {
 						clientAddr = ta.AddrPort().Addr()
 					}
-					r := h.Handle(tcpConnCtx, req, QueryMeta{ClientAddr: clientAddr, ServerName: serverName}, pool.PackTCPBuffer)
+					r := h.Handle(tcpConnCtx, req, QueryMeta{ClientAddr: clientAddr, ServerName: serverName, ClientIdentity: clientID, RawQuery: raw}, pool.PackTCPBuffer)
 					if r == nil {
 						c.Close() // abort the connection
 						return
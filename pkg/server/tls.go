@@ -21,6 +21,10 @@ package server
 
 import (
 	"crypto/tls"
+	"errors"
+	"fmt"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
 )
 
 func LoadCert(tlsCfg *tls.Config, cert, key string) error {
@@ -31,3 +35,74 @@ func LoadCert(tlsCfg *tls.Config, cert, key string) error {
 	tlsCfg.Certificates = []tls.Certificate{c}
 	return nil
 }
+
+// CertFile is a pair of PEM cert and key files.
+type CertFile struct {
+	Cert string
+	Key  string
+}
+
+type TLSOpts struct {
+	// Certs are the server certificates. A certificate is chosen by the
+	// SNI of the client. The first one is the default. Required.
+	Certs []CertFile
+
+	// ClientCAFile is a PEM bundle of CAs. If set, clients must present a
+	// certificate signed by them (mutual TLS). See QueryMeta.ClientIdentity.
+	ClientCAFile string
+
+	// ClientCertOptional also accepts clients without certificates.
+	// Certificates that are presented are still verified.
+	ClientCertOptional bool
+}
+
+// NewTLSConfig builds a server tls.Config from opts.
+func NewTLSConfig(opts TLSOpts) (*tls.Config, error) {
+	if len(opts.Certs) == 0 {
+		return nil, errors.New("no certificate")
+	}
+	c := new(tls.Config)
+	for _, f := range opts.Certs {
+		cert, err := tls.LoadX509KeyPair(f.Cert, f.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load cert %s, %w", f.Cert, err)
+		}
+		// If there are multiple certificates, crypto/tls picks the first one
+		// that supports the client hello (SNI, signature algorithms, etc.).
+		c.Certificates = append(c.Certificates, cert)
+	}
+	if len(opts.ClientCAFile) > 0 {
+		pool, err := utils.LoadCertPool([]string{opts.ClientCAFile})
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client ca, %w", err)
+		}
+		c.ClientCAs = pool
+		if opts.ClientCertOptional {
+			c.ClientAuth = tls.VerifyClientCertIfGiven
+		} else {
+			c.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return c, nil
+}
+
+// clientIdentity returns the identity of the verified client certificate in
+// cs. It is the subject common name, or the first DNS, URI or email SAN if
+// the common name is empty.
+func clientIdentity(cs *tls.ConnectionState) string {
+	if len(cs.VerifiedChains) == 0 || len(cs.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	cert := cs.VerifiedChains[0][0]
+	switch {
+	case len(cert.Subject.CommonName) > 0:
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	}
+	return ""
+}
@@ -0,0 +1,165 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// issueTestCert writes a cert signed by parent (or a self-signed CA if
+// parent is nil) to dir and returns it.
+func issueTestCert(t *testing.T, dir, cn string, parent *tls.Certificate) (tls.Certificate, CertFile) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	signer, signerKey := tmpl, any(key)
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		tmpl.DNSNames = []string{cn}
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := CertFile{Cert: filepath.Join(dir, cn+".crt"), Key: filepath.Join(dir, cn+".key")}
+	if err := os.WriteFile(f.Cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(f.Key, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, f
+}
+
+// metaHandler sends the QueryMeta of queries to c.
+type metaHandler struct {
+	testHandler
+	c chan QueryMeta
+}
+
+func (h *metaHandler) Handle(ctx context.Context, q *dns.Msg, meta QueryMeta, pack func(m *dns.Msg) (*[]byte, error)) *[]byte {
+	h.c <- meta
+	return h.testHandler.Handle(ctx, q, meta, pack)
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca, caFile := issueTestCert(t, dir, "test ca", nil)
+	_, aFile := issueTestCert(t, dir, "a.test", &ca)
+	_, bFile := issueTestCert(t, dir, "b.test", &ca)
+	client, _ := issueTestCert(t, dir, "client1", &ca)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+
+	if _, err := NewTLSConfig(TLSOpts{}); err == nil {
+		t.Fatal("no certificate should fail")
+	}
+
+	tests := []struct {
+		name       string
+		optional   bool
+		sni        string
+		clientCert bool
+		wantErr    bool
+		wantID     string
+	}{
+		{"default cert", false, "a.test", true, false, "client1"},
+		{"sni cert", false, "b.test", true, false, "client1"},
+		{"no client cert", false, "a.test", false, true, ""},
+		{"optional with cert", true, "b.test", true, false, "client1"},
+		{"optional without cert", true, "b.test", false, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc, err := NewTLSConfig(TLSOpts{
+				Certs:              []CertFile{aFile, bFile},
+				ClientCAFile:       caFile.Cert,
+				ClientCertOptional: tt.optional,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			l, err := tls.Listen("tcp", "127.0.0.1:0", tc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			h := &metaHandler{c: make(chan QueryMeta, 1)}
+			go ServeTCP(l, h, TCPServerOpts{})
+
+			// The server cert is verified against sni, so a wrong
+			// cert fails the handshake.
+			clientConfig := &tls.Config{RootCAs: roots, ServerName: tt.sni}
+			if tt.clientCert {
+				clientConfig.Certificates = []tls.Certificate{client}
+			}
+			c := &dns.Client{Net: "tcp-tls", TLSConfig: clientConfig, Timeout: time.Second}
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			_, _, err = c.Exchange(q, l.Addr().String())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("want err %v, got %v", tt.wantErr, err)
+			}
+			if tt.wantErr {
+				return
+			}
+			meta := <-h.c
+			if meta.ServerName != tt.sni || meta.ClientIdentity != tt.wantID {
+				t.Fatalf("unexpected meta %+v", meta)
+			}
+		})
+	}
+}
@@ -76,6 +76,7 @@ func ServeUDP(c *net.UDPConn, h Handler, opts UDPServerOpts) error {
 			logger.Warn("invalid msg", zap.Error(err), zap.Binary("msg", (*rb)[:n]), zap.Stringer("from", remoteAddr))
 			continue
 		}
+		raw := tsigRawQuery(q, (*rb)[:n])
 
 		var dstIpFromCm net.IP
 		if oobReader != nil {
@@ -88,7 +89,7 @@ func ServeUDP(c *net.UDPConn, h Handler, opts UDPServerOpts) error {
 
 		// handle query
 		go func() {
-			payload := h.Handle(listenerCtx, q, QueryMeta{ClientAddr: remoteAddr.Addr(), FromUDP: true}, pool.PackBuffer)
+			payload := h.Handle(listenerCtx, q, QueryMeta{ClientAddr: remoteAddr.Addr(), FromUDP: true, RawQuery: raw}, pool.PackBuffer)
 			if payload == nil {
 				return
 			}
@@ -2,7 +2,11 @@ package server
 
 import (
 	"errors"
+	"io"
 
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/miekg/dns"
 	"go.uber.org/zap"
 )
 
@@ -14,3 +18,26 @@ var (
 var (
 	nopLogger = zap.NewNop()
 )
+
+// tsigRawQuery returns a copy of b if m is signed with TSIG. Otherwise, it returns nil.
+func tsigRawQuery(m *dns.Msg, b []byte) []byte {
+	if m.IsTsig() == nil {
+		return nil
+	}
+	return append([]byte(nil), b...)
+}
+
+// readMsgFromTCP reads a msg from c. raw is set if the msg is signed with TSIG.
+// See QueryMeta.RawQuery.
+func readMsgFromTCP(c io.Reader) (m *dns.Msg, raw []byte, err error) {
+	b, err := dnsutils.ReadRawMsgFromTCP(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer pool.ReleaseBuf(b)
+	m = new(dns.Msg)
+	if err := m.Unpack(*b); err != nil {
+		return nil, nil, err
+	}
+	return m, tsigRawQuery(m, *b), nil
+}
@@ -85,9 +85,27 @@ func NewEntryHandler(opts EntryHandlerOpts) *EntryHandler {
 // If entry returns without a response, a REFUSED response will be returned.
 func (h *EntryHandler) Handle(ctx context.Context, q *dns.Msg, serverMeta server.QueryMeta, packMsgPayload func(m *dns.Msg) (*[]byte, error)) *[]byte {
 	// basic query check.
-	if q.Response || len(q.Question) != 1 || len(q.Answer)+len(q.Ns) > 0 || len(q.Extra) > 1 {
+	if q.Response || len(q.Question) != 1 {
 		return nil
 	}
+	switch q.Opcode {
+	case dns.OpcodeUpdate:
+		// RFC 2136 UPDATE. The prerequisite and update sections are carried in
+		// the answer and authority sections. The additional section may have
+		// an OPT and a TSIG.
+		if len(q.Extra) > 2 {
+			return nil
+		}
+	case dns.OpcodeNotify:
+		// RFC 1996 NOTIFY. The answer section may have the new SOA.
+		if len(q.Answer) > 1 || len(q.Ns) > 0 || len(q.Extra) > 2 {
+			return nil
+		}
+	default:
+		if len(q.Answer)+len(q.Ns) > 0 || len(q.Extra) > 1 {
+			return nil
+		}
+	}
 
 	ddl := time.Now().Add(h.opts.QueryTimeout)
 	ctx, cancel := context.WithDeadline(ctx, ddl)
@@ -126,6 +144,13 @@ func (h *EntryHandler) Handle(ctx context.Context, q *dns.Msg, serverMeta server
 		resp.Truncate(udpSize)
 	}
 
+	if sign := qCtx.RespSigner(); sign != nil {
+		if err := sign(resp); err != nil {
+			h.opts.Logger.Error("failed to sign resp msg", qCtx.InfoField(), zap.Error(err))
+			return nil
+		}
+	}
+
 	payload, err := packMsgPayload(resp)
 	if err != nil {
 		h.opts.Logger.Error("internal err: failed to pack resp msg", qCtx.InfoField(), zap.Error(err))
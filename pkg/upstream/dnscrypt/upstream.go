@@ -0,0 +1,351 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+// Package dnscrypt implements a DNSCrypt version 2 upstream.
+package dnscrypt
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnscrypt"
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	defaultTimeout = time.Second * 5
+
+	// certRefreshInterval is the interval of fetching certs, so the
+	// upstream can switch to a new cert before the old one expires.
+	certRefreshInterval = time.Hour
+
+	// certRetryInterval is the interval of retrying a failed fetch
+	// while the current cert is still valid.
+	certRetryInterval = time.Minute
+)
+
+type Opts struct {
+	// DialContext dials the server. network is "udp" or "tcp". Required.
+	DialContext func(ctx context.Context, network string) (net.Conn, error)
+
+	Logger *zap.Logger
+}
+
+// Upstream is a DNSCrypt upstream. Queries are sent over udp. Truncated
+// responses are retried over tcp. The client key pair is generated
+// when the upstream is created.
+type Upstream struct {
+	stamp  *dnscrypt.Stamp
+	opts   Opts
+	logger *zap.Logger
+
+	pk, sk [dnscrypt.PublicKeySize]byte
+
+	certM     sync.Mutex
+	cert      *serverCert
+	nextFetch time.Time
+	fetchSF   singleflight.Group
+}
+
+type serverCert struct {
+	*dnscrypt.Cert
+	key *[32]byte // shared key
+}
+
+func NewUpstream(stamp *dnscrypt.Stamp, opts Opts) (*Upstream, error) {
+	if opts.DialContext == nil {
+		return nil, errors.New("nil dial func")
+	}
+	u := &Upstream{stamp: stamp, opts: opts, logger: opts.Logger}
+	if u.logger == nil {
+		u.logger = zap.NewNop()
+	}
+	var err error
+	u.pk, u.sk, err = dnscrypt.GenerateKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key, %w", err)
+	}
+	return u, nil
+}
+
+func (u *Upstream) ExchangeContext(ctx context.Context, q []byte) (*[]byte, error) {
+	c, err := u.getCert(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cert, %w", err)
+	}
+	r, err := u.exchangeEncrypted(ctx, c, q, "udp")
+	if err != nil {
+		return nil, err
+	}
+	if len(r) >= 12 && r[2]&(1<<1) != 0 { // truncated
+		r, err = u.exchangeEncrypted(ctx, c, q, "tcp")
+		if err != nil {
+			return nil, err
+		}
+	}
+	b := pool.GetBuf(len(r))
+	copy(*b, r)
+	return b, nil
+}
+
+func (u *Upstream) Close() error {
+	return nil
+}
+
+func (u *Upstream) exchangeEncrypted(ctx context.Context, c *serverCert, q []byte, network string) ([]byte, error) {
+	h := &dnscrypt.QueryHeader{ClientMagic: c.ClientMagic, ClientPk: u.pk}
+	if _, err := rand.Read(h.ClientNonce[:]); err != nil {
+		return nil, err
+	}
+	minLen := 0
+	if network == "udp" {
+		minLen = dnscrypt.MinUDPQueryLen
+	}
+	b := dnscrypt.EncryptQuery(c.EsVersion, c.key, h, q, dnscrypt.PaddedLen(len(q), minLen))
+
+	var r []byte
+	err := u.exchange(ctx, network, b, func(resp []byte) bool {
+		var err error
+		r, err = dnscrypt.DecryptResponse(c.EsVersion, c.key, &h.ClientNonce, resp)
+		return err == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// exchange sends b to the server and reads responses until accept returns
+// true. Over tcp, only one response is read.
+func (u *Upstream) exchange(ctx context.Context, network string, b []byte, accept func(resp []byte) bool) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultTimeout)
+		defer cancel()
+	}
+	conn, err := u.opts.DialContext(ctx, network)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	if network == "tcp" {
+		wb := make([]byte, 2+len(b))
+		binary.BigEndian.PutUint16(wb, uint16(len(b)))
+		copy(wb[2:], b)
+		if _, err := conn.Write(wb); err != nil {
+			return err
+		}
+		var l [2]byte
+		if _, err := io.ReadFull(conn, l[:]); err != nil {
+			return err
+		}
+		resp := make([]byte, binary.BigEndian.Uint16(l[:]))
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			return err
+		}
+		if !accept(resp) {
+			return errors.New("invalid response")
+		}
+		return nil
+	}
+
+	if _, err := conn.Write(b); err != nil {
+		return err
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return err
+		}
+		// Ignore invalid packets. They may be spoofed.
+		if accept(buf[:n]) {
+			return nil
+		}
+	}
+}
+
+// getCert returns the current cert. If it's time to refresh, certs are
+// fetched in the background and the current cert is returned. Only
+// queries that have no valid cert wait for the fetch.
+func (u *Upstream) getCert(ctx context.Context) (*serverCert, error) {
+	u.certM.Lock()
+	c, nextFetch := u.cert, u.nextFetch
+	u.certM.Unlock()
+	now := time.Now()
+	valid := c != nil && c.ValidAt(now)
+	if valid && now.Before(nextFetch) {
+		return c, nil
+	}
+
+	resChan := u.fetchSF.DoChan("", u.refreshCert) // DoChan won't block this goroutine
+	if valid {
+		return c, nil
+	}
+	select {
+	case res := <-resChan:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.(*serverCert), nil
+	case <-ctx.Done():
+		return nil, context.Cause(ctx)
+	}
+}
+
+// refreshCert fetches certs and updates the current cert. It has its own
+// timeout, so a cancelled query won't fail the fetch for others.
+func (u *Upstream) refreshCert() (any, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+	c, err := u.fetchCert(ctx)
+
+	u.certM.Lock()
+	defer u.certM.Unlock()
+	now := time.Now()
+	if err != nil {
+		if u.cert != nil && u.cert.ValidAt(now) {
+			u.logger.Warn("failed to refresh cert, use the current one", zap.String("provider", u.stamp.ProviderName), zap.Error(err))
+			u.nextFetch = now.Add(certRetryInterval)
+			return u.cert, nil
+		}
+		return nil, err
+	}
+	if u.cert == nil || u.cert.Serial != c.Serial || u.cert.EsVersion != c.EsVersion {
+		u.logger.Info(
+			"cert updated",
+			zap.String("provider", u.stamp.ProviderName),
+			zap.Uint32("serial", c.Serial),
+			zap.Stringer("es_version", c.EsVersion),
+			zap.Time("not_after", time.Unix(int64(c.NotAfter), 0)),
+		)
+	}
+	u.cert = c
+	u.nextFetch = now.Add(certRefreshInterval)
+	return c, nil
+}
+
+// fetchCert queries the certs of the provider and returns the best one.
+func (u *Upstream) fetchCert(ctx context.Context) (*serverCert, error) {
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(u.stamp.ProviderName), dns.TypeTXT)
+	q.Id = dns.Id()
+	qb, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	var r *dns.Msg
+	accept := func(b []byte) bool {
+		m := new(dns.Msg)
+		if m.Unpack(b) != nil || m.Id != q.Id {
+			return false
+		}
+		r = m
+		return true
+	}
+	if err := u.exchange(ctx, "udp", qb, accept); err != nil {
+		return nil, err
+	}
+	if r.Truncated {
+		if err := u.exchange(ctx, "tcp", qb, accept); err != nil {
+			return nil, err
+		}
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("cert query failed with rcode %s", dns.RcodeToString[r.Rcode])
+	}
+
+	now := time.Now()
+	var best *dnscrypt.Cert
+	var lastErr error
+	for _, rr := range r.Answer {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			continue
+		}
+		b, err := txtData(txt)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		c, err := dnscrypt.ParseCert(b, ed25519.PublicKey(u.stamp.ServerPk))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if !c.EsVersion.Supported() || !c.ValidAt(now) {
+			continue
+		}
+		if best == nil || c.Serial > best.Serial || (c.Serial == best.Serial && c.EsVersion > best.EsVersion) {
+			best = c
+		}
+	}
+	if best == nil {
+		if lastErr != nil {
+			return nil, fmt.Errorf("no valid cert, %w", lastErr)
+		}
+		return nil, errors.New("no valid cert")
+	}
+	key, err := dnscrypt.SharedKey(best.EsVersion, &u.sk, &best.ResolverPk)
+	if err != nil {
+		return nil, err
+	}
+	return &serverCert{Cert: best, key: key}, nil
+}
+
+// txtData returns the raw bytes of the txt strings. dns.TXT.Txt
+// has escaped strings.
+func txtData(txt *dns.TXT) ([]byte, error) {
+	buf := make([]byte, dns.Len(txt))
+	end, err := dns.PackRR(txt, buf, 0, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	nameLen, err := dns.PackDomainName(txt.Hdr.Name, make([]byte, 256), 0, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	rdata := buf[nameLen+10 : end]
+	var b []byte
+	for len(rdata) > 0 {
+		l := int(rdata[0])
+		if 1+l > len(rdata) {
+			return nil, errors.New("invalid txt record")
+		}
+		b = append(b, rdata[1:1+l]...)
+		rdata = rdata[1+l:]
+	}
+	return b, nil
+}
@@ -0,0 +1,262 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package dnscrypt
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnscrypt"
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/miekg/dns"
+)
+
+const testProvider = "2.dnscrypt-cert.example.com."
+
+// testServer is a minimal DNSCrypt server. It answers A queries with
+// 127.0.0.1. Responses of "big." are truncated over udp.
+type testServer struct {
+	es   dnscrypt.EsVersion
+	cert *dnscrypt.Cert
+	sk   [32]byte
+
+	certDelay atomic.Int64 // delay of cert responses
+}
+
+func newTestServer(t *testing.T, es dnscrypt.EsVersion) (*testServer, ed25519.PublicKey) {
+	providerPk, providerSk, _ := ed25519.GenerateKey(nil)
+	pk, sk, err := dnscrypt.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	c := &dnscrypt.Cert{
+		EsVersion:   es,
+		ResolverPk:  pk,
+		ClientMagic: [8]byte{1, 2, 3, 4, 5, 6, 7, 8},
+		Serial:      1,
+		NotBefore:   uint32(now.Add(-time.Hour).Unix()),
+		NotAfter:    uint32(now.Add(time.Hour).Unix()),
+	}
+	c.Sign(providerSk)
+	return &testServer{es: es, cert: c, sk: sk}, providerPk
+}
+
+func (s *testServer) handle(b []byte, udp bool) []byte {
+	q := new(dns.Msg)
+	if q.Unpack(b) == nil && len(q.Question) == 1 && q.Question[0].Qtype == dns.TypeTXT {
+		time.Sleep(time.Duration(s.certDelay.Load()))
+		r := new(dns.Msg)
+		r.SetReply(q)
+		cb := s.cert.Marshal()
+		txt := &dns.TXT{Hdr: dns.RR_Header{Name: testProvider, Rrtype: dns.TypeTXT, Class: dns.ClassINET}}
+		for len(cb) > 0 {
+			n := min(len(cb), 255)
+			txt.Txt = append(txt.Txt, escapeTxt(cb[:n]))
+			cb = cb[n:]
+		}
+		r.Answer = append(r.Answer, txt)
+		out, _ := r.Pack()
+		return out
+	}
+
+	h, enc, err := dnscrypt.ParseQuery(b)
+	if err != nil || h.ClientMagic != s.cert.ClientMagic {
+		return nil
+	}
+	key, err := dnscrypt.SharedKey(s.es, &s.sk, &h.ClientPk)
+	if err != nil {
+		return nil
+	}
+	qb, err := dnscrypt.DecryptQuery(s.es, key, h, enc)
+	if err != nil || q.Unpack(qb) != nil {
+		return nil
+	}
+	r := new(dns.Msg)
+	r.SetReply(q)
+	if udp && q.Question[0].Name == "big." {
+		r.Truncated = true
+	} else {
+		r.Answer = append(r.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(127, 0, 0, 1),
+		})
+	}
+	rb, _ := r.Pack()
+	out, _ := dnscrypt.EncryptResponse(s.es, key, &h.ClientNonce, rb, dnscrypt.PaddedLen(len(rb), 0))
+	return out
+}
+
+func escapeTxt(b []byte) string {
+	var s []byte
+	for _, c := range b {
+		s = append(s, '\\', '0'+c/100, '0'+c/10%10, '0'+c%10)
+	}
+	return string(s)
+}
+
+func (s *testServer) serve(t *testing.T) string {
+	uc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := uc.LocalAddr().String()
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		uc.Close()
+		l.Close()
+	})
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := uc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			b := append([]byte(nil), buf[:n]...)
+			go func() {
+				if r := s.handle(b, true); r != nil {
+					uc.WriteTo(r, from)
+				}
+			}()
+		}
+	}()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				var lb [2]byte
+				if _, err := io.ReadFull(c, lb[:]); err != nil {
+					return
+				}
+				b := make([]byte, binary.BigEndian.Uint16(lb[:]))
+				if _, err := io.ReadFull(c, b); err != nil {
+					return
+				}
+				r := s.handle(b, false)
+				out := binary.BigEndian.AppendUint16(nil, uint16(len(r)))
+				c.Write(append(out, r...))
+			}()
+		}
+	}()
+	return addr
+}
+
+func TestUpstream(t *testing.T) {
+	for _, es := range []dnscrypt.EsVersion{dnscrypt.XSalsa20Poly1305, dnscrypt.XChacha20Poly1305} {
+		t.Run(es.String(), func(t *testing.T) {
+			s, providerPk := newTestServer(t, es)
+			addr := s.serve(t)
+			stamp := &dnscrypt.Stamp{ServerAddr: addr, ServerPk: providerPk, ProviderName: testProvider}
+			d := new(net.Dialer)
+			u, err := NewUpstream(stamp, Opts{DialContext: func(ctx context.Context, network string) (net.Conn, error) {
+				return d.DialContext(ctx, network, addr)
+			}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer u.Close()
+
+			for _, name := range []string{"example.com.", "big."} {
+				q := new(dns.Msg)
+				q.SetQuestion(name, dns.TypeA)
+				qb, _ := q.Pack()
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+				rb, err := u.ExchangeContext(ctx, qb)
+				cancel()
+				if err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+				r := new(dns.Msg)
+				if err := r.Unpack(*rb); err != nil {
+					t.Fatal(err)
+				}
+				pool.ReleaseBuf(rb)
+				if r.Id != q.Id || r.Truncated || len(r.Answer) != 1 {
+					t.Fatalf("%s: unexpected response %s", name, r)
+				}
+			}
+			if c := u.cert; c == nil || c.Serial != 1 || c.EsVersion != es {
+				t.Fatalf("unexpected cert %+v", c)
+			}
+		})
+	}
+}
+
+func TestUpstream_CertRefresh(t *testing.T) {
+	s, providerPk := newTestServer(t, dnscrypt.XChacha20Poly1305)
+	addr := s.serve(t)
+	stamp := &dnscrypt.Stamp{ServerAddr: addr, ServerPk: providerPk, ProviderName: testProvider}
+	d := new(net.Dialer)
+	u, err := NewUpstream(stamp, Opts{DialContext: func(ctx context.Context, network string) (net.Conn, error) {
+		return d.DialContext(ctx, network, addr)
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+
+	exchange := func(timeout time.Duration) error {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		qb, _ := q.Pack()
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		rb, err := u.ExchangeContext(ctx, qb)
+		if err == nil {
+			pool.ReleaseBuf(rb)
+		}
+		return err
+	}
+	if err := exchange(time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// It's time to refresh but the server is slow. Queries use the current
+	// cert and don't wait for the fetch.
+	s.certDelay.Store(int64(time.Millisecond * 500))
+	u.certM.Lock()
+	u.nextFetch = time.Now()
+	u.certM.Unlock()
+	for i := 0; i < 3; i++ {
+		if err := exchange(time.Millisecond * 200); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(time.Second)
+	u.certM.Lock()
+	refreshed := time.Now().Before(u.nextFetch)
+	u.certM.Unlock()
+	if !refreshed {
+		t.Fatal("cert is not refreshed in the background")
+	}
+}
@@ -0,0 +1,272 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package doh
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	urlpkg "net/url"
+	"sync"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v5/pkg/odoh"
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const (
+	odohConfigTTL        = time.Hour
+	odohConfigRetryDelay = time.Minute
+	maxODoHConfigsLen    = 64 * 1024
+)
+
+var errODoHUnauthorized = errors.New("target rejected the key id")
+
+type ObliviousOpts struct {
+	// Target is the url of the ODoH target, e.g. "https://odoh.example.com/dns-query".
+	Target string
+
+	// Proxy is the url of the oblivious proxy, e.g. "https://proxy.example.com/proxy".
+	// If empty, queries are sent to the target directly. This hides queries
+	// from the network path but not the client address from the target.
+	Proxy string
+
+	// TargetTransport is used to fetch the configs of the target.
+	TargetTransport http.RoundTripper
+
+	// ProxyTransport is used to send queries to the proxy. If Proxy is empty,
+	// TargetTransport is used.
+	ProxyTransport http.RoundTripper
+
+	Logger *zap.Logger
+}
+
+// ObliviousUpstream is an oblivious DNS-over-HTTPS (RFC 9230) upstream.
+// Queries are encrypted to the key of the target and sent through the proxy.
+// The key is fetched from the target's well-known configs url.
+type ObliviousUpstream struct {
+	targetRT  http.RoundTripper
+	proxyRT   http.RoundTripper
+	logger    *zap.Logger // non-nil
+	configURL string
+	queryURL  string
+
+	cm           sync.Mutex
+	config       *odoh.Config // nil if not fetched or invalidated
+	configExpire time.Time
+}
+
+func NewObliviousUpstream(opts ObliviousOpts) (*ObliviousUpstream, error) {
+	target, err := urlpkg.Parse(opts.Target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target url, %w", err)
+	}
+	if target.Scheme != "https" || len(target.Host) == 0 {
+		return nil, fmt.Errorf("invalid target url %s", opts.Target)
+	}
+	if len(target.Path) == 0 {
+		target.Path = "/dns-query"
+	}
+	configURL := urlpkg.URL{Scheme: target.Scheme, Host: target.Host, Path: odoh.WellKnownConfigsPath}
+
+	queryURL := target.String()
+	proxyRT := opts.TargetTransport
+	if len(opts.Proxy) > 0 {
+		proxy, err := urlpkg.Parse(opts.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy url, %w", err)
+		}
+		if proxy.Scheme != "https" || len(proxy.Host) == 0 {
+			return nil, fmt.Errorf("invalid proxy url %s", opts.Proxy)
+		}
+		q := proxy.Query()
+		q.Set("targethost", target.Host)
+		q.Set("targetpath", target.Path)
+		proxy.RawQuery = q.Encode()
+		queryURL = proxy.String()
+		proxyRT = opts.ProxyTransport
+	}
+
+	logger := opts.Logger
+	if logger == nil {
+		logger = nopLogger
+	}
+	return &ObliviousUpstream{
+		targetRT:  opts.TargetTransport,
+		proxyRT:   proxyRT,
+		logger:    logger,
+		configURL: configURL.String(),
+		queryURL:  queryURL,
+	}, nil
+}
+
+func (u *ObliviousUpstream) ExchangeContext(ctx context.Context, q []byte) (*[]byte, error) {
+	type res struct {
+		r   *[]byte
+		err error
+	}
+
+	resChan := make(chan res, 1)
+	go func() {
+		// Same as Upstream, use a fixed timeout to keep connections reusable.
+		ctx, cancel := context.WithTimeout(context.Background(), defaultDoHTimeout)
+		defer cancel()
+		r, err := u.exchange(ctx, q)
+		if errors.Is(err, errODoHUnauthorized) {
+			// The target may have rotated its key. Refetch and retry once.
+			u.invalidateConfig()
+			r, err = u.exchange(ctx, q)
+		}
+		if err != nil {
+			u.logger.Check(zap.WarnLevel, "exchange failed").Write(zap.Error(err))
+		}
+		resChan <- res{r: r, err: err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil, context.Cause(ctx)
+	case res := <-resChan:
+		r := res.r
+		if r != nil {
+			binary.BigEndian.PutUint16(*r, binary.BigEndian.Uint16(q))
+		}
+		return r, res.err
+	}
+}
+
+func (u *ObliviousUpstream) exchange(ctx context.Context, q []byte) (*[]byte, error) {
+	c, err := u.getConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get target config, %w", err)
+	}
+
+	wire := bytes.Clone(q)
+	wire[0] = 0
+	wire[1] = 0
+	msg, qc, err := odoh.EncryptQuery(*c, wire)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.queryURL, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req.Header["Content-Type"] = []string{odoh.ContentType}
+	req.Header["Accept"] = []string{odoh.ContentType}
+	req.Header["User-Agent"] = nil
+	resp, err := u.proxyRT.RoundTrip(req)
+	if err != nil {
+		return nil, fmt.Errorf("http request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return nil, errODoHUnauthorized
+	}
+	if resp.StatusCode != http.StatusOK {
+		body1k, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("bad http status codes %d with body [%s]", resp.StatusCode, body1k)
+	}
+
+	bb := bufPool4k.Get()
+	defer bufPool4k.Release(bb)
+	// Encrypted responses are padded and have some overhead.
+	_, err = bb.ReadFrom(io.LimitReader(resp.Body, 2*dns.MaxMsgSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read http body: %w", err)
+	}
+	r, err := qc.DecryptResponse(bb.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if len(r) < dnsutils.DnsHeaderLen {
+		return nil, dnsutils.ErrPayloadTooSmall
+	}
+	payload := pool.GetBuf(len(r))
+	copy(*payload, r)
+	return payload, nil
+}
+
+func (u *ObliviousUpstream) invalidateConfig() {
+	u.cm.Lock()
+	u.config = nil
+	u.cm.Unlock()
+}
+
+// getConfig returns the cached target config or fetches a new one.
+// If the fetch fails, a stale config is used for a while.
+func (u *ObliviousUpstream) getConfig(ctx context.Context) (*odoh.Config, error) {
+	u.cm.Lock()
+	defer u.cm.Unlock()
+	now := time.Now()
+	if u.config != nil && now.Before(u.configExpire) {
+		return u.config, nil
+	}
+	c, err := u.fetchConfig(ctx)
+	if err != nil {
+		if u.config != nil {
+			u.logger.Warn("failed to refresh odoh config, using the stale one", zap.Error(err))
+			u.configExpire = now.Add(odohConfigRetryDelay)
+			return u.config, nil
+		}
+		return nil, err
+	}
+	u.config = c
+	u.configExpire = now.Add(odohConfigTTL)
+	return c, nil
+}
+
+func (u *ObliviousUpstream) fetchConfig(ctx context.Context) (*odoh.Config, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.configURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header["User-Agent"] = nil
+	resp, err := u.targetRT.RoundTrip(req)
+	if err != nil {
+		return nil, fmt.Errorf("http request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad http status codes %d", resp.StatusCode)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxODoHConfigsLen))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read http body: %w", err)
+	}
+	cs, err := odoh.ParseConfigs(b)
+	if err != nil {
+		return nil, err
+	}
+	c, err := odoh.PickConfig(cs)
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
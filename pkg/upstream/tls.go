@@ -0,0 +1,122 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+)
+
+// TLSOpts are the tls options of DoT, DoH, DoH3 and DoQ upstreams.
+type TLSOpts struct {
+	InsecureSkipVerify bool
+
+	// CAFile is a PEM bundle of CAs to verify servers with.
+	// Default is the system roots.
+	CAFile string
+
+	// ClientCert and ClientKey are the PEM files of the client
+	// certificate for mutual TLS.
+	ClientCert string
+	ClientKey  string
+
+	// ServerName overrides the server name used for SNI and
+	// certificate verification. It won't change the HTTP Host header.
+	ServerName string
+
+	// SPKIPins are base64 encoded SHA-256 digests of server public keys
+	// (SubjectPublicKeyInfo). If set, a key in the verified chain must be
+	// pinned. If InsecureSkipVerify is also set, the chain is not verified
+	// and only the leaf key is checked.
+	SPKIPins []string
+}
+
+// NewTLSConfig builds a tls.Config from opts.
+func NewTLSConfig(opts TLSOpts) (*tls.Config, error) {
+	c := &tls.Config{
+		InsecureSkipVerify: opts.InsecureSkipVerify,
+		ServerName:         opts.ServerName,
+	}
+	if len(opts.CAFile) > 0 {
+		pool, err := utils.LoadCertPool([]string{opts.CAFile})
+		if err != nil {
+			return nil, fmt.Errorf("failed to load ca file, %w", err)
+		}
+		c.RootCAs = pool
+	}
+	if len(opts.ClientCert)+len(opts.ClientKey) > 0 {
+		cert, err := tls.LoadX509KeyPair(opts.ClientCert, opts.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client cert, %w", err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	if len(opts.SPKIPins) > 0 {
+		pins := make(map[[sha256.Size]byte]struct{}, len(opts.SPKIPins))
+		for _, s := range opts.SPKIPins {
+			b, err := base64.StdEncoding.DecodeString(s)
+			if err != nil || len(b) != sha256.Size {
+				return nil, fmt.Errorf("invalid spki pin %s", s)
+			}
+			pins[[sha256.Size]byte(b)] = struct{}{}
+		}
+		c.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifySPKIPins(cs, pins)
+		}
+	}
+	return c, nil
+}
+
+var errSPKIPinMismatch = errors.New("no server public key matches the spki pins")
+
+func verifySPKIPins(cs tls.ConnectionState, pins map[[sha256.Size]byte]struct{}) error {
+	pinned := func(cert *x509.Certificate) bool {
+		_, ok := pins[sha256.Sum256(cert.RawSubjectPublicKeyInfo)]
+		return ok
+	}
+	if len(cs.VerifiedChains) == 0 {
+		// Chains are not verified. Only the leaf is trustworthy because
+		// the server has proved that it owns the leaf key.
+		if len(cs.PeerCertificates) > 0 && pinned(cs.PeerCertificates[0]) {
+			return nil
+		}
+		return errSPKIPinMismatch
+	}
+	for _, chain := range cs.VerifiedChains {
+		for _, cert := range chain {
+			if pinned(cert) {
+				return nil
+			}
+		}
+	}
+	return errSPKIPinMismatch
+}
+
+// SPKIPin returns the pin of cert for TLSOpts.SPKIPins.
+func SPKIPin(cert *x509.Certificate) string {
+	h := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(h[:])
+}
@@ -0,0 +1,285 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/odoh"
+	"github.com/IrineSistiana/mosdns/v5/pkg/server"
+	"github.com/miekg/dns"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCert issues a cert signed by parent. If parent is nil, it
+// issues a self-signed CA.
+func newTestCert(t *testing.T, parent *testCert, cn string, extKeyUsage x509.ExtKeyUsage) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		tmpl.DNSNames = []string{cn}
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{extKeyUsage}
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+func (c *testCert) tlsCert() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key, Leaf: c.cert}
+}
+
+// writeFiles writes the cert and key in PEM format to dir.
+func (c *testCert) writeFiles(t *testing.T, dir, name string) (certFile, keyFile string) {
+	t.Helper()
+	keyDer, err := x509.MarshalPKCS8PrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func Test_TLSOpts(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, nil, "test ca", 0)
+	serverCert := newTestCert(t, ca, "dns.internal", x509.ExtKeyUsageServerAuth)
+	clientCert := newTestCert(t, ca, "client", x509.ExtKeyUsageClientAuth)
+	caFile, _ := ca.writeFiles(t, dir, "ca")
+	clientCertFile, clientKeyFile := clientCert.writeFiles(t, dir, "client")
+
+	// A DoT server that requires client certs signed by ca.
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert.tlsCert()},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dotServer := dns.Server{Net: "tcp-tls", Listener: l, Handler: &vServer{}, MaxTCPQueries: -1}
+	go dotServer.ActivateAndServe()
+	defer dotServer.Shutdown()
+	addr := "tls://" + l.Addr().String()
+
+	full := TLSOpts{
+		CAFile:     caFile,
+		ClientCert: clientCertFile,
+		ClientKey:  clientKeyFile,
+		ServerName: "dns.internal",
+	}
+	tests := []struct {
+		name    string
+		opts    func(o *TLSOpts)
+		wantErr bool
+	}{
+		{"mtls", func(o *TLSOpts) {}, false},
+		{"no client cert", func(o *TLSOpts) { o.ClientCert, o.ClientKey = "", "" }, true},
+		{"no ca", func(o *TLSOpts) { o.CAFile = "" }, true},
+		{"no server name", func(o *TLSOpts) { o.ServerName = "" }, true},
+		{"wrong server name", func(o *TLSOpts) { o.ServerName = "other.internal" }, true},
+		{"ca pin", func(o *TLSOpts) { o.SPKIPins = []string{SPKIPin(ca.cert)} }, false},
+		{"leaf pin", func(o *TLSOpts) { o.SPKIPins = []string{SPKIPin(serverCert.cert)} }, false},
+		{"wrong pin", func(o *TLSOpts) { o.SPKIPins = []string{SPKIPin(clientCert.cert)} }, true},
+		{"insecure leaf pin", func(o *TLSOpts) {
+			o.CAFile, o.InsecureSkipVerify = "", true
+			o.SPKIPins = []string{SPKIPin(serverCert.cert)}
+		}, false},
+		{"insecure ca pin", func(o *TLSOpts) {
+			// The chain is not verified, so the ca pin is not trusted.
+			o.CAFile, o.InsecureSkipVerify = "", true
+			o.SPKIPins = []string{SPKIPin(ca.cert)}
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := full
+			tt.opts(&o)
+			tlsConfig, err := NewTLSConfig(o)
+			if err != nil {
+				t.Fatal(err)
+			}
+			u, err := NewUpstream(addr, Opt{TLSConfig: tlsConfig})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer u.Close()
+
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			b, _ := q.Pack()
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			_, err = u.ExchangeContext(ctx, b)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("want err %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+
+	if _, err := NewTLSConfig(TLSOpts{SPKIPins: []string{"invalid"}}); err == nil {
+		t.Fatal("invalid pin should fail")
+	}
+	if _, err := NewTLSConfig(TLSOpts{ClientCert: clientCertFile}); err == nil {
+		t.Fatal("missing client key should fail")
+	}
+}
+
+type emptyRespHandler struct{}
+
+func (emptyRespHandler) Handle(_ context.Context, q *dns.Msg, _ server.QueryMeta, pack func(m *dns.Msg) (*[]byte, error)) *[]byte {
+	r := new(dns.Msg)
+	r.SetReply(q)
+	b, _ := pack(r)
+	return b
+}
+
+// The tls options of an odoh upstream apply to the target only.
+func Test_ODoHProxyTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, nil, "test ca", 0)
+	targetCert := newTestCert(t, ca, "odoh.internal", x509.ExtKeyUsageServerAuth)
+	clientCert := newTestCert(t, ca, "client", x509.ExtKeyUsageClientAuth)
+	caFile, _ := ca.writeFiles(t, dir, "ca")
+	clientCertFile, clientKeyFile := clientCert.writeFiles(t, dir, "client")
+	caPool := x509.NewCertPool()
+	caPool.AddCert(ca.cert)
+
+	sk, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := odoh.NewKeyPair(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := httptest.NewUnstartedServer(server.NewHttpHandler(emptyRespHandler{}, server.HttpHandlerOpts{ODoHKey: key}))
+	target.TLS = &tls.Config{
+		Certificates: []tls.Certificate{targetCert.tlsCert()},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    caPool,
+	}
+	target.StartTLS()
+	defer target.Close()
+	targetHost := target.Listener.Addr().String()
+
+	proxyHandler := server.NewHttpHandler(nil, server.HttpHandlerOpts{ODoHProxy: &server.ODoHProxy{
+		// The target requires client certs from the proxy as well.
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      caPool,
+			ServerName:   "odoh.internal",
+			Certificates: []tls.Certificate{clientCert.tlsCert()},
+		}},
+		AllowedTargets: []string{targetHost},
+	}})
+	var proxyGotClientCert atomic.Bool
+	proxy := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxyGotClientCert.Store(len(r.TLS.PeerCertificates) > 0)
+		proxyHandler.ServeHTTP(w, r)
+	}))
+	proxy.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	proxy.StartTLS()
+	defer proxy.Close()
+	proxyCAs := x509.NewCertPool()
+	proxyCAs.AddCert(proxy.Certificate())
+
+	tlsConfig, err := NewTLSConfig(TLSOpts{
+		CAFile:     caFile,
+		ClientCert: clientCertFile,
+		ClientKey:  clientKeyFile,
+		ServerName: "odoh.internal",
+		SPKIPins:   []string{SPKIPin(targetCert.cert)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := NewUpstream("odoh://"+targetHost+"/dns-query", Opt{
+		ODoHProxy:          proxy.URL + "/proxy",
+		TLSConfig:          tlsConfig,
+		ODoHProxyTLSConfig: &tls.Config{RootCAs: proxyCAs},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	b, _ := q.Pack()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	if _, err := u.ExchangeContext(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+	if proxyGotClientCert.Load() {
+		t.Fatal("client cert of the target is sent to the proxy")
+	}
+}
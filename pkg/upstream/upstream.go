@@ -34,8 +34,10 @@ import (
 	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/mlog"
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnscrypt"
 	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
 	"github.com/IrineSistiana/mosdns/v5/pkg/upstream/bootstrap"
+	dnscryptupstream "github.com/IrineSistiana/mosdns/v5/pkg/upstream/dnscrypt"
 	"github.com/IrineSistiana/mosdns/v5/pkg/upstream/doh"
 	"github.com/IrineSistiana/mosdns/v5/pkg/upstream/transport"
 	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
@@ -100,6 +102,12 @@ type Opt struct {
 	// Note: There is no fallback. Make sure the server supports it.
 	EnableHTTP3 bool
 
+	// ODoHProxy specifies the url of the oblivious proxy that an oblivious
+	// DoH upstream (odoh://) sends queries through. If empty, queries are
+	// sent to the target directly.
+	// DialAddr, Bootstrap and EnableHTTP3 only apply to the target.
+	ODoHProxy string
+
 	// Bootstrap specifies a plain dns server to solve the
 	// upstream server domain address.
 	// It must be an IP address. Port is optional.
@@ -111,8 +119,14 @@ type Opt struct {
 
 	// TLSConfig specifies the tls.Config that the TLS client will use.
 	// Available for DoT, DoH, DoQ upstream.
+	// For an oblivious DoH upstream, it only applies to the target.
 	TLSConfig *tls.Config
 
+	// ODoHProxyTLSConfig specifies the tls.Config that is used to connect
+	// to the oblivious proxy. Default is a config that verifies the proxy
+	// with system roots and shares the session cache of TLSConfig.
+	ODoHProxyTLSConfig *tls.Config
+
 	// Logger specifies the logger that the upstream will use.
 	Logger *zap.Logger
 
@@ -124,10 +138,12 @@ type Opt struct {
 // NewUpstream creates a upstream.
 // addr has the format of: [protocol://]host[:port][/path].
 // Supported protocol: udp/tcp/tls/https/quic. Default protocol is udp.
+// DNSCrypt upstreams use their stamps "sdns://..." as addr.
 //
 // Helper protocol:
 //   - tcp+pipeline/tls+pipeline: Automatically set opt.EnablePipeline to true.
 //   - h3: Automatically set opt.EnableHTTP3 to true.
+//   - odoh: Oblivious DoH (RFC 9230) to an https target. See opt.ODoHProxy.
 func NewUpstream(addr string, opt Opt) (_ Upstream, err error) {
 	if opt.Logger == nil {
 		opt.Logger = mlog.Nop()
@@ -146,6 +162,7 @@ func NewUpstream(addr string, opt Opt) (_ Upstream, err error) {
 	}
 
 	// Apply helper protocol
+	oblivious := false
 	switch addrURL.Scheme {
 	case "tcp+pipeline", "tls+pipeline":
 		addrURL.Scheme = addrURL.Scheme[:3]
@@ -153,6 +170,9 @@ func NewUpstream(addr string, opt Opt) (_ Upstream, err error) {
 	case "h3":
 		addrURL.Scheme = "https"
 		opt.EnableHTTP3 = true
+	case "odoh":
+		addrURL.Scheme = "https"
+		oblivious = true
 	}
 
 	// If host is a ipv6 without port, it will be in []. This will cause err when
@@ -445,35 +465,58 @@ func NewUpstream(addr string, opt Opt) (_ Upstream, err error) {
 			if err != nil {
 				return nil, fmt.Errorf("failed to init tcp dialer, %w", err)
 			}
-			t1 := &http.Transport{
-				DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) { // overwrite server addr
-					c, err := tcpDialer(ctx)
-					c = wrapConn(c, opt.EventObserver)
-					return c, err
-				},
-				TLSClientConfig:     opt.TLSConfig,
-				TLSHandshakeTimeout: tlsHandshakeTimeout,
-				IdleConnTimeout:     idleConnTimeout,
-
-				// Following opts are for http/1 only.
-				// MaxConnsPerHost:     2,
-				// MaxIdleConnsPerHost: 2,
-			}
-
-			t2, err := http2.ConfigureTransports(t1)
+			t, err = newHTTPTransport(func(ctx context.Context, _ string) (net.Conn, error) { // overwrite server addr
+				return tcpDialer(ctx)
+			}, opt, idleConnTimeout)
 			if err != nil {
-				return nil, fmt.Errorf("failed to upgrade http2 support, %w", err)
+				return nil, err
 			}
-			t2.MaxHeaderListSize = 4 * 1024
-			t2.MaxReadFrameSize = 16 * 1024
-			t2.ReadIdleTimeout = time.Second * 30
-			t2.PingTimeout = time.Second * 5
-			t = t1
 		}
 
-		u, err := doh.NewUpstream(addrURL.String(), t, opt.Logger)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create doh upstream, %w", err)
+		var u dohUpstream
+		if oblivious {
+			proxyRT := t
+			if len(opt.ODoHProxy) > 0 {
+				var d proxy.ContextDialer = dialer
+				if s5Addr := opt.Socks5; len(s5Addr) > 0 {
+					socks5Dialer, err := proxy.SOCKS5("tcp", s5Addr, nil, dialer)
+					if err != nil {
+						return nil, fmt.Errorf("failed to init socks5 dialer: %w", err)
+					}
+					d = socks5Dialer.(proxy.ContextDialer)
+				}
+				// The proxy is another server. Client certs, server name,
+				// pins and CAs of the target must not be used with it.
+				proxyOpt := opt
+				proxyOpt.TLSConfig = opt.ODoHProxyTLSConfig
+				if proxyOpt.TLSConfig == nil {
+					proxyOpt.TLSConfig = new(tls.Config)
+					if opt.TLSConfig != nil {
+						proxyOpt.TLSConfig.ClientSessionCache = opt.TLSConfig.ClientSessionCache
+					}
+				}
+				proxyRT, err = newHTTPTransport(func(ctx context.Context, addr string) (net.Conn, error) {
+					return d.DialContext(ctx, "tcp", addr)
+				}, proxyOpt, idleConnTimeout)
+				if err != nil {
+					return nil, err
+				}
+			}
+			u, err = doh.NewObliviousUpstream(doh.ObliviousOpts{
+				Target:          addrURL.String(),
+				Proxy:           opt.ODoHProxy,
+				TargetTransport: t,
+				ProxyTransport:  proxyRT,
+				Logger:          opt.Logger,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to create odoh upstream, %w", err)
+			}
+		} else {
+			u, err = doh.NewUpstream(addrURL.String(), t, opt.Logger)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create doh upstream, %w", err)
+			}
 		}
 
 		return &dohWithClose{
@@ -552,6 +595,34 @@ func NewUpstream(addr string, opt Opt) (_ Upstream, err error) {
 			MaxConcurrentQueryWhileDialing: 90,
 			Logger:                         opt.Logger,
 		}), nil
+	case "sdns":
+		const defaultPort = 443
+		stamp, err := dnscrypt.ParseStamp(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dnscrypt stamp, %w", err)
+		}
+		serverAddr := stamp.ServerAddr
+		if strings.HasPrefix(serverAddr, "[") && strings.HasSuffix(serverAddr, "]") {
+			serverAddr = serverAddr[1 : len(serverAddr)-1] // ipv6 without port
+		}
+		host, port, err := parseDialAddr(serverAddr, opt.DialAddr, defaultPort)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := netip.ParseAddr(host); err != nil {
+			return nil, fmt.Errorf("addr must be an ip address, %w", err)
+		}
+		dialAddr := joinPort(host, port)
+		return dnscryptupstream.NewUpstream(stamp, dnscryptupstream.Opts{
+			DialContext: func(ctx context.Context, network string) (net.Conn, error) {
+				c, err := dialer.DialContext(ctx, network, dialAddr)
+				if err != nil {
+					return nil, err
+				}
+				return wrapConn(c, opt.EventObserver), nil
+			},
+			Logger: opt.Logger,
+		})
 	default:
 		return nil, fmt.Errorf("unsupported protocol [%s]", addrURL.Scheme)
 	}
@@ -580,8 +651,13 @@ func (u *udpWithFallback) Close() error {
 	return nil
 }
 
+// dohUpstream is a doh.Upstream or a doh.ObliviousUpstream.
+type dohUpstream interface {
+	ExchangeContext(ctx context.Context, m []byte) (*[]byte, error)
+}
+
 type dohWithClose struct {
-	u      *doh.Upstream
+	u      dohUpstream
 	closer io.Closer // maybe nil
 }
 
@@ -596,6 +672,37 @@ func (u *dohWithClose) Close() error {
 	return nil
 }
 
+// newHTTPTransport returns a http/1 and http/2 transport that dials
+// connections with dial.
+func newHTTPTransport(dial func(ctx context.Context, addr string) (net.Conn, error), opt Opt, idleConnTimeout time.Duration) (*http.Transport, error) {
+	t1 := &http.Transport{
+		DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+			c, err := dial(ctx, addr)
+			if err != nil {
+				return nil, err
+			}
+			return wrapConn(c, opt.EventObserver), nil
+		},
+		TLSClientConfig:     opt.TLSConfig,
+		TLSHandshakeTimeout: tlsHandshakeTimeout,
+		IdleConnTimeout:     idleConnTimeout,
+
+		// Following opts are for http/1 only.
+		// MaxConnsPerHost:     2,
+		// MaxIdleConnsPerHost: 2,
+	}
+
+	t2, err := http2.ConfigureTransports(t1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to upgrade http2 support, %w", err)
+	}
+	t2.MaxHeaderListSize = 4 * 1024
+	t2.MaxReadFrameSize = 16 * 1024
+	t2.ReadIdleTimeout = time.Second * 30
+	t2.PingTimeout = time.Second * 5
+	return t1, nil
+}
+
 func newDefaultClientQuicConfig() *quic.Config {
 	return &quic.Config{
 		TokenStore: quic.NewLRUTokenStore(4, 8),
@@ -47,3 +47,40 @@ func SplitString2(s, symbol string) (s1 string, s2 string, ok bool) {
 	}
 	return "", "", false
 }
+
+// Suggest returns the candidate that is closest to s by edit distance.
+// It returns an empty string if no candidate is close enough, which is
+// an edit distance of at most 2, or s itself is a candidate.
+func Suggest(s string, candidates []string) string {
+	best, bestD := "", 3
+	for _, c := range candidates {
+		if c == s {
+			return ""
+		}
+		if d := editDistance(s, c); d < bestD || (d == bestD && len(best) > 0 && c < best) {
+			best, bestD = c, d
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
@@ -121,3 +121,23 @@ func Test_WeakDecode2(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestSuggest(t *testing.T) {
+	candidates := []string{"qname", "qtype", "client_ip", "sequence"}
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{"qnme", "qname"},
+		{"qtyp", "qtype"},
+		{"sequnce", "sequence"},
+		{"qname", ""},
+		{"something", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := Suggest(tt.s, candidates); got != tt.want {
+			t.Errorf("Suggest(%q) = %q, want %q", tt.s, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package zone_file
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/miekg/dns"
+)
+
+// maxCNAMEChain limits how many CNAMEs Zone.Reply follows inside the zone.
+const maxCNAMEChain = 8
+
+// Zone is an authoritative zone. It answers queries as described in
+// RFC 1034 4.3.2, including wildcards, delegations and CNAMEs.
+// A Zone must not be modified after it is loaded. It is safe for concurrent use.
+type Zone struct {
+	origin string // canonical name
+	soa    *dns.SOA
+
+	// nodes contains all names in the zone, including empty non-terminals,
+	// which have an empty rrsets.
+	nodes map[string]rrsets
+}
+
+type rrsets map[uint16][]dns.RR
+
+// NewZone creates an empty zone. Records can be added with Add. A zone must
+// have a SOA record at its origin before it can answer queries.
+func NewZone(origin string) *Zone {
+	origin = dns.CanonicalName(origin)
+	z := &Zone{origin: origin, nodes: make(map[string]rrsets)}
+	z.nodes[origin] = make(rrsets)
+	return z
+}
+
+// LoadZoneFile loads a zone from a RFC 1035 zone file. If origin is empty,
+// the owner of the first SOA record is used as the origin.
+func LoadZoneFile(file string, origin string) (*Zone, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return LoadZone(f, origin, file)
+}
+
+// LoadZone loads a zone from r. See LoadZoneFile. file is used for
+// $INCLUDE directives and error messages.
+func LoadZone(r io.Reader, origin string, file string) (*Zone, error) {
+	parser := dns.NewZoneParser(r, dns.Fqdn(origin), file)
+	parser.SetDefaultTTL(3600)
+	parser.SetIncludeAllowed(true)
+	var z *Zone
+	if len(origin) > 0 {
+		z = NewZone(origin)
+	}
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		if z == nil {
+			soa, ok := rr.(*dns.SOA)
+			if !ok {
+				return nil, errors.New("the first record must be a SOA if origin is not specified")
+			}
+			z = NewZone(soa.Hdr.Name)
+		}
+		if err := z.Add(rr); err != nil {
+			return nil, err
+		}
+	}
+	if err := parser.Err(); err != nil {
+		return nil, err
+	}
+	if z == nil {
+		return nil, errors.New("empty zone")
+	}
+	if z.soa == nil {
+		return nil, fmt.Errorf("zone %s has no SOA record", z.origin)
+	}
+	return z, nil
+}
+
+// Origin returns the canonical origin of the zone.
+func (z *Zone) Origin() string {
+	return z.origin
+}
+
+// SOA returns the SOA record of the zone. It may be nil if the zone is
+// still being built.
+func (z *Zone) SOA() *dns.SOA {
+	return z.soa
+}
+
+// Add adds rr to the zone. rr must be a class IN record at or below the origin.
+func (z *Zone) Add(rr dns.RR) error {
+	h := rr.Header()
+	if h.Class != dns.ClassINET {
+		return fmt.Errorf("unsupported class %s of %s", dns.ClassToString[h.Class], h.Name)
+	}
+	name := dns.CanonicalName(h.Name)
+	if !dns.IsSubDomain(z.origin, name) {
+		return fmt.Errorf("%s is out of zone %s", h.Name, z.origin)
+	}
+	if soa, ok := rr.(*dns.SOA); ok {
+		if name != z.origin {
+			return fmt.Errorf("SOA record %s is not at the zone origin", h.Name)
+		}
+		if z.soa != nil {
+			return errors.New("multiple SOA records")
+		}
+		z.soa = soa
+	}
+	node := z.nodes[name]
+	if node == nil {
+		node = make(rrsets)
+		z.nodes[name] = node
+		// Add empty non-terminals.
+		for n := name; n != z.origin; {
+			n = parent(n)
+			if z.nodes[n] != nil {
+				break
+			}
+			z.nodes[n] = make(rrsets)
+		}
+	}
+	node[h.Rrtype] = append(node[h.Rrtype], rr)
+	return nil
+}
+
+// Records calls f for all records in the zone. The SOA record comes first.
+// f must not modify rr.
+func (z *Zone) Records(f func(rr dns.RR)) {
+	if z.soa != nil {
+		f(z.soa)
+	}
+	for _, node := range z.nodes {
+		for typ, rrs := range node {
+			if typ == dns.TypeSOA {
+				continue
+			}
+			for _, rr := range rrs {
+				f(rr)
+			}
+		}
+	}
+}
+
+// parent returns the parent name of a canonical name. The parent of root is root.
+func parent(name string) string {
+	i, end := dns.NextLabel(name, 0)
+	if end {
+		return "."
+	}
+	return name[i:]
+}
+
+// Reply returns an authoritative response for q. q must have one class IN question
+// at or below the zone origin.
+func (z *Zone) Reply(q *dns.Msg) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Authoritative = true
+	qtype := q.Question[0].Qtype
+	qname := q.Question[0].Name
+
+	visited := make(map[string]struct{})
+	for i := 0; i <= maxCNAMEChain; i++ {
+		name := dns.CanonicalName(qname)
+		visited[name] = struct{}{}
+
+		// Referral. A DS query at the cut is answered by the parent side, which is us.
+		if cut, ns := z.findCut(name); ns != nil && !(qtype == dns.TypeDS && cut == name) {
+			if len(r.Answer) > 0 {
+				return r
+			}
+			r.Authoritative = false
+			r.Ns = copyRRs(ns, "")
+			r.Extra = z.glue(ns)
+			return r
+		}
+
+		node, owner := z.nodes[name], ""
+		if node == nil {
+			node = z.wildcard(name)
+			if node == nil {
+				r.Rcode = dns.RcodeNameError
+				r.Ns = []dns.RR{z.negativeSOA()}
+				return r
+			}
+			owner = qname // synthesize records from the wildcard
+		}
+
+		switch {
+		case qtype == dns.TypeANY:
+			for _, rrs := range node {
+				r.Answer = append(r.Answer, copyRRs(rrs, owner)...)
+			}
+		case len(node[qtype]) > 0:
+			r.Answer = append(r.Answer, copyRRs(node[qtype], owner)...)
+		case len(node[dns.TypeCNAME]) > 0:
+			cname := copyRRs(node[dns.TypeCNAME], owner)
+			r.Answer = append(r.Answer, cname...)
+			target := cname[0].(*dns.CNAME).Target
+			if _, loop := visited[dns.CanonicalName(target)]; loop || !dns.IsSubDomain(z.origin, dns.CanonicalName(target)) {
+				return r
+			}
+			qname = target
+			continue
+		}
+		if len(r.Answer) == 0 || (qtype != dns.TypeANY && len(node[qtype]) == 0) {
+			r.Ns = []dns.RR{z.negativeSOA()} // NODATA
+		}
+		return r
+	}
+	return r
+}
+
+// findCut returns the highest delegation point at or above name and its NS records.
+func (z *Zone) findCut(name string) (cut string, ns []dns.RR) {
+	for n := name; n != z.origin && dns.IsSubDomain(z.origin, n); n = parent(n) {
+		if node := z.nodes[n]; node != nil && len(node[dns.TypeNS]) > 0 {
+			cut, ns = n, node[dns.TypeNS]
+		}
+	}
+	return cut, ns
+}
+
+// wildcard returns the wildcard node that matches name as described in RFC 4592.
+// name must not exist in the zone.
+func (z *Zone) wildcard(name string) rrsets {
+	// Find the closest encloser.
+	n := name
+	for z.nodes[n] == nil {
+		if n == z.origin {
+			return nil
+		}
+		n = parent(n)
+	}
+	return z.nodes["*."+n]
+}
+
+// glue returns A and AAAA records of the name servers in ns from the zone.
+func (z *Zone) glue(ns []dns.RR) []dns.RR {
+	var extra []dns.RR
+	for _, rr := range ns {
+		node := z.nodes[dns.CanonicalName(rr.(*dns.NS).Ns)]
+		if node == nil {
+			continue
+		}
+		extra = append(extra, copyRRs(node[dns.TypeA], "")...)
+		extra = append(extra, copyRRs(node[dns.TypeAAAA], "")...)
+	}
+	return extra
+}
+
+// negativeSOA returns the SOA record for negative responses. Its ttl is
+// the minimum of the SOA ttl and the MINIMUM field (RFC 2308 3).
+func (z *Zone) negativeSOA() dns.RR {
+	soa := dns.Copy(z.soa).(*dns.SOA)
+	if soa.Minttl < soa.Hdr.Ttl {
+		soa.Hdr.Ttl = soa.Minttl
+	}
+	return soa
+}
+
+// copyRRs deep copies rrs, so the caller can modify them. If owner is not
+// empty, the owner of copied records is set to owner.
+func copyRRs(rrs []dns.RR, owner string) []dns.RR {
+	c := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		rr = dns.Copy(rr)
+		if len(owner) > 0 {
+			rr.Header().Name = owner
+		}
+		c = append(c, rr)
+	}
+	return c
+}
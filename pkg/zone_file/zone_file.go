@@ -46,6 +46,22 @@ func (m *Matcher) Load(r io.Reader) error {
 		m.m = make(map[dns.Question][]dns.RR)
 	}
 
+	return ReadRRs(r, func(rr dns.RR) error {
+		h := rr.Header()
+		q := dns.Question{
+			Name:   strings.ToLower(h.Name),
+			Qtype:  h.Rrtype,
+			Qclass: h.Class,
+		}
+		m.m[q] = append(m.m[q], rr)
+		return nil
+	})
+}
+
+// ReadRRs parses a RFC 1035 zone file from r and calls f for each rr.
+// Records without an explicit ttl and $TTL directive have a ttl of 3600.
+// If f returns an error, ReadRRs stops and returns that error.
+func ReadRRs(r io.Reader, f func(rr dns.RR) error) error {
 	parser := dns.NewZoneParser(r, "", "")
 	parser.SetDefaultTTL(3600)
 	for {
@@ -53,13 +69,9 @@ func (m *Matcher) Load(r io.Reader) error {
 		if !ok {
 			break
 		}
-		h := rr.Header()
-		q := dns.Question{
-			Name:   strings.ToLower(h.Name),
-			Qtype:  h.Rrtype,
-			Qclass: h.Class,
+		if err := f(rr); err != nil {
+			return err
 		}
-		m.m[q] = append(m.m[q], rr)
 	}
 	return parser.Err()
 }
@@ -0,0 +1,171 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package zone_file
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const zoneData = `
+$ORIGIN example.com.
+$TTL 3600
+@        IN SOA  ns1 hostmaster 1 7200 3600 1209600 300
+@        IN NS   ns1
+ns1      IN A    192.0.2.53
+www      IN A    192.0.2.1
+alias    IN CNAME www
+ext      IN CNAME www.example.org.
+loop1    IN CNAME loop2
+loop2    IN CNAME loop1
+*.wild   IN A    192.0.2.2
+*.wild   IN TXT  "wild"
+a.b.c    IN A    192.0.2.3
+sub      IN NS   ns.sub
+sub      IN DS   12345 8 2 49FD46E6C4B45C55D4AC69CBD3CD34AC1AFE51DE4CE0D4CB8B2C3B8E8D2B3C4A
+ns.sub   IN A    192.0.2.54
+`
+
+func TestZone_Reply(t *testing.T) {
+	z, err := LoadZone(strings.NewReader(zoneData), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if z.Origin() != "example.com." {
+		t.Fatalf("unexpected origin %s", z.Origin())
+	}
+
+	tests := []struct {
+		name   string
+		qname  string
+		qtype  uint16
+		rcode  int
+		aa     bool
+		answer []string // "name type" of each answer
+		soa    bool     // SOA in authority section
+		ns     int      // NS in authority section
+		extra  int
+	}{
+		{"exact", "www.example.com.", dns.TypeA, dns.RcodeSuccess, true, []string{"www.example.com. A"}, false, 0, 0},
+		{"case insensitive", "WWW.Example.com.", dns.TypeA, dns.RcodeSuccess, true, []string{"www.example.com. A"}, false, 0, 0},
+		{"nodata", "www.example.com.", dns.TypeAAAA, dns.RcodeSuccess, true, nil, true, 0, 0},
+		{"nxdomain", "nx.example.com.", dns.TypeA, dns.RcodeNameError, true, nil, true, 0, 0},
+		{"empty non-terminal", "b.c.example.com.", dns.TypeA, dns.RcodeSuccess, true, nil, true, 0, 0},
+		{"cname chasing", "alias.example.com.", dns.TypeA, dns.RcodeSuccess, true, []string{"alias.example.com. CNAME", "www.example.com. A"}, false, 0, 0},
+		{"cname query", "alias.example.com.", dns.TypeCNAME, dns.RcodeSuccess, true, []string{"alias.example.com. CNAME"}, false, 0, 0},
+		{"cname out of zone", "ext.example.com.", dns.TypeA, dns.RcodeSuccess, true, []string{"ext.example.com. CNAME"}, false, 0, 0},
+		{"cname loop", "loop1.example.com.", dns.TypeA, dns.RcodeSuccess, true, []string{"loop1.example.com. CNAME", "loop2.example.com. CNAME"}, false, 0, 0},
+		{"wildcard", "x.y.wild.example.com.", dns.TypeA, dns.RcodeSuccess, true, []string{"x.y.wild.example.com. A"}, false, 0, 0},
+		{"wildcard nodata", "x.wild.example.com.", dns.TypeAAAA, dns.RcodeSuccess, true, nil, true, 0, 0},
+		{"wildcard blocked by ent", "x.c.example.com.", dns.TypeA, dns.RcodeNameError, true, nil, true, 0, 0},
+		{"referral", "www.sub.example.com.", dns.TypeA, dns.RcodeSuccess, false, nil, false, 1, 1},
+		{"referral at cut", "sub.example.com.", dns.TypeNS, dns.RcodeSuccess, false, nil, false, 1, 1},
+		{"ds at cut", "sub.example.com.", dns.TypeDS, dns.RcodeSuccess, true, []string{"sub.example.com. DS"}, false, 0, 0},
+		{"apex any", "example.com.", dns.TypeANY, dns.RcodeSuccess, true, []string{"example.com. SOA", "example.com. NS"}, false, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := new(dns.Msg)
+			q.SetQuestion(tt.qname, tt.qtype)
+			r := z.Reply(q)
+			if r.Rcode != tt.rcode {
+				t.Fatalf("want rcode %d, got %d", tt.rcode, r.Rcode)
+			}
+			if r.Authoritative != tt.aa {
+				t.Fatalf("want aa %v, got %v", tt.aa, r.Authoritative)
+			}
+			var answer []string
+			for _, rr := range r.Answer {
+				answer = append(answer, rr.Header().Name+" "+dns.TypeToString[rr.Header().Rrtype])
+			}
+			if !sameSet(answer, tt.answer) {
+				t.Fatalf("want answer %v, got %v", tt.answer, answer)
+			}
+			var soa, ns int
+			for _, rr := range r.Ns {
+				switch rr := rr.(type) {
+				case *dns.SOA:
+					soa++
+					if rr.Hdr.Ttl != 300 {
+						t.Fatalf("want negative ttl 300, got %d", rr.Hdr.Ttl)
+					}
+				case *dns.NS:
+					ns++
+				}
+			}
+			if (soa == 1) != tt.soa || ns != tt.ns {
+				t.Fatalf("unexpected authority section %v", r.Ns)
+			}
+			if len(r.Extra) != tt.extra {
+				t.Fatalf("unexpected additional section %v", r.Extra)
+			}
+		})
+	}
+
+	// Replies must not share records with the zone.
+	q := new(dns.Msg)
+	q.SetQuestion("www.example.com.", dns.TypeA)
+	z.Reply(q).Answer[0].Header().Ttl = 1
+	if z.Reply(q).Answer[0].Header().Ttl != 3600 {
+		t.Fatal("zone records were modified")
+	}
+}
+
+func TestLoadZone_Errors(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   string
+		origin string
+	}{
+		{"no soa", "www.example.com. IN A 192.0.2.1", "example.com."},
+		{"first record is not soa", "www.example.com. IN A 192.0.2.1", ""},
+		{"out of zone", "example.com. IN SOA ns1 hm 1 1 1 1 1\nexample.org. IN A 192.0.2.1", ""},
+		{"soa not at origin", "www.example.com. IN SOA ns1 hm 1 1 1 1 1", "example.com."},
+		{"multiple soa", "example.com. IN SOA ns1 hm 1 1 1 1 1\nexample.com. IN SOA ns1 hm 2 1 1 1 1", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := LoadZone(strings.NewReader(tt.data), tt.origin, ""); err == nil {
+				t.Fatal("want error")
+			}
+		})
+	}
+}
+
+func sameSet(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	m := make(map[string]int)
+	for _, s := range a {
+		m[s]++
+	}
+	for _, s := range b {
+		m[s]--
+	}
+	for _, n := range m {
+		if n != 0 {
+			return false
+		}
+	}
+	return true
+}
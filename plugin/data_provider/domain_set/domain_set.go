@@ -23,9 +23,17 @@ import (
 	"bytes"
 	"fmt"
 	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/file_watcher"
+	"github.com/IrineSistiana/mosdns/v5/pkg/geodata"
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/compiled"
 	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/remote_file"
 	"github.com/IrineSistiana/mosdns/v5/plugin/data_provider"
+	"go.uber.org/zap"
 	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const PluginType = "domain_set"
@@ -46,33 +54,153 @@ type Args struct {
 	Exps  []string `yaml:"exps"`
 	Sets  []string `yaml:"sets"`
 	Files []string `yaml:"files"`
+
+	// Compiled are files generated by "mosdns tools compile-domain". They are
+	// memory-mapped and not reloaded by Watch.
+	Compiled []string `yaml:"compiled"`
+
+	// Geosites are v2ray geosite.dat selectors, e.g. "geosite.dat:cn@!ads".
+	// See geodata.Selector.
+	Geosites []string `yaml:"geosites"`
+
+	// Remotes are rule files that are downloaded from urls and updated
+	// periodically.
+	Remotes []remote_file.Args `yaml:"remotes"`
+
+	// Watch reloads files when they are changed. PollInterval (in seconds)
+	// checks files periodically instead. Both are disabled by default.
+	// If the files cannot be loaded, the last rules are kept.
+	Watch        bool `yaml:"watch"`
+	PollInterval int  `yaml:"poll_interval"`
+}
+
+// CheckArgs implements coremain.ArgsChecker.
+func (a *Args) CheckArgs() ([]coremain.PluginRef, []error) {
+	var refs []coremain.PluginRef
+	for _, tag := range a.Sets {
+		refs = append(refs, coremain.PluginRef{Tag: tag, Kind: "sets"})
+	}
+	return refs, nil
 }
 
 var _ data_provider.DomainMatcherProvider = (*DomainSet)(nil)
 
 type DomainSet struct {
-	mg []domain.Matcher[struct{}]
+	mg       []domain.Matcher[struct{}]
+	w        *file_watcher.Watcher
+	remotes  []*remote_file.Source
+	compiled []*compiled.DomainSet
+
+	reloadMu sync.Mutex
 }
 
 func (d *DomainSet) GetDomainMatcher() domain.Matcher[struct{}] {
 	return MatcherGroup(d.mg)
 }
 
+func (d *DomainSet) Close() error {
+	for _, r := range d.remotes {
+		_ = r.Close()
+	}
+	for _, c := range d.compiled {
+		_ = c.Close()
+	}
+	return d.w.Close()
+}
+
 // NewDomainSet inits a DomainSet from given args.
 func NewDomainSet(bp *coremain.BP, args *Args) (*DomainSet, error) {
 	ds := &DomainSet{}
 
-	m := domain.NewDomainMixMatcher()
-	if err := LoadExpsAndFiles(args.Exps, args.Files, m); err != nil {
+	var reload func()
+	for i, ra := range args.Remotes {
+		r, err := remote_file.New(ra, remote_file.Opts{
+			Validate: func(b []byte) error {
+				return domain.LoadFromTextReader[struct{}](domain.NewDomainMixMatcher(), bytes.NewReader(b), nil)
+			},
+			OnUpdate: func() { reload() },
+			Logger:   bp.L(),
+		})
+		if err != nil {
+			_ = ds.Close()
+			return nil, fmt.Errorf("failed to load remote #%d, %w", i, err)
+		}
+		ds.remotes = append(ds.remotes, r)
+	}
+	load := func() (*domain.MixMatcher[struct{}], error) {
+		m := domain.NewDomainMixMatcher()
+		if err := LoadExpsAndFiles(args.Exps, args.Files, m); err != nil {
+			return nil, err
+		}
+		if err := geodata.LoadGeoSites(args.Geosites, m); err != nil {
+			return nil, err
+		}
+		for i, r := range ds.remotes {
+			if err := domain.LoadFromTextReader[struct{}](m, bytes.NewReader(r.Data()), nil); err != nil {
+				return nil, fmt.Errorf("failed to load remote #%d, %w", i, err)
+			}
+		}
+		return m, nil
+	}
+
+	m, err := load()
+	if err != nil {
+		_ = ds.Close()
+		return nil, err
+	}
+	geoFiles, err := geodata.Files(args.Geosites)
+	if err != nil {
+		_ = ds.Close()
 		return nil, err
 	}
-	if m.Len() > 0 {
+	files := append(append([]string(nil), args.Files...), geoFiles...)
+	wOpts := file_watcher.Opts{
+		Watch:        args.Watch,
+		PollInterval: time.Duration(args.PollInterval) * time.Second,
+		Logger:       bp.L(),
+	}
+	if (wOpts.Enabled() && len(files) > 0) || len(ds.remotes) > 0 {
+		rm := new(reloadableMatcher)
+		rm.p.Store(m)
+		ds.mg = append(ds.mg, rm)
+		reload = func() {
+			ds.reloadMu.Lock()
+			defer ds.reloadMu.Unlock()
+			m, err := load()
+			if err != nil {
+				bp.L().Error("failed to reload files, keep using the last rules", zap.Error(err))
+				return
+			}
+			rm.p.Store(m)
+			bp.L().Info("files reloaded", zap.Int("length", m.Len()))
+		}
+		w, err := file_watcher.New(files, reload, wOpts)
+		if err != nil {
+			_ = ds.Close()
+			return nil, fmt.Errorf("failed to watch files, %w", err)
+		}
+		ds.w = w
+		for _, r := range ds.remotes {
+			r.Start()
+		}
+	} else if m.Len() > 0 {
 		ds.mg = append(ds.mg, m)
 	}
 
+	for i, f := range args.Compiled {
+		c, err := compiled.OpenDomainSet(f)
+		if err != nil {
+			_ = ds.Close()
+			return nil, fmt.Errorf("failed to open compiled file #%d, %w", i, err)
+		}
+		ds.compiled = append(ds.compiled, c)
+		ds.mg = append(ds.mg, c)
+	}
+
 	for _, tag := range args.Sets {
 		provider, _ := bp.M().GetPlugin(tag).(data_provider.DomainMatcherProvider)
 		if provider == nil {
+			_ = ds.Close()
 			return nil, fmt.Errorf("%s is not a DomainMatcherProvider", tag)
 		}
 		m := provider.GetDomainMatcher()
@@ -122,3 +250,12 @@ func LoadFile(f string, m *domain.MixMatcher[struct{}]) error {
 	}
 	return nil
 }
+
+// reloadableMatcher is a domain matcher that can be replaced atomically.
+type reloadableMatcher struct {
+	p atomic.Pointer[domain.MixMatcher[struct{}]]
+}
+
+func (m *reloadableMatcher) Match(s string) (struct{}, bool) {
+	return m.p.Load().Match(s)
+}
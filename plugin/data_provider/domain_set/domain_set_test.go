@@ -0,0 +1,93 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package domain_set
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/compiled"
+)
+
+func TestDomainSet_Watch(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "domains.txt")
+	if err := os.WriteFile(f, []byte("full:a.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	bp := coremain.NewBP("test", coremain.NewTestMosdnsWithPlugins(nil))
+	ds, err := NewDomainSet(bp, &Args{Files: []string{f}, Watch: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	m := ds.GetDomainMatcher()
+
+	waitMatch := func(domain string, want bool) {
+		t.Helper()
+		for i := 0; i < 100; i++ {
+			if _, ok := m.Match(domain); ok == want {
+				return
+			}
+			time.Sleep(time.Millisecond * 20)
+		}
+		t.Fatalf("want match %s = %v", domain, want)
+	}
+	waitMatch("a.com.", true)
+
+	// The matcher returned before the reload is updated.
+	if err := os.WriteFile(f, []byte("full:b.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitMatch("b.com.", true)
+	waitMatch("a.com.", false)
+
+	// Invalid file, keep the last rules.
+	if err := os.WriteFile(f, []byte("regexp:(\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Second)
+	waitMatch("b.com.", true)
+}
+
+func TestDomainSet_Compiled(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "domains.bin")
+	b := compiled.NewDomainBuilder()
+	if err := b.Add("a.com", struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := compiled.WriteDomainSet(f, b); err != nil {
+		t.Fatal(err)
+	}
+	bp := coremain.NewBP("test", coremain.NewTestMosdnsWithPlugins(nil))
+	ds, err := NewDomainSet(bp, &Args{Exps: []string{"full:b.com"}, Compiled: []string{f}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	m := ds.GetDomainMatcher()
+	for d, want := range map[string]bool{"www.a.com.": true, "b.com.": true, "c.com.": false} {
+		if _, ok := m.Match(d); ok != want {
+			t.Errorf("%s: want %v, got %v", d, want, ok)
+		}
+	}
+}
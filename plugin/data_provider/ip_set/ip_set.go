@@ -23,11 +23,19 @@ import (
 	"bytes"
 	"fmt"
 	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/file_watcher"
+	"github.com/IrineSistiana/mosdns/v5/pkg/geodata"
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/compiled"
 	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/netlist"
+	"github.com/IrineSistiana/mosdns/v5/pkg/remote_file"
 	"github.com/IrineSistiana/mosdns/v5/plugin/data_provider"
+	"go.uber.org/zap"
 	"net/netip"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const PluginType = "ip_set"
@@ -44,32 +52,152 @@ type Args struct {
 	IPs   []string `yaml:"ips"`
 	Sets  []string `yaml:"sets"`
 	Files []string `yaml:"files"`
+
+	// Compiled are files generated by "mosdns tools compile-ip". They are
+	// memory-mapped and not reloaded by Watch.
+	Compiled []string `yaml:"compiled"`
+
+	// Geoips are v2ray geoip.dat selectors, e.g. "geoip.dat:cn".
+	// See geodata.Selector.
+	Geoips []string `yaml:"geoips"`
+
+	// Remotes are ip files that are downloaded from urls and updated
+	// periodically.
+	Remotes []remote_file.Args `yaml:"remotes"`
+
+	// Watch reloads files when they are changed. PollInterval (in seconds)
+	// checks files periodically instead. Both are disabled by default.
+	// If the files cannot be loaded, the last list is kept.
+	Watch        bool `yaml:"watch"`
+	PollInterval int  `yaml:"poll_interval"`
+}
+
+// CheckArgs implements coremain.ArgsChecker.
+func (a *Args) CheckArgs() ([]coremain.PluginRef, []error) {
+	var refs []coremain.PluginRef
+	for _, tag := range a.Sets {
+		refs = append(refs, coremain.PluginRef{Tag: tag, Kind: "sets"})
+	}
+	return refs, nil
 }
 
 var _ data_provider.IPMatcherProvider = (*IPSet)(nil)
 
 type IPSet struct {
-	mg []netlist.Matcher
+	mg       []netlist.Matcher
+	w        *file_watcher.Watcher
+	remotes  []*remote_file.Source
+	compiled []*compiled.IPSet
+
+	reloadMu sync.Mutex
 }
 
 func (d *IPSet) GetIPMatcher() netlist.Matcher {
 	return MatcherGroup(d.mg)
 }
 
+func (d *IPSet) Close() error {
+	for _, r := range d.remotes {
+		_ = r.Close()
+	}
+	for _, c := range d.compiled {
+		_ = c.Close()
+	}
+	return d.w.Close()
+}
+
 func NewIPSet(bp *coremain.BP, args *Args) (*IPSet, error) {
 	p := &IPSet{}
 
-	l := netlist.NewList()
-	if err := LoadFromIPsAndFiles(args.IPs, args.Files, l); err != nil {
+	var reload func()
+	for i, ra := range args.Remotes {
+		r, err := remote_file.New(ra, remote_file.Opts{
+			Validate: func(b []byte) error {
+				return netlist.LoadFromReader(netlist.NewList(), bytes.NewReader(b))
+			},
+			OnUpdate: func() { reload() },
+			Logger:   bp.L(),
+		})
+		if err != nil {
+			_ = p.Close()
+			return nil, fmt.Errorf("failed to load remote #%d, %w", i, err)
+		}
+		p.remotes = append(p.remotes, r)
+	}
+	load := func() (*netlist.List, error) {
+		l := netlist.NewList()
+		if err := LoadFromIPsAndFiles(args.IPs, args.Files, l); err != nil {
+			return nil, err
+		}
+		if err := geodata.LoadGeoIPs(args.Geoips, l); err != nil {
+			return nil, err
+		}
+		for i, r := range p.remotes {
+			if err := netlist.LoadFromReader(l, bytes.NewReader(r.Data())); err != nil {
+				return nil, fmt.Errorf("failed to load remote #%d, %w", i, err)
+			}
+		}
+		l.Sort()
+		return l, nil
+	}
+
+	l, err := load()
+	if err != nil {
+		_ = p.Close()
+		return nil, err
+	}
+	geoFiles, err := geodata.Files(args.Geoips)
+	if err != nil {
+		_ = p.Close()
 		return nil, err
 	}
-	l.Sort()
-	if l.Len() > 0 {
+	files := append(append([]string(nil), args.Files...), geoFiles...)
+	wOpts := file_watcher.Opts{
+		Watch:        args.Watch,
+		PollInterval: time.Duration(args.PollInterval) * time.Second,
+		Logger:       bp.L(),
+	}
+	if (wOpts.Enabled() && len(files) > 0) || len(p.remotes) > 0 {
+		rl := new(reloadableList)
+		rl.p.Store(l)
+		p.mg = append(p.mg, rl)
+		reload = func() {
+			p.reloadMu.Lock()
+			defer p.reloadMu.Unlock()
+			l, err := load()
+			if err != nil {
+				bp.L().Error("failed to reload files, keep using the last list", zap.Error(err))
+				return
+			}
+			rl.p.Store(l)
+			bp.L().Info("files reloaded", zap.Int("length", l.Len()))
+		}
+		w, err := file_watcher.New(files, reload, wOpts)
+		if err != nil {
+			_ = p.Close()
+			return nil, fmt.Errorf("failed to watch files, %w", err)
+		}
+		p.w = w
+		for _, r := range p.remotes {
+			r.Start()
+		}
+	} else if l.Len() > 0 {
 		p.mg = append(p.mg, l)
 	}
+	for i, f := range args.Compiled {
+		c, err := compiled.OpenIPSet(f)
+		if err != nil {
+			_ = p.Close()
+			return nil, fmt.Errorf("failed to open compiled file #%d, %w", i, err)
+		}
+		p.compiled = append(p.compiled, c)
+		p.mg = append(p.mg, c)
+	}
+
 	for _, tag := range args.Sets {
 		provider, _ := bp.M().GetPlugin(tag).(data_provider.IPMatcherProvider)
 		if provider == nil {
+			_ = p.Close()
 			return nil, fmt.Errorf("%s is not an IPMatcherProvider", tag)
 		}
 		p.mg = append(p.mg, provider.GetIPMatcher())
@@ -141,3 +269,12 @@ func (mg MatcherGroup) Match(addr netip.Addr) bool {
 	}
 	return false
 }
+
+// reloadableList is an ip matcher that can be replaced atomically.
+type reloadableList struct {
+	p atomic.Pointer[netlist.List]
+}
+
+func (l *reloadableList) Match(addr netip.Addr) bool {
+	return l.p.Load().Match(addr)
+}
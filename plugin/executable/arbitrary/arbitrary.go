@@ -24,11 +24,15 @@ import (
 	"context"
 	"fmt"
 	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/file_watcher"
 	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
 	"github.com/IrineSistiana/mosdns/v5/pkg/zone_file"
 	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"go.uber.org/zap"
 	"os"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 const PluginType = "arbitrary"
@@ -40,15 +44,60 @@ func init() {
 type Args struct {
 	Rules []string `yaml:"rules"`
 	Files []string `yaml:"files"`
+
+	// Watch reloads files when they are changed. PollInterval (in seconds)
+	// checks files periodically instead. Both are disabled by default.
+	// If the files cannot be loaded, the last records are kept.
+	Watch        bool `yaml:"watch"`
+	PollInterval int  `yaml:"poll_interval"`
 }
 
 var _ sequence.Executable = (*Arbitrary)(nil)
 
 type Arbitrary struct {
-	m *zone_file.Matcher
+	m atomic.Pointer[zone_file.Matcher]
+	w *file_watcher.Watcher
 }
 
 func NewArbitrary(args *Args) (*Arbitrary, error) {
+	m, err := loadRules(args)
+	if err != nil {
+		return nil, err
+	}
+	a := new(Arbitrary)
+	a.m.Store(m)
+	return a, nil
+}
+
+// watch starts a file watcher if it is enabled by args.
+func (a *Arbitrary) watch(args *Args, logger *zap.Logger) error {
+	reload := func() {
+		m, err := loadRules(args)
+		if err != nil {
+			logger.Error("failed to reload files, keep using the last records", zap.Error(err))
+			return
+		}
+		a.m.Store(m)
+		logger.Info("files reloaded")
+	}
+	opts := file_watcher.Opts{
+		Watch:        args.Watch,
+		PollInterval: time.Duration(args.PollInterval) * time.Second,
+		Logger:       logger,
+	}
+	w, err := file_watcher.New(args.Files, reload, opts)
+	if err != nil {
+		return fmt.Errorf("failed to watch files, %w", err)
+	}
+	a.w = w
+	return nil
+}
+
+func (a *Arbitrary) Close() error {
+	return a.w.Close()
+}
+
+func loadRules(args *Args) (*zone_file.Matcher, error) {
 	m := new(zone_file.Matcher)
 	for i, s := range args.Rules {
 		if err := m.Load(strings.NewReader(s)); err != nil {
@@ -64,19 +113,24 @@ func NewArbitrary(args *Args) (*Arbitrary, error) {
 			return nil, fmt.Errorf("failed to load rr file #%d [%s], %w", i, file, err)
 		}
 	}
-	return &Arbitrary{
-		m: m,
-	}, nil
+	return m, nil
 }
 
 func (a *Arbitrary) Exec(_ context.Context, qCtx *query_context.Context) error {
-	if r := a.m.Reply(qCtx.Q()); r != nil {
+	if r := a.m.Load().Reply(qCtx.Q()); r != nil {
 		qCtx.SetResponse(r)
 	}
 	return nil
 }
 
-func Init(_ *coremain.BP, v any) (any, error) {
+func Init(bp *coremain.BP, v any) (any, error) {
 	args := v.(*Args)
-	return NewArbitrary(args)
+	a, err := NewArbitrary(args)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.watch(args, bp.L()); err != nil {
+		return nil, err
+	}
+	return a, nil
 }
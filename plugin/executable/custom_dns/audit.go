@@ -0,0 +1,137 @@
+package custom_dns
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// actor 是修改记录的身份，会被记录到审计日志中。
+type actor struct {
+	Name       string
+	RemoteAddr string
+}
+
+// writeAuditLog 在 tx 中记录一次修改。old 为 nil 时为创建，new 为 nil 时为删除。
+func writeAuditLog(tx *gorm.DB, a *actor, old, new *recordView) error {
+	entry := &AuditLog{Time: time.Now()}
+	if a != nil {
+		entry.Actor = a.Name
+		entry.RemoteAddr = a.RemoteAddr
+	}
+	switch {
+	case old == nil:
+		entry.Action = "create"
+	case new == nil:
+		entry.Action = "delete"
+	default:
+		entry.Action = "update"
+	}
+	for _, v := range []*recordView{old, new} {
+		if v != nil {
+			entry.Type, entry.Hostname = v.Type, v.Hostname
+		}
+	}
+	if old != nil {
+		b, _ := json.Marshal(old)
+		entry.OldValue = string(b)
+	}
+	if new != nil {
+		b, _ := json.Marshal(new)
+		entry.NewValue = string(b)
+	}
+	return tx.Create(entry).Error
+}
+
+// listAuditLogs 分页列出审计日志，最新的在前。
+// 参数 type、hostname、actor 为精确匹配，since 和 until 为 RFC 3339 格式的时间，page 和 page_size 与 /records 相同。
+func (cdns *CustomDns) listAuditLogs(w http.ResponseWriter, req *http.Request) {
+	type Entry struct {
+		ID         int
+		Time       time.Time
+		Actor      string
+		RemoteAddr string
+		Action     string
+		Type       string
+		Hostname   string
+		OldValue   *recordView
+		NewValue   *recordView
+	}
+	type Response struct {
+		Total    int64
+		Page     int
+		PageSize int
+		Entries  []Entry
+	}
+	vars := req.URL.Query()
+	page, err := parsePositiveInt(vars.Get("page"), 1)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte("invalid page"))
+		return
+	}
+	pageSize, err := parsePositiveInt(vars.Get("page_size"), defaultPageSize)
+	if err != nil || pageSize > maxPageSize {
+		w.WriteHeader(400)
+		w.Write([]byte("invalid page_size"))
+		return
+	}
+
+	q := cdns.db.Model(&AuditLog{})
+	for _, column := range []string{"type", "hostname", "actor"} {
+		if v := vars.Get(column); len(v) > 0 {
+			q = q.Where(column+" = ?", v)
+		}
+	}
+	for param, cond := range map[string]string{"since": "time >= ?", "until": "time < ?"} {
+		if v := vars.Get(param); len(v) > 0 {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				w.WriteHeader(400)
+				w.Write([]byte("invalid " + param))
+				return
+			}
+			q = q.Where(cond, t)
+		}
+	}
+
+	q = q.Session(&gorm.Session{}) // q 会被 Count 和 Find 复用
+	resp := &Response{Page: page, PageSize: pageSize, Entries: []Entry{}}
+	var logs []AuditLog
+	err = q.Count(&resp.Total).Error
+	if err == nil {
+		err = q.Order("id DESC").Offset((page - 1) * pageSize).Limit(pageSize).Find(&logs).Error
+	}
+	if err != nil {
+		cdns.logger.Error("db error", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	for _, l := range logs {
+		resp.Entries = append(resp.Entries, Entry{
+			ID:         l.ID,
+			Time:       l.Time,
+			Actor:      l.Actor,
+			RemoteAddr: l.RemoteAddr,
+			Action:     l.Action,
+			Type:       l.Type,
+			Hostname:   l.Hostname,
+			OldValue:   decodeView(l.OldValue),
+			NewValue:   decodeView(l.NewValue),
+		})
+	}
+	data, _ := json.Marshal(resp)
+	w.Write(data)
+}
+
+func decodeView(s string) *recordView {
+	if len(s) == 0 {
+		return nil
+	}
+	v := new(recordView)
+	_ = json.Unmarshal([]byte(s), v)
+	return v
+}
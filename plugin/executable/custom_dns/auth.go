@@ -0,0 +1,99 @@
+package custom_dns
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// AuthArgs 是管理 api 的认证设置。bearer_tokens 和 basic_users 都为空时不需要认证。
+type AuthArgs struct {
+	BearerTokens []TokenArgs `yaml:"bearer_tokens"`
+	BasicUsers   []UserArgs  `yaml:"basic_users"`
+}
+
+type TokenArgs struct {
+	Name  string `yaml:"name"` // 审计日志中记录的身份
+	Token string `yaml:"token"`
+}
+
+type UserArgs struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+func (a *AuthArgs) enabled() bool {
+	return len(a.BearerTokens) > 0 || len(a.BasicUsers) > 0
+}
+
+// validate 拒绝空的 token、用户名和密码，否则空凭据也能通过认证。
+func (a *AuthArgs) validate() error {
+	for i, t := range a.BearerTokens {
+		if len(t.Token) == 0 {
+			return fmt.Errorf("bearer token #%d has no token", i)
+		}
+	}
+	for i, u := range a.BasicUsers {
+		if len(u.Username) == 0 {
+			return fmt.Errorf("basic user #%d has no username", i)
+		}
+		if len(u.Password) == 0 {
+			return fmt.Errorf("basic user %s has no password", u.Username)
+		}
+	}
+	return nil
+}
+
+// authenticate 检查请求的认证信息，返回请求者的身份。认证失败时 ok 为 false。
+func (a *AuthArgs) authenticate(req *http.Request) (name string, ok bool) {
+	auth := req.Header.Get("Authorization")
+	if token, found := strings.CutPrefix(auth, "Bearer "); found {
+		for _, t := range a.BearerTokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(t.Token)) == 1 {
+				return "token:" + t.Name, true
+			}
+		}
+		return "", false
+	}
+	if username, password, found := req.BasicAuth(); found {
+		for _, u := range a.BasicUsers {
+			usernameOk := subtle.ConstantTimeCompare([]byte(username), []byte(u.Username)) == 1
+			passwordOk := subtle.ConstantTimeCompare([]byte(password), []byte(u.Password)) == 1
+			if usernameOk && passwordOk {
+				return "user:" + u.Username, true
+			}
+		}
+	}
+	return "", false
+}
+
+type actorKey struct{}
+
+// authMiddleware 认证所有 api 请求，并将请求者的身份保存在 request 的 context 中。
+// 没有设置认证时身份为 "anonymous"。
+func (cdns *CustomDns) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		name := "anonymous"
+		if cdns.auth.enabled() {
+			var ok bool
+			name, ok = cdns.auth.authenticate(req)
+			if !ok {
+				if len(cdns.auth.BasicUsers) > 0 {
+					w.Header().Set("WWW-Authenticate", `Basic realm="custom_dns"`)
+				}
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte("unauthorized"))
+				return
+			}
+		}
+		a := &actor{Name: name, RemoteAddr: req.RemoteAddr}
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), actorKey{}, a)))
+	})
+}
+
+func actorFromRequest(req *http.Request) *actor {
+	a, _ := req.Context().Value(actorKey{}).(*actor)
+	return a
+}
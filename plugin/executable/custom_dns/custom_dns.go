@@ -2,15 +2,23 @@ package custom_dns
 
 import (
 	"context"
-	"encoding/binary"
+	"database/sql"
 	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
 	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
 	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
 	"github.com/miekg/dns"
 	"go.uber.org/zap"
 	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 
@@ -20,9 +28,28 @@ import (
 const PluginType = "custom_dns"
 
 type Args struct {
-	// DatabaseType 暂时支持"mysql"和"sqlite"
+	// DatabaseType 支持"mysql"、"postgres"和"sqlite"
 	DatabaseType    string `yaml:"database_type"`
 	DatabaseAddress string `yaml:"database_address"`
+	// ReloadInterval 定期从数据库重新加载记录的间隔(秒)，用于多个 mosdns 节点共用同一个数据库的情况。
+	// 默认为 0，不定期加载。通过本节点的 api 修改记录时总是会立即重新加载。
+	ReloadInterval int `yaml:"reload_interval"`
+
+	// 连接池设置，默认为 0，使用 database/sql 的默认值。
+	MaxOpenConns    int `yaml:"max_open_conns"`
+	MaxIdleConns    int `yaml:"max_idle_conns"`
+	ConnMaxLifetime int `yaml:"conn_max_lifetime"`  // 秒
+	ConnMaxIdleTime int `yaml:"conn_max_idle_time"` // 秒
+
+	// Auth 管理 api 的认证设置，不设置时任何能访问 api 端口的人都可以修改记录。
+	Auth AuthArgs `yaml:"auth"`
+
+	// Views 根据客户端地址选择记录的视图，按顺序使用第一个匹配的视图，都不匹配时使用默认视图。
+	// 视图中没有某个域名的记录时使用默认视图中的记录。
+	Views []ViewArgs `yaml:"views"`
+
+	// Update 动态更新(RFC 2136)设置，不设置时不处理更新请求。
+	Update UpdateArgs `yaml:"update"`
 }
 
 func init() {
@@ -30,11 +57,13 @@ func init() {
 }
 
 var _ sequence.Executable = (*CustomDns)(nil)
+var _ io.Closer = (*CustomDns)(nil)
 
 func Init(bp *coremain.BP, args any) (any, error) {
 	cdns, err := NewCustomDns(args.(*Args), Opts{
 		Logger:     bp.L(),
 		MetricsTag: bp.Tag(),
+		BQ:         bp,
 	})
 	if err != nil {
 		return nil, err
@@ -46,30 +75,70 @@ func Init(bp *coremain.BP, args any) (any, error) {
 type Opts struct {
 	Logger     *zap.Logger
 	MetricsTag string
+	BQ         sequence.BQ // 用于查找视图引用的 ip_set 插件，可以为 nil
 }
 
 func NewCustomDns(args *Args, opts Opts) (*CustomDns, error) {
+	if err := args.Auth.validate(); err != nil {
+		return nil, fmt.Errorf("invalid auth args, %w", err)
+	}
 	cdns := &CustomDns{
-		logger: opts.Logger,
+		logger:      opts.Logger,
+		auth:        args.Auth,
+		closeNotify: make(chan struct{}),
 	}
 	var err error
+	cdns.views, err = newViews(opts.BQ, args.Views)
+	if err != nil {
+		return nil, err
+	}
+	cdns.updater, err = newUpdater(args.Update)
+	if err != nil {
+		return nil, err
+	}
 	switch args.DatabaseType {
 	case "sqlite":
 		cdns.db, err = gorm.Open(sqlite.Open(args.DatabaseAddress), &gorm.Config{})
 	case "mysql":
 		cdns.db, err = gorm.Open(mysql.Open(args.DatabaseAddress), &gorm.Config{})
+	case "postgres":
+		cdns.db, err = gorm.Open(postgres.Open(args.DatabaseAddress), &gorm.Config{})
 	default:
 		return nil, errors.New("unsupported database type")
 	}
 	if err != nil {
 		return nil, err
 	}
-	err = cdns.db.AutoMigrate(&RecordA{}, &RecordAAAA{},
-		&RecordTXT{}, &RecordTXTValue{},
-		&RecordAAAAValue{}, &RecordAValue{})
+	sqlDB, err := cdns.db.DB()
 	if err != nil {
 		return nil, err
 	}
+	if args.MaxOpenConns > 0 {
+		sqlDB.SetMaxOpenConns(args.MaxOpenConns)
+	}
+	if args.MaxIdleConns > 0 {
+		sqlDB.SetMaxIdleConns(args.MaxIdleConns)
+	}
+	if args.ConnMaxLifetime > 0 {
+		sqlDB.SetConnMaxLifetime(time.Duration(args.ConnMaxLifetime) * time.Second)
+	}
+	if args.ConnMaxIdleTime > 0 {
+		sqlDB.SetConnMaxIdleTime(time.Duration(args.ConnMaxIdleTime) * time.Second)
+	}
+	if err := migrate(cdns.db, cdns.logger); err != nil {
+		sqlDB.Close()
+		return nil, err
+	}
+	if err := cdns.reload(); err != nil {
+		sqlDB.Close()
+		return nil, fmt.Errorf("failed to load records, %w", err)
+	}
+	if !args.Auth.enabled() {
+		cdns.logger.Warn("custom_dns api authentication is not configured, anyone who can reach the api can modify records")
+	}
+	if args.ReloadInterval > 0 {
+		cdns.startReloadLoop(time.Duration(args.ReloadInterval) * time.Second)
+	}
 	return cdns, nil
 
 }
@@ -77,144 +146,152 @@ func NewCustomDns(args *Args, opts Opts) (*CustomDns, error) {
 type CustomDns struct {
 	db     *gorm.DB
 	logger *zap.Logger
+	auth   AuthArgs
+	views  []view
+
+	updater  *updater // 为 nil 时不处理更新请求
+	updateMu sync.Mutex
+
+	reloadMu    sync.Mutex
+	snapshot    atomic.Pointer[snapshot] // Exec 只从 snapshot 中查询记录，不会访问数据库
+	closeOnce   sync.Once
+	closeNotify chan struct{}
 }
 
-func (cdns *CustomDns) Exec(_ context.Context, qCtx *query_context.Context) error {
+func (cdns *CustomDns) Close() error {
+	var err error
+	cdns.closeOnce.Do(func() {
+		close(cdns.closeNotify)
+		// 热重载时会重新创建插件，必须关闭旧的连接池
+		var sqlDB *sql.DB
+		if sqlDB, err = cdns.db.DB(); err == nil {
+			err = sqlDB.Close()
+		}
+	})
+	return err
+}
+
+// maxCNAMEChain 是在插件内追踪 CNAME 的最大次数
+const maxCNAMEChain = 8
+
+func (cdns *CustomDns) Exec(ctx context.Context, qCtx *query_context.Context) error {
 	m := qCtx.Q()
 	if len(m.Question) != 1 {
 		return nil
 	}
+	if m.Opcode == dns.OpcodeUpdate {
+		if cdns.updater == nil {
+			return nil
+		}
+		return cdns.execUpdate(qCtx)
+	}
 	q := m.Question[0]
 	typ := q.Qtype
 	fqdn := q.Name
-	// 只实现 A AAAA TXT PTR
-	if typ != dns.TypeA && typ != dns.TypeAAAA && typ != dns.TypePTR && typ != dns.TypeTXT {
+	if !isSupportedType(typ) {
 		return nil
 	}
 	r := new(dns.Msg)
 	r.SetReply(m)
-	switch typ {
-	case dns.TypeTXT:
-		hostname := domain.NormalizeDomain(fqdn)
-		record := cdns.queryRecordTXT(hostname) //精准匹配
-		if record == nil {                      // *. 匹配
-			if subDomain := GetSubDomain(hostname); subDomain != "" {
-				record = cdns.queryRecordTXT("*." + subDomain)
-			}
+	// 先查找客户端所在视图的记录，再查找默认视图的记录
+	vrs := cdns.snapshot.Load().lookup(cdns.selectView(ctx, qCtx))
+	if typ == dns.TypePTR {
+		addr, _ := dnsutils.ParsePTRQName(fqdn)
+		// 无法解析的 PTR 域名直接忽略，交给后续插件处理
+		if !addr.IsValid() {
+			return nil
 		}
-		if record == nil { // domain: 匹配
-			ds := NewDomainScanner(hostname)
-			for {
-				label := ds.NextLabel()
-				record = cdns.queryRecordTXT("domain:" + label)
-				if record != nil {
-					break
-				}
-				if !ds.Scan() {
-					break
-				}
+		for _, vr := range vrs {
+			if rrs, ok := vr.resolvePTR(fqdn, addr.Unmap()); ok {
+				r.Answer = rrs
+				qCtx.SetResponse(r)
+				return nil
 			}
 		}
-		var txtValue []string
+		return nil
+	}
 
-		if record != nil {
-			for i := 0; i < len(record.Value); i++ {
-				txtValue = append(txtValue, record.Value[i].TXT)
-			}
-			shuffle(txtValue)
-			rr := &dns.TXT{
-				Hdr: dns.RR_Header{
-					Name:   fqdn,
-					Rrtype: dns.TypeTXT,
-					Class:  dns.ClassINET,
-					Ttl:    uint32(record.TTL),
-				},
-				Txt: txtValue,
+	// 查到 CNAME 时在插件内继续查询目标域名，直到查到记录或者目标域名不在数据库中。
+	// 如果目标域名不在数据库中，只返回 CNAME 记录。
+	name := fqdn
+	visited := make(map[string]struct{})
+	for i := 0; i <= maxCNAMEChain; i++ {
+		visited[name] = struct{}{}
+		var rrs []dns.RR
+		var target string
+		var found bool
+		for _, vr := range vrs {
+			if rrs, target, found = vr.resolve(name, typ); found {
+				break
 			}
-			r.Answer = append(r.Answer, rr)
-			qCtx.SetResponse(r)
 		}
-	case dns.TypeAAAA:
-		hostname := domain.NormalizeDomain(fqdn)
-		record := cdns.queryRecordAAAA(hostname) //精准匹配
-		if record == nil {                       // *. 匹配
-			if subDomain := GetSubDomain(hostname); subDomain != "" {
-				record = cdns.queryRecordAAAA("*." + subDomain)
+		if !found {
+			if i == 0 {
+				return nil
 			}
+			break
 		}
-		if record == nil { // domain: 匹配
-			ds := NewDomainScanner(hostname)
-			for {
-				label := ds.NextLabel()
-				record = cdns.queryRecordAAAA("domain:" + label)
-				if record != nil {
-					break
-				}
-				if !ds.Scan() {
-					break
-				}
-			}
+		r.Answer = append(r.Answer, rrs...)
+		if len(target) == 0 {
+			break
 		}
-		if record != nil {
-			for i := 0; i < len(record.Value); i++ {
-				buf := make([]byte, 16)
-				binary.BigEndian.PutUint64(buf[8:], uint64(record.Value[i].IPAddrLo))
-				binary.BigEndian.PutUint64(buf[:8], uint64(record.Value[i].IPAddrHi))
-				rr := &dns.AAAA{
-					Hdr: dns.RR_Header{
-						Name:   fqdn,
-						Rrtype: dns.TypeAAAA,
-						Class:  dns.ClassINET,
-						Ttl:    uint32(record.TTL),
-					},
-					AAAA: buf,
-				}
-				r.Answer = append(r.Answer, rr)
-			}
-			shuffle(r.Answer)
-			qCtx.SetResponse(r)
+		if _, ok := visited[target]; ok { // CNAME 循环
+			break
 		}
+		name = target
+	}
+	qCtx.SetResponse(r)
+	return nil
+}
 
-	case dns.TypeA:
-		hostname := domain.NormalizeDomain(fqdn)
-		record := cdns.queryRecordA(hostname) //精准匹配
-		if record == nil {                    // *. 匹配
-			if subDomain := GetSubDomain(hostname); subDomain != "" {
-				record = cdns.queryRecordA("*." + subDomain)
-			}
-		}
-		if record == nil { // domain: 匹配
-			ds := NewDomainScanner(hostname)
-			for {
-				label := ds.NextLabel()
-				record = cdns.queryRecordA("domain:" + label)
-				if record != nil {
-					break
-				}
-				if !ds.Scan() {
-					break
-				}
-			}
+func isSupportedType(typ uint16) bool {
+	switch typ {
+	case dns.TypeA, dns.TypeAAAA, dns.TypeTXT, dns.TypePTR,
+		dns.TypeCNAME, dns.TypeMX, dns.TypeSRV, dns.TypeCAA, dns.TypeNS:
+		return true
+	default:
+		return false
+	}
+}
+
+// resolve 按照 精准匹配 > *. 匹配 > domain: 匹配 的顺序查找 name 的 typ 类型记录。
+// 同一匹配方式下 typ 类型的记录优先于 CNAME 记录。查到 CNAME 记录时 target 为别名的目标域名。
+func (s *viewRecords) resolve(name string, typ uint16) (rrs []dns.RR, target string, found bool) {
+	s.match(domain.NormalizeDomain(name), func(nr nameRecords) bool {
+		if set, ok := nr[typ]; ok {
+			rrs, found = set.answer(name), true
+			return true
 		}
-		if record != nil {
-			for i := 0; i < len(record.Value); i++ {
-				buf := make([]byte, 4)
-				binary.BigEndian.PutUint32(buf, record.Value[i].IPAddr)
-				rr := &dns.A{
-					Hdr: dns.RR_Header{
-						Name:   fqdn,
-						Rrtype: dns.TypeA,
-						Class:  dns.ClassINET,
-						Ttl:    uint32(record.TTL),
-					},
-					A: buf,
-				}
-				r.Answer = append(r.Answer, rr)
-			}
-			shuffle(r.Answer)
-			qCtx.SetResponse(r)
+		if set, ok := nr[dns.TypeCNAME]; ok && typ != dns.TypeCNAME {
+			rrs, found = set.answer(name), true
+			target = rrs[0].(*dns.CNAME).Target
+			return true
 		}
+		return false
+	})
+	return rrs, target, found
+}
 
+// resolvePTR 查找 addr 的 PTR 记录，手动设置的 PTR 记录优先于根据 A/AAAA 记录反查的结果。
+func (s *viewRecords) resolvePTR(fqdn string, addr netip.Addr) (rrs []dns.RR, found bool) {
+	if set, ok := s.ptr[addr]; ok {
+		return set.answer(fqdn), true
 	}
-	return nil
+	reverses := s.reverse[addr]
+	if len(reverses) == 0 {
+		return nil, false
+	}
+	ttl := reverses[0].ttl
+	for _, rev := range reverses {
+		if rev.ttl < ttl {
+			ttl = rev.ttl
+		}
+	}
+	for _, rev := range reverses {
+		rrs = append(rrs, &dns.PTR{
+			Hdr: newHdr(fqdn, dns.TypePTR, ttl),
+			Ptr: dns.Fqdn(rev.hostname),
+		})
+	}
+	return rrs, true
 }
@@ -1,22 +1,42 @@
 package custom_dns
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 
+	"github.com/IrineSistiana/mosdns/v5/pkg/zone_file"
 	"github.com/go-chi/chi/v5"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
 )
 
 func (cdns *CustomDns) Api() *chi.Mux {
 	r := chi.NewRouter()
+	r.Use(cdns.authMiddleware)
 	r.Get("/list", func(w http.ResponseWriter, req *http.Request) {
 		// 列出有记录的域名
+		type PTR struct {
+			Address string
+			TTL     uint
+		}
 		type Response struct {
-			RecordA    []RecordA
-			RecordAAAA []RecordAAAA
-			RecordTXT  []RecordTXT
+			RecordA     []RecordA
+			RecordAAAA  []RecordAAAA
+			RecordTXT   []RecordTXT
+			RecordPTR   []PTR
+			RecordCNAME []RecordCNAME
+			RecordMX    []RecordMX
+			RecordSRV   []RecordSRV
+			RecordCAA   []RecordCAA
+			RecordNS    []RecordNS
 		}
 		resp := &Response{}
 		result := cdns.db.Find(&resp.RecordA)
@@ -37,6 +57,27 @@ func (cdns *CustomDns) Api() *chi.Mux {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
+		for _, records := range []any{&resp.RecordCNAME, &resp.RecordMX, &resp.RecordSRV, &resp.RecordCAA, &resp.RecordNS} {
+			result = cdns.db.Find(records)
+			if result.Error != nil {
+				cdns.logger.Error("db error:" + result.Error.Error())
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+		var recordPTR []RecordPTR
+		result = cdns.db.Find(&recordPTR)
+		if result.Error != nil {
+			cdns.logger.Error("db error:" + result.Error.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		for _, record := range recordPTR {
+			resp.RecordPTR = append(resp.RecordPTR, PTR{
+				Address: IntIPv6toAddr(record.IPAddrHi, record.IPAddrLo).Unmap().String(),
+				TTL:     record.TTL,
+			})
+		}
 		data, _ := json.Marshal(resp)
 		w.Write(data)
 	})
@@ -46,6 +87,12 @@ func (cdns *CustomDns) Api() *chi.Mux {
 			RecordA    []string
 			RecordAAAA []string
 			TXT        []string
+			PTR        []string `json:",omitempty"`
+			CNAME      []string
+			MX         []string
+			SRV        []string
+			CAA        []string
+			NS         []string
 		}
 		vars := req.URL.Query()
 		hostname, ok2 := vars["hostname"]
@@ -54,8 +101,9 @@ func (cdns *CustomDns) Api() *chi.Mux {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
+		view := vars.Get("view")
 		response := &Response{}
-		recordA := cdns.queryRecordA(hostname[0])
+		recordA := cdns.queryRecordA(hostname[0], view)
 		if recordA != nil {
 			for i := 0; i < len(recordA.Value); i++ {
 				response.RecordA = append(response.RecordA, IntIPv4toString(recordA.Value[i].IPAddr))
@@ -64,7 +112,7 @@ func (cdns *CustomDns) Api() *chi.Mux {
 				response.RecordA = []string{}
 			}
 		}
-		recordAAAA := cdns.queryRecordAAAA(hostname[0])
+		recordAAAA := cdns.queryRecordAAAA(hostname[0], view)
 		if recordAAAA != nil {
 			for i := 0; i < len(recordAAAA.Value); i++ {
 				response.RecordAAAA = append(response.RecordAAAA,
@@ -74,7 +122,7 @@ func (cdns *CustomDns) Api() *chi.Mux {
 				response.RecordAAAA = []string{}
 			}
 		}
-		recordTXT := cdns.queryRecordTXT(hostname[0])
+		recordTXT := cdns.queryRecordTXT(hostname[0], view)
 		if recordTXT != nil {
 			for i := 0; i < len(recordTXT.Value); i++ {
 				response.TXT = append(response.TXT,
@@ -84,260 +132,461 @@ func (cdns *CustomDns) Api() *chi.Mux {
 				response.TXT = []string{}
 			}
 		}
+		for typ, values := range map[uint16]*[]string{
+			dns.TypeCNAME: &response.CNAME,
+			dns.TypeMX:    &response.MX,
+			dns.TypeSRV:   &response.SRV,
+			dns.TypeCAA:   &response.CAA,
+			dns.TypeNS:    &response.NS,
+		} {
+			rrs, found := cdns.queryRRs(hostname[0], view, ".", typ)
+			if !found {
+				continue
+			}
+			*values = []string{}
+			for _, rr := range rrs {
+				*values = append(*values, formatRRValue(rr))
+			}
+		}
+		if addr, err := parsePTRAddr(hostname[0]); err == nil {
+			if recordPTR := cdns.queryRecordPTR(addr, view); recordPTR != nil {
+				response.PTR = []string{}
+				for i := 0; i < len(recordPTR.Value); i++ {
+					response.PTR = append(response.PTR, recordPTR.Value[i].PTR)
+				}
+			}
+		}
 		data, _ := json.Marshal(response)
 		w.Write(data)
 	})
 	r.Post("/set", func(w http.ResponseWriter, r *http.Request) {
 		// 设置域名
+		request := recordView{}
+		requestBody, _ := io.ReadAll(r.Body)
+
+		if err := json.Unmarshal(requestBody, &request); err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte("json format error"))
+			return
+		}
+		// 存在则更新，不存在则创建
+		var created bool
+		err := cdns.checkView(request.View)
+		if err == nil {
+			err = cdns.db.Transaction(func(tx *gorm.DB) error {
+				var err error
+				created, err = upsertRecord(tx, request, actorFromRequest(r))
+				return err
+			})
+		}
+		if err != nil {
+			cdns.writeError(w, err)
+			return
+		}
+		cdns.reloadAfterUpdate()
+		if created {
+			w.Write([]byte("create hostname success"))
+		} else {
+			w.Write([]byte("update hostname success"))
+		}
+	})
+	r.Post("/delete", func(w http.ResponseWriter, r *http.Request) {
 		type Request struct {
 			Hostname string
-			Type     string //a aaaa txt ptr
-			Value    []string
-			TTL      uint
+			View     string
+			Type     string //a aaaa txt ptr cname mx srv caa ns
 		}
 		request := &Request{}
 		requestBody, _ := io.ReadAll(r.Body)
-
 		if err := json.Unmarshal(requestBody, &request); err != nil {
 			w.WriteHeader(400)
 			w.Write([]byte("json format error"))
 			return
 		}
+		cdns.deleteRecord(w, r, request.Type, request.Hostname, request.View)
+	})
+	r.Delete("/records/{type}/{hostname}", func(w http.ResponseWriter, r *http.Request) {
+		cdns.deleteRecord(w, r, chi.URLParam(r, "type"), chi.URLParam(r, "hostname"), r.URL.Query().Get("view"))
+	})
+	r.Get("/records", cdns.listRecords)
+	r.Get("/export", cdns.exportRecords)
+	r.Post("/import", cdns.importRecords)
+	r.Get("/audit", cdns.listAuditLogs)
+	return r
+}
+
+// writeError 根据 err 的类型返回 400 或者 500。
+func (cdns *CustomDns) writeError(w http.ResponseWriter, err error) {
+	var badRequest *badRequestError
+	if errors.As(err, &badRequest) {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	cdns.logger.Error("update database error", zap.Error(err))
+	w.WriteHeader(500)
+	w.Write([]byte("update database error"))
+}
+
+func (cdns *CustomDns) deleteRecord(w http.ResponseWriter, req *http.Request, typ string, hostname string, view string) {
+	if _, _, ok := newModel(typ); !ok {
+		w.WriteHeader(400)
+		w.Write([]byte("unsupported hostname type"))
+		return
+	}
+	var found bool
+	err := cdns.db.Transaction(func(tx *gorm.DB) error {
 		var err error
-		if strings.Index(request.Hostname, "domain:") == 0 {
-			err = CheckFqdn(request.Hostname[7:])
-		} else if strings.Index(request.Hostname, "*.") == 0 {
-			err = CheckFqdn(request.Hostname[3:])
-		} else {
-			err = CheckFqdn(request.Hostname)
+		found, err = removeRecord(tx, typ, hostname, view, actorFromRequest(req))
+		return err
+	})
+	if err != nil {
+		cdns.writeError(w, err)
+		return
+	}
+	if !found {
+		w.WriteHeader(404)
+		w.Write([]byte("hostname not found"))
+		return
+	}
+	cdns.reloadAfterUpdate()
+	w.Write([]byte("delete hostname success"))
+}
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// listRecords 分页列出记录及其值。
+// 参数 type 只列出该类型的记录，hostname 只列出规则中包含该字符串的记录(PTR 记录为 ip 地址的精确匹配)，
+// view 只列出该视图中的记录(view 为空时为默认视图)。
+// page 从 1 开始，page_size 默认为 100，最大为 1000。
+func (cdns *CustomDns) listRecords(w http.ResponseWriter, req *http.Request) {
+	type Response struct {
+		Total    int64
+		Page     int
+		PageSize int
+		Records  []recordView
+	}
+	vars := req.URL.Query()
+	types := recordTypes
+	if typ := vars.Get("type"); len(typ) > 0 {
+		if _, _, ok := newModel(typ); !ok {
+			w.WriteHeader(400)
+			w.Write([]byte("unsupported hostname type"))
+			return
+		}
+		types = []string{typ}
+	}
+	page, err := parsePositiveInt(vars.Get("page"), 1)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte("invalid page"))
+		return
+	}
+	pageSize, err := parsePositiveInt(vars.Get("page_size"), defaultPageSize)
+	if err != nil || pageSize > maxPageSize {
+		w.WriteHeader(400)
+		w.Write([]byte("invalid page_size"))
+		return
+	}
+
+	resp := &Response{Page: page, PageSize: pageSize, Records: []recordView{}}
+	offset := int64((page - 1) * pageSize)
+	err = cdns.db.Transaction(func(tx *gorm.DB) error {
+		// 各类型的记录依次排列，跳过 offset 之前的类型后从各个表中取出剩余的记录。
+		for _, typ := range types {
+			q, ok := filterRecords(tx, typ, vars)
+			if !ok {
+				continue
+			}
+			record, _, _ := newModel(typ)
+			var count int64
+			if err := q.Model(record).Count(&count).Error; err != nil {
+				return err
+			}
+			resp.Total += count
+			remain := pageSize - len(resp.Records)
+			if remain == 0 || offset >= count {
+				offset -= min(offset, count)
+				continue
+			}
+			q, _ = filterRecords(tx, typ, vars)
+			models, err := findRecordsByType(q.Offset(int(offset)).Limit(remain), typ)
+			if err != nil {
+				return err
+			}
+			offset = 0
+			for _, m := range models {
+				resp.Records = append(resp.Records, m.view())
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		cdns.logger.Error("db error", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	data, _ := json.Marshal(resp)
+	w.Write(data)
+}
+
+// filterRecords 为 tx 添加 listRecords 中 hostname 和 view 参数的条件。ok 为 false 时代表该类型不可能有满足条件的记录。
+func filterRecords(tx *gorm.DB, typ string, vars url.Values) (q *gorm.DB, ok bool) {
+	if vars.Has("view") {
+		tx = tx.Where("view_name = ?", vars.Get("view"))
+	}
+	filter := vars.Get("hostname")
+	if len(filter) == 0 {
+		return tx, true
+	}
+	if typ == "ptr" {
+		addr, err := parsePTRAddr(filter)
+		if err != nil {
+			return tx, false
+		}
+		hi, lo := AddrToInt(addr)
+		return tx.Where("ip_addr_hi = ? AND ip_addr_lo = ?", hi, lo), true
+	}
+	return tx.Where("hostname LIKE ? ESCAPE '!'", "%"+escapeLike(filter)+"%"), true
+}
+
+// escapeLike 转义 LIKE 中的通配符。转义字符为 "!"，因为不同数据库对反斜杠的处理不同。
+func escapeLike(s string) string {
+	return strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(s)
+}
+
+func parsePositiveInt(s string, def int) (int, error) {
+	if len(s) == 0 {
+		return def, nil
+	}
+	i, err := strconv.Atoi(s)
+	if err != nil || i <= 0 {
+		return 0, errors.New("invalid number")
+	}
+	return i, nil
+}
+
+// exportRecords 导出所有记录。参数 format 为 json(默认) 或者 zone。
+// zone 文件格式无法表示 domain: 规则，这些记录会以注释的形式导出，导入时会被忽略。
+// 参数 view 只导出该视图中的记录。zone 文件格式无法表示视图，不设置 view 时只导出默认视图。
+func (cdns *CustomDns) exportRecords(w http.ResponseWriter, req *http.Request) {
+	vars := req.URL.Query()
+	format := vars.Get("format")
+	if len(format) == 0 {
+		format = "json"
+	}
+	if format != "json" && format != "zone" {
+		w.WriteHeader(400)
+		w.Write([]byte("unsupported format"))
+		return
+	}
+
+	var models []recordModel
+	err := cdns.db.Transaction(func(tx *gorm.DB) error {
+		q := tx
+		if format == "zone" || vars.Has("view") {
+			q = tx.Where("view_name = ?", vars.Get("view"))
+		}
+		for _, typ := range recordTypes {
+			m, err := findRecordsByType(q.Session(&gorm.Session{}), typ)
+			if err != nil {
+				return err
+			}
+			models = append(models, m...)
+		}
+		return nil
+	})
+	if err != nil {
+		cdns.logger.Error("db error", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if format == "json" {
+		views := make([]recordView, 0, len(models))
+		for _, m := range models {
+			views = append(views, m.view())
+		}
+		data, _ := json.Marshal(views)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+		return
+	}
+
+	b := new(bytes.Buffer)
+	for _, m := range models {
+		v := m.view()
+		var owner string
+		switch {
+		case v.Type == "ptr":
+			owner, _ = dns.ReverseAddr(v.Hostname)
+		case strings.HasPrefix(v.Hostname, "domain:"):
+			for _, rr := range m.rrs(dns.Fqdn(v.Hostname[7:])) {
+				b.WriteString("; domain:" + rr.String() + "\n")
+			}
+			continue
+		default:
+			owner = dns.Fqdn(v.Hostname)
+		}
+		for _, rr := range m.rrs(owner) {
+			b.WriteString(rr.String() + "\n")
+		}
+	}
+	w.Header().Set("Content-Type", "text/dns")
+	w.Write(b.Bytes())
+}
+
+// importRecords 在一个事务中导入记录，任何一条记录出错时都不会修改数据库。
+// 参数 format 为 json(默认) 或者 zone，json 格式为 recordView 的数组。
+// 参数 mode 为 merge(默认) 或者 replace。merge 只替换同视图同类型同规则的记录，replace 会先删除所有记录。
+// 参数 view 为 zone 文件中的记录所属的视图，json 格式的记录使用各自的 View。
+// 设置了 view 参数时，replace 只删除该视图中的记录。
+// zone 文件中同一个域名同一类型的所有 rr 会被合并为一条记录，ttl 为第一个 rr 的 ttl。
+// zone 文件中不支持的类型会被跳过，并在响应中列出(SOA 除外)。
+func (cdns *CustomDns) importRecords(w http.ResponseWriter, req *http.Request) {
+	vars := req.URL.Query()
+	format := vars.Get("format")
+	if len(format) == 0 {
+		format = "json"
+	}
+	mode := vars.Get("mode")
+	if len(mode) == 0 {
+		mode = "merge"
+	}
+	if mode != "merge" && mode != "replace" {
+		w.WriteHeader(400)
+		w.Write([]byte("unsupported mode"))
+		return
+	}
+
+	var views []recordView
+	var skipped []string
+	switch format {
+	case "json":
+		requestBody, _ := io.ReadAll(req.Body)
+		if err := json.Unmarshal(requestBody, &views); err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte("json format error"))
+			return
 		}
+	case "zone":
+		var err error
+		views, skipped, err = parseZoneRecords(req.Body)
 		if err != nil {
 			w.WriteHeader(400)
 			w.Write([]byte(err.Error()))
 			return
 		}
+		for i := range views {
+			views[i].View = vars.Get("view")
+		}
+	default:
+		w.WriteHeader(400)
+		w.Write([]byte("unsupported format"))
+		return
+	}
 
-		switch request.Type {
-		case "txt":
-			for _, value := range request.Value {
-				if len(value) > 255 {
-					w.WriteHeader(400)
-					w.Write([]byte("txt value larger than 255 byte"))
-					return
-				}
-			}
-			// 存在则更新，不存在则创建
-			result := cdns.queryRecordTXT(request.Hostname)
-			if result != nil { // 存在
-				delResult := cdns.db.Where("record_refer = ?", result.ID).Delete(result.Value)
-				if delResult.Error != nil {
-					cdns.logger.Error("delete record failed: " + delResult.Error.Error())
-					w.WriteHeader(500)
-					w.Write([]byte("update database error"))
-					return
-				}
-				result.TTL = request.TTL
-				result.Value = nil
-				for i := 0; i < len(request.Value); i++ {
-					result.Value = append(result.Value, RecordTXTValue{
-						RecordRefer: result.ID,
-						TXT:         request.Value[i],
-					})
-				}
-				updateResult := cdns.db.Save(result)
-				if updateResult.Error != nil {
-					cdns.logger.Error("update record failed: " + updateResult.Error.Error())
-					w.WriteHeader(500)
-					w.Write([]byte("update database error"))
-					return
-				}
-				w.Write([]byte("update hostname success"))
-			} else {
-				record := &RecordTXT{
-					Hostname: request.Hostname,
-					TTL:      request.TTL,
-				}
-				for i := 0; i < len(request.Value); i++ {
-					record.Value = append(record.Value, RecordTXTValue{
-						TXT: request.Value[i],
-					})
-				}
-				updateResult := cdns.db.Save(record)
-				if updateResult.Error != nil {
-					cdns.logger.Error("insert record failed: " + updateResult.Error.Error())
-					w.WriteHeader(500)
-					w.Write([]byte("update database error"))
-					return
+	for i, v := range views {
+		if err := cdns.checkView(v.View); err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(fmt.Sprintf("record #%d %s %s: %s", i, v.Type, v.Hostname, err)))
+			return
+		}
+	}
+
+	a := actorFromRequest(req)
+	err := cdns.db.Transaction(func(tx *gorm.DB) error {
+		if mode == "replace" {
+			for _, typ := range recordTypes {
+				record, value, _ := newModel(typ)
+				// 只删除 view 视图中的记录时使用 view_name 条件，否则删除所有记录
+				cond, args := "1 = 1", []any(nil)
+				if vars.Has("view") {
+					cond, args = "view_name = ?", []any{vars.Get("view")}
 				}
-				w.Write([]byte("create hostname success"))
-			}
-		case "aaaa":
-			// 存在则更新，不存在则创建
-			result := cdns.queryRecordAAAA(request.Hostname)
-			if result != nil { // 存在
-				delResult := cdns.db.Where("record_refer = ?", result.ID).Delete(result.Value)
-				if delResult.Error != nil {
-					cdns.logger.Error("delete record failed: " + delResult.Error.Error())
-					w.WriteHeader(500)
-					w.Write([]byte("update database error"))
-					return
+				// 删除前读取所有记录，用于审计日志
+				models, err := findRecordsByType(tx.Where(cond, args...), typ)
+				if err != nil {
+					return err
 				}
-				result.TTL = request.TTL
-				result.Value = nil
-				for i := 0; i < len(request.Value); i++ {
-					ipaddrhi, ipaddrlo, err := StringIPv6toInt(request.Value[i])
-					if err != nil {
-						w.WriteHeader(400)
-						w.Write([]byte(err.Error()))
-						return
+				for _, m := range models {
+					old := m.view()
+					if err := writeAuditLog(tx, a, &old, nil); err != nil {
+						return err
 					}
-					result.Value = append(result.Value, RecordAAAAValue{
-						RecordRefer: result.ID,
-						IPAddrHi:    ipaddrhi,
-						IPAddrLo:    ipaddrlo,
-					})
-				}
-				updateResult := cdns.db.Save(result)
-				if updateResult.Error != nil {
-					cdns.logger.Error("update record failed: " + updateResult.Error.Error())
-					w.WriteHeader(500)
-					w.Write([]byte("update database error"))
-					return
 				}
-				w.Write([]byte("update hostname success"))
-			} else {
-				record := &RecordAAAA{
-					Hostname: request.Hostname,
-					TTL:      request.TTL,
-				}
-				for i := 0; i < len(request.Value); i++ {
-					ipaddrhi, ipaddrlo, err := StringIPv6toInt(request.Value[i])
-					if err != nil {
-						w.WriteHeader(400)
-						w.Write([]byte(err.Error()))
+				if value != nil {
+					ids := tx.Model(record).Select("id").Where(cond, args...)
+					if err := tx.Where("record_refer IN (?)", ids).Delete(value).Error; err != nil {
+						return err
 					}
-					record.Value = append(record.Value, RecordAAAAValue{
-						IPAddrHi: ipaddrhi,
-						IPAddrLo: ipaddrlo,
-					})
 				}
-				updateResult := cdns.db.Save(record)
-				if updateResult.Error != nil {
-					cdns.logger.Error("insert record failed: " + updateResult.Error.Error())
-					w.WriteHeader(500)
-					w.Write([]byte("update database error"))
-					return
+				if err := tx.Where(cond, args...).Delete(record).Error; err != nil {
+					return err
 				}
-				w.Write([]byte("create hostname success"))
 			}
-		case "a":
-			// 存在则更新，不存在则创建
-			result := cdns.queryRecordA(request.Hostname)
-			if result != nil { // 存在
-				delResult := cdns.db.Where("record_refer = ?", result.ID).Delete(result.Value)
-				if delResult.Error != nil {
-					cdns.logger.Error("delete record failed: " + delResult.Error.Error())
-					w.WriteHeader(500)
-					w.Write([]byte("update database error"))
-					return
-				}
-				result.TTL = request.TTL
-				result.Value = nil
-				for i := 0; i < len(request.Value); i++ {
-					ipaddr, err := StringIPv4ToInt(request.Value[i])
-					cdns.logger.Info("add a record: " + request.Value[i])
-					if err != nil {
-						w.WriteHeader(400)
-						w.Write([]byte(err.Error()))
-						return
-					}
-					result.Value = append(result.Value, RecordAValue{
-						RecordRefer: result.ID,
-						IPAddr:      ipaddr,
-					})
-				}
-				updateResult := cdns.db.Save(result)
-				if updateResult.Error != nil {
-					cdns.logger.Error("update record failed: " + updateResult.Error.Error())
-					w.WriteHeader(500)
-					w.Write([]byte("update database error"))
-					return
-				}
-				w.Write([]byte("update hostname success"))
-			} else {
-				record := &RecordA{
-					Hostname: request.Hostname,
-					TTL:      request.TTL,
-				}
-				for i := 0; i < len(request.Value); i++ {
-					ipaddr, err := StringIPv4ToInt(request.Value[i])
-					if err != nil {
-						w.WriteHeader(400)
-						w.Write([]byte(err.Error()))
-					}
-					record.Value = append(record.Value, RecordAValue{
-						IPAddr: ipaddr,
-					})
-				}
-				updateResult := cdns.db.Save(record)
-				if updateResult.Error != nil {
-					cdns.logger.Error("insert record failed: " + updateResult.Error.Error())
-					w.WriteHeader(500)
-					w.Write([]byte("update database error"))
-					return
+		}
+		for i, v := range views {
+			if _, err := upsertRecord(tx, v, a); err != nil {
+				var badRequest *badRequestError
+				if errors.As(err, &badRequest) {
+					return &badRequestError{err: fmt.Errorf("record #%d %s %s: %w", i, v.Type, v.Hostname, err)}
 				}
-				w.Write([]byte("create hostname success"))
+				return err
 			}
-		default:
-			w.WriteHeader(400)
-			w.Write([]byte("unsupported hostname type"))
-			return
 		}
-
+		return nil
 	})
-	r.Post("/delete", func(w http.ResponseWriter, r *http.Request) {
-		type Request struct {
-			Hostname string
-			Type     string //a aaaa txt ptr
-		}
-		request := &Request{}
-		requestBody := make([]byte, r.ContentLength)
-		r.Body.Read(requestBody)
-		if err := json.Unmarshal(requestBody, &request); err != nil {
-			w.WriteHeader(400)
-			w.Write([]byte("json format error"))
-			return
-		}
-		switch request.Type {
-		case "txt":
-			result := cdns.db.Where("hostname = ?", request.Hostname).Delete(&RecordTXT{})
-			if result.Error != nil {
-				w.WriteHeader(500)
-				w.Write([]byte("update database error"))
-				return
-			}
-			w.Write([]byte("delete hostname success"))
-		case "a":
-			result := cdns.db.Where("hostname = ?", request.Hostname).Delete(&RecordA{})
-			if result.Error != nil {
-				w.WriteHeader(500)
-				w.Write([]byte("update database error"))
-				return
+	if err != nil {
+		cdns.writeError(w, err)
+		return
+	}
+	cdns.reloadAfterUpdate()
+	msg := fmt.Sprintf("import %d records success", len(views))
+	if len(skipped) > 0 {
+		msg += fmt.Sprintf(", skipped %d unsupported records: %s", len(skipped), strings.Join(skipped, ", "))
+	}
+	w.Write([]byte(msg))
+}
+
+// parseZoneRecords 将 zone 文件中的 rr 转换为 recordView。
+// 不支持的类型会被跳过，skipped 为这些 rr 的域名和类型。SOA 总是存在于 zone 文件中，直接忽略。
+func parseZoneRecords(r io.Reader) (views []recordView, skipped []string, err error) {
+	index := make(map[dns.Question]int)
+	err = zone_file.ReadRRs(r, func(rr dns.RR) error {
+		h := rr.Header()
+		typ := strings.ToLower(dns.TypeToString[h.Rrtype])
+		if _, _, ok := newModel(typ); !ok {
+			if h.Rrtype != dns.TypeSOA {
+				skipped = append(skipped, h.Name+" "+dns.TypeToString[h.Rrtype])
 			}
-			w.Write([]byte("delete hostname success"))
-		case "aaaa":
-			result := cdns.db.Where("hostname = ?", request.Hostname).Delete(&RecordAAAA{})
-			if result.Error != nil {
-				w.WriteHeader(500)
-				w.Write([]byte("update database error"))
-				return
+			return nil
+		}
+		hostname := strings.TrimSuffix(strings.ToLower(h.Name), ".")
+		if typ == "ptr" {
+			addr, err := parsePTRAddr(hostname)
+			if err != nil {
+				return err
 			}
-			w.Write([]byte("delete hostname success"))
-		default:
-			w.WriteHeader(400)
-			w.Write([]byte("unsupported hostname type"))
-			return
+			hostname = addr.String()
 		}
+		var values []string
+		if txt, ok := rr.(*dns.TXT); ok {
+			values = txt.Txt
+		} else {
+			values = []string{formatRRValue(rr)}
+		}
+		q := dns.Question{Name: hostname, Qtype: h.Rrtype}
+		if i, ok := index[q]; ok {
+			views[i].Value = append(views[i].Value, values...)
+			return nil
+		}
+		index[q] = len(views)
+		views = append(views, recordView{Hostname: hostname, Type: typ, Value: values, TTL: uint(h.Ttl)})
+		return nil
 	})
-	return r
+	return views, skipped, err
 }
@@ -0,0 +1,726 @@
+package custom_dns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/server"
+	"github.com/IrineSistiana/mosdns/v5/pkg/server_handler"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func newTestCustomDns(t *testing.T) *CustomDns {
+	t.Helper()
+	cdns, err := NewCustomDns(&Args{
+		DatabaseType:    "sqlite",
+		DatabaseAddress: filepath.Join(t.TempDir(), "test.db"),
+	}, Opts{Logger: zap.NewNop()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cdns.Close() })
+	return cdns
+}
+
+func apiSet(t *testing.T, h http.Handler, hostname, typ string, ttl uint, value ...string) {
+	t.Helper()
+	b, _ := json.Marshal(map[string]any{
+		"Hostname": hostname,
+		"Type":     typ,
+		"Value":    value,
+		"TTL":      ttl,
+	})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/set", bytes.NewReader(b)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("set %s %s: %d %s", typ, hostname, w.Code, w.Body.String())
+	}
+}
+
+func exec(t *testing.T, cdns *CustomDns, name string, typ uint16) *dns.Msg {
+	t.Helper()
+	q := new(dns.Msg)
+	q.SetQuestion(name, typ)
+	qCtx := query_context.NewContext(q)
+	if err := cdns.Exec(context.Background(), qCtx); err != nil {
+		t.Fatal(err)
+	}
+	return qCtx.R()
+}
+
+func TestCustomDns_PTR(t *testing.T) {
+	cdns := newTestCustomDns(t)
+	api := cdns.Api()
+	apiSet(t, api, "host.example.com", "a", 100, "192.168.1.10")
+	apiSet(t, api, "*.example.com", "a", 100, "192.168.1.20")
+	apiSet(t, api, "host.example.com", "aaaa", 200, "2001:db8::10")
+	apiSet(t, api, "192.168.1.30", "ptr", 300, "override.example.com")
+
+	tests := []struct {
+		name    string
+		qname   string
+		wantPtr string
+		wantTTL uint32
+	}{
+		{"a", "10.1.168.192.in-addr.arpa.", "host.example.com.", 100},
+		{"aaaa", "0.1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.", "host.example.com.", 200},
+		{"override", "30.1.168.192.in-addr.arpa.", "override.example.com.", 300},
+		{"wildcard_ignored", "20.1.168.192.in-addr.arpa.", "", 0},
+		{"not_found", "40.1.168.192.in-addr.arpa.", "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := exec(t, cdns, tt.qname, dns.TypePTR)
+			if len(tt.wantPtr) == 0 {
+				if r != nil {
+					t.Fatalf("want no response, got %v", r)
+				}
+				return
+			}
+			if r == nil || len(r.Answer) != 1 {
+				t.Fatalf("want 1 answer, got %v", r)
+			}
+			ptr, ok := r.Answer[0].(*dns.PTR)
+			if !ok || ptr.Ptr != tt.wantPtr || ptr.Hdr.Ttl != tt.wantTTL {
+				t.Fatalf("want %s ttl %d, got %v", tt.wantPtr, tt.wantTTL, r.Answer[0])
+			}
+		})
+	}
+}
+
+func TestCustomDns_RecordTypes(t *testing.T) {
+	cdns := newTestCustomDns(t)
+	api := cdns.Api()
+	apiSet(t, api, "www.example.com", "a", 100, "192.168.1.10")
+	apiSet(t, api, "alias.example.com", "cname", 100, "www.example.com")
+	apiSet(t, api, "*.alias.example.com", "cname", 100, "alias.example.com")
+	apiSet(t, api, "external.example.com", "cname", 100, "www.example.org")
+	apiSet(t, api, "loop1.example.com", "cname", 100, "loop2.example.com")
+	apiSet(t, api, "loop2.example.com", "cname", 100, "loop1.example.com")
+	apiSet(t, api, "domain:example.com", "mx", 100, "10 mail.example.com", "20 mail2.example.com.")
+	apiSet(t, api, "_sip._udp.example.com", "srv", 100, "10 5 5060 sip.example.com")
+	apiSet(t, api, "example.com", "caa", 100, `0 issue "letsencrypt.org"`)
+	apiSet(t, api, "sub.example.com", "ns", 100, "ns1.example.com")
+
+	tests := []struct {
+		name  string
+		qname string
+		qtype uint16
+		want  []string
+	}{
+		{"cname_chase", "alias.example.com.", dns.TypeA, []string{
+			"alias.example.com.\t100\tIN\tCNAME\twww.example.com.",
+			"www.example.com.\t100\tIN\tA\t192.168.1.10",
+		}},
+		{"cname_chase_wildcard", "a.alias.example.com.", dns.TypeA, []string{
+			"a.alias.example.com.\t100\tIN\tCNAME\talias.example.com.",
+			"alias.example.com.\t100\tIN\tCNAME\twww.example.com.",
+			"www.example.com.\t100\tIN\tA\t192.168.1.10",
+		}},
+		{"cname_query", "alias.example.com.", dns.TypeCNAME, []string{
+			"alias.example.com.\t100\tIN\tCNAME\twww.example.com.",
+		}},
+		{"cname_external", "external.example.com.", dns.TypeAAAA, []string{
+			"external.example.com.\t100\tIN\tCNAME\twww.example.org.",
+		}},
+		{"cname_loop", "loop1.example.com.", dns.TypeA, []string{
+			"loop1.example.com.\t100\tIN\tCNAME\tloop2.example.com.",
+			"loop2.example.com.\t100\tIN\tCNAME\tloop1.example.com.",
+		}},
+		{"mx", "a.example.com.", dns.TypeMX, []string{
+			"a.example.com.\t100\tIN\tMX\t10 mail.example.com.",
+			"a.example.com.\t100\tIN\tMX\t20 mail2.example.com.",
+		}},
+		{"srv", "_sip._udp.example.com.", dns.TypeSRV, []string{
+			"_sip._udp.example.com.\t100\tIN\tSRV\t10 5 5060 sip.example.com.",
+		}},
+		{"caa", "example.com.", dns.TypeCAA, []string{
+			"example.com.\t100\tIN\tCAA\t0 issue \"letsencrypt.org\"",
+		}},
+		{"ns", "sub.example.com.", dns.TypeNS, []string{
+			"sub.example.com.\t100\tIN\tNS\tns1.example.com.",
+		}},
+		{"not_found", "www.example.org.", dns.TypeA, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := exec(t, cdns, tt.qname, tt.qtype)
+			if tt.want == nil {
+				if r != nil {
+					t.Fatalf("want no response, got %v", r)
+				}
+				return
+			}
+			if r == nil {
+				t.Fatal("want response, got nil")
+			}
+			var got []string
+			for _, rr := range r.Answer {
+				got = append(got, rr.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("want %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestCustomDns_Reload(t *testing.T) {
+	cdns := newTestCustomDns(t)
+
+	// 模拟其他节点直接修改数据库
+	if err := cdns.db.Save(&RecordA{
+		Hostname: "www.example.com",
+		TTL:      100,
+		Value:    []RecordAValue{{IPAddr: 0x7f000001}},
+	}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if r := exec(t, cdns, "www.example.com.", dns.TypeA); r != nil {
+		t.Fatalf("snapshot should not be updated before reload, got %v", r)
+	}
+	if err := cdns.reload(); err != nil {
+		t.Fatal(err)
+	}
+	r := exec(t, cdns, "www.example.com.", dns.TypeA)
+	if r == nil || len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "127.0.0.1" {
+		t.Fatalf("unexpected response %v", r)
+	}
+}
+
+func apiDo(t *testing.T, h http.Handler, method, target string, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return w
+}
+
+func TestCustomDns_Close(t *testing.T) {
+	cdns := newTestCustomDns(t)
+	sqlDB, err := cdns.db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cdns.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sqlDB.Ping(); err == nil {
+		t.Fatal("database is not closed")
+	}
+}
+
+func TestCustomDns_RecordsApi(t *testing.T) {
+	cdns := newTestCustomDns(t)
+	api := cdns.Api()
+	for i := 0; i < 5; i++ {
+		apiSet(t, api, fmt.Sprintf("host%d.example.com", i), "a", 100, fmt.Sprintf("192.168.1.%d", i))
+	}
+	apiSet(t, api, "host0.example.com", "txt", 100, "v=spf1 -all")
+	apiSet(t, api, "*.example.org", "aaaa", 100, "2001:db8::1")
+
+	type listResponse struct {
+		Total   int64
+		Records []recordView
+	}
+	list := func(query string) listResponse {
+		t.Helper()
+		w := apiDo(t, api, http.MethodGet, "/records?"+query, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("list %s: %d %s", query, w.Code, w.Body.String())
+		}
+		var resp listResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// 第二页跨越 a 和 aaaa 两个表
+	resp := list("page=2&page_size=4")
+	if resp.Total != 7 || len(resp.Records) != 3 {
+		t.Fatalf("unexpected page %+v", resp)
+	}
+	if v := resp.Records[0]; v.Hostname != "host4.example.com" || v.Type != "a" || v.Value[0] != "192.168.1.4" {
+		t.Fatalf("unexpected record %+v", v)
+	}
+	if v := resp.Records[1]; v.Type != "aaaa" || v.Value[0] != "2001:db8::1" {
+		t.Fatalf("unexpected record %+v", v)
+	}
+	if resp = list("type=a&hostname=host1"); resp.Total != 1 || resp.Records[0].Hostname != "host1.example.com" {
+		t.Fatalf("unexpected filter result %+v", resp)
+	}
+
+	if w := apiDo(t, api, http.MethodDelete, "/records/a/host1.example.com", ""); w.Code != http.StatusOK {
+		t.Fatalf("delete: %d %s", w.Code, w.Body.String())
+	}
+	if w := apiDo(t, api, http.MethodDelete, "/records/a/host1.example.com", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("delete again: want 404, got %d", w.Code)
+	}
+	if r := exec(t, cdns, "host1.example.com.", dns.TypeA); r != nil {
+		t.Fatalf("deleted record still answered: %v", r)
+	}
+	var values int64
+	cdns.db.Model(&RecordAValue{}).Count(&values)
+	if values != 4 {
+		t.Fatalf("values of deleted record should be deleted, got %d values", values)
+	}
+}
+
+func TestCustomDns_ImportExport(t *testing.T) {
+	cdns := newTestCustomDns(t)
+	api := cdns.Api()
+
+	zone := `
+$TTL 300
+example.com.         IN SOA   ns1.example.com. admin.example.com. 1 7200 3600 1209600 300
+www.example.com.     IN A     192.168.1.1
+www.example.com.     IN A     192.168.1.2
+*.example.com.       IN AAAA  2001:db8::1
+example.com.         IN MX    10 mail.example.com.
+example.com.  600    IN TXT   "a" "b"
+1.1.168.192.in-addr.arpa. IN PTR www.example.com.
+`
+	w := apiDo(t, api, http.MethodPost, "/import?format=zone", zone)
+	if w.Code != http.StatusOK {
+		t.Fatalf("import: %d %s", w.Code, w.Body.String())
+	}
+	if msg := w.Body.String(); msg != "import 5 records success" {
+		t.Fatalf("unexpected import response %s", msg)
+	}
+	r := exec(t, cdns, "www.example.com.", dns.TypeA)
+	if r == nil || len(r.Answer) != 2 || r.Answer[0].Header().Ttl != 300 {
+		t.Fatalf("unexpected response %v", r)
+	}
+	if r = exec(t, cdns, "1.1.168.192.in-addr.arpa.", dns.TypePTR); r == nil || r.Answer[0].(*dns.PTR).Ptr != "www.example.com." {
+		t.Fatalf("unexpected response %v", r)
+	}
+
+	// 导入出错时不应该修改数据库
+	bad := `[{"Hostname":"new.example.com","Type":"a","Value":["10.0.0.1"]},{"Hostname":"bad.example.com","Type":"a","Value":["x"]}]`
+	if w := apiDo(t, api, http.MethodPost, "/import?mode=replace", bad); w.Code != http.StatusBadRequest {
+		t.Fatalf("bad import: want 400, got %d %s", w.Code, w.Body.String())
+	}
+	if r := exec(t, cdns, "www.example.com.", dns.TypeA); r == nil {
+		t.Fatal("failed import should be rolled back")
+	}
+
+	// 其他不支持的类型被跳过并在响应中列出
+	dnskey := "example.com. IN DNSKEY 256 3 13 dGVzdA==\nmail.example.com. IN A 192.168.1.3\n"
+	w = apiDo(t, api, http.MethodPost, "/import?format=zone", dnskey)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "skipped 1 unsupported records: example.com. DNSKEY") {
+		t.Fatalf("import: %d %s", w.Code, w.Body.String())
+	}
+
+	w = apiDo(t, api, http.MethodGet, "/export", "")
+	var exported []recordView
+	if err := json.Unmarshal(w.Body.Bytes(), &exported); err != nil {
+		t.Fatal(err)
+	}
+	if len(exported) != 6 {
+		t.Fatalf("want 6 records, got %+v", exported)
+	}
+
+	// json 导出的内容导入到新的数据库后应该完全相同
+	cdns2 := newTestCustomDns(t)
+	api2 := cdns2.Api()
+	if w := apiDo(t, api2, http.MethodPost, "/import", w.Body.String()); w.Code != http.StatusOK {
+		t.Fatalf("import: %d %s", w.Code, w.Body.String())
+	}
+	w2 := apiDo(t, api2, http.MethodGet, "/export", "")
+	if w.Body.String() != w2.Body.String() {
+		t.Fatalf("export mismatch:\n%s\n%s", w.Body.String(), w2.Body.String())
+	}
+
+	wz := apiDo(t, api, http.MethodGet, "/export?format=zone", "")
+	wz2 := apiDo(t, api2, http.MethodGet, "/export?format=zone", "")
+	if wz.Body.String() != wz2.Body.String() || !strings.Contains(wz.Body.String(), "*.example.com.\t300\tIN\tAAAA\t2001:db8::1") {
+		t.Fatalf("unexpected zone export:\n%s", wz.Body.String())
+	}
+}
+
+func TestCustomDns_MigrateLegacySchema(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "legacy.db")
+	db, err := gorm.Open(sqlite.Open(p), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 引入 schema 版本之前的数据库
+	if err := db.AutoMigrate(&recordAv1{}, &recordAAAAv1{}, &recordTXTv1{}, &recordTXTValuev1{},
+		&recordAAAAValuev1{}, &recordAValuev1{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(&recordTXTv1{Hostname: "example.com", TTL: 100, Value: []recordTXTValuev1{{TXT: "hello"}}}).Error; err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, _ := db.DB()
+	sqlDB.Close()
+
+	cdns, err := NewCustomDns(&Args{DatabaseType: "sqlite", DatabaseAddress: p}, Opts{Logger: zap.NewNop()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := cdns.db.Migrator()
+	if m.HasIndex(&recordTXTv1{}, "idx_record_txts_id") || !m.HasIndex(&RecordTXT{}, "Hostname") {
+		t.Fatal("record_txts indexes are not migrated")
+	}
+	var versions []SchemaVersion
+	cdns.db.Order("version").Find(&versions)
+	if len(versions) != len(migrations) {
+		t.Fatalf("want %d schema versions, got %+v", len(migrations), versions)
+	}
+	r := exec(t, cdns, "example.com.", dns.TypeTXT)
+	if r == nil || r.Answer[0].(*dns.TXT).Txt[0] != "hello" {
+		t.Fatalf("existing record lost after migration, got %v", r)
+	}
+
+	// 再次启动时不会重复执行迁移
+	if err := migrate(cdns.db, zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	cdns.db.Create(&SchemaVersion{Version: len(migrations) + 1})
+	if err := migrate(cdns.db, zap.NewNop()); err == nil {
+		t.Fatal("migrate should fail on a newer schema version")
+	}
+}
+
+// 旧的迁移不受模型修改的影响，新数据库上每个迁移都会执行。
+func TestCustomDns_MigrationsFrozen(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mg := range migrations[:len(migrations)-1] {
+		if err := mg.up(db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if db.Migrator().HasColumn(&RecordA{}, "view_name") {
+		t.Fatal("view_name is created before the record views migration")
+	}
+	if err := migrations[len(migrations)-1].up(db); err != nil {
+		t.Fatal(err)
+	}
+	if !db.Migrator().HasColumn(&RecordA{}, "view_name") {
+		t.Fatal("view_name is not created")
+	}
+}
+
+func TestCustomDns_AuthAndAudit(t *testing.T) {
+	cdns, err := NewCustomDns(&Args{
+		DatabaseType:    "sqlite",
+		DatabaseAddress: filepath.Join(t.TempDir(), "test.db"),
+		Auth: AuthArgs{
+			BearerTokens: []TokenArgs{{Name: "provisioning", Token: "secret-token"}},
+			BasicUsers:   []UserArgs{{Username: "admin", Password: "pw"}},
+		},
+	}, Opts{Logger: zap.NewNop()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := cdns.Api()
+
+	do := func(method, target, body string, auth func(r *http.Request)) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if auth != nil {
+			auth(req)
+		}
+		api.ServeHTTP(w, req)
+		return w
+	}
+	bearer := func(token string) func(r *http.Request) {
+		return func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }
+	}
+	basic := func(r *http.Request) { r.SetBasicAuth("admin", "pw") }
+
+	set := `{"Hostname":"www.example.com","Type":"a","Value":["10.0.0.1"],"TTL":60}`
+	if w := do(http.MethodPost, "/set", set, nil); w.Code != http.StatusUnauthorized {
+		t.Fatalf("want 401 without credentials, got %d", w.Code)
+	}
+	if w := do(http.MethodPost, "/set", set, bearer("wrong")); w.Code != http.StatusUnauthorized {
+		t.Fatalf("want 401 with wrong token, got %d", w.Code)
+	}
+	if w := do(http.MethodPost, "/set", set, bearer("secret-token")); w.Code != http.StatusOK {
+		t.Fatalf("set: %d %s", w.Code, w.Body.String())
+	}
+	update := `{"Hostname":"www.example.com","Type":"a","Value":["10.0.0.2"],"TTL":60}`
+	if w := do(http.MethodPost, "/set", update, basic); w.Code != http.StatusOK {
+		t.Fatalf("update: %d %s", w.Code, w.Body.String())
+	}
+	if w := do(http.MethodDelete, "/records/a/www.example.com", "", basic); w.Code != http.StatusOK {
+		t.Fatalf("delete: %d %s", w.Code, w.Body.String())
+	}
+
+	w := do(http.MethodGet, "/audit?hostname=www.example.com", "", basic)
+	if w.Code != http.StatusOK {
+		t.Fatalf("audit: %d %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Total   int64
+		Entries []struct {
+			Actor    string
+			Action   string
+			OldValue *recordView
+			NewValue *recordView
+		}
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Total != 3 {
+		t.Fatalf("want 3 audit entries, got %s", w.Body.String())
+	}
+	// 最新的在前
+	del, upd, create := resp.Entries[0], resp.Entries[1], resp.Entries[2]
+	if create.Action != "create" || create.Actor != "token:provisioning" || create.OldValue != nil || create.NewValue.Value[0] != "10.0.0.1" {
+		t.Fatalf("unexpected create entry %+v", create)
+	}
+	if upd.Action != "update" || upd.Actor != "user:admin" || upd.OldValue.Value[0] != "10.0.0.1" || upd.NewValue.Value[0] != "10.0.0.2" {
+		t.Fatalf("unexpected update entry %+v", upd)
+	}
+	if del.Action != "delete" || del.OldValue.Value[0] != "10.0.0.2" || del.NewValue != nil {
+		t.Fatalf("unexpected delete entry %+v", del)
+	}
+}
+
+func TestCustomDns_InvalidAuth(t *testing.T) {
+	for _, auth := range []AuthArgs{
+		{BearerTokens: []TokenArgs{{Name: "empty"}}},
+		{BasicUsers: []UserArgs{{Password: "pw"}}},
+		{BasicUsers: []UserArgs{{Username: "admin"}}},
+	} {
+		_, err := NewCustomDns(&Args{
+			DatabaseType:    "sqlite",
+			DatabaseAddress: filepath.Join(t.TempDir(), "test.db"),
+			Auth:            auth,
+		}, Opts{Logger: zap.NewNop()})
+		if err == nil {
+			t.Fatalf("want error for empty credentials %+v", auth)
+		}
+	}
+}
+
+func TestCustomDns_Views(t *testing.T) {
+	cdns, err := NewCustomDns(&Args{
+		DatabaseType:    "sqlite",
+		DatabaseAddress: filepath.Join(t.TempDir(), "test.db"),
+		Views: []ViewArgs{
+			{Name: "office", IPs: []string{"192.168.0.0/16"}},
+			{Name: "vpn", IPs: []string{"10.8.0.0/24", "fd00::/8"}},
+		},
+	}, Opts{Logger: zap.NewNop()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := cdns.Api()
+	set := func(view, hostname, typ, value string) {
+		t.Helper()
+		body := fmt.Sprintf(`{"Hostname":%q,"View":%q,"Type":%q,"Value":[%q],"TTL":60}`, hostname, view, typ, value)
+		if w := apiDo(t, api, http.MethodPost, "/set", body); w.Code != http.StatusOK {
+			t.Fatalf("set %s %s: %d %s", view, hostname, w.Code, w.Body.String())
+		}
+	}
+	set("", "www.example.com", "a", "203.0.113.1")
+	set("office", "www.example.com", "a", "192.168.1.1")
+	set("vpn", "www.example.com", "a", "10.8.0.1")
+	set("", "mail.example.com", "a", "203.0.113.2")
+	set("office", "alias.example.com", "cname", "mail.example.com")
+
+	if w := apiDo(t, api, http.MethodPost, "/set", `{"Hostname":"a.example.com","View":"unknown","Type":"a","Value":["1.1.1.1"]}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("want 400 for undefined view, got %d", w.Code)
+	}
+
+	query := func(client string, name string, typ uint16) []string {
+		t.Helper()
+		q := new(dns.Msg)
+		q.SetQuestion(name, typ)
+		qCtx := query_context.NewContext(q)
+		qCtx.ServerMeta.ClientAddr = netip.MustParseAddr(client)
+		if err := cdns.Exec(context.Background(), qCtx); err != nil {
+			t.Fatal(err)
+		}
+		var answers []string
+		if r := qCtx.R(); r != nil {
+			for _, rr := range r.Answer {
+				answers = append(answers, rr.String())
+			}
+		}
+		return answers
+	}
+	tests := []struct {
+		name   string
+		client string
+		qname  string
+		qtype  uint16
+		want   []string
+	}{
+		{"office", "192.168.3.4", "www.example.com.", dns.TypeA, []string{"www.example.com.\t60\tIN\tA\t192.168.1.1"}},
+		{"vpn", "10.8.0.9", "www.example.com.", dns.TypeA, []string{"www.example.com.\t60\tIN\tA\t10.8.0.1"}},
+		{"vpn_ipv6", "fd00::1", "www.example.com.", dns.TypeA, []string{"www.example.com.\t60\tIN\tA\t10.8.0.1"}},
+		{"public", "198.51.100.1", "www.example.com.", dns.TypeA, []string{"www.example.com.\t60\tIN\tA\t203.0.113.1"}},
+		{"fallback_to_default", "192.168.3.4", "mail.example.com.", dns.TypeA, []string{"mail.example.com.\t60\tIN\tA\t203.0.113.2"}},
+		{"view_cname_to_default", "192.168.3.4", "alias.example.com.", dns.TypeA, []string{
+			"alias.example.com.\t60\tIN\tCNAME\tmail.example.com.",
+			"mail.example.com.\t60\tIN\tA\t203.0.113.2",
+		}},
+		{"view_only_record", "198.51.100.1", "alias.example.com.", dns.TypeA, nil},
+		{"view_ptr", "10.8.0.9", "1.0.8.10.in-addr.arpa.", dns.TypePTR, []string{"1.0.8.10.in-addr.arpa.\t60\tIN\tPTR\twww.example.com."}},
+		{"ptr_not_in_view", "198.51.100.1", "1.0.8.10.in-addr.arpa.", dns.TypePTR, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := query(tt.client, tt.qname, tt.qtype); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("want %v, got %v", tt.want, got)
+			}
+		})
+	}
+
+	if w := apiDo(t, api, http.MethodDelete, "/records/a/www.example.com?view=office", ""); w.Code != http.StatusOK {
+		t.Fatalf("delete: %d %s", w.Code, w.Body.String())
+	}
+	if got := query("192.168.3.4", "www.example.com.", dns.TypeA); len(got) != 1 || !strings.HasSuffix(got[0], "203.0.113.1") {
+		t.Fatalf("want default view record after deleting office record, got %v", got)
+	}
+	w := apiDo(t, api, http.MethodGet, "/export?format=zone&view=vpn", "")
+	if want := "www.example.com.\t60\tIN\tA\t10.8.0.1\n"; w.Body.String() != want {
+		t.Fatalf("want %q, got %q", want, w.Body.String())
+	}
+}
+
+func TestCustomDns_Update(t *testing.T) {
+	const secret = "c2VjcmV0LWtleS1mb3ItdGVzdGluZw=="
+	cdns, err := NewCustomDns(&Args{
+		DatabaseType:    "sqlite",
+		DatabaseAddress: filepath.Join(t.TempDir(), "test.db"),
+		Update: UpdateArgs{
+			Zones:    []string{"example.com", "168.192.in-addr.arpa"},
+			TsigKeys: []TsigKeyArgs{{Name: "dhcp-key", Secret: secret}},
+		},
+	}, Opts{Logger: zap.NewNop()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	go server.ServeUDP(c, server_handler.NewEntryHandler(server_handler.EntryHandlerOpts{Entry: cdns}), server.UDPServerOpts{})
+
+	client := &dns.Client{TsigSecret: map[string]string{"dhcp-key.": secret}}
+	update := func(zone string, sign bool, f func(m *dns.Msg)) int {
+		t.Helper()
+		m := new(dns.Msg)
+		m.SetUpdate(zone)
+		f(m)
+		if sign {
+			m.SetTsig("dhcp-key.", dns.HmacSHA256, 300, time.Now().Unix())
+		}
+		// client 会校验应答的 TSIG
+		r, _, err := client.Exchange(m, c.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r.Rcode
+	}
+	rr := func(s string) dns.RR {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rr
+	}
+
+	if rcode := update("example.com.", false, func(m *dns.Msg) {
+		m.Insert([]dns.RR{rr("host.example.com. 300 IN A 192.168.1.10")})
+	}); rcode != dns.RcodeRefused {
+		t.Fatalf("unsigned update: want REFUSED, got %s", dns.RcodeToString[rcode])
+	}
+	if rcode := update("example.com.", true, func(m *dns.Msg) {
+		m.NameNotUsed([]dns.RR{&dns.ANY{Hdr: dns.RR_Header{Name: "host.example.com."}}})
+		m.Insert([]dns.RR{rr("host.example.com. 300 IN A 192.168.1.10"), rr("host.example.com. 300 IN A 192.168.1.11")})
+		m.Insert([]dns.RR{rr("10.1.168.192.in-addr.arpa. 300 IN PTR host.example.com.")})
+	}); rcode != dns.RcodeNotZone {
+		t.Fatalf("ptr outside of zone: want NOTZONE, got %s", dns.RcodeToString[rcode])
+	}
+	if rcode := update("example.com.", true, func(m *dns.Msg) {
+		m.NameNotUsed([]dns.RR{&dns.ANY{Hdr: dns.RR_Header{Name: "host.example.com."}}})
+		m.Insert([]dns.RR{rr("host.example.com. 300 IN A 192.168.1.10"), rr("host.example.com. 300 IN A 192.168.1.11")})
+	}); rcode != dns.RcodeSuccess {
+		t.Fatalf("insert: want NOERROR, got %s", dns.RcodeToString[rcode])
+	}
+	if rcode := update("168.192.in-addr.arpa.", true, func(m *dns.Msg) {
+		m.Insert([]dns.RR{rr("10.1.168.192.in-addr.arpa. 300 IN PTR host.example.com.")})
+	}); rcode != dns.RcodeSuccess {
+		t.Fatalf("insert ptr: want NOERROR, got %s", dns.RcodeToString[rcode])
+	}
+	if rcode := update("example.com.", true, func(m *dns.Msg) {
+		m.NameNotUsed([]dns.RR{&dns.ANY{Hdr: dns.RR_Header{Name: "host.example.com."}}})
+		m.Insert([]dns.RR{rr("host.example.com. 300 IN A 192.168.1.12")})
+	}); rcode != dns.RcodeYXDomain {
+		t.Fatalf("prerequisite: want YXDOMAIN, got %s", dns.RcodeToString[rcode])
+	}
+	if rcode := update("example.com.", true, func(m *dns.Msg) {
+		m.Used([]dns.RR{rr("host.example.com. 0 IN A 192.168.1.10")})
+		m.Insert([]dns.RR{rr("host.example.com. 300 IN A 192.168.1.12")})
+	}); rcode != dns.RcodeNXRrset {
+		t.Fatalf("value dependent prerequisite: want NXRRSET, got %s", dns.RcodeToString[rcode])
+	}
+	if rcode := update("example.com.", true, func(m *dns.Msg) {
+		m.Used([]dns.RR{rr("host.example.com. 0 IN A 192.168.1.10"), rr("host.example.com. 0 IN A 192.168.1.11")})
+		m.Remove([]dns.RR{rr("host.example.com. 0 IN A 192.168.1.10")})
+		m.Insert([]dns.RR{rr("host.example.com. 600 IN TXT \"a\" \"b\"")})
+	}); rcode != dns.RcodeSuccess {
+		t.Fatalf("remove: want NOERROR, got %s", dns.RcodeToString[rcode])
+	}
+
+	for _, tt := range []struct {
+		qname string
+		qtype uint16
+		want  []string
+	}{
+		{"host.example.com.", dns.TypeA, []string{"host.example.com.\t300\tIN\tA\t192.168.1.11"}},
+		{"10.1.168.192.in-addr.arpa.", dns.TypePTR, []string{"10.1.168.192.in-addr.arpa.\t300\tIN\tPTR\thost.example.com."}},
+	} {
+		r := exec(t, cdns, tt.qname, tt.qtype)
+		var got []string
+		for _, rr := range r.Answer {
+			got = append(got, rr.String())
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("%s: want %v, got %v", tt.qname, tt.want, got)
+		}
+	}
+	if r := exec(t, cdns, "host.example.com.", dns.TypeTXT); len(r.Answer) != 1 || len(r.Answer[0].(*dns.TXT).Txt) != 2 {
+		t.Fatalf("unexpected txt answer %v", r)
+	}
+
+	if rcode := update("example.com.", true, func(m *dns.Msg) {
+		m.RemoveName([]dns.RR{&dns.ANY{Hdr: dns.RR_Header{Name: "host.example.com."}}})
+	}); rcode != dns.RcodeSuccess {
+		t.Fatalf("remove name: want NOERROR, got %s", dns.RcodeToString[rcode])
+	}
+	if r := exec(t, cdns, "host.example.com.", dns.TypeA); r != nil {
+		t.Fatalf("removed name still answered: %v", r)
+	}
+	var logs []AuditLog
+	cdns.db.Where("actor = ?", "tsig:dhcp-key").Find(&logs)
+	if len(logs) != 7 {
+		t.Fatalf("want 7 audit logs, got %d", len(logs))
+	}
+}
@@ -0,0 +1,279 @@
+package custom_dns
+
+import (
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// SchemaVersion 记录已经执行过的数据库迁移。
+type SchemaVersion struct {
+	Version   int `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+type migration struct {
+	version int
+	name    string
+	up      func(tx *gorm.DB) error
+}
+
+// migrations 按版本号顺序执行，已经发布的迁移不能再修改，修改数据库模型时需要在末尾添加新的迁移。
+// 迁移必须使用固定为当时定义的模型(见下面的 recordTXTv1)，否则模型修改后旧的迁移会创建新的列，
+// 后面的迁移在新数据库上就不会执行任何操作。只有最新的迁移可以直接使用 models.go 中的模型，
+// 添加新的迁移时需要先把它改为使用固定的模型。
+var migrations = []migration{
+	{version: 1, name: "initial schema", up: migrateInitialSchema},
+	{version: 2, name: "record_txt primary key and hostname index", up: migrateRecordTXTIndex},
+	{version: 3, name: "audit log", up: func(tx *gorm.DB) error { return tx.AutoMigrate(&auditLogv3{}) }},
+	{version: 4, name: "record views", up: migrateRecordViews},
+}
+
+// 以下是版本 1 中各个模型的定义。
+
+type recordAv1 struct {
+	ID       int              `gorm:"primaryKey"`
+	Hostname string           `gorm:"index;size:253"`
+	Value    []recordAValuev1 `gorm:"foreignKey:RecordRefer"`
+	TTL      uint
+}
+
+func (recordAv1) TableName() string { return "record_as" }
+
+type recordAValuev1 struct {
+	ID          int    `gorm:"primaryKey,autoIncrement"`
+	RecordRefer int    `gorm:"index"`
+	IPAddr      uint32 `gorm:"index"`
+}
+
+func (recordAValuev1) TableName() string { return "record_a_values" }
+
+type recordAAAAv1 struct {
+	ID       int                 `gorm:"primaryKey"`
+	Hostname string              `gorm:"index;size:253"`
+	Value    []recordAAAAValuev1 `gorm:"foreignKey:RecordRefer"`
+	TTL      uint
+}
+
+func (recordAAAAv1) TableName() string { return "record_aaaas" }
+
+type recordAAAAValuev1 struct {
+	ID          int   `gorm:"primaryKey,autoIncrement"`
+	RecordRefer int   `gorm:"index"`
+	IPAddrHi    int64 `gorm:"index:idx_aaaa_value_addr"`
+	IPAddrLo    int64 `gorm:"index:idx_aaaa_value_addr"`
+}
+
+func (recordAAAAValuev1) TableName() string { return "record_aaaa_values" }
+
+// recordTXTv1 ID 上有一个多余的索引，Hostname 没有索引。
+type recordTXTv1 struct {
+	ID       int                `gorm:"index"`
+	Hostname string             `gorm:"size:253"`
+	Value    []recordTXTValuev1 `gorm:"foreignKey:RecordRefer"`
+	TTL      uint
+}
+
+func (recordTXTv1) TableName() string { return "record_txts" }
+
+type recordTXTValuev1 struct {
+	ID          int `gorm:"primaryKey,autoIncrement"`
+	RecordRefer int `gorm:"index"`
+	TXT         string
+}
+
+func (recordTXTValuev1) TableName() string { return "record_txt_values" }
+
+type recordPTRv1 struct {
+	ID       int                `gorm:"primaryKey"`
+	IPAddrHi int64              `gorm:"index:idx_ptr_addr"`
+	IPAddrLo int64              `gorm:"index:idx_ptr_addr"`
+	Value    []recordPTRValuev1 `gorm:"foreignKey:RecordRefer"`
+	TTL      uint
+}
+
+func (recordPTRv1) TableName() string { return "record_ptrs" }
+
+type recordPTRValuev1 struct {
+	ID          int `gorm:"primaryKey,autoIncrement"`
+	RecordRefer int `gorm:"index"`
+	PTR         string
+}
+
+func (recordPTRValuev1) TableName() string { return "record_ptr_values" }
+
+type recordCNAMEv1 struct {
+	ID       int    `gorm:"primaryKey"`
+	Hostname string `gorm:"index;size:253"`
+	Target   string `gorm:"size:253"`
+	TTL      uint
+}
+
+func (recordCNAMEv1) TableName() string { return "record_cnames" }
+
+type recordMXv1 struct {
+	ID       int               `gorm:"primaryKey"`
+	Hostname string            `gorm:"index;size:253"`
+	Value    []recordMXValuev1 `gorm:"foreignKey:RecordRefer"`
+	TTL      uint
+}
+
+func (recordMXv1) TableName() string { return "record_mxes" }
+
+type recordMXValuev1 struct {
+	ID          int `gorm:"primaryKey,autoIncrement"`
+	RecordRefer int `gorm:"index"`
+	Preference  uint16
+	Mx          string `gorm:"size:253"`
+}
+
+func (recordMXValuev1) TableName() string { return "record_mx_values" }
+
+type recordSRVv1 struct {
+	ID       int                `gorm:"primaryKey"`
+	Hostname string             `gorm:"index;size:253"`
+	Value    []recordSRVValuev1 `gorm:"foreignKey:RecordRefer"`
+	TTL      uint
+}
+
+func (recordSRVv1) TableName() string { return "record_srvs" }
+
+type recordSRVValuev1 struct {
+	ID          int `gorm:"primaryKey,autoIncrement"`
+	RecordRefer int `gorm:"index"`
+	Priority    uint16
+	Weight      uint16
+	Port        uint16
+	Target      string `gorm:"size:253"`
+}
+
+func (recordSRVValuev1) TableName() string { return "record_srv_values" }
+
+type recordCAAv1 struct {
+	ID       int                `gorm:"primaryKey"`
+	Hostname string             `gorm:"index;size:253"`
+	Value    []recordCAAValuev1 `gorm:"foreignKey:RecordRefer"`
+	TTL      uint
+}
+
+func (recordCAAv1) TableName() string { return "record_caas" }
+
+type recordCAAValuev1 struct {
+	ID          int `gorm:"primaryKey,autoIncrement"`
+	RecordRefer int `gorm:"index"`
+	Flag        uint8
+	Tag         string
+	Content     string
+}
+
+func (recordCAAValuev1) TableName() string { return "record_caa_values" }
+
+type recordNSv1 struct {
+	ID       int               `gorm:"primaryKey"`
+	Hostname string            `gorm:"index;size:253"`
+	Value    []recordNSValuev1 `gorm:"foreignKey:RecordRefer"`
+	TTL      uint
+}
+
+func (recordNSv1) TableName() string { return "record_ns" }
+
+type recordNSValuev1 struct {
+	ID          int    `gorm:"primaryKey,autoIncrement"`
+	RecordRefer int    `gorm:"index"`
+	Ns          string `gorm:"size:253"`
+}
+
+func (recordNSValuev1) TableName() string { return "record_ns_values" }
+
+// recordTXTv2 是版本 2 中 RecordTXT 的定义。
+type recordTXTv2 struct {
+	ID       int                `gorm:"primaryKey"`
+	Hostname string             `gorm:"index;size:253"`
+	Value    []recordTXTValuev1 `gorm:"foreignKey:RecordRefer"`
+	TTL      uint
+}
+
+func (recordTXTv2) TableName() string { return "record_txts" }
+
+// auditLogv3 是版本 3 中 AuditLog 的定义。
+type auditLogv3 struct {
+	ID         int       `gorm:"primaryKey"`
+	Time       time.Time `gorm:"index"`
+	Actor      string    `gorm:"index;size:128"`
+	RemoteAddr string    `gorm:"size:64"`
+	Action     string    `gorm:"size:16"`
+	Type       string    `gorm:"size:16"`
+	Hostname   string    `gorm:"index;size:253"`
+	OldValue   string
+	NewValue   string
+}
+
+func (auditLogv3) TableName() string { return "audit_logs" }
+
+// migrateInitialSchema 创建版本 1 的所有表。在引入 schema 版本之前已经通过 AutoMigrate 创建的数据库也会执行这个迁移。
+func migrateInitialSchema(tx *gorm.DB) error {
+	return tx.AutoMigrate(&recordAv1{}, &recordAAAAv1{},
+		&recordTXTv1{}, &recordTXTValuev1{},
+		&recordAAAAValuev1{}, &recordAValuev1{},
+		&recordPTRv1{}, &recordPTRValuev1{},
+		&recordCNAMEv1{},
+		&recordMXv1{}, &recordMXValuev1{},
+		&recordSRVv1{}, &recordSRVValuev1{},
+		&recordCAAv1{}, &recordCAAValuev1{},
+		&recordNSv1{}, &recordNSValuev1{})
+}
+
+// migrateRecordTXTIndex 删除 record_txts.id 上多余的索引，并为 hostname 添加索引。
+func migrateRecordTXTIndex(tx *gorm.DB) error {
+	m := tx.Migrator()
+	if m.HasIndex(&recordTXTv1{}, "idx_record_txts_id") {
+		if err := m.DropIndex(&recordTXTv1{}, "idx_record_txts_id"); err != nil {
+			return err
+		}
+	}
+	if !m.HasIndex(&recordTXTv2{}, "Hostname") {
+		return m.CreateIndex(&recordTXTv2{}, "Hostname")
+	}
+	return nil
+}
+
+// migrateRecordViews 为所有记录添加 view_name 列，已有的记录属于默认视图。
+func migrateRecordViews(tx *gorm.DB) error {
+	return tx.AutoMigrate(&RecordA{}, &RecordAAAA{}, &RecordTXT{}, &RecordPTR{},
+		&RecordCNAME{}, &RecordMX{}, &RecordSRV{}, &RecordCAA{}, &RecordNS{})
+}
+
+// migrate 执行所有还没有执行过的迁移。每个迁移在单独的事务中执行。
+// 注意 MySQL 的 DDL 语句会隐式提交事务，迁移失败时可能只执行了一部分，需要手动处理。
+func migrate(db *gorm.DB, logger *zap.Logger) error {
+	if err := db.AutoMigrate(&SchemaVersion{}); err != nil {
+		return err
+	}
+	var current int
+	if err := db.Model(&SchemaVersion{}).Select("COALESCE(MAX(version), 0)").Scan(&current).Error; err != nil {
+		return err
+	}
+	latest := migrations[len(migrations)-1].version
+	if current > latest {
+		return fmt.Errorf("database schema version %d is newer than the latest supported version %d", current, latest)
+	}
+	for _, mg := range migrations {
+		if mg.version <= current {
+			continue
+		}
+		logger.Info("migrating database schema", zap.Int("version", mg.version), zap.String("name", mg.name))
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := mg.up(tx); err != nil {
+				return err
+			}
+			return tx.Create(&SchemaVersion{Version: mg.version, Name: mg.name, AppliedAt: time.Now()}).Error
+		})
+		if err != nil {
+			return fmt.Errorf("failed to migrate database schema to version %d (%s), %w", mg.version, mg.name, err)
+		}
+	}
+	return nil
+}
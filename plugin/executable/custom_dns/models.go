@@ -1,35 +1,42 @@
 package custom_dns
 
+import "time"
+
+// 所有记录的 View 为记录所属的视图名称，默认视图为空字符串，见 Args.Views。
+
 type RecordA struct {
 	ID       int            `gorm:"primaryKey" json:"-"`
 	Hostname string         `gorm:"index;size:253"`
+	View     string         `gorm:"column:view_name;index;size:64;not null;default:''"`
 	Value    []RecordAValue `gorm:"foreignKey:RecordRefer" json:"-"`
 	TTL      uint
 }
 
 type RecordAValue struct {
-	ID          int `gorm:"primaryKey,autoIncrement"`
-	RecordRefer int `gorm:"index"`
-	IPAddr      uint32
+	ID          int    `gorm:"primaryKey,autoIncrement"`
+	RecordRefer int    `gorm:"index"`
+	IPAddr      uint32 `gorm:"index"` // 用于 PTR 反向查询
 }
 
 type RecordAAAA struct {
 	ID       int               `gorm:"primaryKey" json:"-"`
 	Hostname string            `gorm:"index;size:253"`
+	View     string            `gorm:"column:view_name;index;size:64;not null;default:''"`
 	Value    []RecordAAAAValue `gorm:"foreignKey:RecordRefer" json:"-"`
 	TTL      uint
 }
 
 type RecordAAAAValue struct {
-	ID          int `gorm:"primaryKey,autoIncrement"`
-	RecordRefer int `gorm:"index"`
-	IPAddrHi    int64
-	IPAddrLo    int64
+	ID          int   `gorm:"primaryKey,autoIncrement"`
+	RecordRefer int   `gorm:"index"`
+	IPAddrHi    int64 `gorm:"index:idx_aaaa_value_addr"` // 用于 PTR 反向查询
+	IPAddrLo    int64 `gorm:"index:idx_aaaa_value_addr"`
 }
 
 type RecordTXT struct {
-	ID       int              `gorm:"index" json:"-"`
-	Hostname string           `gorm:"size:253"`
+	ID       int              `gorm:"primaryKey" json:"-"`
+	Hostname string           `gorm:"index;size:253"`
+	View     string           `gorm:"column:view_name;index;size:64;not null;default:''"`
 	Value    []RecordTXTValue `gorm:"foreignKey:RecordRefer" json:"-"`
 	TTL      uint
 }
@@ -39,3 +46,105 @@ type RecordTXTValue struct {
 	RecordRefer int `gorm:"index"`
 	TXT         string
 }
+
+// RecordPTR 手动指定的 PTR 记录，优先于根据 A/AAAA 记录反查的结果。
+// IPv4 地址以 IPv4-mapped IPv6 的形式保存。
+type RecordPTR struct {
+	ID       int              `gorm:"primaryKey" json:"-"`
+	IPAddrHi int64            `gorm:"index:idx_ptr_addr" json:"-"`
+	IPAddrLo int64            `gorm:"index:idx_ptr_addr" json:"-"`
+	View     string           `gorm:"column:view_name;index;size:64;not null;default:''"`
+	Value    []RecordPTRValue `gorm:"foreignKey:RecordRefer" json:"-"`
+	TTL      uint
+}
+
+type RecordPTRValue struct {
+	ID          int `gorm:"primaryKey,autoIncrement"`
+	RecordRefer int `gorm:"index"`
+	PTR         string
+}
+
+// RecordCNAME 别名记录。一个域名只能有一个别名。
+type RecordCNAME struct {
+	ID       int    `gorm:"primaryKey" json:"-"`
+	Hostname string `gorm:"index;size:253"`
+	View     string `gorm:"column:view_name;index;size:64;not null;default:''"`
+	Target   string `gorm:"size:253" json:"-"`
+	TTL      uint
+}
+
+type RecordMX struct {
+	ID       int             `gorm:"primaryKey" json:"-"`
+	Hostname string          `gorm:"index;size:253"`
+	View     string          `gorm:"column:view_name;index;size:64;not null;default:''"`
+	Value    []RecordMXValue `gorm:"foreignKey:RecordRefer" json:"-"`
+	TTL      uint
+}
+
+type RecordMXValue struct {
+	ID          int `gorm:"primaryKey,autoIncrement"`
+	RecordRefer int `gorm:"index"`
+	Preference  uint16
+	Mx          string `gorm:"size:253"`
+}
+
+type RecordSRV struct {
+	ID       int              `gorm:"primaryKey" json:"-"`
+	Hostname string           `gorm:"index;size:253"`
+	View     string           `gorm:"column:view_name;index;size:64;not null;default:''"`
+	Value    []RecordSRVValue `gorm:"foreignKey:RecordRefer" json:"-"`
+	TTL      uint
+}
+
+type RecordSRVValue struct {
+	ID          int `gorm:"primaryKey,autoIncrement"`
+	RecordRefer int `gorm:"index"`
+	Priority    uint16
+	Weight      uint16
+	Port        uint16
+	Target      string `gorm:"size:253"`
+}
+
+type RecordCAA struct {
+	ID       int              `gorm:"primaryKey" json:"-"`
+	Hostname string           `gorm:"index;size:253"`
+	View     string           `gorm:"column:view_name;index;size:64;not null;default:''"`
+	Value    []RecordCAAValue `gorm:"foreignKey:RecordRefer" json:"-"`
+	TTL      uint
+}
+
+type RecordCAAValue struct {
+	ID          int `gorm:"primaryKey,autoIncrement"`
+	RecordRefer int `gorm:"index"`
+	Flag        uint8
+	Tag         string
+	Content     string
+}
+
+type RecordNS struct {
+	ID       int             `gorm:"primaryKey" json:"-"`
+	Hostname string          `gorm:"index;size:253"`
+	View     string          `gorm:"column:view_name;index;size:64;not null;default:''"`
+	Value    []RecordNSValue `gorm:"foreignKey:RecordRefer" json:"-"`
+	TTL      uint
+}
+
+type RecordNSValue struct {
+	ID          int    `gorm:"primaryKey,autoIncrement"`
+	RecordRefer int    `gorm:"index"`
+	Ns          string `gorm:"size:253"`
+}
+
+// AuditLog 记录通过 api 对记录的每一次修改。
+// OldValue 和 NewValue 为 json 格式的 recordView，记录不存在时为空。
+type AuditLog struct {
+	ID         int       `gorm:"primaryKey"`
+	Time       time.Time `gorm:"index"`
+	Actor      string    `gorm:"index;size:128"`
+	RemoteAddr string    `gorm:"size:64"`
+	Action     string    `gorm:"size:16"` // create update delete
+	Type       string    `gorm:"size:16"`
+	Hostname   string    `gorm:"index;size:253"`
+	OldValue   string
+	NewValue   string
+}
@@ -0,0 +1,544 @@
+package custom_dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+
+	"github.com/miekg/dns"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// 以下方法根据数据库中的记录生成 owner 为 name 的 rr
+
+func (r *RecordA) rrs(name string) []dns.RR {
+	var rrs []dns.RR
+	for i := 0; i < len(r.Value); i++ {
+		buf := make([]byte, 4)
+		binary.BigEndian.PutUint32(buf, r.Value[i].IPAddr)
+		rrs = append(rrs, &dns.A{
+			Hdr: newHdr(name, dns.TypeA, r.TTL),
+			A:   buf,
+		})
+	}
+	return rrs
+}
+
+func (r *RecordAAAA) rrs(name string) []dns.RR {
+	var rrs []dns.RR
+	for i := 0; i < len(r.Value); i++ {
+		buf := make([]byte, 16)
+		binary.BigEndian.PutUint64(buf[8:], uint64(r.Value[i].IPAddrLo))
+		binary.BigEndian.PutUint64(buf[:8], uint64(r.Value[i].IPAddrHi))
+		rrs = append(rrs, &dns.AAAA{
+			Hdr:  newHdr(name, dns.TypeAAAA, r.TTL),
+			AAAA: buf,
+		})
+	}
+	return rrs
+}
+
+// TXT 记录的所有值放在同一个 rr 中
+func (r *RecordTXT) rrs(name string) []dns.RR {
+	var txtValue []string
+	for i := 0; i < len(r.Value); i++ {
+		txtValue = append(txtValue, r.Value[i].TXT)
+	}
+	if len(txtValue) == 0 {
+		return nil
+	}
+	return []dns.RR{&dns.TXT{
+		Hdr: newHdr(name, dns.TypeTXT, r.TTL),
+		Txt: txtValue,
+	}}
+}
+
+func (r *RecordPTR) rrs(name string) []dns.RR {
+	var rrs []dns.RR
+	for i := 0; i < len(r.Value); i++ {
+		rrs = append(rrs, &dns.PTR{
+			Hdr: newHdr(name, dns.TypePTR, r.TTL),
+			Ptr: dns.Fqdn(r.Value[i].PTR),
+		})
+	}
+	return rrs
+}
+
+func (r *RecordCNAME) rrs(name string) []dns.RR {
+	return []dns.RR{&dns.CNAME{
+		Hdr:    newHdr(name, dns.TypeCNAME, r.TTL),
+		Target: dns.Fqdn(r.Target),
+	}}
+}
+
+func (r *RecordMX) rrs(name string) []dns.RR {
+	var rrs []dns.RR
+	for i := 0; i < len(r.Value); i++ {
+		rrs = append(rrs, &dns.MX{
+			Hdr:        newHdr(name, dns.TypeMX, r.TTL),
+			Preference: r.Value[i].Preference,
+			Mx:         dns.Fqdn(r.Value[i].Mx),
+		})
+	}
+	return rrs
+}
+
+func (r *RecordSRV) rrs(name string) []dns.RR {
+	var rrs []dns.RR
+	for i := 0; i < len(r.Value); i++ {
+		rrs = append(rrs, &dns.SRV{
+			Hdr:      newHdr(name, dns.TypeSRV, r.TTL),
+			Priority: r.Value[i].Priority,
+			Weight:   r.Value[i].Weight,
+			Port:     r.Value[i].Port,
+			Target:   dns.Fqdn(r.Value[i].Target),
+		})
+	}
+	return rrs
+}
+
+func (r *RecordCAA) rrs(name string) []dns.RR {
+	var rrs []dns.RR
+	for i := 0; i < len(r.Value); i++ {
+		rrs = append(rrs, &dns.CAA{
+			Hdr:   newHdr(name, dns.TypeCAA, r.TTL),
+			Flag:  r.Value[i].Flag,
+			Tag:   r.Value[i].Tag,
+			Value: r.Value[i].Content,
+		})
+	}
+	return rrs
+}
+
+func (r *RecordNS) rrs(name string) []dns.RR {
+	var rrs []dns.RR
+	for i := 0; i < len(r.Value); i++ {
+		rrs = append(rrs, &dns.NS{
+			Hdr: newHdr(name, dns.TypeNS, r.TTL),
+			Ns:  dns.Fqdn(r.Value[i].Ns),
+		})
+	}
+	return rrs
+}
+
+func newHdr(name string, typ uint16, ttl uint) dns.RR_Header {
+	return dns.RR_Header{
+		Name:   name,
+		Rrtype: typ,
+		Class:  dns.ClassINET,
+		Ttl:    uint32(ttl),
+	}
+}
+
+// queryRRs 从数据库中查找 view 视图中规则为 pattern 的 typ 类型记录，并生成 owner 为 name 的 rr。
+// 记录存在但没有值时 found 为 true，rrs 为空。
+func (cdns *CustomDns) queryRRs(pattern string, view string, name string, typ uint16) (rrs []dns.RR, found bool) {
+	type record interface{ rrs(name string) []dns.RR }
+	var r record
+	switch typ {
+	case dns.TypeA:
+		if v := cdns.queryRecordA(pattern, view); v != nil {
+			r = v
+		}
+	case dns.TypeAAAA:
+		if v := cdns.queryRecordAAAA(pattern, view); v != nil {
+			r = v
+		}
+	case dns.TypeTXT:
+		if v := cdns.queryRecordTXT(pattern, view); v != nil {
+			r = v
+		}
+	case dns.TypeCNAME:
+		if v := cdns.queryRecordCNAME(pattern, view); v != nil {
+			r = v
+		}
+	case dns.TypeMX:
+		if v := cdns.queryRecordMX(pattern, view); v != nil {
+			r = v
+		}
+	case dns.TypeSRV:
+		if v := cdns.queryRecordSRV(pattern, view); v != nil {
+			r = v
+		}
+	case dns.TypeCAA:
+		if v := cdns.queryRecordCAA(pattern, view); v != nil {
+			r = v
+		}
+	case dns.TypeNS:
+		if v := cdns.queryRecordNS(pattern, view); v != nil {
+			r = v
+		}
+	}
+	if r == nil {
+		return nil, false
+	}
+	return r.rrs(name), true
+}
+
+// recordView 是 api 中记录的表示方式，与 /set 的请求格式相同。
+// Value 的格式与 zone 文件中 rr 的 rdata 相同，TXT 记录的每个值是一个字符串。
+// PTR 记录的 Hostname 为 ip 地址。View 为空时是默认视图。
+type recordView struct {
+	Hostname string
+	View     string `json:",omitempty"`
+	Type     string
+	Value    []string
+	TTL      uint
+}
+
+// recordModel 是所有记录类型的数据库模型需要实现的接口。
+type recordModel interface {
+	rrs(name string) []dns.RR
+	view() recordView
+}
+
+// recordTypes 是 api 中支持的所有记录类型，顺序也是列出记录时的顺序。
+var recordTypes = []string{"a", "aaaa", "txt", "ptr", "cname", "mx", "srv", "caa", "ns"}
+
+func newView(hostname string, view string, typ string, ttl uint, rrs []dns.RR) recordView {
+	v := recordView{Hostname: hostname, View: view, Type: typ, TTL: ttl, Value: []string{}}
+	for _, rr := range rrs {
+		v.Value = append(v.Value, formatRRValue(rr))
+	}
+	return v
+}
+
+func (r *RecordA) view() recordView    { return newView(r.Hostname, r.View, "a", r.TTL, r.rrs(".")) }
+func (r *RecordAAAA) view() recordView { return newView(r.Hostname, r.View, "aaaa", r.TTL, r.rrs(".")) }
+func (r *RecordCNAME) view() recordView {
+	return newView(r.Hostname, r.View, "cname", r.TTL, r.rrs("."))
+}
+func (r *RecordMX) view() recordView  { return newView(r.Hostname, r.View, "mx", r.TTL, r.rrs(".")) }
+func (r *RecordSRV) view() recordView { return newView(r.Hostname, r.View, "srv", r.TTL, r.rrs(".")) }
+func (r *RecordCAA) view() recordView { return newView(r.Hostname, r.View, "caa", r.TTL, r.rrs(".")) }
+func (r *RecordNS) view() recordView  { return newView(r.Hostname, r.View, "ns", r.TTL, r.rrs(".")) }
+
+func (r *RecordTXT) view() recordView {
+	v := recordView{Hostname: r.Hostname, View: r.View, Type: "txt", TTL: r.TTL, Value: []string{}}
+	for i := 0; i < len(r.Value); i++ {
+		v.Value = append(v.Value, r.Value[i].TXT)
+	}
+	return v
+}
+
+func (r *RecordPTR) view() recordView {
+	addr := IntIPv6toAddr(r.IPAddrHi, r.IPAddrLo).Unmap()
+	v := recordView{Hostname: addr.String(), View: r.View, Type: "ptr", TTL: r.TTL, Value: []string{}}
+	for i := 0; i < len(r.Value); i++ {
+		v.Value = append(v.Value, r.Value[i].PTR)
+	}
+	return v
+}
+
+// newModel 返回 typ 类型记录及其值对应的空数据库模型，用于查询和删除。没有值表的类型 value 为 nil。
+func newModel(typ string) (record any, value any, ok bool) {
+	switch typ {
+	case "a":
+		return &RecordA{}, &RecordAValue{}, true
+	case "aaaa":
+		return &RecordAAAA{}, &RecordAAAAValue{}, true
+	case "txt":
+		return &RecordTXT{}, &RecordTXTValue{}, true
+	case "ptr":
+		return &RecordPTR{}, &RecordPTRValue{}, true
+	case "cname":
+		return &RecordCNAME{}, nil, true
+	case "mx":
+		return &RecordMX{}, &RecordMXValue{}, true
+	case "srv":
+		return &RecordSRV{}, &RecordSRVValue{}, true
+	case "caa":
+		return &RecordCAA{}, &RecordCAAValue{}, true
+	case "ns":
+		return &RecordNS{}, &RecordNSValue{}, true
+	default:
+		return nil, nil, false
+	}
+}
+
+// checkHostname 检查 api 中的域名匹配规则是否合法。
+func checkHostname(hostname string) error {
+	switch {
+	case strings.HasPrefix(hostname, "domain:"):
+		return CheckFqdn(hostname[7:])
+	case strings.HasPrefix(hostname, "*."):
+		return CheckFqdn(hostname[2:])
+	default:
+		return CheckFqdn(hostname)
+	}
+}
+
+// buildRecord 检查 v 并生成对应的数据库模型。
+func buildRecord(v recordView) (recordModel, error) {
+	if len(v.View) > maxViewNameLen {
+		return nil, errors.New("view name too long")
+	}
+	if v.Type == "ptr" {
+		addr, err := parsePTRAddr(v.Hostname)
+		if err != nil {
+			return nil, err
+		}
+		hi, lo := AddrToInt(addr)
+		record := &RecordPTR{IPAddrHi: hi, IPAddrLo: lo, View: v.View, TTL: v.TTL}
+		for _, value := range v.Value {
+			if err := CheckFqdn(strings.TrimSuffix(value, ".")); err != nil {
+				return nil, err
+			}
+			record.Value = append(record.Value, RecordPTRValue{PTR: value})
+		}
+		return record, nil
+	}
+
+	if err := checkHostname(v.Hostname); err != nil {
+		return nil, err
+	}
+	switch v.Type {
+	case "txt":
+		record := &RecordTXT{Hostname: v.Hostname, View: v.View, TTL: v.TTL}
+		for _, value := range v.Value {
+			if len(value) > 255 {
+				return nil, errors.New("txt value larger than 255 byte")
+			}
+			record.Value = append(record.Value, RecordTXTValue{TXT: value})
+		}
+		return record, nil
+	case "aaaa":
+		record := &RecordAAAA{Hostname: v.Hostname, View: v.View, TTL: v.TTL}
+		for _, value := range v.Value {
+			ipaddrhi, ipaddrlo, err := StringIPv6toInt(value)
+			if err != nil {
+				return nil, err
+			}
+			record.Value = append(record.Value, RecordAAAAValue{IPAddrHi: ipaddrhi, IPAddrLo: ipaddrlo})
+		}
+		return record, nil
+	case "a":
+		record := &RecordA{Hostname: v.Hostname, View: v.View, TTL: v.TTL}
+		for _, value := range v.Value {
+			ipaddr, err := StringIPv4ToInt(value)
+			if err != nil {
+				return nil, err
+			}
+			record.Value = append(record.Value, RecordAValue{IPAddr: ipaddr})
+		}
+		return record, nil
+	case "cname":
+		if len(v.Value) != 1 {
+			return nil, errors.New("cname record must have exactly one value")
+		}
+		rr, err := parseRRValue(dns.TypeCNAME, v.Value[0])
+		if err != nil {
+			return nil, err
+		}
+		return &RecordCNAME{Hostname: v.Hostname, View: v.View, Target: rr.(*dns.CNAME).Target, TTL: v.TTL}, nil
+	case "mx":
+		record := &RecordMX{Hostname: v.Hostname, View: v.View, TTL: v.TTL}
+		for _, value := range v.Value {
+			rr, err := parseRRValue(dns.TypeMX, value)
+			if err != nil {
+				return nil, err
+			}
+			mx := rr.(*dns.MX)
+			record.Value = append(record.Value, RecordMXValue{Preference: mx.Preference, Mx: mx.Mx})
+		}
+		return record, nil
+	case "srv":
+		record := &RecordSRV{Hostname: v.Hostname, View: v.View, TTL: v.TTL}
+		for _, value := range v.Value {
+			rr, err := parseRRValue(dns.TypeSRV, value)
+			if err != nil {
+				return nil, err
+			}
+			srv := rr.(*dns.SRV)
+			record.Value = append(record.Value, RecordSRVValue{
+				Priority: srv.Priority,
+				Weight:   srv.Weight,
+				Port:     srv.Port,
+				Target:   srv.Target,
+			})
+		}
+		return record, nil
+	case "caa":
+		record := &RecordCAA{Hostname: v.Hostname, View: v.View, TTL: v.TTL}
+		for _, value := range v.Value {
+			rr, err := parseRRValue(dns.TypeCAA, value)
+			if err != nil {
+				return nil, err
+			}
+			caa := rr.(*dns.CAA)
+			record.Value = append(record.Value, RecordCAAValue{Flag: caa.Flag, Tag: caa.Tag, Content: caa.Value})
+		}
+		return record, nil
+	case "ns":
+		record := &RecordNS{Hostname: v.Hostname, View: v.View, TTL: v.TTL}
+		for _, value := range v.Value {
+			rr, err := parseRRValue(dns.TypeNS, value)
+			if err != nil {
+				return nil, err
+			}
+			record.Value = append(record.Value, RecordNSValue{Ns: rr.(*dns.NS).Ns})
+		}
+		return record, nil
+	default:
+		return nil, errors.New("unsupported hostname type")
+	}
+}
+
+// whereKey 为 tx 添加查找 view 视图中 typ 类型、规则为 hostname 的记录的条件。PTR 记录的 hostname 为 ip 地址。
+func whereKey(tx *gorm.DB, typ string, hostname string, view string) (*gorm.DB, error) {
+	if typ == "ptr" {
+		addr, err := parsePTRAddr(hostname)
+		if err != nil {
+			return nil, err
+		}
+		hi, lo := AddrToInt(addr)
+		return tx.Where("ip_addr_hi = ? AND ip_addr_lo = ? AND view_name = ?", hi, lo, view), nil
+	}
+	return tx.Where("hostname = ? AND view_name = ?", hostname, view), nil
+}
+
+// deleteRecord 删除 view 视图中 typ 类型、规则为 hostname 的记录及其所有值，返回删除的记录数。
+func deleteRecord(tx *gorm.DB, typ string, hostname string, view string) (int64, error) {
+	record, value, ok := newModel(typ)
+	if !ok {
+		return 0, errors.New("unsupported hostname type")
+	}
+	q, err := whereKey(tx.Model(record), typ, hostname, view)
+	if err != nil {
+		return 0, err
+	}
+	var ids []int
+	if err := q.Pluck("id", &ids).Error; err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	if value != nil {
+		if err := tx.Where("record_refer IN ?", ids).Delete(value).Error; err != nil {
+			return 0, err
+		}
+	}
+	result := tx.Where("id IN ?", ids).Delete(record)
+	return result.RowsAffected, result.Error
+}
+
+// upsertRecord 保存 v，已经存在的同视图同类型同规则的记录会被替换。created 表示记录之前不存在。
+// 修改会以 actor 的身份记录到审计日志中。
+func upsertRecord(tx *gorm.DB, v recordView, actor *actor) (created bool, err error) {
+	record, err := buildRecord(v)
+	if err != nil {
+		return false, &badRequestError{err: err}
+	}
+	old, err := findRecordView(tx, v.Type, v.Hostname, v.View)
+	if err != nil {
+		return false, err
+	}
+	if old != nil {
+		if _, err := deleteRecord(tx, v.Type, v.Hostname, v.View); err != nil {
+			return false, err
+		}
+	}
+	if err := tx.Create(record).Error; err != nil {
+		return false, err
+	}
+	newView := record.view()
+	if err := writeAuditLog(tx, actor, old, &newView); err != nil {
+		return false, err
+	}
+	return old == nil, nil
+}
+
+// removeRecord 删除 view 视图中 typ 类型、规则为 hostname 的记录，并以 actor 的身份记录到审计日志中。
+// 记录不存在时 found 为 false。
+func removeRecord(tx *gorm.DB, typ string, hostname string, view string, actor *actor) (found bool, err error) {
+	old, err := findRecordView(tx, typ, hostname, view)
+	if err != nil || old == nil {
+		return false, err
+	}
+	if _, err := deleteRecord(tx, typ, hostname, view); err != nil {
+		return false, err
+	}
+	return true, writeAuditLog(tx, actor, old, nil)
+}
+
+// findRecordView 查找 view 视图中 typ 类型、规则为 hostname 的记录，不存在时返回 nil。
+func findRecordView(tx *gorm.DB, typ string, hostname string, view string) (*recordView, error) {
+	m, err := findRecordModel(tx, typ, hostname, view)
+	if err != nil || m == nil {
+		return nil, err
+	}
+	v := m.view()
+	return &v, nil
+}
+
+// findRecordModel 与 findRecordView 相同，但是返回数据库模型。
+func findRecordModel(tx *gorm.DB, typ string, hostname string, view string) (recordModel, error) {
+	q, err := whereKey(tx, typ, hostname, view)
+	if err != nil {
+		return nil, &badRequestError{err: err}
+	}
+	models, err := findRecordsByType(q.Limit(1), typ)
+	if err != nil {
+		return nil, err
+	}
+	if len(models) == 0 {
+		return nil, nil
+	}
+	return models[0], nil
+}
+
+// badRequestError 表示请求中的记录不合法，api 应该返回 400。
+type badRequestError struct {
+	err error
+}
+
+func (e *badRequestError) Error() string {
+	return e.err.Error()
+}
+
+func (e *badRequestError) Unwrap() error {
+	return e.err
+}
+
+// findRecords 查找 tx 条件下的所有 T 类型记录及其值。
+func findRecords[T any, PT interface {
+	*T
+	recordModel
+}](tx *gorm.DB) ([]recordModel, error) {
+	var records []T
+	if err := tx.Preload(clause.Associations).Order("id").Find(&records).Error; err != nil {
+		return nil, err
+	}
+	models := make([]recordModel, 0, len(records))
+	for i := range records {
+		models = append(models, PT(&records[i]))
+	}
+	return models, nil
+}
+
+func findRecordsByType(tx *gorm.DB, typ string) ([]recordModel, error) {
+	switch typ {
+	case "a":
+		return findRecords[RecordA](tx)
+	case "aaaa":
+		return findRecords[RecordAAAA](tx)
+	case "txt":
+		return findRecords[RecordTXT](tx)
+	case "ptr":
+		return findRecords[RecordPTR](tx)
+	case "cname":
+		return findRecords[RecordCNAME](tx)
+	case "mx":
+		return findRecords[RecordMX](tx)
+	case "srv":
+		return findRecords[RecordSRV](tx)
+	case "caa":
+		return findRecords[RecordCAA](tx)
+	case "ns":
+		return findRecords[RecordNS](tx)
+	default:
+		return nil, errors.New("unsupported hostname type")
+	}
+}
@@ -0,0 +1,276 @@
+package custom_dns
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// rrSet 是一个域名规则下某一类型的所有记录。
+type rrSet struct {
+	rrs     []dns.RR // owner 为空，应答时复制并设置 owner
+	shuffle bool     // 应答时是否打乱顺序
+}
+
+// answer 复制 rrSet 中的 rr 并将 owner 设置为 name。
+func (s *rrSet) answer(name string) []dns.RR {
+	rrs := make([]dns.RR, 0, len(s.rrs))
+	for _, rr := range s.rrs {
+		rr = dns.Copy(rr)
+		rr.Header().Name = name
+		rrs = append(rrs, rr)
+	}
+	if s.shuffle {
+		if len(rrs) == 1 {
+			if txt, ok := rrs[0].(*dns.TXT); ok {
+				shuffle(txt.Txt)
+			}
+		}
+		shuffle(rrs)
+	}
+	return rrs
+}
+
+// nameRecords 是一个域名规则下所有类型的记录。
+type nameRecords map[uint16]*rrSet
+
+// snapshot 是数据库中所有记录的只读内存索引，每个视图的记录保存在单独的 viewRecords 中。
+// snapshot 创建后不会再被修改，数据库更新时会创建新的 snapshot 并原子地替换旧的 snapshot。
+type snapshot struct {
+	views map[string]*viewRecords // key 为视图名称，默认视图为 ""
+}
+
+// viewRecords 是一个视图中的所有记录，与 domain.MixMatcher 类似，三种匹配方式分别保存在不同的 map 中。
+type viewRecords struct {
+	full     map[string]nameRecords // 精准匹配
+	wildcard map[string]nameRecords // *. 匹配，key 为去掉 "*." 后的域名
+	domain   map[string]nameRecords // domain: 匹配，key 为去掉 "domain:" 后的域名
+
+	ptr     map[netip.Addr]*rrSet    // 手动设置的 PTR 记录
+	reverse map[netip.Addr][]reverse // 根据 A/AAAA 记录反查 PTR
+}
+
+type reverse struct {
+	hostname string
+	ttl      uint
+}
+
+func newViewRecords() *viewRecords {
+	return &viewRecords{
+		full:     make(map[string]nameRecords),
+		wildcard: make(map[string]nameRecords),
+		domain:   make(map[string]nameRecords),
+		ptr:      make(map[netip.Addr]*rrSet),
+		reverse:  make(map[netip.Addr][]reverse),
+	}
+}
+
+// view 返回名称为 name 的视图，不存在时创建。只在创建 snapshot 时使用。
+func (s *snapshot) view(name string) *viewRecords {
+	vr := s.views[name]
+	if vr == nil {
+		vr = newViewRecords()
+		s.views[name] = vr
+	}
+	return vr
+}
+
+// lookup 返回 view 视图查询时依次查找的 viewRecords：先查找 view 视图，再查找默认视图。
+func (s *snapshot) lookup(view string) []*viewRecords {
+	var vrs []*viewRecords
+	if len(view) > 0 {
+		if vr := s.views[view]; vr != nil {
+			vrs = append(vrs, vr)
+		}
+	}
+	if vr := s.views[""]; vr != nil {
+		vrs = append(vrs, vr)
+	}
+	return vrs
+}
+
+// add 将规则为 pattern 的 typ 类型记录加入索引。
+func (s *viewRecords) add(pattern string, typ uint16, rrs []dns.RR, shuffle bool) {
+	var m map[string]nameRecords
+	switch {
+	case strings.HasPrefix(pattern, "*."):
+		m, pattern = s.wildcard, pattern[2:]
+	case strings.HasPrefix(pattern, "domain:"):
+		m, pattern = s.domain, pattern[7:]
+	default:
+		m = s.full
+	}
+	nr := m[pattern]
+	if nr == nil {
+		nr = make(nameRecords)
+		m[pattern] = nr
+	}
+	nr[typ] = &rrSet{rrs: rrs, shuffle: shuffle}
+}
+
+// match 按照 精准匹配 > *. 匹配 > domain: 匹配 的顺序依次用 hostname 可以匹配的规则调用 f，直到 f 返回 true。
+func (s *viewRecords) match(hostname string, f func(nr nameRecords) bool) {
+	if nr, ok := s.full[hostname]; ok && f(nr) {
+		return
+	}
+	if subDomain := GetSubDomain(hostname); subDomain != "" {
+		if nr, ok := s.wildcard[subDomain]; ok && f(nr) {
+			return
+		}
+	}
+	ds := NewDomainScanner(hostname)
+	for {
+		if nr, ok := s.domain[ds.NextLabel()]; ok && f(nr) {
+			return
+		}
+		if !ds.Scan() {
+			return
+		}
+	}
+}
+
+// loadSnapshot 从数据库中读取所有记录并创建 snapshot。
+func loadSnapshot(db *gorm.DB) (*snapshot, error) {
+	s := &snapshot{views: make(map[string]*viewRecords)}
+
+	var recordA []RecordA
+	if err := db.Preload("Value").Find(&recordA).Error; err != nil {
+		return nil, err
+	}
+	for i := range recordA {
+		r := &recordA[i]
+		s.view(r.View).add(r.Hostname, dns.TypeA, r.rrs(""), true)
+		if isRealHostname(r.Hostname) {
+			for _, v := range r.Value {
+				var b [4]byte
+				binary.BigEndian.PutUint32(b[:], v.IPAddr)
+				s.view(r.View).addReverse(netip.AddrFrom4(b), r.Hostname, r.TTL)
+			}
+		}
+	}
+
+	var recordAAAA []RecordAAAA
+	if err := db.Preload("Value").Find(&recordAAAA).Error; err != nil {
+		return nil, err
+	}
+	for i := range recordAAAA {
+		r := &recordAAAA[i]
+		s.view(r.View).add(r.Hostname, dns.TypeAAAA, r.rrs(""), true)
+		if isRealHostname(r.Hostname) {
+			for _, v := range r.Value {
+				s.view(r.View).addReverse(IntIPv6toAddr(v.IPAddrHi, v.IPAddrLo), r.Hostname, r.TTL)
+			}
+		}
+	}
+
+	var recordTXT []RecordTXT
+	if err := db.Preload("Value").Find(&recordTXT).Error; err != nil {
+		return nil, err
+	}
+	for i := range recordTXT {
+		s.view(recordTXT[i].View).add(recordTXT[i].Hostname, dns.TypeTXT, recordTXT[i].rrs(""), true)
+	}
+
+	var recordCNAME []RecordCNAME
+	if err := db.Find(&recordCNAME).Error; err != nil {
+		return nil, err
+	}
+	for i := range recordCNAME {
+		s.view(recordCNAME[i].View).add(recordCNAME[i].Hostname, dns.TypeCNAME, recordCNAME[i].rrs(""), false)
+	}
+
+	var recordMX []RecordMX
+	if err := db.Preload("Value").Find(&recordMX).Error; err != nil {
+		return nil, err
+	}
+	for i := range recordMX {
+		s.view(recordMX[i].View).add(recordMX[i].Hostname, dns.TypeMX, recordMX[i].rrs(""), false)
+	}
+
+	var recordSRV []RecordSRV
+	if err := db.Preload("Value").Find(&recordSRV).Error; err != nil {
+		return nil, err
+	}
+	for i := range recordSRV {
+		s.view(recordSRV[i].View).add(recordSRV[i].Hostname, dns.TypeSRV, recordSRV[i].rrs(""), false)
+	}
+
+	var recordCAA []RecordCAA
+	if err := db.Preload("Value").Find(&recordCAA).Error; err != nil {
+		return nil, err
+	}
+	for i := range recordCAA {
+		s.view(recordCAA[i].View).add(recordCAA[i].Hostname, dns.TypeCAA, recordCAA[i].rrs(""), false)
+	}
+
+	var recordNS []RecordNS
+	if err := db.Preload("Value").Find(&recordNS).Error; err != nil {
+		return nil, err
+	}
+	for i := range recordNS {
+		s.view(recordNS[i].View).add(recordNS[i].Hostname, dns.TypeNS, recordNS[i].rrs(""), false)
+	}
+
+	var recordPTR []RecordPTR
+	if err := db.Preload("Value").Find(&recordPTR).Error; err != nil {
+		return nil, err
+	}
+	for i := range recordPTR {
+		r := &recordPTR[i]
+		addr := IntIPv6toAddr(r.IPAddrHi, r.IPAddrLo).Unmap()
+		s.view(r.View).ptr[addr] = &rrSet{rrs: r.rrs("")}
+	}
+	return s, nil
+}
+
+func (s *viewRecords) addReverse(addr netip.Addr, hostname string, ttl uint) {
+	addr = addr.Unmap()
+	s.reverse[addr] = append(s.reverse[addr], reverse{hostname: hostname, ttl: ttl})
+}
+
+// isRealHostname 通配符和 domain: 规则不是真实的域名，不能用于 PTR 反查。
+func isRealHostname(hostname string) bool {
+	return !strings.HasPrefix(hostname, "*.") && !strings.HasPrefix(hostname, "domain:")
+}
+
+// reload 从数据库重新加载 snapshot 并替换旧的 snapshot。
+func (cdns *CustomDns) reload() error {
+	cdns.reloadMu.Lock()
+	defer cdns.reloadMu.Unlock()
+	s, err := loadSnapshot(cdns.db)
+	if err != nil {
+		return err
+	}
+	cdns.snapshot.Store(s)
+	return nil
+}
+
+// reloadAfterUpdate 在 api 修改数据库后调用。
+func (cdns *CustomDns) reloadAfterUpdate() {
+	if err := cdns.reload(); err != nil {
+		cdns.logger.Error("failed to reload records after update", zap.Error(err))
+	}
+}
+
+// startReloadLoop 定期从数据库重新加载记录，用于同步其他共用数据库的 mosdns 节点的修改。
+func (cdns *CustomDns) startReloadLoop(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := cdns.reload(); err != nil {
+					cdns.logger.Error("failed to reload records", zap.Error(err))
+				}
+			case <-cdns.closeNotify:
+				return
+			}
+		}
+	}()
+}
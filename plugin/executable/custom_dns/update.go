@@ -0,0 +1,471 @@
+package custom_dns
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// UpdateArgs 是动态更新(RFC 2136)的设置。没有设置 TsigKeys 时不处理更新请求。
+type UpdateArgs struct {
+	// Zones 允许动态更新的区域，例如 "example.com" 或者 "1.168.192.in-addr.arpa"。
+	Zones []string `yaml:"zones"`
+	// TsigKeys 更新请求必须使用其中一个密钥签名。
+	TsigKeys []TsigKeyArgs `yaml:"tsig_keys"`
+}
+
+type TsigKeyArgs struct {
+	Name      string `yaml:"name"`      // 密钥名称，与 nsupdate 等客户端中的名称相同
+	Algorithm string `yaml:"algorithm"` // hmac-sha1、hmac-sha224、hmac-sha256(默认)、hmac-sha384 或者 hmac-sha512
+	Secret    string `yaml:"secret"`    // base64 编码的密钥
+}
+
+type tsigKey struct {
+	algorithm string
+	secret    string
+}
+
+// updater 保存动态更新的设置。
+type updater struct {
+	zones map[string]struct{} // 小写的 fqdn
+	keys  map[string]tsigKey  // key 为小写的 fqdn 格式的密钥名称
+}
+
+func newUpdater(args UpdateArgs) (*updater, error) {
+	if len(args.TsigKeys) == 0 {
+		return nil, nil
+	}
+	if len(args.Zones) == 0 {
+		return nil, errors.New("update zones are not configured")
+	}
+	u := &updater{zones: make(map[string]struct{}), keys: make(map[string]tsigKey)}
+	for _, z := range args.Zones {
+		u.zones[dns.CanonicalName(z)] = struct{}{}
+	}
+	for i, k := range args.TsigKeys {
+		if len(k.Name) == 0 {
+			return nil, fmt.Errorf("tsig key #%d has no name", i)
+		}
+		alg := dns.CanonicalName(k.Algorithm)
+		if len(k.Algorithm) == 0 {
+			alg = dns.HmacSHA256
+		}
+		switch alg {
+		case dns.HmacSHA1, dns.HmacSHA224, dns.HmacSHA256, dns.HmacSHA384, dns.HmacSHA512:
+		default:
+			return nil, fmt.Errorf("tsig key %s: unsupported algorithm %s", k.Name, k.Algorithm)
+		}
+		if _, err := base64.StdEncoding.DecodeString(k.Secret); err != nil || len(k.Secret) == 0 {
+			return nil, fmt.Errorf("tsig key %s: invalid base64 secret", k.Name)
+		}
+		u.keys[dns.CanonicalName(k.Name)] = tsigKey{algorithm: alg, secret: k.Secret}
+	}
+	return u, nil
+}
+
+// execUpdate 处理动态更新请求。更新只修改默认视图中的记录。
+func (cdns *CustomDns) execUpdate(qCtx *query_context.Context) error {
+	q := qCtx.Q()
+	r := new(dns.Msg)
+	r.SetReply(q)
+	reply := func(rcode int) error {
+		r.Rcode = rcode
+		qCtx.SetResponse(r)
+		return nil
+	}
+
+	zone := q.Question[0]
+	if zone.Qtype != dns.TypeSOA || zone.Qclass != dns.ClassINET {
+		return reply(dns.RcodeFormatError)
+	}
+	zoneName := dns.CanonicalName(zone.Name)
+	if _, ok := cdns.updater.zones[zoneName]; !ok {
+		return reply(dns.RcodeNotAuth)
+	}
+
+	// NewContext 会把 OPT 移动到最后，所以 TSIG 不一定是最后一个 rr。
+	var tsig *dns.TSIG
+	for _, rr := range q.Extra {
+		if t, ok := rr.(*dns.TSIG); ok {
+			tsig = t
+		}
+	}
+	if tsig == nil || qCtx.ServerMeta.RawQuery == nil {
+		return reply(dns.RcodeRefused)
+	}
+	key, ok := cdns.updater.keys[dns.CanonicalName(tsig.Hdr.Name)]
+	if !ok || key.algorithm != dns.CanonicalName(tsig.Algorithm) {
+		return reply(dns.RcodeNotAuth)
+	}
+	if err := dns.TsigVerify(qCtx.ServerMeta.RawQuery, key.secret, "", false); err != nil {
+		cdns.logger.Warn("tsig verification failed", qCtx.InfoField(), zap.Error(err))
+		return reply(dns.RcodeNotAuth)
+	}
+	qCtx.SetRespSigner(tsigSigner(tsig, key.secret))
+
+	a := &actor{Name: "tsig:" + strings.TrimSuffix(dns.CanonicalName(tsig.Hdr.Name), ".")}
+	if addr := qCtx.ServerMeta.ClientAddr; addr.IsValid() {
+		a.RemoteAddr = addr.String()
+	}
+	// 预先检查所有更新，任何一个更新不合法时都不修改数据库 (RFC 2136 3.4.1)
+	for _, rr := range q.Ns {
+		if rcode := prescanUpdate(rr, zoneName); rcode != dns.RcodeSuccess {
+			return reply(rcode)
+		}
+	}
+
+	cdns.updateMu.Lock()
+	defer cdns.updateMu.Unlock()
+	rcode := dns.RcodeSuccess
+	err := cdns.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if rcode, err = checkPrerequisites(tx, q.Answer, zoneName); err != nil || rcode != dns.RcodeSuccess {
+			return err
+		}
+		for _, rr := range q.Ns {
+			if err := applyUpdate(tx, rr, zoneName, a); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		cdns.logger.Error("failed to apply update", qCtx.InfoField(), zap.Error(err))
+		return reply(dns.RcodeServerFailure)
+	}
+	if rcode == dns.RcodeSuccess && len(q.Ns) > 0 {
+		cdns.reloadAfterUpdate()
+	}
+	return reply(rcode)
+}
+
+// tsigSigner 返回使用 secret 签名应答的函数，req 为请求中的 TSIG。
+func tsigSigner(req *dns.TSIG, secret string) func(m *dns.Msg) error {
+	return func(m *dns.Msg) error {
+		t := &dns.TSIG{
+			Hdr:       dns.RR_Header{Name: req.Hdr.Name, Rrtype: dns.TypeTSIG, Class: dns.ClassANY},
+			Algorithm: req.Algorithm,
+			Fudge:     300,
+			OrigId:    m.Id,
+		}
+		m.Extra = append(m.Extra, t)
+		// TsigGenerate 会从 m 中移除 t 并设置 t 的签名时间，这里将带有 MAC 的 t 重新放回 m 中。
+		_, mac, err := dns.TsigGenerate(m, secret, req.MAC, false)
+		if err != nil {
+			return err
+		}
+		t.MAC, t.MACSize = mac, uint16(len(mac)/2)
+		m.Extra = append(m.Extra, t)
+		return nil
+	}
+}
+
+func inZone(name string, zone string) bool {
+	return dns.IsSubDomain(zone, dns.CanonicalName(name))
+}
+
+// updatableType 返回 typ 在 api 中的名称。ok 为 false 时表示不能保存这个类型的记录。
+func updatableType(typ uint16) (name string, ok bool) {
+	if isSupportedType(typ) {
+		return strings.ToLower(dns.TypeToString[typ]), true
+	}
+	return "", false
+}
+
+// updateHostname 返回动态更新中 name 的 typ 类型记录在数据库中的规则。PTR 记录为 ip 地址。
+func updateHostname(name string, typ string) (string, error) {
+	hostname := strings.TrimSuffix(dns.CanonicalName(name), ".")
+	if typ == "ptr" {
+		addr, err := parsePTRAddr(hostname)
+		if err != nil {
+			return "", err
+		}
+		return addr.Unmap().String(), nil
+	}
+	return hostname, checkHostname(hostname)
+}
+
+// isMetaType 返回 typ 是否是不能出现在更新中的元类型。
+func isMetaType(typ uint16) bool {
+	switch typ {
+	case dns.TypeANY, dns.TypeAXFR, dns.TypeIXFR, dns.TypeMAILA, dns.TypeMAILB, dns.TypeOPT, dns.TypeTSIG, dns.TypeTKEY:
+		return true
+	}
+	return false
+}
+
+// prescanUpdate 检查一个更新是否合法 (RFC 2136 3.4.1.3)。
+func prescanUpdate(rr dns.RR, zone string) int {
+	h := rr.Header()
+	if !inZone(h.Name, zone) {
+		return dns.RcodeNotZone
+	}
+	switch h.Class {
+	case dns.ClassINET:
+		typ, ok := updatableType(h.Rrtype)
+		if !ok {
+			if isMetaType(h.Rrtype) {
+				return dns.RcodeFormatError
+			}
+			return dns.RcodeRefused // 例如 SOA 和 DHCID，数据库无法保存
+		}
+		if _, err := updateHostname(h.Name, typ); err != nil {
+			return dns.RcodeRefused
+		}
+	case dns.ClassANY:
+		if h.Ttl != 0 || h.Rdlength != 0 || (h.Rrtype != dns.TypeANY && isMetaType(h.Rrtype)) {
+			return dns.RcodeFormatError
+		}
+	case dns.ClassNONE:
+		if h.Ttl != 0 || isMetaType(h.Rrtype) {
+			return dns.RcodeFormatError
+		}
+	default:
+		return dns.RcodeFormatError
+	}
+	return dns.RcodeSuccess
+}
+
+// loadRRset 读取默认视图中 name 的 typ 类型记录，owner 为 name。
+// TXT 记录的每个字符串拆分为单独的 rr。记录不存在或者不能保存这个类型时 found 为 false。
+func loadRRset(tx *gorm.DB, name string, typ uint16) (rrs []dns.RR, found bool, err error) {
+	typName, ok := updatableType(typ)
+	if !ok {
+		return nil, false, nil
+	}
+	hostname, err := updateHostname(name, typName)
+	if err != nil {
+		return nil, false, nil
+	}
+	m, err := findRecordModel(tx, typName, hostname, "")
+	if err != nil || m == nil {
+		return nil, false, err
+	}
+	for _, rr := range m.rrs(name) {
+		rrs = append(rrs, explodeRR(rr)...)
+	}
+	return rrs, true, nil
+}
+
+// saveRRset 将 rrs 保存为默认视图中 name 的 typ 类型记录，rrs 为空时删除记录。
+func saveRRset(tx *gorm.DB, name string, typ uint16, rrs []dns.RR, ttl uint32, a *actor) error {
+	typName, _ := updatableType(typ)
+	hostname, err := updateHostname(name, typName)
+	if err != nil {
+		return err
+	}
+	if len(rrs) == 0 {
+		_, err := removeRecord(tx, typName, hostname, "", a)
+		return err
+	}
+	v := recordView{Hostname: hostname, Type: typName, TTL: uint(ttl)}
+	for _, rr := range rrs {
+		if txt, ok := rr.(*dns.TXT); ok {
+			v.Value = append(v.Value, txt.Txt...)
+		} else {
+			v.Value = append(v.Value, formatRRValue(rr))
+		}
+	}
+	_, err = upsertRecord(tx, v, a)
+	return err
+}
+
+// nameInUse 返回默认视图中 name 是否有任何类型的记录。
+func nameInUse(tx *gorm.DB, name string) (bool, error) {
+	for _, typ := range recordTypes {
+		_, found, err := loadRRset(tx, name, dns.StringToType[strings.ToUpper(typ)])
+		if err != nil || found {
+			return found, err
+		}
+	}
+	return false, nil
+}
+
+// containsRR 返回 rrs 中是否有与 rr 的数据相同的 rr，忽略 class 和 ttl。
+func containsRR(rrs []dns.RR, rr dns.RR) bool {
+	return indexRR(rrs, rr) >= 0
+}
+
+func indexRR(rrs []dns.RR, rr dns.RR) int {
+	rr = dns.Copy(rr)
+	rr.Header().Class = dns.ClassINET
+	for i, r := range rrs {
+		if dns.IsDuplicate(r, rr) {
+			return i
+		}
+	}
+	return -1
+}
+
+// explodeRR 将有多个字符串的 TXT 记录拆分为多个 rr，与 loadRRset 保持一致。
+func explodeRR(rr dns.RR) []dns.RR {
+	txt, ok := rr.(*dns.TXT)
+	if !ok || len(txt.Txt) <= 1 {
+		return []dns.RR{rr}
+	}
+	var rrs []dns.RR
+	for _, s := range txt.Txt {
+		rrs = append(rrs, &dns.TXT{Hdr: txt.Hdr, Txt: []string{s}})
+	}
+	return rrs
+}
+
+// checkPrerequisites 检查更新的前提条件 (RFC 2136 3.2)。
+func checkPrerequisites(tx *gorm.DB, prereqs []dns.RR, zone string) (int, error) {
+	type rrsetKey struct {
+		name string
+		typ  uint16
+	}
+	// class 为 IN 的前提条件要求记录集与请求中的所有 rr 完全相同，需要先收集所有 rr 再比较。
+	valueDependent := make(map[rrsetKey][]dns.RR)
+	var keys []rrsetKey
+	for _, rr := range prereqs {
+		h := rr.Header()
+		if h.Ttl != 0 {
+			return dns.RcodeFormatError, nil
+		}
+		if !inZone(h.Name, zone) {
+			return dns.RcodeNotZone, nil
+		}
+		switch h.Class {
+		case dns.ClassANY, dns.ClassNONE:
+			if h.Rdlength != 0 {
+				return dns.RcodeFormatError, nil
+			}
+			var exists bool
+			var err error
+			if h.Rrtype == dns.TypeANY {
+				exists, err = nameInUse(tx, h.Name)
+			} else {
+				_, exists, err = loadRRset(tx, h.Name, h.Rrtype)
+			}
+			if err != nil {
+				return dns.RcodeServerFailure, err
+			}
+			switch {
+			case h.Class == dns.ClassANY && !exists && h.Rrtype == dns.TypeANY:
+				return dns.RcodeNameError, nil
+			case h.Class == dns.ClassANY && !exists:
+				return dns.RcodeNXRrset, nil
+			case h.Class == dns.ClassNONE && exists && h.Rrtype == dns.TypeANY:
+				return dns.RcodeYXDomain, nil
+			case h.Class == dns.ClassNONE && exists:
+				return dns.RcodeYXRrset, nil
+			}
+		case dns.ClassINET:
+			k := rrsetKey{name: dns.CanonicalName(h.Name), typ: h.Rrtype}
+			if _, ok := valueDependent[k]; !ok {
+				keys = append(keys, k)
+			}
+			for _, r := range explodeRR(rr) {
+				if !containsRR(valueDependent[k], r) {
+					valueDependent[k] = append(valueDependent[k], r)
+				}
+			}
+		default:
+			return dns.RcodeFormatError, nil
+		}
+	}
+	for _, k := range keys {
+		want := valueDependent[k]
+		rrs, _, err := loadRRset(tx, k.name, k.typ)
+		if err != nil {
+			return dns.RcodeServerFailure, err
+		}
+		if len(rrs) != len(want) {
+			return dns.RcodeNXRrset, nil
+		}
+		for _, rr := range want {
+			if !containsRR(rrs, rr) {
+				return dns.RcodeNXRrset, nil
+			}
+		}
+	}
+	return dns.RcodeSuccess, nil
+}
+
+// applyUpdate 执行一个已经通过 prescanUpdate 检查的更新 (RFC 2136 3.4.2)。
+func applyUpdate(tx *gorm.DB, rr dns.RR, zone string, a *actor) error {
+	h := rr.Header()
+	isApex := dns.CanonicalName(h.Name) == zone
+	switch h.Class {
+	case dns.ClassINET:
+		// 同一个域名不能同时有 CNAME 和其他记录，冲突的更新会被忽略
+		if h.Rrtype == dns.TypeCNAME {
+			for _, typ := range recordTypes {
+				if typ == "cname" {
+					continue
+				}
+				_, found, err := loadRRset(tx, h.Name, dns.StringToType[strings.ToUpper(typ)])
+				if err != nil || found {
+					return err
+				}
+			}
+			return saveRRset(tx, h.Name, h.Rrtype, []dns.RR{rr}, h.Ttl, a)
+		}
+		if _, found, err := loadRRset(tx, h.Name, dns.TypeCNAME); err != nil || found {
+			return err
+		}
+		rrs, _, err := loadRRset(tx, h.Name, h.Rrtype)
+		if err != nil {
+			return err
+		}
+		for _, r := range explodeRR(rr) {
+			if !containsRR(rrs, r) {
+				rrs = append(rrs, r)
+			}
+		}
+		// 记录集中所有 rr 使用相同的 ttl，新添加的 rr 的 ttl 会替换原来的 ttl
+		return saveRRset(tx, h.Name, h.Rrtype, rrs, h.Ttl, a)
+	case dns.ClassANY:
+		types := []uint16{h.Rrtype}
+		if h.Rrtype == dns.TypeANY {
+			types = nil
+			for _, typ := range recordTypes {
+				types = append(types, dns.StringToType[strings.ToUpper(typ)])
+			}
+		}
+		for _, typ := range types {
+			if _, ok := updatableType(typ); !ok || (isApex && typ == dns.TypeNS) {
+				continue // 区域顶点的 NS 记录不能被删除
+			}
+			if _, found, err := loadRRset(tx, h.Name, typ); err != nil || !found {
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			if err := saveRRset(tx, h.Name, typ, nil, 0, a); err != nil {
+				return err
+			}
+		}
+		return nil
+	case dns.ClassNONE:
+		rrs, found, err := loadRRset(tx, h.Name, h.Rrtype)
+		if err != nil || !found {
+			return err
+		}
+		var ttl uint32
+		if len(rrs) > 0 {
+			ttl = rrs[0].Header().Ttl
+		}
+		changed := false
+		for _, r := range explodeRR(rr) {
+			if i := indexRR(rrs, r); i >= 0 {
+				rrs = append(rrs[:i], rrs[i+1:]...)
+				changed = true
+			}
+		}
+		if !changed || (isApex && h.Rrtype == dns.TypeNS && len(rrs) == 0) {
+			return nil
+		}
+		return saveRRset(tx, h.Name, h.Rrtype, rrs, ttl, a)
+	}
+	return nil
+}
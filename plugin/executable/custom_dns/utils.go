@@ -6,9 +6,13 @@ import (
 	"fmt"
 	"math/rand"
 	"net"
+	"net/netip"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/miekg/dns"
 )
 
 func shuffle[T any](slice []T) {
@@ -60,9 +64,53 @@ func StringIPv6toInt(ipstring string) (int64, int64, error) {
 	return int64(binary.BigEndian.Uint64(buf[:8])), int64(binary.BigEndian.Uint64(buf[8:])), nil
 }
 
-func (cdns *CustomDns) queryRecordA(hostname string) *RecordA {
-	var record []RecordA
-	result := cdns.db.Where("hostname = ?", hostname).Preload("Value").Limit(1).Find(&record)
+// IntIPv6toAddr 是 AddrToInt 的逆操作。
+func IntIPv6toAddr(IPAddrHi int64, IPAddrLo int64) netip.Addr {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(IPAddrHi))
+	binary.BigEndian.PutUint64(b[8:], uint64(IPAddrLo))
+	return netip.AddrFrom16(b)
+}
+
+// parsePTRAddr 解析 api 中 PTR 记录的地址，支持 ip 地址和 in-addr.arpa/ip6.arpa 格式的域名。
+func parsePTRAddr(s string) (netip.Addr, error) {
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return addr, nil
+	}
+	addr, err := dnsutils.ParsePTRQName(dns.Fqdn(s))
+	if err != nil {
+		return netip.Addr{}, errors.New("invalid ptr address: " + s)
+	}
+	return addr, nil
+}
+
+// parseRRValue 以 zone 文件的格式解析 api 中 typ 类型记录的值，例如 MX 记录的值 "10 mail.example.com"。
+func parseRRValue(typ uint16, value string) (dns.RR, error) {
+	rr, err := dns.NewRR(". 0 IN " + dns.TypeToString[typ] + " " + value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s value %q: %w", dns.TypeToString[typ], value, err)
+	}
+	if rr == nil || rr.Header().Rrtype != typ {
+		return nil, fmt.Errorf("invalid %s value %q", dns.TypeToString[typ], value)
+	}
+	return rr, nil
+}
+
+// formatRRValue 是 parseRRValue 的逆操作，返回 rr 去掉 header 后的部分。
+func formatRRValue(rr dns.RR) string {
+	return strings.TrimPrefix(rr.String(), rr.Header().String())
+}
+
+// AddrToInt 将 ip 地址转换为 PTR 记录使用的两个 int64。IPv4 地址会被转换为 IPv4-mapped IPv6 地址。
+func AddrToInt(addr netip.Addr) (int64, int64) {
+	b := addr.As16()
+	return int64(binary.BigEndian.Uint64(b[:8])), int64(binary.BigEndian.Uint64(b[8:]))
+}
+
+// queryRecord 查找规则为 hostname 的记录及其所有值
+func queryRecord[T any](cdns *CustomDns, hostname string, view string) *T {
+	var record []T
+	result := cdns.db.Where("hostname = ? AND view_name = ?", hostname, view).Preload("Value").Limit(1).Find(&record)
 	if result.Error != nil {
 		cdns.logger.Error("db error:" + result.Error.Error())
 		return nil
@@ -73,9 +121,37 @@ func (cdns *CustomDns) queryRecordA(hostname string) *RecordA {
 	return &record[0]
 }
 
-func (cdns *CustomDns) queryRecordAAAA(hostname string) *RecordAAAA {
-	var record []RecordAAAA
-	result := cdns.db.Where("hostname = ?", hostname).Preload("Value").Limit(1).Find(&record)
+func (cdns *CustomDns) queryRecordA(hostname string, view string) *RecordA {
+	return queryRecord[RecordA](cdns, hostname, view)
+}
+
+func (cdns *CustomDns) queryRecordAAAA(hostname string, view string) *RecordAAAA {
+	return queryRecord[RecordAAAA](cdns, hostname, view)
+}
+
+func (cdns *CustomDns) queryRecordTXT(hostname string, view string) *RecordTXT {
+	return queryRecord[RecordTXT](cdns, hostname, view)
+}
+
+func (cdns *CustomDns) queryRecordMX(hostname string, view string) *RecordMX {
+	return queryRecord[RecordMX](cdns, hostname, view)
+}
+
+func (cdns *CustomDns) queryRecordSRV(hostname string, view string) *RecordSRV {
+	return queryRecord[RecordSRV](cdns, hostname, view)
+}
+
+func (cdns *CustomDns) queryRecordCAA(hostname string, view string) *RecordCAA {
+	return queryRecord[RecordCAA](cdns, hostname, view)
+}
+
+func (cdns *CustomDns) queryRecordNS(hostname string, view string) *RecordNS {
+	return queryRecord[RecordNS](cdns, hostname, view)
+}
+
+func (cdns *CustomDns) queryRecordCNAME(hostname string, view string) *RecordCNAME {
+	var record []RecordCNAME
+	result := cdns.db.Where("hostname = ? AND view_name = ?", hostname, view).Limit(1).Find(&record)
 	if result.Error != nil {
 		cdns.logger.Error("db error:" + result.Error.Error())
 		return nil
@@ -86,9 +162,10 @@ func (cdns *CustomDns) queryRecordAAAA(hostname string) *RecordAAAA {
 	return &record[0]
 }
 
-func (cdns *CustomDns) queryRecordTXT(hostname string) *RecordTXT {
-	var record []RecordTXT
-	result := cdns.db.Where("hostname = ?", hostname).Preload("Value").Limit(1).Find(&record)
+func (cdns *CustomDns) queryRecordPTR(addr netip.Addr, view string) *RecordPTR {
+	var record []RecordPTR
+	hi, lo := AddrToInt(addr)
+	result := cdns.db.Where("ip_addr_hi = ? AND ip_addr_lo = ? AND view_name = ?", hi, lo, view).Preload("Value").Limit(1).Find(&record)
 	if result.Error != nil {
 		cdns.logger.Error("db error:" + result.Error.Error())
 		return nil
@@ -154,8 +231,8 @@ func CheckFqdn(fqdn string) error {
 			return errors.New("subdomain names cannot start or end with \"-\"")
 		}
 		for i := 0; i < len(subDomain); i++ {
-			if !((subDomain[i] >= 'a' && subDomain[i] <= 'z') || (subDomain[i] >= '0' && subDomain[i] <= '9') || subDomain[i] == '-') {
-				return errors.New("domain name can only consist of a-z,0-9,\"-\",\".\"")
+			if !((subDomain[i] >= 'a' && subDomain[i] <= 'z') || (subDomain[i] >= '0' && subDomain[i] <= '9') || subDomain[i] == '-' || subDomain[i] == '_') {
+				return errors.New("domain name can only consist of a-z,0-9,\"-\",\"_\",\".\"")
 			}
 		}
 	}
@@ -0,0 +1,87 @@
+package custom_dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/netlist"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/IrineSistiana/mosdns/v5/plugin/matcher/base_ip"
+)
+
+// maxViewNameLen 与数据库中 view_name 列的长度相同。
+const maxViewNameLen = 64
+
+// ViewArgs 定义一个视图。客户端地址匹配 IPs、IPSets 或者 Files 中的任何一个时使用这个视图。
+type ViewArgs struct {
+	Name   string   `yaml:"name"`
+	IPs    []string `yaml:"ips"`     // ip 或者 CIDR
+	IPSets []string `yaml:"ip_sets"` // ip_set 插件的 tag
+	Files  []string `yaml:"files"`
+}
+
+// view 是一个按客户端地址选择的记录视图。
+type view struct {
+	name    string
+	matcher *base_ip.Matcher
+}
+
+// newViews 根据 args 创建视图。bq 用于查找 ip_set 插件，为 nil 时视图不能引用 ip_set。
+func newViews(bq sequence.BQ, args []ViewArgs) ([]view, error) {
+	var views []view
+	names := make(map[string]struct{})
+	for i, va := range args {
+		if len(va.Name) == 0 {
+			return nil, fmt.Errorf("view #%d has no name", i)
+		}
+		if len(va.Name) > maxViewNameLen {
+			return nil, fmt.Errorf("view #%d name too long", i)
+		}
+		if _, dup := names[va.Name]; dup {
+			return nil, fmt.Errorf("duplicated view %s", va.Name)
+		}
+		names[va.Name] = struct{}{}
+		if bq == nil && len(va.IPSets) > 0 {
+			return nil, fmt.Errorf("view %s: ip_sets are not available", va.Name)
+		}
+		m, err := base_ip.NewMatcher(bq, &base_ip.Args{IPs: va.IPs, IPSets: va.IPSets, Files: va.Files}, matchClientAddr)
+		if err != nil {
+			return nil, fmt.Errorf("view %s: %w", va.Name, err)
+		}
+		views = append(views, view{name: va.Name, matcher: m})
+	}
+	return views, nil
+}
+
+func matchClientAddr(qCtx *query_context.Context, m netlist.Matcher) (bool, error) {
+	addr := qCtx.ServerMeta.ClientAddr
+	if !addr.IsValid() {
+		return false, nil
+	}
+	return m.Match(addr), nil
+}
+
+// selectView 按顺序返回第一个匹配客户端地址的视图名称，都不匹配时返回默认视图 ""。
+func (cdns *CustomDns) selectView(ctx context.Context, qCtx *query_context.Context) string {
+	for _, v := range cdns.views {
+		if ok, _ := v.matcher.Match(ctx, qCtx); ok {
+			return v.name
+		}
+	}
+	return ""
+}
+
+// checkView 检查 api 请求中的视图是否已经在 Args.Views 中定义。
+func (cdns *CustomDns) checkView(name string) error {
+	if len(name) == 0 {
+		return nil
+	}
+	for _, v := range cdns.views {
+		if v.name == name {
+			return nil
+		}
+	}
+	return &badRequestError{err: errors.New("undefined view " + name)}
+}
@@ -54,12 +54,18 @@ type Args struct {
 	Upstreams  []UpstreamConfig `yaml:"upstreams"`
 	Concurrent int              `yaml:"concurrent"`
 
+	// Strategy of picking upstreams. Can be "random" (default), "fastest",
+	// "weighted", "round_robin" or "consistent_hash".
+	Strategy string `yaml:"strategy"`
+
 	// Global options.
 	Socks5       string `yaml:"socks5"`
 	SoMark       int    `yaml:"so_mark"`
 	BindToDevice string `yaml:"bind_to_device"`
 	Bootstrap    string `yaml:"bootstrap"`
 	BootstrapVer int    `yaml:"bootstrap_version"`
+
+	HealthCheck HealthCheckArgs `yaml:"health_check"`
 }
 
 type UpstreamConfig struct {
@@ -68,6 +74,10 @@ type UpstreamConfig struct {
 	DialAddr    string `yaml:"dial_addr"`
 	IdleTimeout int    `yaml:"idle_timeout"`
 
+	// Weight is used by "weighted" and "consistent_hash" strategies.
+	// Default is 1.
+	Weight int `yaml:"weight"`
+
 	// Deprecated: This option has no affect.
 	// TODO: (v6) Remove this option.
 	MaxConns           int  `yaml:"max_conns"`
@@ -75,6 +85,17 @@ type UpstreamConfig struct {
 	EnableHTTP3        bool `yaml:"enable_http3"`
 	InsecureSkipVerify bool `yaml:"insecure_skip_verify"`
 
+	// TLS options of tls, https, h3 and quic upstreams.
+	// See upstream.TLSOpts.
+	CAFile     string   `yaml:"ca_file"`
+	ClientCert string   `yaml:"client_cert"`
+	ClientKey  string   `yaml:"client_key"`
+	ServerName string   `yaml:"server_name"`
+	SPKIPins   []string `yaml:"spki_pins"`
+
+	// ODoHProxy is the oblivious proxy url of an "odoh://" upstream.
+	ODoHProxy string `yaml:"odoh_proxy"`
+
 	Socks5       string `yaml:"socks5"`
 	SoMark       int    `yaml:"so_mark"`
 	BindToDevice string `yaml:"bind_to_device"`
@@ -91,6 +112,7 @@ func Init(bp *coremain.BP, args any) (any, error) {
 		_ = f.Close()
 		return nil, err
 	}
+	bp.RegAPI(f.Api())
 	return f, nil
 }
 
@@ -102,7 +124,9 @@ type Forward struct {
 
 	logger       *zap.Logger
 	us           []*upstreamWrapper
+	picker       picker                      // picks from us
 	tag2Upstream map[string]*upstreamWrapper // for fast tag lookup only.
+	stopProbe    context.CancelFunc          // nil if active probes are disabled.
 }
 
 type Opts struct {
@@ -134,13 +158,50 @@ func NewForward(args *Args, opt Opts) (*Forward, error) {
 		utils.SetDefaultUnsignNum(&c.BootstrapVer, args.BootstrapVer)
 	}
 
+	hc := &args.HealthCheck
+	var probeQuery []byte
+	if hc.MaxFails > 0 {
+		hc.init()
+		if hc.Interval > 0 {
+			qtype, err := sequence.ParseQtype(hc.Qtype)
+			if err != nil {
+				return nil, fmt.Errorf("invalid health check qtype, %w", err)
+			}
+			q := new(dns.Msg)
+			q.SetQuestion(dns.Fqdn(hc.Qname), qtype)
+			probeQuery, err = q.Pack()
+			if err != nil {
+				return nil, fmt.Errorf("invalid health check query, %w", err)
+			}
+		}
+	}
+
 	for i, c := range args.Upstreams {
 		if len(c.Addr) == 0 {
 			return nil, fmt.Errorf("#%d upstream invalid args, addr is required", i)
 		}
 		applyGlobal(&c)
+		utils.SetDefaultUnsignNum(&c.Weight, 1)
+
+		tlsConfig, err := upstream.NewTLSConfig(upstream.TLSOpts{
+			InsecureSkipVerify: c.InsecureSkipVerify,
+			CAFile:             c.CAFile,
+			ClientCert:         c.ClientCert,
+			ClientKey:          c.ClientKey,
+			ServerName:         c.ServerName,
+			SPKIPins:           c.SPKIPins,
+		})
+		if err != nil {
+			_ = f.Close()
+			return nil, fmt.Errorf("#%d upstream invalid tls args, %w", i, err)
+		}
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(4)
 
 		uw := newWrapper(i, c, opt.MetricsTag)
+		uw.logger = opt.Logger
+		if hc.MaxFails > 0 {
+			uw.health = newHealth(hc)
+		}
 		uOpt := upstream.Opt{
 			DialAddr:       c.DialAddr,
 			Socks5:         c.Socks5,
@@ -149,14 +210,12 @@ func NewForward(args *Args, opt Opts) (*Forward, error) {
 			IdleTimeout:    time.Duration(c.IdleTimeout) * time.Second,
 			EnablePipeline: c.EnablePipeline,
 			EnableHTTP3:    c.EnableHTTP3,
+			ODoHProxy:      c.ODoHProxy,
 			Bootstrap:      c.Bootstrap,
 			BootstrapVer:   c.BootstrapVer,
-			TLSConfig: &tls.Config{
-				InsecureSkipVerify: c.InsecureSkipVerify,
-				ClientSessionCache: tls.NewLRUClientSessionCache(4),
-			},
-			Logger:        opt.Logger,
-			EventObserver: uw,
+			TLSConfig:      tlsConfig,
+			Logger:         opt.Logger,
+			EventObserver:  uw,
 		}
 
 		u, err := upstream.NewUpstream(c.Addr, uOpt)
@@ -176,6 +235,18 @@ func NewForward(args *Args, opt Opts) (*Forward, error) {
 		}
 	}
 
+	p, err := newPicker(args.Strategy, f.us)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	f.picker = p
+
+	if probeQuery != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		f.stopProbe = cancel
+		go f.probeLoop(ctx, hc, probeQuery)
+	}
 	return f, nil
 }
 
@@ -193,7 +264,7 @@ func (f *Forward) RegisterMetricsTo(r prometheus.Registerer) error {
 }
 
 func (f *Forward) Exec(ctx context.Context, qCtx *query_context.Context) (err error) {
-	r, err := f.exchange(ctx, qCtx, f.us)
+	r, err := f.exchange(ctx, qCtx, f.picker)
 	if err != nil {
 		return err
 	}
@@ -203,10 +274,11 @@ func (f *Forward) Exec(ctx context.Context, qCtx *query_context.Context) (err er
 
 // QuickConfigureExec format: [upstream_tag]...
 func (f *Forward) QuickConfigureExec(args string) (any, error) {
-	var us []*upstreamWrapper
+	var p picker
 	if len(args) == 0 { // No args, use all upstreams.
-		us = f.us
+		p = f.picker
 	} else { // Pick up upstreams by tags.
+		var us []*upstreamWrapper
 		for _, tag := range strings.Fields(args) {
 			u := f.tag2Upstream[tag]
 			if u == nil {
@@ -214,9 +286,14 @@ func (f *Forward) QuickConfigureExec(args string) (any, error) {
 			}
 			us = append(us, u)
 		}
+		var err error
+		p, err = newPicker(f.args.Strategy, us)
+		if err != nil {
+			return nil, err
+		}
 	}
 	var execFunc sequence.ExecutableFunc = func(ctx context.Context, qCtx *query_context.Context) error {
-		r, err := f.exchange(ctx, qCtx, us)
+		r, err := f.exchange(ctx, qCtx, p)
 		if err != nil {
 			return err
 		}
@@ -227,16 +304,16 @@ func (f *Forward) QuickConfigureExec(args string) (any, error) {
 }
 
 func (f *Forward) Close() error {
+	if f.stopProbe != nil {
+		f.stopProbe()
+	}
 	for _, u := range f.us {
 		_ = u.Close()
 	}
 	return nil
 }
 
-func (f *Forward) exchange(ctx context.Context, qCtx *query_context.Context, us []*upstreamWrapper) (*dns.Msg, error) {
-	if len(us) == 0 {
-		return nil, errors.New("no upstream to exchange")
-	}
+func (f *Forward) exchange(ctx context.Context, qCtx *query_context.Context, p picker) (*dns.Msg, error) {
 
 	queryPayload, err := pool.PackBuffer(qCtx.Q())
 	if err != nil {
@@ -251,6 +328,11 @@ func (f *Forward) exchange(ctx context.Context, qCtx *query_context.Context, us
 	if concurrent > maxConcurrentQueries {
 		concurrent = maxConcurrentQueries
 	}
+	us := p.pick(qCtx, concurrent)
+	if len(us) == 0 {
+		return nil, errors.New("no upstream to exchange")
+	}
+	concurrent = len(us)
 
 	type res struct {
 		r   *dns.Msg
@@ -261,8 +343,8 @@ func (f *Forward) exchange(ctx context.Context, qCtx *query_context.Context, us
 	done := make(chan struct{})
 	defer close(done)
 
-	for i := 0; i < concurrent; i++ {
-		u := randPick(us)
+	for _, u := range us {
+		u := u
 		qc := copyPayload(queryPayload)
 		go func(uqid uint32, question dns.Question) {
 			defer pool.ReleaseBuf(qc)
@@ -0,0 +1,291 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/go-chi/chi/v5"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+var errProbeServfail = errors.New("probe got a SERVFAIL response")
+
+// HealthCheckArgs configures upstream health checking.
+// Health checking is disabled if MaxFails is 0.
+type HealthCheckArgs struct {
+	// MaxFails is the number of consecutive failures that takes an upstream
+	// out of the pick set.
+	MaxFails int `yaml:"max_fails"`
+
+	// EjectTime is the first ejection time in seconds. It doubles on each
+	// consecutive ejection, up to MaxEjectTime. Default is 10 and 300.
+	EjectTime    int `yaml:"eject_time"`
+	MaxEjectTime int `yaml:"max_eject_time"`
+
+	// Interval is the interval of active probes in seconds.
+	// 0 disables active probes. Probes are not sent to ejected upstreams.
+	Interval int    `yaml:"interval"`
+	Qname    string `yaml:"qname"`   // Default is ".".
+	Qtype    string `yaml:"qtype"`   // Default is NS.
+	Timeout  int    `yaml:"timeout"` // In seconds. Default is 5.
+}
+
+func (a *HealthCheckArgs) init() {
+	utils.SetDefaultUnsignNum(&a.EjectTime, 10)
+	utils.SetDefaultUnsignNum(&a.MaxEjectTime, 300)
+	utils.SetDefaultString(&a.Qname, ".")
+	utils.SetDefaultString(&a.Qtype, "NS")
+	utils.SetDefaultUnsignNum(&a.Timeout, 5)
+}
+
+// health tracks consecutive failures of an upstream. An upstream is ejected
+// after maxFails consecutive failures. An ejected upstream is readmitted
+// after the ejection time. The first failure after readmission ejects it
+// again with a doubled ejection time. A success resets the backoff.
+type health struct {
+	maxFails     int
+	ejectTime    time.Duration
+	maxEjectTime time.Duration
+
+	ejectedUntil atomic.Int64 // unix nano, 0 if never ejected.
+
+	m         sync.Mutex
+	fails     int
+	ejections int
+	lastErr   error
+}
+
+func newHealth(a *HealthCheckArgs) *health {
+	return &health{
+		maxFails:     a.MaxFails,
+		ejectTime:    time.Duration(a.EjectTime) * time.Second,
+		maxEjectTime: time.Duration(a.MaxEjectTime) * time.Second,
+	}
+}
+
+func (h *health) available(now time.Time) bool {
+	return now.UnixNano() >= h.ejectedUntil.Load()
+}
+
+// onSuccess reports whether the upstream recovered from ejections.
+// Results during an ejection are ignored. They are from queries that
+// were sent before the ejection.
+func (h *health) onSuccess(now time.Time) (recovered bool) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if !h.available(now) {
+		return false
+	}
+	recovered = h.ejections > 0
+	h.fails = 0
+	h.ejections = 0
+	h.lastErr = nil
+	return recovered
+}
+
+// onFailure returns the ejection time if the upstream was ejected.
+func (h *health) onFailure(now time.Time, err error) (ejected time.Duration) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if !h.available(now) {
+		return 0
+	}
+	h.lastErr = err
+	h.fails++
+	if h.fails < h.maxFails {
+		return 0
+	}
+	d := h.ejectTime
+	for i := 0; i < h.ejections && d < h.maxEjectTime; i++ {
+		d *= 2
+	}
+	d = min(d, h.maxEjectTime)
+	h.ejectedUntil.Store(now.Add(d).UnixNano())
+	h.ejections++
+	h.fails = h.maxFails - 1
+	return d
+}
+
+// UpstreamHealth is the health state of an upstream.
+type UpstreamHealth struct {
+	Upstream            string     `json:"upstream"`
+	Healthy             bool       `json:"healthy"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	Ejections           int        `json:"ejections"`
+	EjectedUntil        *time.Time `json:"ejected_until,omitempty"`
+	LastErr             string     `json:"last_error,omitempty"`
+
+	// EWMA of the response latency and the error rate.
+	LatencyEWMA float64 `json:"latency_ewma_ms"`
+	ErrRateEWMA float64 `json:"error_rate_ewma"`
+}
+
+func (h *health) state(now time.Time) UpstreamHealth {
+	h.m.Lock()
+	defer h.m.Unlock()
+	s := UpstreamHealth{
+		Healthy:             h.available(now),
+		ConsecutiveFailures: h.fails,
+		Ejections:           h.ejections,
+	}
+	if !s.Healthy {
+		t := time.Unix(0, h.ejectedUntil.Load())
+		s.EjectedUntil = &t
+	}
+	if h.lastErr != nil {
+		s.LastErr = h.lastErr.Error()
+	}
+	return s
+}
+
+func (uw *upstreamWrapper) available(now time.Time) bool {
+	return uw.health == nil || uw.health.available(now)
+}
+
+func (uw *upstreamWrapper) reportHealth(err error) {
+	if uw.health == nil {
+		return
+	}
+	now := time.Now()
+	if err == nil {
+		if uw.health.onSuccess(now) {
+			uw.logger.Info("upstream recovered", zap.String("upstream", uw.name()))
+		}
+		return
+	}
+	if d := uw.health.onFailure(now, err); d > 0 {
+		uw.logger.Warn(
+			"upstream ejected",
+			zap.String("upstream", uw.name()),
+			zap.Duration("duration", d),
+			zap.Error(err),
+		)
+	}
+}
+
+// Health returns the health state and stats of the upstream. If health
+// checking is disabled, the upstream is always healthy.
+func (uw *upstreamWrapper) Health() UpstreamHealth {
+	var s UpstreamHealth
+	if uw.health != nil {
+		s = uw.health.state(time.Now())
+	} else {
+		s.Healthy = true
+	}
+	s.Upstream = uw.name()
+	s.LatencyEWMA, s.ErrRateEWMA = uw.stats.get()
+	return s
+}
+
+// availableUpstreams returns upstreams that are not ejected. If all upstreams
+// are ejected, it returns us. The returned slice must not be modified.
+func availableUpstreams(us []*upstreamWrapper) []*upstreamWrapper {
+	now := time.Now()
+	n := 0
+	for _, u := range us {
+		if u.available(now) {
+			n++
+		}
+	}
+	if n == len(us) || n == 0 {
+		return us
+	}
+	s := make([]*upstreamWrapper, 0, n)
+	for _, u := range us {
+		if u.available(now) {
+			s = append(s, u)
+		}
+	}
+	return s
+}
+
+// probe sends a probe query to the upstream. A response with rcode
+// other than SERVFAIL is a success.
+func (uw *upstreamWrapper) probe(ctx context.Context, q []byte) error {
+	r, err := uw.u.ExchangeContext(ctx, q)
+	if err == nil {
+		m := new(dns.Msg)
+		err = m.Unpack(*r)
+		pool.ReleaseBuf(r)
+		if err == nil && m.Rcode == dns.RcodeServerFailure {
+			err = errProbeServfail
+		}
+	}
+	uw.reportHealth(err)
+	return err
+}
+
+// probeLoop sends probes to available upstreams every interval until ctx is done.
+func (f *Forward) probeLoop(ctx context.Context, a *HealthCheckArgs, q []byte) {
+	ticker := time.NewTicker(time.Duration(a.Interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			now := time.Now()
+			for _, u := range f.us {
+				if !u.available(now) {
+					continue
+				}
+				go func(u *upstreamWrapper) {
+					probeCtx, cancel := context.WithTimeout(ctx, time.Duration(a.Timeout)*time.Second)
+					defer cancel()
+					if err := u.probe(probeCtx, q); err != nil {
+						f.logger.Debug("probe failed", zap.String("upstream", u.name()), zap.Error(err))
+					}
+				}(u)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Health returns the health state of all upstreams.
+func (f *Forward) Health() []UpstreamHealth {
+	s := make([]UpstreamHealth, 0, len(f.us))
+	for _, u := range f.us {
+		s = append(s, u.Health())
+	}
+	return s
+}
+
+// Api returns the api of the forward.
+// GET /health returns the health state of all upstreams in json.
+func (f *Forward) Api() *chi.Mux {
+	r := chi.NewRouter()
+	r.Get("/health", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("content-type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(f.Health())
+	})
+	return r
+}
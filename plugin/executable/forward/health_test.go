@@ -0,0 +1,129 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+func TestHealth_Backoff(t *testing.T) {
+	h := newHealth(&HealthCheckArgs{MaxFails: 2, EjectTime: 10, MaxEjectTime: 25})
+	now := time.Now()
+	errFoo := errors.New("foo")
+
+	if d := h.onFailure(now, errFoo); d != 0 {
+		t.Fatalf("ejected after 1 failure")
+	}
+	if d := h.onFailure(now, errFoo); d != 10*time.Second {
+		t.Fatalf("want ejection 10s, got %s", d)
+	}
+	if h.available(now.Add(9*time.Second)) || !h.available(now.Add(10*time.Second)) {
+		t.Fatal("invalid ejection time")
+	}
+
+	// Results during the ejection are ignored.
+	if h.onSuccess(now.Add(time.Second)) {
+		t.Fatal("success during ejection should be ignored")
+	}
+
+	// The first failure after readmission ejects it again with a doubled time.
+	now = now.Add(10 * time.Second)
+	if d := h.onFailure(now, errFoo); d != 20*time.Second {
+		t.Fatalf("want ejection 20s, got %s", d)
+	}
+	now = now.Add(20 * time.Second)
+	if d := h.onFailure(now, errFoo); d != 25*time.Second {
+		t.Fatalf("want ejection capped at 25s, got %s", d)
+	}
+
+	now = now.Add(25 * time.Second)
+	if !h.onSuccess(now) {
+		t.Fatal("upstream should be recovered")
+	}
+	if s := h.state(now); !s.Healthy || s.Ejections != 0 || s.ConsecutiveFailures != 0 {
+		t.Fatalf("unexpected state %+v", s)
+	}
+	if d := h.onFailure(now, errFoo); d != 0 {
+		t.Fatal("backoff should be reset after a success")
+	}
+}
+
+type dummyUpstream struct {
+	err error
+}
+
+func (u *dummyUpstream) ExchangeContext(_ context.Context, m []byte) (*[]byte, error) {
+	if u.err != nil {
+		return nil, u.err
+	}
+	q := new(dns.Msg)
+	if err := q.Unpack(m); err != nil {
+		return nil, err
+	}
+	r := new(dns.Msg)
+	r.SetReply(q)
+	return pool.PackBuffer(r)
+}
+
+func (u *dummyUpstream) Close() error { return nil }
+
+func TestForward_Ejection(t *testing.T) {
+	hc := &HealthCheckArgs{MaxFails: 1}
+	hc.init()
+	newUw := func(tag string, err error) *upstreamWrapper {
+		uw := newWrapper(0, UpstreamConfig{Tag: tag}, "")
+		uw.u = &dummyUpstream{err: err}
+		uw.logger = zap.NewNop()
+		uw.health = newHealth(hc)
+		return uw
+	}
+	good, bad := newUw("good", nil), newUw("bad", errors.New("dead"))
+	f := &Forward{args: &Args{}, logger: zap.NewNop(), us: []*upstreamWrapper{good, bad}}
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	for i := 0; i < 10; i++ {
+		b, _ := q.Pack()
+		_, _ = bad.ExchangeContext(context.Background(), b)
+	}
+	if us := availableUpstreams(f.us); len(us) != 1 || us[0] != good {
+		t.Fatalf("bad upstream should be ejected")
+	}
+	if s := f.Health(); s[0].Healthy != true || s[1].Healthy != false || s[1].LastErr != "dead" {
+		t.Fatalf("unexpected health %+v", s)
+	}
+
+	// All upstreams are ejected, use all of them.
+	b, _ := q.Pack()
+	good.u = &dummyUpstream{err: errors.New("dead")}
+	if err := good.probe(context.Background(), b); err == nil {
+		t.Fatal("probe should fail")
+	}
+	if us := availableUpstreams(f.us); len(us) != 2 {
+		t.Fatalf("want all upstreams, got %d", len(us))
+	}
+}
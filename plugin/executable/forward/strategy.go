@@ -0,0 +1,285 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/miekg/dns"
+)
+
+// Strategies of picking upstreams.
+const (
+	StrategyRandom         = "random"
+	StrategyFastest        = "fastest"
+	StrategyWeighted       = "weighted"
+	StrategyRoundRobin     = "round_robin"
+	StrategyConsistentHash = "consistent_hash"
+)
+
+// picker picks upstreams for a query.
+type picker interface {
+	// pick returns n upstreams for the query. Picked upstreams are
+	// distinct unless the strategy allows duplicates (random) or
+	// there are not enough upstreams.
+	pick(qCtx *query_context.Context, n int) []*upstreamWrapper
+}
+
+func newPicker(strategy string, us []*upstreamWrapper) (picker, error) {
+	switch strategy {
+	case "", StrategyRandom:
+		return randomPicker(us), nil
+	case StrategyFastest:
+		return fastestPicker(us), nil
+	case StrategyWeighted:
+		return weightedPicker(us), nil
+	case StrategyRoundRobin:
+		return &roundRobinPicker{us: us}, nil
+	case StrategyConsistentHash:
+		return newHashPicker(us), nil
+	default:
+		return nil, fmt.Errorf("unknown strategy %s", strategy)
+	}
+}
+
+// randomPicker picks upstreams uniformly at random. It may pick the
+// same upstream more than once.
+type randomPicker []*upstreamWrapper
+
+func (p randomPicker) pick(_ *query_context.Context, n int) []*upstreamWrapper {
+	us := availableUpstreams(p)
+	s := make([]*upstreamWrapper, n)
+	for i := range s {
+		s[i] = randPick(us)
+	}
+	return s
+}
+
+// fastestPicker picks upstreams with the lowest score. See upstreamStats.score.
+// Only the first upstream is picked by score. Others are picked at random,
+// so the stats of other upstreams keep updating. If n is 1, a random
+// upstream is picked with a small probability for the same reason.
+type fastestPicker []*upstreamWrapper
+
+const fastestExploreRate = 0.05
+
+func (p fastestPicker) pick(_ *query_context.Context, n int) []*upstreamWrapper {
+	us := availableUpstreams(p)
+	if n == 1 && len(us) > 1 && rand.Float64() < fastestExploreRate {
+		return []*upstreamWrapper{randPick(us)}
+	}
+	best := 0
+	bestScore := us[0].stats.score()
+	for i := 1; i < len(us); i++ {
+		if s := us[i].stats.score(); s < bestScore {
+			best, bestScore = i, s
+		}
+	}
+	s := make([]*upstreamWrapper, 0, n)
+	s = append(s, us[best])
+	if n > 1 {
+		for _, i := range rand.Perm(len(us)) {
+			if len(s) == n {
+				break
+			}
+			if i != best {
+				s = append(s, us[i])
+			}
+		}
+	}
+	return s
+}
+
+// weightedPicker picks distinct upstreams at random. The probability is
+// proportional to the upstream weight.
+type weightedPicker []*upstreamWrapper
+
+func (p weightedPicker) pick(_ *query_context.Context, n int) []*upstreamWrapper {
+	us := availableUpstreams(p)
+	n = min(n, len(us))
+	total := 0
+	for _, u := range us {
+		total += u.cfg.Weight
+	}
+	picked := make([]bool, len(us))
+	s := make([]*upstreamWrapper, 0, n)
+	for len(s) < n {
+		r := rand.Intn(total)
+		for i, u := range us {
+			if picked[i] {
+				continue
+			}
+			if r -= u.cfg.Weight; r < 0 {
+				picked[i] = true
+				total -= u.cfg.Weight
+				s = append(s, u)
+				break
+			}
+		}
+	}
+	return s
+}
+
+// roundRobinPicker picks n consecutive upstreams in turn.
+type roundRobinPicker struct {
+	us   []*upstreamWrapper
+	next atomic.Uint32
+}
+
+func (p *roundRobinPicker) pick(_ *query_context.Context, n int) []*upstreamWrapper {
+	us := availableUpstreams(p.us)
+	n = min(n, len(us))
+	i := int(p.next.Add(1) % uint32(len(us)))
+	s := make([]*upstreamWrapper, 0, n)
+	for j := 0; j < n; j++ {
+		s = append(s, us[(i+j)%len(us)])
+	}
+	return s
+}
+
+// hashPicker picks upstreams by consistent hashing on the qname, so queries
+// of the same name go to the same upstream and its cache stays warm. Each
+// upstream has weight * hashVNodes points on the ring. Unavailable upstreams
+// are skipped, so only their names are moved to other upstreams.
+type hashPicker struct {
+	us     []*upstreamWrapper
+	points []uint32
+	owners []int // index of us, same length as points
+}
+
+const hashVNodes = 64
+
+func newHashPicker(us []*upstreamWrapper) *hashPicker {
+	type point struct {
+		h     uint32
+		owner int
+	}
+	var ps []point
+	for i, u := range us {
+		for v := 0; v < u.cfg.Weight*hashVNodes; v++ {
+			ps = append(ps, point{h: hashString(u.name() + "#" + strconv.Itoa(v)), owner: i})
+		}
+	}
+	sort.Slice(ps, func(i, j int) bool { return ps[i].h < ps[j].h })
+	p := &hashPicker{us: us}
+	for _, pt := range ps {
+		p.points = append(p.points, pt.h)
+		p.owners = append(p.owners, pt.owner)
+	}
+	return p
+}
+
+func hashString(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+func (p *hashPicker) pick(qCtx *query_context.Context, n int) []*upstreamWrapper {
+	h := hashString(dns.CanonicalName(qCtx.QQuestion().Name))
+	start := sort.Search(len(p.points), func(i int) bool { return p.points[i] >= h })
+
+	now := time.Now()
+	s := p.walk(start, n, func(u *upstreamWrapper) bool { return u.available(now) })
+	if len(s) == 0 { // All upstreams are ejected.
+		s = p.walk(start, n, func(*upstreamWrapper) bool { return true })
+	}
+	return s
+}
+
+// walk collects at most n distinct upstreams clockwise from point start.
+func (p *hashPicker) walk(start, n int, ok func(u *upstreamWrapper) bool) []*upstreamWrapper {
+	n = min(n, len(p.us))
+	var s []*upstreamWrapper
+	seen := make([]bool, len(p.us))
+	for i := 0; i < len(p.points) && len(s) < n; i++ {
+		o := p.owners[(start+i)%len(p.points)]
+		if seen[o] {
+			continue
+		}
+		seen[o] = true
+		if ok(p.us[o]) {
+			s = append(s, p.us[o])
+		}
+	}
+	return s
+}
+
+// upstreamStats is the latency and error rate EWMA of an upstream.
+// It is updated by upstreamWrapper.
+type upstreamStats struct {
+	m       sync.Mutex
+	latency float64 // in millisecond
+	errRate float64
+	sampled bool
+}
+
+const statsAlpha = 0.2
+
+func (s *upstreamStats) observe(latency time.Duration, err error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	e := 0.0
+	if err != nil {
+		e = 1
+	}
+	if !s.sampled {
+		s.sampled = true
+		s.errRate = e
+		if err == nil {
+			s.latency = float64(latency.Microseconds()) / 1000
+		}
+		return
+	}
+	s.errRate += statsAlpha * (e - s.errRate)
+	if err == nil {
+		l := float64(latency.Microseconds()) / 1000
+		if s.latency == 0 {
+			s.latency = l
+		} else {
+			s.latency += statsAlpha * (l - s.latency)
+		}
+	}
+}
+
+// score is the expected latency in millisecond. Each error costs queryTimeout.
+// Upstreams without stats have the lowest score, so they are tried first.
+func (s *upstreamStats) score() float64 {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if !s.sampled {
+		return -1
+	}
+	return s.latency + s.errRate*float64(queryTimeout.Milliseconds())
+}
+
+func (s *upstreamStats) get() (latency, errRate float64) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.latency, s.errRate
+}
@@ -0,0 +1,142 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/miekg/dns"
+)
+
+func newTestUpstreams(n int) []*upstreamWrapper {
+	var us []*upstreamWrapper
+	for i := 0; i < n; i++ {
+		us = append(us, newWrapper(i, UpstreamConfig{Tag: "u" + strconv.Itoa(i), Weight: 1}, ""))
+	}
+	return us
+}
+
+func newTestQCtx(name string) *query_context.Context {
+	q := new(dns.Msg)
+	q.SetQuestion(name, dns.TypeA)
+	return query_context.NewContext(q)
+}
+
+func TestRoundRobinPicker(t *testing.T) {
+	us := newTestUpstreams(3)
+	p, _ := newPicker(StrategyRoundRobin, us)
+	qCtx := newTestQCtx("example.com.")
+	first := p.pick(qCtx, 2)
+	if len(first) != 2 || first[0] == first[1] {
+		t.Fatalf("want 2 distinct upstreams, got %v", first)
+	}
+	next := p.pick(qCtx, 1)[0]
+	if next != first[1] {
+		t.Fatal("round robin should move to the next upstream")
+	}
+	if n := len(p.pick(qCtx, 5)); n != 3 {
+		t.Fatalf("want 3 upstreams, got %d", n)
+	}
+}
+
+func TestWeightedPicker(t *testing.T) {
+	us := newTestUpstreams(2)
+	us[0].cfg.Weight = 9
+	p, _ := newPicker(StrategyWeighted, us)
+	qCtx := newTestQCtx("example.com.")
+	cnt := 0
+	for i := 0; i < 1000; i++ {
+		if p.pick(qCtx, 1)[0] == us[0] {
+			cnt++
+		}
+	}
+	if cnt < 800 || cnt > 980 {
+		t.Fatalf("upstream with weight 9 was picked %d/1000 times", cnt)
+	}
+	if s := p.pick(qCtx, 3); len(s) != 2 || s[0] == s[1] {
+		t.Fatalf("want 2 distinct upstreams, got %v", s)
+	}
+}
+
+func TestFastestPicker(t *testing.T) {
+	us := newTestUpstreams(3)
+	us[0].stats.observe(time.Millisecond*50, nil)
+	us[1].stats.observe(time.Millisecond*10, nil)
+	us[2].stats.observe(time.Millisecond*5, errors.New("err"))
+	p, _ := newPicker(StrategyFastest, us)
+	qCtx := newTestQCtx("example.com.")
+	if s := p.pick(qCtx, 3); len(s) != 3 || s[0] != us[1] {
+		t.Fatalf("want the fastest upstream first, got %v", s)
+	}
+	cnt := 0
+	for i := 0; i < 1000; i++ {
+		if p.pick(qCtx, 1)[0] == us[1] {
+			cnt++
+		}
+	}
+	if cnt < 900 {
+		t.Fatalf("fastest upstream was picked %d/1000 times", cnt)
+	}
+}
+
+func TestHashPicker(t *testing.T) {
+	us := newTestUpstreams(4)
+	hc := &HealthCheckArgs{MaxFails: 1}
+	hc.init()
+	for _, u := range us {
+		u.health = newHealth(hc)
+	}
+	p, _ := newPicker(StrategyConsistentHash, us)
+
+	owner := make(map[string]*upstreamWrapper)
+	seen := make(map[*upstreamWrapper]bool)
+	for i := 0; i < 100; i++ {
+		name := strconv.Itoa(i) + ".example.com."
+		u := p.pick(newTestQCtx(name), 1)[0]
+		if p.pick(newTestQCtx(name), 1)[0] != u {
+			t.Fatalf("%s is not picked consistently", name)
+		}
+		owner[name] = u
+		seen[u] = true
+	}
+	if len(seen) != 4 {
+		t.Fatalf("names should be spread over all upstreams, got %d", len(seen))
+	}
+
+	// Eject an upstream. Only its names move.
+	ejected := us[0]
+	ejected.health.onFailure(time.Now(), errors.New("err"))
+	for name, u := range owner {
+		got := p.pick(newTestQCtx(name), 1)[0]
+		if got == ejected {
+			t.Fatal("ejected upstream was picked")
+		}
+		if u != ejected && got != u {
+			t.Fatalf("%s moved from %s to %s", name, u.name(), got.name())
+		}
+	}
+	if s := p.pick(newTestQCtx("a.com."), 3); len(s) != 3 {
+		t.Fatalf("want 3 upstreams, got %d", len(s))
+	}
+}
@@ -28,6 +28,7 @@ import (
 	"github.com/IrineSistiana/mosdns/v5/pkg/upstream"
 	"github.com/miekg/dns"
 	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
@@ -42,6 +43,14 @@ type upstreamWrapper struct {
 
 	connOpened prometheus.Counter
 	connClosed prometheus.Counter
+
+	// Only registered if health checking is enabled.
+	healthy          prometheus.GaugeFunc
+	consecutiveFails prometheus.GaugeFunc
+
+	stats  upstreamStats
+	logger *zap.Logger
+	health *health // nil if health checking is disabled.
 }
 
 func (uw *upstreamWrapper) OnEvent(typ upstream.Event) {
@@ -57,7 +66,7 @@ func (uw *upstreamWrapper) OnEvent(typ upstream.Event) {
 // Note: upstreamWrapper.u still needs to be set.
 func newWrapper(idx int, cfg UpstreamConfig, pluginTag string) *upstreamWrapper {
 	lb := map[string]string{"upstream": cfg.Tag, "tag": pluginTag}
-	return &upstreamWrapper{
+	uw := &upstreamWrapper{
 		cfg: cfg,
 		queryTotal: prometheus.NewCounter(prometheus.CounterOpts{
 			Name:        "query_total",
@@ -92,17 +101,39 @@ func newWrapper(idx int, cfg UpstreamConfig, pluginTag string) *upstreamWrapper
 			ConstLabels: lb,
 		}),
 	}
+	uw.healthy = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "healthy",
+		Help:        "Whether this upstream is in the pick set (1) or ejected (0)",
+		ConstLabels: lb,
+	}, func() float64 {
+		if uw.available(time.Now()) {
+			return 1
+		}
+		return 0
+	})
+	uw.consecutiveFails = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "consecutive_failures",
+		Help:        "The number of consecutive failures of this upstream",
+		ConstLabels: lb,
+	}, func() float64 {
+		return float64(uw.Health().ConsecutiveFailures)
+	})
+	return uw
 }
 
 func (uw *upstreamWrapper) registerMetricsTo(r prometheus.Registerer) error {
-	for _, collector := range [...]prometheus.Collector{
+	collectors := []prometheus.Collector{
 		uw.queryTotal,
 		uw.errTotal,
 		uw.thread,
 		uw.responseLatency,
 		uw.connOpened,
 		uw.connClosed,
-	} {
+	}
+	if uw.health != nil {
+		collectors = append(collectors, uw.healthy, uw.consecutiveFails)
+	}
+	for _, collector := range collectors {
 		if err := r.Register(collector); err != nil {
 			return err
 		}
@@ -126,12 +157,14 @@ func (uw *upstreamWrapper) ExchangeContext(ctx context.Context, m []byte) (*[]by
 	uw.thread.Inc()
 	r, err := uw.u.ExchangeContext(ctx, m)
 	uw.thread.Dec()
+	uw.stats.observe(time.Since(start), err)
 
 	if err != nil {
 		uw.errTotal.Inc()
 	} else {
 		uw.responseLatency.Observe(float64(time.Since(start).Milliseconds()))
 	}
+	uw.reportHealth(err)
 	return r, err
 }
 
@@ -24,12 +24,16 @@ import (
 	"context"
 	"fmt"
 	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/file_watcher"
 	"github.com/IrineSistiana/mosdns/v5/pkg/hosts"
 	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
 	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
 	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
 	"github.com/miekg/dns"
+	"go.uber.org/zap"
 	"os"
+	"sync/atomic"
+	"time"
 )
 
 const PluginType = "hosts"
@@ -43,17 +47,42 @@ var _ sequence.Executable = (*Hosts)(nil)
 type Args struct {
 	Entries []string `yaml:"entries"`
 	Files   []string `yaml:"files"`
+
+	// Watch reloads files when they are changed. PollInterval (in seconds)
+	// checks files periodically instead. Both are disabled by default.
+	// If the files cannot be loaded, the last entries are kept.
+	Watch        bool `yaml:"watch"`
+	PollInterval int  `yaml:"poll_interval"`
 }
 
 type Hosts struct {
-	h *hosts.Hosts
+	h atomic.Pointer[hosts.Hosts]
+	w *file_watcher.Watcher
 }
 
-func Init(_ *coremain.BP, args any) (any, error) {
-	return NewHosts(args.(*Args))
+func Init(bp *coremain.BP, args any) (any, error) {
+	a := args.(*Args)
+	h, err := NewHosts(a)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.watch(a, bp.L()); err != nil {
+		return nil, err
+	}
+	return h, nil
 }
 
 func NewHosts(args *Args) (*Hosts, error) {
+	hh, err := loadHosts(args)
+	if err != nil {
+		return nil, err
+	}
+	h := new(Hosts)
+	h.h.Store(hh)
+	return h, nil
+}
+
+func loadHosts(args *Args) (*hosts.Hosts, error) {
 	m := domain.NewMixMatcher[*hosts.IPs]()
 	m.SetDefaultMatcher(domain.MatcherFull)
 	for i, entry := range args.Entries {
@@ -71,17 +100,43 @@ func NewHosts(args *Args) (*Hosts, error) {
 		}
 	}
 
-	return &Hosts{
-		h: hosts.NewHosts(m),
-	}, nil
+	return hosts.NewHosts(m), nil
+}
+
+// watch starts a file watcher if it is enabled by args.
+func (h *Hosts) watch(args *Args, logger *zap.Logger) error {
+	reload := func() {
+		hh, err := loadHosts(args)
+		if err != nil {
+			logger.Error("failed to reload files, keep using the last entries", zap.Error(err))
+			return
+		}
+		h.h.Store(hh)
+		logger.Info("files reloaded")
+	}
+	opts := file_watcher.Opts{
+		Watch:        args.Watch,
+		PollInterval: time.Duration(args.PollInterval) * time.Second,
+		Logger:       logger,
+	}
+	w, err := file_watcher.New(args.Files, reload, opts)
+	if err != nil {
+		return fmt.Errorf("failed to watch files, %w", err)
+	}
+	h.w = w
+	return nil
+}
+
+func (h *Hosts) Close() error {
+	return h.w.Close()
 }
 
 func (h *Hosts) Response(q *dns.Msg) *dns.Msg {
-	return h.h.LookupMsg(q)
+	return h.h.Load().LookupMsg(q)
 }
 
 func (h *Hosts) Exec(_ context.Context, qCtx *query_context.Context) error {
-	r := h.h.LookupMsg(qCtx.Q())
+	r := h.h.Load().LookupMsg(qCtx.Q())
 	if r != nil {
 		qCtx.SetResponse(r)
 	}
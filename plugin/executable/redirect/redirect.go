@@ -25,8 +25,11 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/file_watcher"
 	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
 	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
 	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
@@ -45,22 +48,71 @@ var _ sequence.RecursiveExecutable = (*Redirect)(nil)
 type Args struct {
 	Rules []string `yaml:"rules"`
 	Files []string `yaml:"files"`
+
+	// Watch reloads files when they are changed. PollInterval (in seconds)
+	// checks files periodically instead. Both are disabled by default.
+	// If the files cannot be loaded, the last rules are kept.
+	Watch        bool `yaml:"watch"`
+	PollInterval int  `yaml:"poll_interval"`
 }
 
 type Redirect struct {
-	m *domain.MixMatcher[string]
+	m atomic.Pointer[domain.MixMatcher[string]]
+	w *file_watcher.Watcher
 }
 
 func Init(bp *coremain.BP, args any) (any, error) {
-	r, err := NewRedirect(args.(*Args))
+	a := args.(*Args)
+	r, err := NewRedirect(a)
 	if err != nil {
 		return nil, err
 	}
 	bp.L().Info("redirect rules loaded", zap.Int("length", r.Len()))
+	if err := r.watch(a, bp.L()); err != nil {
+		return nil, err
+	}
 	return r, nil
 }
 
 func NewRedirect(args *Args) (*Redirect, error) {
+	m, err := loadRules(args)
+	if err != nil {
+		return nil, err
+	}
+	r := new(Redirect)
+	r.m.Store(m)
+	return r, nil
+}
+
+// watch starts a file watcher if it is enabled by args.
+func (r *Redirect) watch(args *Args, logger *zap.Logger) error {
+	reload := func() {
+		m, err := loadRules(args)
+		if err != nil {
+			logger.Error("failed to reload files, keep using the last rules", zap.Error(err))
+			return
+		}
+		r.m.Store(m)
+		logger.Info("redirect rules reloaded", zap.Int("length", m.Len()))
+	}
+	opts := file_watcher.Opts{
+		Watch:        args.Watch,
+		PollInterval: time.Duration(args.PollInterval) * time.Second,
+		Logger:       logger,
+	}
+	w, err := file_watcher.New(args.Files, reload, opts)
+	if err != nil {
+		return fmt.Errorf("failed to watch files, %w", err)
+	}
+	r.w = w
+	return nil
+}
+
+func (r *Redirect) Close() error {
+	return r.w.Close()
+}
+
+func loadRules(args *Args) (*domain.MixMatcher[string], error) {
 	parseFunc := func(s string) (p, v string, err error) {
 		f := strings.Fields(s)
 		if len(f) != 2 {
@@ -84,7 +136,7 @@ func NewRedirect(args *Args) (*Redirect, error) {
 			return nil, fmt.Errorf("failed to load file #%d %s, %w", i, file, err)
 		}
 	}
-	return &Redirect{m: m}, nil
+	return m, nil
 }
 
 func (r *Redirect) Exec(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker) error {
@@ -94,7 +146,7 @@ func (r *Redirect) Exec(ctx context.Context, qCtx *query_context.Context, next s
 	}
 
 	orgQName := q.Question[0].Name
-	redirectTarget, ok := r.m.Match(orgQName)
+	redirectTarget, ok := r.m.Load().Match(orgQName)
 	if !ok {
 		return next.ExecNext(ctx, qCtx)
 	}
@@ -130,5 +182,5 @@ func (r *Redirect) Exec(ctx context.Context, qCtx *query_context.Context, next s
 }
 
 func (r *Redirect) Len() int {
-	return r.m.Len()
+	return r.m.Load().Len()
 }
@@ -0,0 +1,465 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package secondary
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/mlog"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/zone_file"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const PluginType = "secondary"
+
+const (
+	queryTimeout    = time.Second * 5
+	transferTimeout = time.Second * 30
+
+	// initialRetry is the retry interval before the first successful transfer,
+	// when we don't have the SOA retry value yet.
+	initialRetry = time.Second * 30
+	minInterval  = time.Second
+)
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+type Args struct {
+	Zones []ZoneArgs `yaml:"zones"`
+}
+
+type ZoneArgs struct {
+	Origin string `yaml:"origin"`
+
+	// Primary is the address of the primary server. Default port is 53.
+	Primary string `yaml:"primary"`
+
+	// AllowNotify is a list of ips or CIDRs that can send NOTIFY messages.
+	// Default is the ip of the primary server.
+	AllowNotify []string `yaml:"allow_notify"`
+}
+
+var _ sequence.Executable = (*Secondary)(nil)
+
+// Secondary transfers zones from primary servers and answers queries
+// from memory authoritatively. Queries that are not in any zone are ignored.
+// It also accepts NOTIFY messages (RFC 1996) for its zones.
+type Secondary struct {
+	zones map[string]*secondaryZone // key: canonical origin
+
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+}
+
+type secondaryZone struct {
+	origin      string
+	primary     string
+	allowNotify []netip.Prefix
+	logger      *zap.Logger
+
+	z       atomic.Pointer[zone_file.Zone]
+	expired atomic.Bool
+	notify  chan struct{}
+}
+
+func Init(bp *coremain.BP, v any) (any, error) {
+	return NewSecondary(v.(*Args), bp.L())
+}
+
+// NewSecondary creates a Secondary and starts the refresh loops of all zones.
+// logger can be nil.
+func NewSecondary(args *Args, logger *zap.Logger) (*Secondary, error) {
+	if logger == nil {
+		logger = mlog.Nop()
+	}
+	s := &Secondary{
+		zones:       make(map[string]*secondaryZone),
+		closeNotify: make(chan struct{}),
+	}
+	for i, za := range args.Zones {
+		sz, err := newSecondaryZone(&za, logger)
+		if err != nil {
+			return nil, fmt.Errorf("invalid zone #%d, %w", i, err)
+		}
+		if _, dup := s.zones[sz.origin]; dup {
+			return nil, fmt.Errorf("duplicated zone %s", sz.origin)
+		}
+		s.zones[sz.origin] = sz
+	}
+	for _, sz := range s.zones {
+		go sz.refreshLoop(s.closeNotify)
+	}
+	return s, nil
+}
+
+func newSecondaryZone(args *ZoneArgs, logger *zap.Logger) (*secondaryZone, error) {
+	if len(args.Origin) == 0 {
+		return nil, errors.New("missing origin")
+	}
+	if len(args.Primary) == 0 {
+		return nil, errors.New("missing primary")
+	}
+	primary := args.Primary
+	host, _, err := net.SplitHostPort(primary)
+	if err != nil {
+		host = primary
+		primary = net.JoinHostPort(primary, "53")
+	}
+	sz := &secondaryZone{
+		origin:  dns.CanonicalName(args.Origin),
+		primary: primary,
+		logger:  logger.With(zap.String("zone", dns.CanonicalName(args.Origin))),
+		notify:  make(chan struct{}, 1),
+	}
+	if len(args.AllowNotify) == 0 {
+		if addr, err := netip.ParseAddr(host); err == nil {
+			sz.allowNotify = append(sz.allowNotify, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+		}
+	}
+	for _, s := range args.AllowNotify {
+		p, err := parsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allow_notify %s, %w", s, err)
+		}
+		sz.allowNotify = append(sz.allowNotify, p)
+	}
+	return sz, nil
+}
+
+func parsePrefix(s string) (netip.Prefix, error) {
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+	}
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	if p.Addr().Is4In6() {
+		p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+	}
+	return p.Masked(), nil
+}
+
+func (s *Secondary) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closeNotify)
+	})
+	return nil
+}
+
+func (s *Secondary) Exec(_ context.Context, qCtx *query_context.Context) error {
+	q := qCtx.Q()
+	if len(q.Question) != 1 || q.Question[0].Qclass != dns.ClassINET {
+		return nil
+	}
+	switch q.Opcode {
+	case dns.OpcodeNotify:
+		if sz := s.zones[dns.CanonicalName(q.Question[0].Name)]; sz != nil {
+			qCtx.SetResponse(sz.handleNotify(qCtx))
+		}
+	case dns.OpcodeQuery:
+		if sz := s.findZone(q.Question[0].Name); sz != nil {
+			z := sz.z.Load()
+			if z == nil || sz.expired.Load() {
+				r := new(dns.Msg)
+				r.SetRcode(q, dns.RcodeServerFailure)
+				qCtx.SetResponse(r)
+				return nil
+			}
+			qCtx.SetResponse(z.Reply(q))
+		}
+	}
+	return nil
+}
+
+// findZone returns the most specific zone that contains name.
+func (s *Secondary) findZone(name string) *secondaryZone {
+	name = dns.CanonicalName(name)
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if sz := s.zones[name[off:]]; sz != nil {
+			return sz
+		}
+	}
+	return s.zones["."]
+}
+
+func (sz *secondaryZone) handleNotify(qCtx *query_context.Context) *dns.Msg {
+	q := qCtx.Q()
+	r := new(dns.Msg)
+	if q.Question[0].Qtype != dns.TypeSOA {
+		r.SetRcode(q, dns.RcodeFormatError)
+		return r
+	}
+	if !sz.notifyAllowed(qCtx.ServerMeta.ClientAddr) {
+		sz.logger.Warn("notify refused", zap.Stringer("client", qCtx.ServerMeta.ClientAddr))
+		r.SetRcode(q, dns.RcodeRefused)
+		return r
+	}
+	select {
+	case sz.notify <- struct{}{}:
+	default: // A refresh is already pending.
+	}
+	r.SetReply(q)
+	r.Authoritative = true
+	return r
+}
+
+func (sz *secondaryZone) notifyAllowed(addr netip.Addr) bool {
+	if !addr.IsValid() {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range sz.allowNotify {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// refreshLoop refreshes the zone as described in RFC 1034 4.3.5. It returns
+// when closeNotify is closed.
+func (sz *secondaryZone) refreshLoop(closeNotify chan struct{}) {
+	var lastRefresh time.Time
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-sz.notify:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		case <-closeNotify:
+			return
+		}
+
+		var next time.Duration
+		if err := sz.refresh(); err != nil {
+			sz.logger.Warn("failed to refresh zone", zap.Error(err))
+			next = initialRetry
+			if z := sz.z.Load(); z != nil {
+				soa := z.SOA()
+				next = time.Duration(soa.Retry) * time.Second
+				if !sz.expired.Load() && time.Since(lastRefresh) >= time.Duration(soa.Expire)*time.Second {
+					sz.logger.Error("zone expired")
+					sz.expired.Store(true)
+				}
+			}
+		} else {
+			lastRefresh = time.Now()
+			next = time.Duration(sz.z.Load().SOA().Refresh) * time.Second
+		}
+		if next < minInterval {
+			next = minInterval
+		}
+		timer.Reset(next)
+	}
+}
+
+// refresh checks the SOA serial on the primary and transfers the zone if
+// it is newer than ours.
+func (sz *secondaryZone) refresh() error {
+	serial, err := sz.primarySerial()
+	if err != nil {
+		return fmt.Errorf("failed to query primary soa, %w", err)
+	}
+	cur := sz.z.Load()
+	if cur != nil && !serialGreater(serial, cur.SOA().Serial) {
+		sz.expired.Store(false)
+		return nil
+	}
+
+	var z *zone_file.Zone
+	if cur != nil {
+		z, err = sz.ixfr(cur)
+		if err != nil {
+			sz.logger.Debug("ixfr failed, fallback to axfr", zap.Error(err))
+		}
+	}
+	if z == nil {
+		z, err = sz.axfr()
+		if err != nil {
+			return fmt.Errorf("axfr failed, %w", err)
+		}
+	}
+	sz.z.Store(z)
+	sz.expired.Store(false)
+	sz.logger.Info("zone transferred", zap.Uint32("serial", z.SOA().Serial))
+	return nil
+}
+
+func (sz *secondaryZone) primarySerial() (uint32, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(sz.origin, dns.TypeSOA)
+	c := &dns.Client{Timeout: queryTimeout}
+	r, _, err := c.Exchange(m, sz.primary)
+	if err == nil && r.Truncated {
+		c.Net = "tcp"
+		r, _, err = c.Exchange(m, sz.primary)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return 0, fmt.Errorf("primary returned rcode %s", dns.RcodeToString[r.Rcode])
+	}
+	for _, rr := range r.Answer {
+		if soa, ok := rr.(*dns.SOA); ok && dns.CanonicalName(soa.Hdr.Name) == sz.origin {
+			return soa.Serial, nil
+		}
+	}
+	return 0, errors.New("primary returned no soa")
+}
+
+func (sz *secondaryZone) transfer(m *dns.Msg) ([]dns.RR, error) {
+	t := &dns.Transfer{DialTimeout: queryTimeout, ReadTimeout: transferTimeout, WriteTimeout: queryTimeout}
+	ch, err := t.In(m, sz.primary)
+	if err != nil {
+		return nil, err
+	}
+	var rrs []dns.RR
+	for env := range ch {
+		if env.Error != nil {
+			err = env.Error // Keep draining ch.
+			continue
+		}
+		rrs = append(rrs, env.RR...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(rrs) == 0 {
+		return nil, errors.New("empty transfer")
+	}
+	if _, ok := rrs[0].(*dns.SOA); !ok {
+		return nil, errors.New("transfer does not start with a soa")
+	}
+	return rrs, nil
+}
+
+func (sz *secondaryZone) axfr() (*zone_file.Zone, error) {
+	m := new(dns.Msg)
+	m.SetAxfr(sz.origin)
+	rrs, err := sz.transfer(m)
+	if err != nil {
+		return nil, err
+	}
+	return buildZone(sz.origin, rrs[:len(rrs)-1])
+}
+
+func (sz *secondaryZone) ixfr(cur *zone_file.Zone) (*zone_file.Zone, error) {
+	soa := cur.SOA()
+	m := new(dns.Msg)
+	m.SetIxfr(sz.origin, soa.Serial, soa.Ns, soa.Mbox)
+	rrs, err := sz.transfer(m)
+	if err != nil {
+		return nil, err
+	}
+	return applyIXFR(cur, rrs)
+}
+
+// applyIXFR applies an IXFR response (RFC 1995 4) to z and returns a new zone.
+// z is not modified.
+func applyIXFR(z *zone_file.Zone, rrs []dns.RR) (*zone_file.Zone, error) {
+	newSOA := rrs[0].(*dns.SOA)
+	if len(rrs) == 1 { // We are up to date.
+		if serialGreater(newSOA.Serial, z.SOA().Serial) {
+			return nil, errors.New("primary returned a single newer soa")
+		}
+		return z, nil
+	}
+	if _, ok := rrs[1].(*dns.SOA); !ok { // AXFR style response
+		return buildZone(z.Origin(), rrs[:len(rrs)-1])
+	}
+
+	records := make(map[string]dns.RR)
+	z.Records(func(rr dns.RR) {
+		if rr.Header().Rrtype != dns.TypeSOA {
+			records[rrKey(rr)] = rr
+		}
+	})
+	isSOA := func(i int) bool {
+		_, ok := rrs[i].(*dns.SOA)
+		return ok
+	}
+	// Each difference sequence is: old SOA, deleted RRs, new SOA, added RRs.
+	i := 1
+	for i < len(rrs)-1 {
+		for i++; i < len(rrs) && !isSOA(i); i++ {
+			delete(records, rrKey(rrs[i]))
+		}
+		if i >= len(rrs) {
+			return nil, errors.New("incomplete ixfr response")
+		}
+		for i++; i < len(rrs) && !isSOA(i); i++ {
+			records[rrKey(rrs[i])] = rrs[i]
+		}
+		if i >= len(rrs) {
+			return nil, errors.New("incomplete ixfr response")
+		}
+	}
+
+	l := make([]dns.RR, 0, len(records)+1)
+	l = append(l, newSOA)
+	for _, rr := range records {
+		l = append(l, rr)
+	}
+	return buildZone(z.Origin(), l)
+}
+
+func buildZone(origin string, rrs []dns.RR) (*zone_file.Zone, error) {
+	z := zone_file.NewZone(origin)
+	for _, rr := range rrs {
+		if err := z.Add(rr); err != nil {
+			return nil, err
+		}
+	}
+	if z.SOA() == nil {
+		return nil, errors.New("zone has no soa")
+	}
+	return z, nil
+}
+
+// rrKey returns a key of rr that ignores its ttl and the case of its owner.
+func rrKey(rr dns.RR) string {
+	c := dns.Copy(rr)
+	c.Header().Name = dns.CanonicalName(c.Header().Name)
+	c.Header().Ttl = 0
+	return c.String()
+}
+
+// serialGreater reports whether serial a is greater than b (RFC 1982).
+func serialGreater(a, b uint32) bool {
+	return a != b && int32(a-b) > 0
+}
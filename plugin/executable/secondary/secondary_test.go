@@ -0,0 +1,251 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package secondary
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/miekg/dns"
+)
+
+// testPrimary is a primary server that serves a zone with two versions.
+// IXFR from serial 1 to 2 is incremental.
+type testPrimary struct {
+	mu     sync.Mutex
+	serial uint32
+	ixfrs  int
+	axfrs  int
+	v1, v2 []dns.RR
+}
+
+func mustRR(s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		panic(err)
+	}
+	return rr
+}
+
+func soa(serial uint32) dns.RR {
+	rr := mustRR("example.com. 3600 IN SOA ns1.example.com. hm.example.com. 0 3600 600 86400 300")
+	rr.(*dns.SOA).Serial = serial
+	return rr
+}
+
+var (
+	rrNS   = mustRR("example.com. 3600 IN NS ns1.example.com.")
+	rrNS1  = mustRR("ns1.example.com. 3600 IN A 192.0.2.53")
+	rrWWW1 = mustRR("www.example.com. 3600 IN A 192.0.2.1")
+	rrWWW2 = mustRR("www.example.com. 3600 IN A 192.0.2.2")
+)
+
+func (p *testPrimary) ServeDNS(w dns.ResponseWriter, q *dns.Msg) {
+	p.mu.Lock()
+	serial := p.serial
+	records := p.v1
+	if serial == 2 {
+		records = p.v2
+	}
+	p.mu.Unlock()
+
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Authoritative = true
+	switch q.Question[0].Qtype {
+	case dns.TypeSOA:
+		r.Answer = []dns.RR{soa(serial)}
+		w.WriteMsg(r)
+		return
+	case dns.TypeAXFR:
+		p.mu.Lock()
+		p.axfrs++
+		p.mu.Unlock()
+		r.Answer = append(append([]dns.RR{soa(serial)}, records...), soa(serial))
+	case dns.TypeIXFR:
+		p.mu.Lock()
+		p.ixfrs++
+		p.mu.Unlock()
+		if q.Ns[0].(*dns.SOA).Serial == 1 && serial == 2 {
+			r.Answer = []dns.RR{soa(2), soa(1), rrWWW1, soa(2), rrWWW2, soa(2)}
+		} else {
+			r.Answer = []dns.RR{soa(serial)}
+		}
+	default:
+		r.Rcode = dns.RcodeRefused
+		w.WriteMsg(r)
+		return
+	}
+	tr := new(dns.Transfer)
+	ch := make(chan *dns.Envelope, 1)
+	ch <- &dns.Envelope{RR: r.Answer}
+	close(ch)
+	tr.Out(w, q, ch)
+}
+
+func startPrimary(t *testing.T, p *testPrimary) string {
+	t.Helper()
+	tl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uc, err := net.ListenPacket("udp", tl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := &dns.Server{Listener: tl, Handler: p}
+	us := &dns.Server{PacketConn: uc, Handler: p}
+	go ts.ActivateAndServe()
+	go us.ActivateAndServe()
+	t.Cleanup(func() {
+		ts.Shutdown()
+		us.Shutdown()
+	})
+	return tl.Addr().String()
+}
+
+func waitSerial(t *testing.T, s *Secondary, serial uint32) {
+	t.Helper()
+	sz := s.zones["example.com."]
+	for i := 0; i < 100; i++ {
+		if z := sz.z.Load(); z != nil && z.SOA().Serial == serial {
+			return
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	t.Fatalf("zone was not transferred to serial %d", serial)
+}
+
+func exec(t *testing.T, s *Secondary, q *dns.Msg, client string) *dns.Msg {
+	t.Helper()
+	qCtx := query_context.NewContext(q)
+	qCtx.ServerMeta.ClientAddr = netip.MustParseAddr(client)
+	if err := s.Exec(context.Background(), qCtx); err != nil {
+		t.Fatal(err)
+	}
+	return qCtx.R()
+}
+
+func TestSecondary(t *testing.T) {
+	p := &testPrimary{
+		serial: 1,
+		v1:     []dns.RR{rrNS, rrNS1, rrWWW1},
+		v2:     []dns.RR{rrNS, rrNS1, rrWWW2},
+	}
+	addr := startPrimary(t, p)
+	s, err := NewSecondary(&Args{Zones: []ZoneArgs{{Origin: "example.com", Primary: addr}}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// Not in any zone.
+	q := new(dns.Msg)
+	q.SetQuestion("www.example.org.", dns.TypeA)
+	if r := exec(t, s, q, "127.0.0.1"); r != nil {
+		t.Fatal("unexpected response for out of zone query")
+	}
+
+	waitSerial(t, s, 1)
+	q = new(dns.Msg)
+	q.SetQuestion("www.example.com.", dns.TypeA)
+	r := exec(t, s, q, "127.0.0.1")
+	if !r.Authoritative || len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+		t.Fatalf("unexpected response %s", r)
+	}
+
+	// NOTIFY from an unknown address is refused.
+	p.mu.Lock()
+	p.serial = 2
+	p.mu.Unlock()
+	n := new(dns.Msg)
+	n.SetNotify("example.com.")
+	if r := exec(t, s, n, "192.0.2.100"); r.Rcode != dns.RcodeRefused {
+		t.Fatalf("want REFUSED, got %s", dns.RcodeToString[r.Rcode])
+	}
+
+	// NOTIFY from the primary triggers an incremental transfer.
+	r = exec(t, s, n, "127.0.0.1")
+	if r.Rcode != dns.RcodeSuccess || !r.Authoritative || r.Opcode != dns.OpcodeNotify {
+		t.Fatalf("unexpected notify response %s", r)
+	}
+	waitSerial(t, s, 2)
+	r = exec(t, s, q, "127.0.0.1")
+	if len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "192.0.2.2" {
+		t.Fatalf("unexpected response after ixfr %s", r)
+	}
+	p.mu.Lock()
+	if p.axfrs != 1 || p.ixfrs != 1 {
+		t.Fatalf("want 1 axfr and 1 ixfr, got %d and %d", p.axfrs, p.ixfrs)
+	}
+	p.mu.Unlock()
+}
+
+func TestApplyIXFR(t *testing.T) {
+	z, err := buildZone("example.com.", []dns.RR{soa(1), rrNS, rrNS1, rrWWW1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rrA := mustRR("a.example.com. 3600 IN A 192.0.2.10")
+
+	// Two difference sequences.
+	nz, err := applyIXFR(z, []dns.RR{soa(3), soa(1), rrWWW1, soa(2), rrWWW2, soa(2), soa(3), rrA, soa(3)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	nz.Records(func(rr dns.RR) { got = append(got, rrKey(rr)) })
+	if len(got) != 5 || nz.SOA().Serial != 3 {
+		t.Fatalf("unexpected zone %v", got)
+	}
+
+	// Up to date.
+	if nz, err := applyIXFR(z, []dns.RR{soa(1)}); err != nil || nz != z {
+		t.Fatalf("want the same zone, got %v, %v", nz, err)
+	}
+
+	// Incomplete.
+	if _, err := applyIXFR(z, []dns.RR{soa(2), soa(1), rrWWW1}); err == nil {
+		t.Fatal("want error")
+	}
+}
+
+func TestSerialGreater(t *testing.T) {
+	tests := []struct {
+		a, b uint32
+		want bool
+	}{
+		{2, 1, true},
+		{1, 2, false},
+		{1, 1, false},
+		{0, 0xffffffff, true},
+		{0xffffffff, 0, false},
+	}
+	for _, tt := range tests {
+		if got := serialGreater(tt.a, tt.b); got != tt.want {
+			t.Errorf("serialGreater(%d, %d) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
@@ -34,6 +34,17 @@ type ChainNode struct {
 	// In case both are set. E is preferred.
 	E  Executable
 	RE RecursiveExecutable
+
+	// Desc describes this node in query traces. Can be empty.
+	Desc NodeDesc
+}
+
+// NodeDesc describes a ChainNode.
+type NodeDesc struct {
+	Sequence string   // Tag of the sequence.
+	Index    int      // Index of the rule in the sequence.
+	Matches  []string // Matchers in config form, e.g. "!$tag args".
+	Exec     string   // Executable in config form.
 }
 
 type ChainWalker struct {
@@ -51,17 +62,33 @@ func NewChainWalker(chain []*ChainNode, jumpBack *ChainWalker) ChainWalker {
 
 func (w *ChainWalker) ExecNext(ctx context.Context, qCtx *query_context.Context) error {
 	p := w.p
+	tr := qCtx.Trace()
 	// Evaluate rules' matchers in loop.
 checkMatchesLoop:
 	for p < len(w.chain) {
 		n := w.chain[p]
+		var ev *query_context.TraceEvent
+		if tr != nil {
+			ev = n.newTraceEvent()
+		}
 
-		for _, match := range n.Matches {
+		for mi, match := range n.Matches {
 			ok, err := match.Match(ctx, qCtx)
+			if ev != nil {
+				ev.Matches = append(ev.Matches, query_context.TraceMatch{Matcher: n.Desc.match(mi), Result: ok, Err: errString(err)})
+			}
 			if err != nil {
+				if ev != nil {
+					finishTraceEvent(ev, respSnapshot{}, qCtx, err)
+					tr.Add(*ev)
+				}
 				return err
 			}
 			if !ok {
+				if ev != nil {
+					finishTraceEvent(ev, respSnapshot{}, qCtx, nil)
+					tr.Add(*ev)
+				}
 				// Skip this node if condition was not matched.
 				p++
 				continue checkMatchesLoop
@@ -71,7 +98,19 @@ checkMatchesLoop:
 		// Exec rules' executables in loop, or in stack if it is a recursive executable.
 		switch {
 		case n.E != nil:
-			if err := n.E.Exec(ctx, qCtx); err != nil {
+			if ev == nil {
+				if err := n.E.Exec(ctx, qCtx); err != nil {
+					return err
+				}
+				p++
+				continue
+			}
+			ev.Exec = n.Desc.Exec
+			before := packResp(qCtx.R())
+			err := n.E.Exec(ctx, qCtx)
+			finishTraceEvent(ev, before, qCtx, err)
+			tr.Add(*ev)
+			if err != nil {
 				return err
 			}
 			p++
@@ -82,7 +121,16 @@ checkMatchesLoop:
 				chain:    w.chain,
 				jumpBack: w.jumpBack,
 			}
-			return n.RE.Exec(ctx, qCtx, next)
+			if ev == nil {
+				return n.RE.Exec(ctx, qCtx, next)
+			}
+			ev.Exec = n.Desc.Exec
+			ev.Recursive = true
+			before := packResp(qCtx.R())
+			i := tr.Add(*ev)
+			err := n.RE.Exec(ctx, qCtx, next)
+			tr.Update(i, func(e *query_context.TraceEvent) { finishTraceEvent(e, before, qCtx, err) })
+			return err
 		default:
 			panic("n cannot be executed")
 		}
@@ -115,6 +163,7 @@ func (s *Sequence) buildChain(bq BQ, rs []RuleConfig) error {
 
 func (s *Sequence) newNode(bq BQ, r RuleConfig, ri int) (*ChainNode, error) {
 	n := new(ChainNode)
+	n.Desc = newNodeDesc(r, ri)
 
 	// init matches
 	for mi, mc := range r.Matches {
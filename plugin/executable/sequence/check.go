@@ -0,0 +1,92 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package sequence
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+)
+
+var _ coremain.ArgsChecker = (*Args)(nil)
+
+// CheckArgs implements coremain.ArgsChecker.
+func (a *Args) CheckArgs() (refs []coremain.PluginRef, errs []error) {
+	for ri, ra := range *a {
+		rc := parseArgs(ra)
+		for mi, mc := range rc.Matches {
+			r, err := checkQuickSetup(mc.Tag, mc.Type, mc.Args, "match", true)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("rule #%d matcher #%d: %w", ri, mi, err))
+			}
+			refs = append(refs, r...)
+		}
+		r, err := checkQuickSetup(rc.Tag, rc.Type, rc.Args, "exec", false)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("rule #%d exec: %w", ri, err))
+		}
+		refs = append(refs, r...)
+	}
+	return refs, errs
+}
+
+func checkQuickSetup(tag, typ, args, kind string, isMatcher bool) ([]coremain.PluginRef, error) {
+	switch {
+	case len(tag) > 0:
+		return []coremain.PluginRef{{Tag: tag, Kind: kind}}, nil
+	case len(typ) > 0:
+		var ok bool
+		var types []string
+		if isMatcher {
+			matchQuickSetupReg.RLock()
+			_, ok = matchQuickSetupReg.m[typ]
+			types = quickSetupTypes(matchQuickSetupReg.m)
+			matchQuickSetupReg.RUnlock()
+		} else {
+			execQuickSetupReg.RLock()
+			_, ok = execQuickSetupReg.m[typ]
+			types = quickSetupTypes(execQuickSetupReg.m)
+			execQuickSetupReg.RUnlock()
+		}
+		if !ok {
+			err := fmt.Errorf("invalid %s type %s", kind, typ)
+			if s := utils.Suggest(typ, types); len(s) > 0 {
+				err = fmt.Errorf("%w, did you mean %s?", err, s)
+			}
+			return nil, err
+		}
+		if f := getQuickSetupRefs(typ); f != nil {
+			return f(args), nil
+		}
+		return nil, nil
+	default:
+		return nil, errors.New("missing args")
+	}
+}
+
+// sequenceRefs returns a QuickSetupRefsFunc of jump and goto, whose args
+// is the tag of a sequence.
+func sequenceRefs(kind string) QuickSetupRefsFunc {
+	return func(args string) []coremain.PluginRef {
+		return []coremain.PluginRef{{Tag: args, Kind: kind, Type: PluginType}}
+	}
+}
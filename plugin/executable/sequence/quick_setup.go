@@ -120,3 +120,40 @@ func GetMatchQuickSetup(typ string) MatchQuickSetupFunc {
 	defer matchQuickSetupReg.RUnlock()
 	return matchQuickSetupReg.m[typ]
 }
+
+// QuickSetupRefsFunc returns the plugins that the quick setup args refer to.
+// It is used to check configs without initializing plugins.
+type QuickSetupRefsFunc func(args string) []coremain.PluginRef
+
+var quickSetupRefsReg struct {
+	sync.RWMutex
+	m map[string]QuickSetupRefsFunc
+}
+
+// MustRegQuickSetupRefs registers f for the quick setup type typ.
+// Matcher and executable quick setups with the same type share f.
+func MustRegQuickSetupRefs(typ string, f QuickSetupRefsFunc) {
+	quickSetupRefsReg.Lock()
+	defer quickSetupRefsReg.Unlock()
+	if _, ok := quickSetupRefsReg.m[typ]; ok {
+		panic(fmt.Sprintf("refs func of type %s has already been registered", typ))
+	}
+	if quickSetupRefsReg.m == nil {
+		quickSetupRefsReg.m = make(map[string]QuickSetupRefsFunc)
+	}
+	quickSetupRefsReg.m[typ] = f
+}
+
+func getQuickSetupRefs(typ string) QuickSetupRefsFunc {
+	quickSetupRefsReg.RLock()
+	defer quickSetupRefsReg.RUnlock()
+	return quickSetupRefsReg.m[typ]
+}
+
+func quickSetupTypes[F any](reg map[string]F) []string {
+	var s []string
+	for typ := range reg {
+		s = append(s, typ)
+	}
+	return s
+}
@@ -37,6 +37,8 @@ func init() {
 	MustRegExecQuickSetup("jump", setupJump)
 	MustRegMatchQuickSetup("_true", setupTrue) // add _ prefix to avoid being mis-parsed as bool
 	MustRegMatchQuickSetup("_false", setupFalse)
+	MustRegQuickSetupRefs("goto", sequenceRefs("goto"))
+	MustRegQuickSetupRefs("jump", sequenceRefs("jump"))
 }
 
 type Sequence struct {
@@ -51,10 +53,18 @@ func (s *Sequence) Close() error {
 	return nil
 }
 
-type Args = []RuleArgs
+type Args []RuleArgs
 
 func Init(bp *coremain.BP, args any) (any, error) {
-	return NewSequence(bp, *args.(*Args))
+	s, err := NewSequence(bp, *args.(*Args))
+	if err != nil {
+		return nil, err
+	}
+	s.setTag(bp.Tag())
+	if bp.M().TraceAPIEnabled(bp.Tag()) {
+		bp.RegAPI(s.api(bp.M()))
+	}
+	return s, nil
 }
 
 func NewSequence(bq BQ, ra []RuleArgs) (*Sequence, error) {
@@ -0,0 +1,228 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package sequence
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/go-chi/chi/v5"
+	"github.com/miekg/dns"
+)
+
+const defaultTraceTimeout = time.Second * 5
+
+func newNodeDesc(r RuleConfig, ri int) NodeDesc {
+	d := NodeDesc{Index: ri}
+	for _, mc := range r.Matches {
+		s := configString(mc.Tag, mc.Type, mc.Args)
+		if mc.Reverse {
+			s = "!" + s
+		}
+		d.Matches = append(d.Matches, s)
+	}
+	d.Exec = configString(r.Tag, r.Type, r.Args)
+	return d
+}
+
+func configString(tag, typ, args string) string {
+	s := typ
+	if len(tag) > 0 {
+		s = "$" + tag
+	}
+	if len(args) > 0 {
+		s += " " + args
+	}
+	return s
+}
+
+func (d *NodeDesc) match(i int) string {
+	if i < len(d.Matches) {
+		return d.Matches[i]
+	}
+	return ""
+}
+
+func (n *ChainNode) newTraceEvent() *query_context.TraceEvent {
+	return &query_context.TraceEvent{
+		Sequence: n.Desc.Sequence,
+		Node:     n.Desc.Index,
+		Start:    time.Now(),
+	}
+}
+
+// respSnapshot is the packed response before an executable runs.
+type respSnapshot struct {
+	taken bool
+	b     []byte // nil if there is no response.
+}
+
+func packResp(r *dns.Msg) respSnapshot {
+	s := respSnapshot{taken: true}
+	if r != nil {
+		s.b, _ = r.Pack()
+	}
+	return s
+}
+
+// finishTraceEvent fills the elapsed time, error and response states of e.
+// Response flags are only set if before was taken.
+func finishTraceEvent(e *query_context.TraceEvent, before respSnapshot, qCtx *query_context.Context, err error) {
+	e.Elapsed = time.Since(e.Start)
+	e.Err = errString(err)
+	r := qCtx.R()
+	e.Rcode = -1
+	if r != nil {
+		e.Rcode = r.Rcode
+	}
+	if !before.taken {
+		return
+	}
+	switch {
+	case before.b == nil:
+		e.RespSet = r != nil
+	case r == nil:
+		e.RespChanged = true
+	default:
+		after, _ := r.Pack()
+		e.RespChanged = !bytes.Equal(before.b, after)
+	}
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// TraceResult is the result of a traced query. See ExecTrace.
+type TraceResult struct {
+	Query    string                     `json:"query"`
+	Response string                     `json:"response,omitempty"` // In presentation format.
+	Rcode    string                     `json:"rcode,omitempty"`
+	Err      string                     `json:"error,omitempty"`
+	Trace    []query_context.TraceEvent `json:"trace"`
+}
+
+// ExecTrace runs q through e with tracing enabled and returns the
+// final response and all recorded sequence nodes.
+func ExecTrace(ctx context.Context, e Executable, q *dns.Msg, meta query_context.ServerMeta) *TraceResult {
+	res := &TraceResult{Query: q.Question[0].String()}
+	qCtx := query_context.NewContext(q)
+	qCtx.ServerMeta = meta
+	qCtx.EnableTrace()
+	err := e.Exec(ctx, qCtx)
+	res.Err = errString(err)
+	if r := qCtx.R(); r != nil {
+		res.Response = r.String()
+		res.Rcode = dns.RcodeToString[r.Rcode]
+	}
+	res.Trace = qCtx.Trace().Events()
+	return res
+}
+
+func (s *Sequence) setTag(tag string) {
+	for _, n := range s.chain {
+		n.Desc.Sequence = tag
+	}
+}
+
+// api returns the debug api of the sequence. It is only registered if it
+// is enabled by coremain.APIConfig.TraceSequences.
+// GET /trace?qname=example.com&qtype=A&client=10.0.0.1&server_name=&url_path=
+// runs a synthetic query through the sequence and returns its trace in json.
+// The query is a real query. Plugins in the sequence may have side effects,
+// e.g. caching the response or adding the answer to a set.
+func (s *Sequence) api(m *coremain.Mosdns) *chi.Mux {
+	r := chi.NewRouter()
+	r.Get("/trace", func(w http.ResponseWriter, req *http.Request) {
+		q, meta, err := parseTraceQuery(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Same as server handlers, don't run queries on a plugin graph
+		// that is being closed by a reload.
+		if !m.Acquire() {
+			http.Error(w, "the sequence is being closed, try again", http.StatusServiceUnavailable)
+			return
+		}
+		defer m.Release()
+		ctx, cancel := context.WithTimeout(req.Context(), defaultTraceTimeout)
+		defer cancel()
+		res := ExecTrace(ctx, s, q, meta)
+		w.Header().Set("content-type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(res)
+	})
+	return r
+}
+
+func parseTraceQuery(req *http.Request) (*dns.Msg, query_context.ServerMeta, error) {
+	var meta query_context.ServerMeta
+	v := req.URL.Query()
+	qname := v.Get("qname")
+	if len(qname) == 0 {
+		return nil, meta, errors.New("missing qname")
+	}
+	qtype, err := ParseQtype(v.Get("qtype"))
+	if err != nil {
+		return nil, meta, err
+	}
+	if s := v.Get("client"); len(s) > 0 {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, meta, fmt.Errorf("invalid client addr, %w", err)
+		}
+		meta.ClientAddr = addr
+	}
+	meta.ServerName = v.Get("server_name")
+	meta.UrlPath = v.Get("url_path")
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(qname), qtype)
+	return q, meta, nil
+}
+
+// ParseQtype parses a type name (e.g. "AAAA") or number. Empty s is A.
+func ParseQtype(s string) (uint16, error) {
+	if len(s) == 0 {
+		return dns.TypeA, nil
+	}
+	if t, ok := dns.StringToType[strings.ToUpper(s)]; ok {
+		return t, nil
+	}
+	n, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid qtype %s", s)
+	}
+	return uint16(n), nil
+}
@@ -0,0 +1,123 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package sequence
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/miekg/dns"
+)
+
+func TestSequence_Trace(t *testing.T) {
+	p := make(map[string]any)
+	preparePlugins(p)
+	p["nxdomain"] = ExecutableFunc(func(ctx context.Context, qCtx *query_context.Context) error {
+		r := new(dns.Msg)
+		r.SetRcode(qCtx.Q(), dns.RcodeNameError)
+		qCtx.SetResponse(r)
+		return nil
+	})
+	m := coremain.NewTestMosdnsWithPlugins(p)
+	s, err := NewSequence(coremain.NewBP("seq", m), []RuleArgs{
+		{Matches: []string{"$true", "!$true"}, Exec: "$target"},
+		{Matches: []string{"$true"}, Exec: "$nxdomain"},
+		{Exec: "$nop"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.setTag("seq")
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// Tracing is disabled by default.
+	qCtx := query_context.NewContext(q.Copy())
+	if err := s.Exec(context.Background(), qCtx); err != nil {
+		t.Fatal(err)
+	}
+	if qCtx.Trace() != nil {
+		t.Fatal("unexpected trace")
+	}
+
+	res := ExecTrace(context.Background(), s, q.Copy(), query_context.ServerMeta{})
+	if res.Rcode != "NXDOMAIN" {
+		t.Fatalf("want NXDOMAIN, got %s", res.Rcode)
+	}
+	events := res.Trace
+	if len(events) != 3 {
+		t.Fatalf("want 3 events, got %d", len(events))
+	}
+
+	// Skipped by the second (reversed) matcher.
+	e := events[0]
+	if e.Sequence != "seq" || e.Node != 0 || e.Exec != "" || len(e.Matches) != 2 ||
+		e.Matches[0].Matcher != "$true" || !e.Matches[0].Result ||
+		e.Matches[1].Matcher != "!$true" || e.Matches[1].Result {
+		t.Fatalf("unexpected event #0 %+v", e)
+	}
+
+	e = events[1]
+	if e.Node != 1 || e.Exec != "$nxdomain" || !e.RespSet || e.RespChanged || e.Rcode != dns.RcodeNameError || e.Recursive {
+		t.Fatalf("unexpected event #1 %+v", e)
+	}
+
+	e = events[2]
+	if e.Node != 2 || e.Exec != "$nop" || !e.Recursive || e.RespSet || e.RespChanged {
+		t.Fatalf("unexpected event #2 %+v", e)
+	}
+
+	// Debug api.
+	if m.TraceAPIEnabled("seq") {
+		t.Fatal("trace api should be disabled by default")
+	}
+	srv := httptest.NewServer(s.api(m))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/trace?qname=example.com&qtype=aaaa&client=10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+	res = new(TraceResult)
+	if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Query != ";example.com.\tIN\t AAAA" || len(res.Trace) != 3 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+
+	resp, err = http.Get(srv.URL + "/trace?qtype=A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("want bad request, got %d", resp.StatusCode)
+	}
+}
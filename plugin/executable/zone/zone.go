@@ -0,0 +1,97 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package zone
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/zone_file"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+)
+
+const PluginType = "zone"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+type Args struct {
+	Zones []ZoneArgs `yaml:"zones"`
+}
+
+type ZoneArgs struct {
+	// Origin is optional. If empty, the owner of the first SOA record
+	// in the file is used.
+	Origin string `yaml:"origin"`
+	File   string `yaml:"file"`
+}
+
+var _ sequence.Executable = (*Zone)(nil)
+
+// Zone answers queries authoritatively from zone files. Queries that
+// are not in any zone are ignored.
+type Zone struct {
+	zones map[string]*zone_file.Zone // key: canonical origin
+}
+
+func NewZone(args *Args) (*Zone, error) {
+	z := &Zone{zones: make(map[string]*zone_file.Zone)}
+	for i, za := range args.Zones {
+		zf, err := zone_file.LoadZoneFile(za.File, za.Origin)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load zone #%d [%s], %w", i, za.File, err)
+		}
+		if _, dup := z.zones[zf.Origin()]; dup {
+			return nil, fmt.Errorf("duplicated zone %s", zf.Origin())
+		}
+		z.zones[zf.Origin()] = zf
+	}
+	return z, nil
+}
+
+func (z *Zone) Exec(_ context.Context, qCtx *query_context.Context) error {
+	q := qCtx.Q()
+	if len(q.Question) != 1 || q.Question[0].Qclass != dns.ClassINET {
+		return nil
+	}
+	if zf := z.findZone(q.Question[0].Name); zf != nil {
+		qCtx.SetResponse(zf.Reply(q))
+	}
+	return nil
+}
+
+// findZone returns the most specific zone that contains name.
+func (z *Zone) findZone(name string) *zone_file.Zone {
+	name = dns.CanonicalName(name)
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if zf := z.zones[name[off:]]; zf != nil {
+			return zf
+		}
+	}
+	return z.zones["."]
+}
+
+func Init(_ *coremain.BP, v any) (any, error) {
+	return NewZone(v.(*Args))
+}
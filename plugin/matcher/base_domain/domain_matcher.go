@@ -22,6 +22,7 @@ package base_domain
 import (
 	"context"
 	"fmt"
+	"github.com/IrineSistiana/mosdns/v5/coremain"
 	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
 	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
 	"github.com/IrineSistiana/mosdns/v5/plugin/data_provider"
@@ -101,3 +102,13 @@ func ParseQuickSetupArgs(s string) *Args {
 	}
 	return args
 }
+
+// QuickSetupRefs returns the domain set plugins referred by quick setup args s.
+// It is a sequence.QuickSetupRefsFunc.
+func QuickSetupRefs(s string) []coremain.PluginRef {
+	var refs []coremain.PluginRef
+	for _, tag := range ParseQuickSetupArgs(s).DomainSets {
+		refs = append(refs, coremain.PluginRef{Tag: tag, Kind: "domain_set"})
+	}
+	return refs
+}
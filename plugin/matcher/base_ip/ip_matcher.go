@@ -22,6 +22,7 @@ package base_ip
 import (
 	"context"
 	"fmt"
+	"github.com/IrineSistiana/mosdns/v5/coremain"
 	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/netlist"
 	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
 	"github.com/IrineSistiana/mosdns/v5/plugin/data_provider"
@@ -103,3 +104,13 @@ func ParseQuickSetupArgs(s string) *Args {
 	}
 	return args
 }
+
+// QuickSetupRefs returns the ip set plugins referred by quick setup args s.
+// It is a sequence.QuickSetupRefsFunc.
+func QuickSetupRefs(s string) []coremain.PluginRef {
+	var refs []coremain.PluginRef
+	for _, tag := range ParseQuickSetupArgs(s).IPSets {
+		refs = append(refs, coremain.PluginRef{Tag: tag, Kind: "ip_set"})
+	}
+	return refs
+}
@@ -31,6 +31,7 @@ const PluginType = "cname"
 
 func init() {
 	sequence.MustRegMatchQuickSetup(PluginType, QuickSetup)
+	sequence.MustRegQuickSetupRefs(PluginType, base_domain.QuickSetupRefs)
 }
 
 type Args = base_domain.Args
@@ -30,6 +30,7 @@ const PluginType = "qname"
 
 func init() {
 	sequence.MustRegMatchQuickSetup(PluginType, QuickSetup)
+	sequence.MustRegQuickSetupRefs(PluginType, base.QuickSetupRefs)
 }
 
 type Args = base.Args
@@ -67,7 +67,7 @@ func NewMatcher(f GetStrFunc, sm StringMatcher) *Matcher {
 }
 
 // Format: "scr_string_name op [string]..."
-// scr_string_name = {url_path|server_name|$env_key}
+// scr_string_name = {url_path|server_name|client_identity|$env_key}
 // op = {zl|eq|prefix|suffix|contains|regexp}
 func QuickSetupFromStr(s string) (sequence.Matcher, error) {
 	sf := strings.Fields(s)
@@ -121,6 +121,8 @@ func QuickSetupFromStr(s string) (sequence.Matcher, error) {
 			gf = getUrlPath
 		case "server_name":
 			gf = getServerName
+		case "client_identity":
+			gf = getClientIdentity
 		default:
 			return nil, fmt.Errorf("invalid src string name %s", srcStrName)
 		}
@@ -182,3 +184,7 @@ func getUrlPath(qCtx *query_context.Context) string {
 func getServerName(qCtx *query_context.Context) string {
 	return qCtx.ServerMeta.ServerName
 }
+
+func getClientIdentity(qCtx *query_context.Context) string {
+	return qCtx.ServerMeta.ClientIdentity
+}
@@ -33,7 +33,7 @@ func TestMatcher_Match(t *testing.T) {
 	r := require.New(t)
 	q := new(dns.Msg)
 	qc := query_context.NewContext(q)
-	qc.ServerMeta = query_context.ServerMeta{UrlPath: "/dns-query", ServerName: "a.b.c"}
+	qc.ServerMeta = query_context.ServerMeta{UrlPath: "/dns-query", ServerName: "a.b.c", ClientIdentity: "client.a.b.c"}
 	os.Setenv("STRING_EXP_TEST", "abc")
 
 	doTest := func(arg string, want bool) {
@@ -61,6 +61,10 @@ func TestMatcher_Match(t *testing.T) {
 	doTest("server_name eq abc a.b.c def", true)
 	doTest("server_name eq abc def", false)
 
+	doTest("client_identity eq client.a.b.c", true)
+	doTest("client_identity suffix .a.b.c", true)
+	doTest("client_identity eq a.b.c", false)
+
 	doTest("$STRING_EXP_TEST eq 123 abc def", true)
 	doTest("$STRING_EXP_TEST eq 123 def", false)
 	doTest("$STRING_EXP_TEST_NOT_EXIST eq 123 abc def", false)
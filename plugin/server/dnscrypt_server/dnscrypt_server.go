@@ -0,0 +1,300 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package dnscrypt_server
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnscrypt"
+	"github.com/IrineSistiana/mosdns/v5/pkg/server"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/IrineSistiana/mosdns/v5/plugin/server/server_utils"
+	"go.uber.org/zap"
+)
+
+const PluginType = "dnscrypt_server"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+type Args struct {
+	Entry  string `yaml:"entry"`
+	Listen string `yaml:"listen"` // Both udp and tcp.
+
+	// ProviderName is the provider name, e.g. "2.dnscrypt-cert.example.com".
+	ProviderName string `yaml:"provider_name"`
+
+	// ProviderKey is the file of the provider ed25519 private key in
+	// PKCS #8 PEM format. A new key is generated and saved to the file
+	// if the file does not exist.
+	ProviderKey string `yaml:"provider_key"`
+
+	// EsVersion is the encryption system of resolver certs,
+	// "xsalsa20poly1305" (default) or "xchacha20poly1305".
+	EsVersion string `yaml:"es_version"`
+
+	// CertTTL is the validity period of resolver certs in seconds.
+	// A new cert is issued every half of CertTTL. Default is 86400.
+	CertTTL int `yaml:"cert_ttl"`
+
+	IdleTimeout int `yaml:"idle_timeout"`
+}
+
+func (a *Args) init() {
+	utils.SetDefaultString(&a.Listen, "127.0.0.1:443")
+	utils.SetDefaultString(&a.EsVersion, "xsalsa20poly1305")
+	utils.SetDefaultUnsignNum(&a.CertTTL, 86400)
+	utils.SetDefaultNum(&a.IdleTimeout, 10)
+}
+
+// CheckArgs implements coremain.ArgsChecker.
+func (a *Args) CheckArgs() ([]coremain.PluginRef, []error) {
+	var errs []error
+	if len(a.ProviderName) == 0 {
+		errs = append(errs, errors.New("missing provider name"))
+	}
+	if len(a.ProviderKey) == 0 {
+		errs = append(errs, errors.New("missing provider key"))
+	}
+	if len(a.Entry) == 0 {
+		return nil, append(errs, errors.New("missing entry"))
+	}
+	return []coremain.PluginRef{{Tag: a.Entry, Kind: "entry"}}, errs
+}
+
+func parseEsVersion(s string) (dnscrypt.EsVersion, error) {
+	switch strings.ToLower(s) {
+	case "xsalsa20poly1305":
+		return dnscrypt.XSalsa20Poly1305, nil
+	case "xchacha20poly1305":
+		return dnscrypt.XChacha20Poly1305, nil
+	default:
+		return 0, fmt.Errorf("unknown es_version %s", s)
+	}
+}
+
+type DNSCryptServer struct {
+	args *Args
+
+	h          *server_utils.Handler
+	uc         net.PacketConn
+	l          net.Listener
+	providerSk ed25519.PrivateKey
+	es         dnscrypt.EsVersion
+	certs      *dnscrypt.CertStore
+	logger     *zap.Logger
+
+	closed      atomic.Bool
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+}
+
+var _ coremain.ReusablePlugin = (*DNSCryptServer)(nil)
+
+func (s *DNSCryptServer) Close() error {
+	s.closed.Store(true)
+	s.closeOnce.Do(func() { close(s.closeNotify) })
+	_ = s.l.Close()
+	return s.uc.Close()
+}
+
+// Reuse implements coremain.ReusablePlugin. It keeps the sockets and
+// certs and switches the entry to the new plugin graph.
+func (s *DNSCryptServer) Reuse(bp *coremain.BP) error {
+	return server_utils.ReloadHandlers(bp, s.h)
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	return StartServer(bp, args.(*Args))
+}
+
+func StartServer(bp *coremain.BP, args *Args) (*DNSCryptServer, error) {
+	args.init()
+	if len(args.ProviderName) == 0 {
+		return nil, errors.New("missing provider name")
+	}
+	es, err := parseEsVersion(args.EsVersion)
+	if err != nil {
+		return nil, err
+	}
+	providerSk, err := loadOrGenerateKey(args.ProviderKey, bp.L())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load provider key, %w", err)
+	}
+	dh, err := server_utils.NewHandler(bp, args.Entry)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init dns handler, %w", err)
+	}
+
+	s := &DNSCryptServer{
+		args:        args,
+		h:           dh,
+		providerSk:  providerSk,
+		es:          es,
+		certs:       new(dnscrypt.CertStore),
+		logger:      bp.L(),
+		closeNotify: make(chan struct{}),
+	}
+	if err := s.rotateCert(); err != nil {
+		return nil, err
+	}
+
+	socketOpt := server_utils.ListenerSocketOpts{
+		SO_REUSEPORT: true,
+		SO_RCVBUF:    64 * 1024,
+	}
+	lc := net.ListenConfig{Control: server_utils.ListenerControl(socketOpt)}
+	uc, err := lc.ListenPacket(context.Background(), "udp", args.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create udp socket, %w", err)
+	}
+	l, err := lc.Listen(context.Background(), "tcp", args.Listen)
+	if err != nil {
+		uc.Close()
+		return nil, fmt.Errorf("failed to listen tcp socket, %w", err)
+	}
+	s.uc, s.l = uc, l
+
+	stamp := &dnscrypt.Stamp{
+		Props:        dnscrypt.StampPropNoLog | dnscrypt.StampPropNoFilter,
+		ServerAddr:   uc.LocalAddr().String(),
+		ServerPk:     providerSk.Public().(ed25519.PublicKey),
+		ProviderName: args.ProviderName,
+	}
+	bp.L().Info(
+		"dnscrypt server started",
+		zap.Stringer("addr", uc.LocalAddr()),
+		zap.String("provider_name", args.ProviderName),
+		zap.String("provider_public_key", hex.EncodeToString(stamp.ServerPk)),
+		zap.Stringer("stamp", stamp),
+	)
+
+	serverOpts := server.DNSCryptServerOpts{
+		Logger:       bp.L(),
+		ProviderName: args.ProviderName,
+		Certs:        s.certs,
+		IdleTimeout:  time.Duration(args.IdleTimeout) * time.Second,
+	}
+	go func() {
+		defer uc.Close()
+		err := server.ServeDNSCryptUDP(uc, dh, serverOpts)
+		if !s.closed.Load() {
+			bp.M().GetSafeClose().SendCloseSignal(err)
+		}
+	}()
+	go func() {
+		defer l.Close()
+		err := server.ServeDNSCryptTCP(l, dh, serverOpts)
+		if !s.closed.Load() {
+			bp.M().GetSafeClose().SendCloseSignal(err)
+		}
+	}()
+	go s.rotateLoop()
+	return s, nil
+}
+
+// rotateCert issues a new cert. The previous cert is kept because it is
+// still valid and clients may be using it.
+func (s *DNSCryptServer) rotateCert() error {
+	now := time.Now()
+	ttl := time.Duration(s.args.CertTTL) * time.Second
+	c, err := dnscrypt.NewResolverCert(s.providerSk, s.es, uint32(now.Unix()), now.Add(-time.Minute), now.Add(ttl))
+	if err != nil {
+		return fmt.Errorf("failed to issue resolver cert, %w", err)
+	}
+	certs := []*dnscrypt.ResolverCert{c}
+	if old := s.certs.Certs(); len(old) > 0 && old[0].ValidAt(now) {
+		certs = append(certs, old[0])
+	}
+	s.certs.Set(certs)
+	s.logger.Info("resolver cert issued", zap.Uint32("serial", c.Serial), zap.Time("not_after", time.Unix(int64(c.NotAfter), 0)))
+	return nil
+}
+
+func (s *DNSCryptServer) rotateLoop() {
+	ticker := time.NewTicker(time.Duration(s.args.CertTTL) * time.Second / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.rotateCert(); err != nil {
+				s.logger.Error("failed to rotate cert", zap.Error(err))
+			}
+		case <-s.closeNotify:
+			return
+		}
+	}
+}
+
+// loadOrGenerateKey loads the ed25519 private key from file. If the file
+// does not exist, it generates a new key and saves it to file.
+func loadOrGenerateKey(file string, logger *zap.Logger) (ed25519.PrivateKey, error) {
+	if len(file) == 0 {
+		return nil, errors.New("missing provider key file")
+	}
+	b, err := os.ReadFile(file)
+	if err == nil {
+		blk, _ := pem.Decode(b)
+		if blk == nil {
+			return nil, errors.New("invalid pem file")
+		}
+		k, err := x509.ParsePKCS8PrivateKey(blk.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		sk, ok := k.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("key is a %T, not an ed25519 key", k)
+		}
+		return sk, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	_, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(sk)
+	if err != nil {
+		return nil, err
+	}
+	b = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(file, b, 0600); err != nil {
+		return nil, err
+	}
+	logger.Info("provider key generated", zap.String("file", file))
+	return sk, nil
+}
@@ -21,13 +21,17 @@ package tcp_server
 
 import (
 	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/odoh"
 	"github.com/IrineSistiana/mosdns/v5/pkg/server"
 	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
 	"github.com/IrineSistiana/mosdns/v5/plugin/server/server_utils"
@@ -51,28 +55,103 @@ type Args struct {
 	Cert        string `yaml:"cert"`
 	Key         string `yaml:"key"`
 	IdleTimeout int    `yaml:"idle_timeout"`
+
+	// Certs are additional certificates. A certificate is chosen by the
+	// SNI of the client. Cert and Key are the default.
+	Certs []server_utils.CertArgs `yaml:"certs"`
+
+	// ClientCA is a PEM bundle of CAs. If set, clients must present a
+	// certificate signed by them. Its identity can be matched by
+	// "string_exp client_identity ...".
+	ClientCA string `yaml:"client_ca"`
+
+	// ClientCertOptional also accepts clients without certificates.
+	ClientCertOptional bool `yaml:"client_cert_optional"`
+
+	// ODoHKey is the file of the oblivious DoH (RFC 9230) target X25519
+	// private key in PKCS #8 PEM format. If set, entries also accept
+	// oblivious queries and the target config is published at
+	// /.well-known/odohconfigs. A new key is generated and saved to the
+	// file if the file does not exist.
+	ODoHKey string `yaml:"odoh_key"`
+
+	// ODoHProxy enables the oblivious proxy on entries.
+	ODoHProxy bool `yaml:"odoh_proxy"`
+
+	// ODoHProxyTargets are the target hosts ("host[:port]") that the
+	// proxy forwards to. Required if ODoHProxy is enabled.
+	ODoHProxyTargets []string `yaml:"odoh_proxy_targets"`
 }
 
 func (a *Args) init() {
 	utils.SetDefaultNum(&a.IdleTimeout, 30)
 }
 
+// CheckArgs implements coremain.ArgsChecker.
+func (a *Args) CheckArgs() (refs []coremain.PluginRef, errs []error) {
+	if len(a.Entries) == 0 {
+		errs = append(errs, errors.New("no entry is configured"))
+	}
+	for i, e := range a.Entries {
+		if len(e.Exec) == 0 {
+			errs = append(errs, fmt.Errorf("entry #%d: missing exec", i))
+			continue
+		}
+		refs = append(refs, coremain.PluginRef{Tag: e.Exec, Kind: "entry"})
+	}
+	if a.ODoHProxy && len(a.ODoHProxyTargets) == 0 {
+		errs = append(errs, errors.New("odoh proxy requires odoh_proxy_targets"))
+	}
+	return refs, errs
+}
+
 type HttpServer struct {
 	args *Args
 
+	hs     []*server_utils.Handler
 	server *http.Server
+	closed atomic.Bool
 }
 
+var _ coremain.ReusablePlugin = (*HttpServer)(nil)
+
 func (s *HttpServer) Close() error {
+	s.closed.Store(true)
 	return s.server.Close()
 }
 
+// Reuse implements coremain.ReusablePlugin. It keeps the listener and
+// switches the entries to the new plugin graph.
+func (s *HttpServer) Reuse(bp *coremain.BP) error {
+	return server_utils.ReloadHandlers(bp, s.hs...)
+}
+
 func Init(bp *coremain.BP, args any) (any, error) {
 	return StartServer(bp, args.(*Args))
 }
 
 func StartServer(bp *coremain.BP, args *Args) (*HttpServer, error) {
+	var odohKey *odoh.KeyPair
+	if len(args.ODoHKey) > 0 {
+		var err error
+		odohKey, err = loadOrGenerateODoHKey(args.ODoHKey, bp.L())
+		if err != nil {
+			return nil, fmt.Errorf("failed to load odoh key, %w", err)
+		}
+		bp.L().Info("odoh target enabled", zap.String("key_id", hex.EncodeToString(odohKey.Config().KeyID())))
+	}
+	var odohProxy *server.ODoHProxy
+	if args.ODoHProxy {
+		if len(args.ODoHProxyTargets) == 0 {
+			return nil, errors.New("odoh proxy requires odoh_proxy_targets")
+		}
+		odohProxy = &server.ODoHProxy{AllowedTargets: args.ODoHProxyTargets}
+	}
+
 	mux := http.NewServeMux()
+	var dhs []*server_utils.Handler
+	var firstHH *server.HttpHandler
+	configsPathUsed := false
 	for _, entry := range args.Entries {
 		dh, err := server_utils.NewHandler(bp, entry.Exec)
 		if err != nil {
@@ -81,9 +160,33 @@ func StartServer(bp *coremain.BP, args *Args) (*HttpServer, error) {
 		hhOpts := server.HttpHandlerOpts{
 			GetSrcIPFromHeader: args.SrcIPHeader,
 			Logger:             bp.L(),
+			ODoHKey:            odohKey,
+			ODoHProxy:          odohProxy,
 		}
+		dhs = append(dhs, dh)
 		hh := server.NewHttpHandler(dh, hhOpts)
 		mux.Handle(entry.Path, hh)
+		if entry.Path == odoh.WellKnownConfigsPath {
+			configsPathUsed = true
+		}
+		if firstHH == nil {
+			firstHH = hh
+		}
+	}
+	if odohKey != nil && firstHH != nil && !configsPathUsed {
+		// All handlers serve the same config.
+		mux.Handle(odoh.WellKnownConfigsPath, firstHH)
+	}
+
+	tc, err := server_utils.NewTLSConfig(server_utils.TLSArgs{
+		Cert:               args.Cert,
+		Key:                args.Key,
+		Certs:              args.Certs,
+		ClientCA:           args.ClientCA,
+		ClientCertOptional: args.ClientCertOptional,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to init tls, %w", err)
 	}
 
 	socketOpt := server_utils.ListenerSocketOpts{
@@ -107,6 +210,7 @@ func StartServer(bp *coremain.BP, args *Args) (*HttpServer, error) {
 		ReadTimeout:    time.Second,
 		IdleTimeout:    time.Duration(args.IdleTimeout) * time.Second,
 		MaxHeaderBytes: 512,
+		TLSConfig:      tc,
 	}
 	if err := http2.ConfigureServer(hs, &http2.Server{
 		MaxReadFrameSize:             16 * 1024,
@@ -117,17 +221,21 @@ func StartServer(bp *coremain.BP, args *Args) (*HttpServer, error) {
 		return nil, fmt.Errorf("failed to setup http2 server, %w", err)
 	}
 
+	s := &HttpServer{
+		args:   args,
+		hs:     dhs,
+		server: hs,
+	}
 	go func() {
 		var err error
-		if len(args.Key)+len(args.Cert) > 0 {
-			err = hs.ServeTLS(l, args.Cert, args.Key)
+		if tc != nil {
+			err = hs.ServeTLS(l, "", "")
 		} else {
 			err = hs.Serve(l)
 		}
-		bp.M().GetSafeClose().SendCloseSignal(err)
+		if !s.closed.Load() {
+			bp.M().GetSafeClose().SendCloseSignal(err)
+		}
 	}()
-	return &HttpServer{
-		args:   args,
-		server: hs,
-	}, nil
+	return s, nil
 }
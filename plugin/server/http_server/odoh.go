@@ -0,0 +1,72 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tcp_server
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/odoh"
+	"go.uber.org/zap"
+)
+
+// loadOrGenerateODoHKey loads the X25519 private key from file. If the file
+// does not exist, it generates a new key and saves it to file.
+func loadOrGenerateODoHKey(file string, logger *zap.Logger) (*odoh.KeyPair, error) {
+	b, err := os.ReadFile(file)
+	if err == nil {
+		blk, _ := pem.Decode(b)
+		if blk == nil {
+			return nil, errors.New("invalid pem file")
+		}
+		k, err := x509.ParsePKCS8PrivateKey(blk.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		sk, ok := k.(*ecdh.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("key is a %T, not a X25519 key", k)
+		}
+		return odoh.NewKeyPair(sk)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	sk, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(sk)
+	if err != nil {
+		return nil, err
+	}
+	b = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(file, b, 0600); err != nil {
+		return nil, err
+	}
+	logger.Info("odoh key generated", zap.String("file", file))
+	return odoh.NewKeyPair(sk)
+}
@@ -20,10 +20,10 @@
 package quic_server
 
 import (
-	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/coremain"
@@ -46,22 +46,53 @@ type Args struct {
 	Cert        string `yaml:"cert"`
 	Key         string `yaml:"key"`
 	IdleTimeout int    `yaml:"idle_timeout"`
+
+	// Certs are additional certificates. A certificate is chosen by the
+	// SNI of the client. Cert and Key are the default.
+	Certs []server_utils.CertArgs `yaml:"certs"`
+
+	// ClientCA is a PEM bundle of CAs. If set, clients must present a
+	// certificate signed by them. Its identity can be matched by
+	// "string_exp client_identity ...".
+	ClientCA string `yaml:"client_ca"`
+
+	// ClientCertOptional also accepts clients without certificates.
+	ClientCertOptional bool `yaml:"client_cert_optional"`
 }
 
 func (a *Args) init() {
 	utils.SetDefaultNum(&a.IdleTimeout, 30)
 }
 
+// CheckArgs implements coremain.ArgsChecker.
+func (a *Args) CheckArgs() ([]coremain.PluginRef, []error) {
+	if len(a.Entry) == 0 {
+		return nil, []error{errors.New("missing entry")}
+	}
+	return []coremain.PluginRef{{Tag: a.Entry, Kind: "entry"}}, nil
+}
+
 type QuicServer struct {
 	args *Args
 
-	l *quic.Listener
+	h      *server_utils.Handler
+	l      *quic.Listener
+	closed atomic.Bool
 }
 
+var _ coremain.ReusablePlugin = (*QuicServer)(nil)
+
 func (s *QuicServer) Close() error {
+	s.closed.Store(true)
 	return s.l.Close()
 }
 
+// Reuse implements coremain.ReusablePlugin. It keeps the listener and
+// switches the entry to the new plugin graph.
+func (s *QuicServer) Reuse(bp *coremain.BP) error {
+	return server_utils.ReloadHandlers(bp, s.h)
+}
+
 func Init(bp *coremain.BP, args any) (any, error) {
 	return StartServer(bp, args.(*Args))
 }
@@ -75,12 +106,18 @@ func StartServer(bp *coremain.BP, args *Args) (*QuicServer, error) {
 	}
 
 	// Init tls
-	if len(args.Key) == 0 || len(args.Cert) == 0 {
-		return nil, errors.New("quic server requires a tls certificate")
+	tlsConfig, err := server_utils.NewTLSConfig(server_utils.TLSArgs{
+		Cert:               args.Cert,
+		Key:                args.Key,
+		Certs:              args.Certs,
+		ClientCA:           args.ClientCA,
+		ClientCertOptional: args.ClientCertOptional,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to init tls, %w", err)
 	}
-	tlsConfig := new(tls.Config)
-	if err := server.LoadCert(tlsConfig, args.Cert, args.Key); err != nil {
-		return nil, fmt.Errorf("failed to read tls cert, %w", err)
+	if tlsConfig == nil {
+		return nil, errors.New("quic server requires a tls certificate")
 	}
 	tlsConfig.NextProtos = []string{"doq"}
 
@@ -119,14 +156,18 @@ func StartServer(bp *coremain.BP, args *Args) (*QuicServer, error) {
 	}
 	bp.L().Info("quic server started", zap.Stringer("addr", quicListener.Addr()))
 
+	s := &QuicServer{
+		args: args,
+		h:    dh,
+		l:    quicListener,
+	}
 	go func() {
 		defer quicListener.Close()
 		serverOpts := server.DoQServerOpts{Logger: bp.L(), IdleTimeout: idleTimeout}
 		err := server.ServeDoQ(quicListener, dh, serverOpts)
-		bp.M().GetSafeClose().SendCloseSignal(err)
+		if !s.closed.Load() {
+			bp.M().GetSafeClose().SendCloseSignal(err)
+		}
 	}()
-	return &QuicServer{
-		args: args,
-		l:    quicListener,
-	}, nil
+	return s, nil
 }
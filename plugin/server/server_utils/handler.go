@@ -20,24 +20,72 @@
 package server_utils
 
 import (
+	"context"
 	"fmt"
+	"sync/atomic"
 
 	"github.com/IrineSistiana/mosdns/v5/coremain"
 	"github.com/IrineSistiana/mosdns/v5/pkg/server"
 	"github.com/IrineSistiana/mosdns/v5/pkg/server_handler"
 	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
 )
 
-func NewHandler(bp *coremain.BP, entry string) (server.Handler, error) {
-	p := bp.M().GetPlugin(entry)
-	exec := sequence.ToExecutable(p)
-	if exec == nil {
-		return nil, fmt.Errorf("cannot find executable entry by tag %s", entry)
+// Handler is a server.Handler that runs queries on an entry executable.
+// The entry can be switched to a new plugin graph by ReloadHandlers
+// after a config reload.
+type Handler struct {
+	entry string
+	e     atomic.Pointer[entryHandler]
+}
+
+type entryHandler struct {
+	h *server_handler.EntryHandler
+	m *coremain.Mosdns
+}
+
+var _ server.Handler = (*Handler)(nil)
+
+func NewHandler(bp *coremain.BP, entry string) (*Handler, error) {
+	h := &Handler{entry: entry}
+	if err := ReloadHandlers(bp, h); err != nil {
+		return nil, err
 	}
+	return h, nil
+}
+
+// ReloadHandlers switches the entries of hs to the plugin graph of bp.
+// If any entry cannot be found, none of hs are changed.
+func ReloadHandlers(bp *coremain.BP, hs ...*Handler) error {
+	ehs := make([]*entryHandler, 0, len(hs))
+	for _, h := range hs {
+		exec := sequence.ToExecutable(bp.M().GetPlugin(h.entry))
+		if exec == nil {
+			return fmt.Errorf("cannot find executable entry by tag %s", h.entry)
+		}
+		handlerOpts := server_handler.EntryHandlerOpts{
+			Logger: bp.L(),
+			Entry:  exec,
+		}
+		ehs = append(ehs, &entryHandler{h: server_handler.NewEntryHandler(handlerOpts), m: bp.M()})
+	}
+	for i, h := range hs {
+		h.e.Store(ehs[i])
+	}
+	return nil
+}
 
-	handlerOpts := server_handler.EntryHandlerOpts{
-		Logger: bp.L(),
-		Entry:  exec,
+// Handle implements server.Handler.
+func (h *Handler) Handle(ctx context.Context, q *dns.Msg, meta server.QueryMeta, packMsgPayload func(m *dns.Msg) (*[]byte, error)) *[]byte {
+	for {
+		e := h.e.Load()
+		if e.m.Acquire() {
+			defer e.m.Release()
+			return e.h.Handle(ctx, q, meta, packMsgPayload)
+		}
+		// The plugin graph of e is being closed.
+		if h.e.Load() == e { // This server is also being closed.
+			return nil
+		}
 	}
-	return server_handler.NewEntryHandler(handlerOpts), nil
 }
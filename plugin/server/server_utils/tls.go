@@ -0,0 +1,69 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server_utils
+
+import (
+	"crypto/tls"
+	"errors"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/server"
+)
+
+// CertArgs is a pair of cert and key files.
+type CertArgs struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+}
+
+// TLSArgs are the tls args of tcp, http and quic servers.
+type TLSArgs struct {
+	// Cert and Key are the default certificate.
+	Cert string
+	Key  string
+
+	// Certs are additional certificates chosen by SNI.
+	Certs []CertArgs
+
+	ClientCA           string
+	ClientCertOptional bool
+}
+
+// NewTLSConfig returns a server tls.Config. It returns nil if no
+// certificate is configured.
+func NewTLSConfig(args TLSArgs) (*tls.Config, error) {
+	var certs []server.CertFile
+	if len(args.Cert)+len(args.Key) > 0 {
+		certs = append(certs, server.CertFile{Cert: args.Cert, Key: args.Key})
+	}
+	for _, c := range args.Certs {
+		certs = append(certs, server.CertFile{Cert: c.Cert, Key: c.Key})
+	}
+	if len(certs) == 0 {
+		if len(args.ClientCA) > 0 {
+			return nil, errors.New("client ca requires a tls certificate")
+		}
+		return nil, nil
+	}
+	return server.NewTLSConfig(server.TLSOpts{
+		Certs:              certs,
+		ClientCAFile:       args.ClientCA,
+		ClientCertOptional: args.ClientCertOptional,
+	})
+}
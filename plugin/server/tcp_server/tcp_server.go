@@ -22,9 +22,11 @@ package tcp_server
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/coremain"
@@ -46,6 +48,18 @@ type Args struct {
 	Cert        string `yaml:"cert"`
 	Key         string `yaml:"key"`
 	IdleTimeout int    `yaml:"idle_timeout"`
+
+	// Certs are additional certificates. A certificate is chosen by the
+	// SNI of the client. Cert and Key are the default.
+	Certs []server_utils.CertArgs `yaml:"certs"`
+
+	// ClientCA is a PEM bundle of CAs. If set, clients must present a
+	// certificate signed by them. Its identity can be matched by
+	// "string_exp client_identity ...".
+	ClientCA string `yaml:"client_ca"`
+
+	// ClientCertOptional also accepts clients without certificates.
+	ClientCertOptional bool `yaml:"client_cert_optional"`
 }
 
 func (a *Args) init() {
@@ -53,16 +67,35 @@ func (a *Args) init() {
 	utils.SetDefaultNum(&a.IdleTimeout, 10)
 }
 
+// CheckArgs implements coremain.ArgsChecker.
+func (a *Args) CheckArgs() ([]coremain.PluginRef, []error) {
+	if len(a.Entry) == 0 {
+		return nil, []error{errors.New("missing entry")}
+	}
+	return []coremain.PluginRef{{Tag: a.Entry, Kind: "entry"}}, nil
+}
+
 type TcpServer struct {
 	args *Args
 
-	l net.Listener
+	h      *server_utils.Handler
+	l      net.Listener
+	closed atomic.Bool
 }
 
+var _ coremain.ReusablePlugin = (*TcpServer)(nil)
+
 func (s *TcpServer) Close() error {
+	s.closed.Store(true)
 	return s.l.Close()
 }
 
+// Reuse implements coremain.ReusablePlugin. It keeps the listener and
+// switches the entry to the new plugin graph.
+func (s *TcpServer) Reuse(bp *coremain.BP) error {
+	return server_utils.ReloadHandlers(bp, s.h)
+}
+
 func Init(bp *coremain.BP, args any) (any, error) {
 	return StartServer(bp, args.(*Args))
 }
@@ -74,12 +107,15 @@ func StartServer(bp *coremain.BP, args *Args) (*TcpServer, error) {
 	}
 
 	// Init tls
-	var tc *tls.Config
-	if len(args.Key)+len(args.Cert) > 0 {
-		tc = new(tls.Config)
-		if err := server.LoadCert(tc, args.Cert, args.Key); err != nil {
-			return nil, fmt.Errorf("failed to read tls cert, %w", err)
-		}
+	tc, err := server_utils.NewTLSConfig(server_utils.TLSArgs{
+		Cert:               args.Cert,
+		Key:                args.Key,
+		Certs:              args.Certs,
+		ClientCA:           args.ClientCA,
+		ClientCertOptional: args.ClientCertOptional,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to init tls, %w", err)
 	}
 
 	socketOpt := server_utils.ListenerSocketOpts{
@@ -100,14 +136,18 @@ func StartServer(bp *coremain.BP, args *Args) (*TcpServer, error) {
 	}
 	bp.L().Info("tcp server started", zap.Stringer("addr", l.Addr()), zap.Bool("tls", tc != nil))
 
+	s := &TcpServer{
+		args: args,
+		h:    dh,
+		l:    l,
+	}
 	go func() {
 		defer l.Close()
 		serverOpts := server.TCPServerOpts{Logger: bp.L(), IdleTimeout: time.Duration(args.IdleTimeout) * time.Second}
 		err := server.ServeTCP(l, dh, serverOpts)
-		bp.M().GetSafeClose().SendCloseSignal(err)
+		if !s.closed.Load() {
+			bp.M().GetSafeClose().SendCloseSignal(err)
+		}
 	}()
-	return &TcpServer{
-		args: args,
-		l:    l,
-	}, nil
+	return s, nil
 }
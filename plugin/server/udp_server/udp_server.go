@@ -21,8 +21,10 @@ package udp_server
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
+	"sync/atomic"
 
 	"github.com/IrineSistiana/mosdns/v5/coremain"
 	"github.com/IrineSistiana/mosdns/v5/pkg/server"
@@ -46,16 +48,35 @@ func (a *Args) init() {
 	utils.SetDefaultString(&a.Listen, "127.0.0.1:53")
 }
 
+// CheckArgs implements coremain.ArgsChecker.
+func (a *Args) CheckArgs() ([]coremain.PluginRef, []error) {
+	if len(a.Entry) == 0 {
+		return nil, []error{errors.New("missing entry")}
+	}
+	return []coremain.PluginRef{{Tag: a.Entry, Kind: "entry"}}, nil
+}
+
 type UdpServer struct {
 	args *Args
 
-	c net.PacketConn
+	h      *server_utils.Handler
+	c      net.PacketConn
+	closed atomic.Bool
 }
 
+var _ coremain.ReusablePlugin = (*UdpServer)(nil)
+
 func (s *UdpServer) Close() error {
+	s.closed.Store(true)
 	return s.c.Close()
 }
 
+// Reuse implements coremain.ReusablePlugin. It keeps the socket and
+// switches the entry to the new plugin graph.
+func (s *UdpServer) Reuse(bp *coremain.BP) error {
+	return server_utils.ReloadHandlers(bp, s.h)
+}
+
 func Init(bp *coremain.BP, args any) (any, error) {
 	return StartServer(bp, args.(*Args))
 }
@@ -77,13 +98,17 @@ func StartServer(bp *coremain.BP, args *Args) (*UdpServer, error) {
 	}
 	bp.L().Info("udp server started", zap.Stringer("addr", c.LocalAddr()))
 
+	s := &UdpServer{
+		args: args,
+		h:    dh,
+		c:    c,
+	}
 	go func() {
 		defer c.Close()
 		err := server.ServeUDP(c.(*net.UDPConn), dh, server.UDPServerOpts{Logger: bp.L()})
-		bp.M().GetSafeClose().SendCloseSignal(err)
+		if !s.closed.Load() {
+			bp.M().GetSafeClose().SendCloseSignal(err)
+		}
 	}()
-	return &UdpServer{
-		args: args,
-		c:    c,
-	}, nil
+	return s, nil
 }
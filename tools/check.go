@@ -0,0 +1,107 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tools
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/spf13/cobra"
+)
+
+func newCheckCmd() *cobra.Command {
+	var cfg, graph string
+	c := &cobra.Command{
+		Use:   "check [-c config_file] [--graph dot|json]",
+		Args:  cobra.NoArgs,
+		Short: "Check a config without starting it.",
+		Long: `Check a config and its includes without initializing plugins.
+
+It reports unknown plugin types, invalid args, duplicated tags, and references
+to plugins that are missing, defined later or of a wrong type. All errors are
+printed. It exits with code 1 if there is any error.
+
+With --graph, it prints the plugin dependency graph in dot or json format.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runCheck(cmd.OutOrStdout(), cmd.ErrOrStderr(), cfg, graph)
+		},
+		DisableFlagsInUseLine: true,
+		SilenceUsage:          true,
+	}
+	c.Flags().StringVarP(&cfg, "config", "c", "", "config file")
+	c.Flags().StringVar(&graph, "graph", "", "print the plugin graph, dot or json")
+	_ = c.MarkFlagFilename("config")
+	return c
+}
+
+func runCheck(out, errOut io.Writer, cfg, graph string) error {
+	switch graph {
+	case "", "dot", "json":
+	default:
+		return fmt.Errorf("invalid graph format %s", graph)
+	}
+
+	res := coremain.CheckConfig(cfg)
+	for _, err := range res.Errors {
+		fmt.Fprintln(errOut, err)
+	}
+
+	switch graph {
+	case "dot":
+		printDotGraph(out, res.Plugins)
+	case "json":
+		e := json.NewEncoder(out)
+		e.SetIndent("", "  ")
+		if err := e.Encode(res.Plugins); err != nil {
+			return err
+		}
+	}
+
+	if n := len(res.Errors); n > 0 {
+		return fmt.Errorf("%d error(s) found", n)
+	}
+	if len(graph) == 0 {
+		fmt.Fprintf(out, "config is ok, %d plugins checked\n", len(res.Plugins))
+	}
+	return nil
+}
+
+func printDotGraph(w io.Writer, ps []coremain.CheckedPlugin) {
+	fmt.Fprintln(w, "digraph mosdns {")
+	for _, p := range ps {
+		fmt.Fprintf(w, "  %s [label=%s];\n", strconv.Quote(p.Tag), strconv.Quote(p.Tag+"\n"+p.Type))
+	}
+	type edge struct{ from, to, kind string }
+	seen := make(map[edge]struct{})
+	for _, p := range ps {
+		for _, ref := range p.Refs {
+			e := edge{from: p.Tag, to: ref.Tag, kind: ref.Kind}
+			if _, ok := seen[e]; ok {
+				continue
+			}
+			seen[e] = struct{}{}
+			fmt.Fprintf(w, "  %s -> %s [label=%s];\n", strconv.Quote(e.from), strconv.Quote(e.to), strconv.Quote(e.kind))
+		}
+	}
+	fmt.Fprintln(w, "}")
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tools
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/IrineSistiana/mosdns/v5/mlog"
+	"github.com/IrineSistiana/mosdns/v5/pkg/geodata"
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/compiled"
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/netlist"
+	"github.com/IrineSistiana/mosdns/v5/plugin/data_provider/ip_set"
+	"github.com/spf13/cobra"
+)
+
+func newCompileDomainCmd() *cobra.Command {
+	var (
+		out      string
+		exps     []string
+		files    []string
+		geosites []string
+	)
+	c := &cobra.Command{
+		Use:   "compile-domain -o output [-e exp]... [-f file]... [-g geosite_selector]...",
+		Args:  cobra.NoArgs,
+		Short: "Compile domain rules into a file that can be used by domain_set \"compiled\".",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := compileDomain(out, exps, files, geosites); err != nil {
+				mlog.S().Fatal(err)
+			}
+		},
+		DisableFlagsInUseLine: true,
+	}
+	c.Flags().StringVarP(&out, "out", "o", "", "output file")
+	c.Flags().StringArrayVarP(&exps, "exp", "e", nil, "domain expression")
+	c.Flags().StringArrayVarP(&files, "file", "f", nil, "domain rule file")
+	c.Flags().StringArrayVarP(&geosites, "geosite", "g", nil, "geosite selector, e.g. geosite.dat:cn@!ads")
+	c.MarkFlagRequired("out")
+	c.MarkFlagFilename("out")
+	c.MarkFlagFilename("file")
+	return c
+}
+
+func newCompileIPCmd() *cobra.Command {
+	var (
+		out    string
+		ips    []string
+		files  []string
+		geoips []string
+	)
+	c := &cobra.Command{
+		Use:   "compile-ip -o output [-i ip]... [-f file]... [-g geoip_selector]...",
+		Args:  cobra.NoArgs,
+		Short: "Compile ip rules into a file that can be used by ip_set \"compiled\".",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := compileIP(out, ips, files, geoips); err != nil {
+				mlog.S().Fatal(err)
+			}
+		},
+		DisableFlagsInUseLine: true,
+	}
+	c.Flags().StringVarP(&out, "out", "o", "", "output file")
+	c.Flags().StringArrayVarP(&ips, "ip", "i", nil, "ip or cidr")
+	c.Flags().StringArrayVarP(&files, "file", "f", nil, "ip rule file")
+	c.Flags().StringArrayVarP(&geoips, "geoip", "g", nil, "geoip selector, e.g. geoip.dat:cn")
+	c.MarkFlagRequired("out")
+	c.MarkFlagFilename("out")
+	c.MarkFlagFilename("file")
+	return c
+}
+
+func compileDomain(out string, exps, files, geosites []string) error {
+	b := compiled.NewDomainBuilder()
+	for i, exp := range exps {
+		if err := b.Add(exp, struct{}{}); err != nil {
+			return fmt.Errorf("failed to load expression #%d %s, %w", i, exp, err)
+		}
+	}
+	for i, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		if err := domain.LoadFromTextReader[struct{}](b, bytes.NewReader(data), nil); err != nil {
+			return fmt.Errorf("failed to load file #%d %s, %w", i, f, err)
+		}
+	}
+	if err := geodata.LoadGeoSites(geosites, b); err != nil {
+		return err
+	}
+	if err := compiled.WriteDomainSet(out, b); err != nil {
+		return err
+	}
+	mlog.S().Infof("%d rules compiled to %s", b.Len(), out)
+	return nil
+}
+
+func compileIP(out string, ips, files, geoips []string) error {
+	l := netlist.NewList()
+	if err := ip_set.LoadFromIPsAndFiles(ips, files, l); err != nil {
+		return err
+	}
+	if err := geodata.LoadGeoIPs(geoips, l); err != nil {
+		return err
+	}
+	if err := compiled.WriteIPSet(out, l); err != nil {
+		return err
+	}
+	mlog.S().Infof("%d prefixes compiled to %s", l.Len(), out)
+	return nil
+}
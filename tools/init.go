@@ -42,4 +42,14 @@ func init() {
 	}
 	configCmd.AddCommand(newGenCmd(), newConvCmd())
 	coremain.AddSubCmd(configCmd)
+
+	toolsCmd := &cobra.Command{
+		Use:   "tools",
+		Short: "Tools that can compile rule files.",
+	}
+	toolsCmd.AddCommand(newCompileDomainCmd(), newCompileIPCmd())
+	coremain.AddSubCmd(toolsCmd)
+
+	coremain.AddSubCmd(newQueryCmd())
+	coremain.AddSubCmd(newCheckCmd())
 }
@@ -0,0 +1,254 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/hosts"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"github.com/spf13/cobra"
+)
+
+type queryFlags struct {
+	c          string
+	entry      string
+	client     string
+	serverName string
+	urlPath    string
+	udp        bool
+	stubs      []string
+	json       bool
+	timeout    time.Duration
+	logLevel   string
+}
+
+func newQueryCmd() *cobra.Command {
+	f := new(queryFlags)
+	c := &cobra.Command{
+		Use:   "query -c config_file --entry tag [flags] qname [qtype]",
+		Args:  cobra.RangeArgs(1, 2),
+		Short: "Run a query through a config without starting servers, and print the response and the sequence path.",
+		Long: `Run a query through a config without starting servers, and print the response and the sequence path.
+
+Plugins whose type ends with "_server" are not loaded. Plugins can be replaced
+by local stubs with --stub tag=hosts_file. A stub answers queries from a file
+in the hosts plugin format and replies NXDOMAIN to other queries. A stub
+without a file always replies NXDOMAIN.
+
+It exits with code 1 if the entry returns an error.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			qtype := ""
+			if len(args) > 1 {
+				qtype = args[1]
+			}
+			return runQuery(cmd.OutOrStdout(), f, args[0], qtype)
+		},
+		DisableFlagsInUseLine: true,
+		SilenceUsage:          true,
+	}
+	fs := c.Flags()
+	fs.StringVarP(&f.c, "config", "c", "", "config file")
+	fs.StringVar(&f.entry, "entry", "", "tag of the entry executable, e.g. a sequence")
+	fs.StringVar(&f.client, "client", "", "client address")
+	fs.StringVar(&f.serverName, "server-name", "", "server name (TLS SNI)")
+	fs.StringVar(&f.urlPath, "url-path", "", "url path of a http query")
+	fs.BoolVar(&f.udp, "udp", false, "mark the query as from udp")
+	fs.StringArrayVar(&f.stubs, "stub", nil, "replace a plugin with a local stub, tag[=hosts_file]")
+	fs.BoolVar(&f.json, "json", false, "print the result in json")
+	fs.DurationVar(&f.timeout, "timeout", time.Second*5, "query timeout")
+	fs.StringVar(&f.logLevel, "log-level", "error", "log level, overrides the config")
+	_ = c.MarkFlagRequired("entry")
+	_ = c.MarkFlagFilename("config")
+	return c
+}
+
+func runQuery(out io.Writer, f *queryFlags, qname, qtypeStr string) error {
+	qtype, err := sequence.ParseQtype(qtypeStr)
+	if err != nil {
+		return err
+	}
+	var meta query_context.ServerMeta
+	if len(f.client) > 0 {
+		addr, err := netip.ParseAddr(f.client)
+		if err != nil {
+			return fmt.Errorf("invalid client addr, %w", err)
+		}
+		meta.ClientAddr = addr
+	}
+	meta.ServerName = f.serverName
+	meta.UrlPath = f.urlPath
+	meta.FromUDP = f.udp
+
+	stubs, err := loadStubs(f.stubs)
+	if err != nil {
+		return err
+	}
+
+	cfg, _, err := coremain.LoadConfig(f.c)
+	if err != nil {
+		return fmt.Errorf("fail to load config, %w", err)
+	}
+	cfg.Log.Level = f.logLevel
+	m, err := coremain.NewOfflineMosdns(cfg, coremain.OfflineOpts{
+		Skip: func(c coremain.PluginConfig) bool {
+			return strings.HasSuffix(c.Type, "_server")
+		},
+		Replace: func(c coremain.PluginConfig) any {
+			if s, ok := stubs[c.Tag]; ok {
+				delete(stubs, c.Tag)
+				return s
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		m.GetSafeClose().SendCloseSignal(nil)
+		_ = m.GetSafeClose().WaitClosed()
+	}()
+	for tag := range stubs {
+		return fmt.Errorf("stubbed plugin %s is not in the config", tag)
+	}
+
+	entry := sequence.ToExecutable(m.GetPlugin(f.entry))
+	if entry == nil {
+		return fmt.Errorf("cannot find executable entry %s", f.entry)
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(qname), qtype)
+	q.RecursionDesired = true
+	ctx, cancel := context.WithTimeout(context.Background(), f.timeout)
+	defer cancel()
+	res := sequence.ExecTrace(ctx, entry, q, meta)
+
+	if f.json {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(res); err != nil {
+			return err
+		}
+	} else {
+		printTraceResult(out, res)
+	}
+	if len(res.Err) > 0 {
+		return errors.New(res.Err)
+	}
+	return nil
+}
+
+func printTraceResult(w io.Writer, res *sequence.TraceResult) {
+	fmt.Fprintf(w, ";; QUESTION: %s\n\n", res.Query)
+	fmt.Fprintln(w, ";; PATH:")
+	for _, e := range res.Trace {
+		var ms []string
+		for _, m := range e.Matches {
+			r := "true"
+			switch {
+			case len(m.Err) > 0:
+				r = "error: " + m.Err
+			case !m.Result:
+				r = "false"
+			}
+			ms = append(ms, fmt.Sprintf("[%s => %s]", m.Matcher, r))
+		}
+		fmt.Fprintf(w, "%s #%d", e.Sequence, e.Node)
+		if len(ms) > 0 {
+			fmt.Fprintf(w, " %s", strings.Join(ms, " "))
+		}
+		if len(e.Exec) == 0 {
+			fmt.Fprintf(w, " skipped")
+		} else {
+			fmt.Fprintf(w, " exec %s", e.Exec)
+			switch {
+			case e.RespSet:
+				fmt.Fprintf(w, " (response set, %s)", dns.RcodeToString[e.Rcode])
+			case e.RespChanged:
+				fmt.Fprintf(w, " (response changed)")
+			}
+		}
+		if len(e.Err) > 0 {
+			fmt.Fprintf(w, " error: %s", e.Err)
+		}
+		fmt.Fprintf(w, " %s\n", e.Elapsed)
+	}
+	fmt.Fprintln(w)
+	if len(res.Response) == 0 {
+		fmt.Fprintln(w, ";; NO RESPONSE")
+	} else {
+		fmt.Fprintln(w, res.Response)
+	}
+	if len(res.Err) > 0 {
+		fmt.Fprintf(w, ";; ERROR: %s\n", res.Err)
+	}
+}
+
+// stub is a fake upstream that answers queries from a hosts file.
+type stub struct {
+	h *hosts.Hosts // nil if there is no file.
+}
+
+var _ sequence.Executable = (*stub)(nil)
+
+func (s *stub) Exec(_ context.Context, qCtx *query_context.Context) error {
+	var r *dns.Msg
+	if s.h != nil {
+		r = s.h.Response(qCtx.Q())
+	}
+	if r == nil {
+		r = new(dns.Msg)
+		r.SetRcode(qCtx.Q(), dns.RcodeNameError)
+	}
+	qCtx.SetResponse(r)
+	return nil
+}
+
+func loadStubs(ss []string) (map[string]*stub, error) {
+	m := make(map[string]*stub)
+	for _, s := range ss {
+		tag, file, _ := strings.Cut(s, "=")
+		if len(tag) == 0 {
+			return nil, fmt.Errorf("invalid stub %s", s)
+		}
+		st := new(stub)
+		if len(file) > 0 {
+			h, err := hosts.NewHosts(&hosts.Args{Files: []string{file}})
+			if err != nil {
+				return nil, fmt.Errorf("failed to load stub %s, %w", s, err)
+			}
+			st.h = h
+		}
+		m[tag] = st
+	}
+	return m, nil
+}